@@ -0,0 +1,1324 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+	"bitbucket.org/tshannon/freehold-sync/local"
+	"bitbucket.org/tshannon/freehold-sync/log"
+	"bitbucket.org/tshannon/freehold-sync/remote"
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+/*
+	The /v1/ API is for scripts and other tools.  Its paths and JSON schemas
+	only ever change in ways that don't break existing clients; anything else
+	goes in a new version.  Profile IDs contain slashes, and must be URL escaped
+	when they're part of a path.
+
+	/v1/profiles:
+		Get: List every profile
+		Post: Create a profile
+	/v1/profiles/test:
+		Post: Test a new profile's connection, and that its paths can be read
+			and written, without creating it
+	/v1/profiles/export:
+		Post: Export profiles, with their secrets sealed by a passphrase if one
+			is passed in, to be imported by another freehold-sync
+	/v1/profiles/import:
+		Post: Add exported profiles
+	/v1/profiles/<id>:
+		Get: Retrieve a profile
+		Put: Replace a profile's settings
+		Delete: Remove a profile
+	/v1/profiles/<id>/status:
+		Get: Retrieve the sync status of a profile, and of each of its destinations
+	/v1/profiles/<id>/stats:
+		Get: Retrieve what a profile has synced since freehold-sync started
+	/v1/profiles/<id>/pause:
+		Post: Pause a profile
+	/v1/profiles/<id>/resume:
+		Post: Resume a paused profile
+	/v1/profiles/<id>/sync:
+		Post: Rescan a profile and sync what's changed now
+	/v1/profiles/<id>/test:
+		Post: Test a profile's connection, and that its paths can be read and written
+	/v1/profiles/<id>/conflicts:
+		Get: List the conflicts a profile is waiting to have resolved, or with
+			?all=true every conflict and how it was resolved
+	/v1/profiles/<id>/conflicts/<path>:
+		Post: Resolve a conflict by keeping the local file, the remote file, or both
+	/v1/profiles/<id>/quarantine:
+		Get: List the files a profile quarantined for being synced back and forth,
+			and why
+	/v1/profiles/<id>/quarantine/<path>:
+		Delete: Release a quarantined file, and sync it again
+	/v1/profiles/<id>/queue:
+		Get: List the pending and running changes of a profile
+	/v1/profiles/<id>/queue/<change id>:
+		Delete: Cancel a pending or running change
+	/v1/profiles/<id>/template:
+		Post: Save a profile's filter rules, throttles and conflict settings as
+			a named template
+	/v1/profiles/<id>/clone:
+		Post: Create a profile with the same settings and secrets as a profile,
+			syncing a different pair of folders
+	/v1/templates:
+		Get: List every template
+		Post: Create or replace a template
+	/v1/templates/<name>:
+		Get: Retrieve a template
+		Put: Replace a template's settings
+		Delete: Remove a template
+	/v1/templates/<name>/profiles:
+		Post: Create a profile, with the template's settings in place of its own
+	/v1/stats:
+		Get: Retrieve what every profile has synced since freehold-sync started,
+			along with their totals
+	/v1/log?since=<time>&until=<time>&level=<level>&profile=<name>&module=<module>&path=<path>&limit=<n>&offset=<n>:
+		Get: Query the log, newest first.  Times are RFC 3339, or durations such
+			as 24h for that long ago.  Level is the least severe level returned,
+			and path returns entries about the file, or the files in the folder
+	/v1/log/config:
+		Get: Retrieve the log level of every module, and whether the system log
+			is written as JSON
+		Put: Change how entries are logged until freehold-sync is restarted
+	/v1/local/folders?path=<path>:
+		Get: List the folders in a local folder, or the folders which can be
+			browsed without a path, to pick a profile's local path from
+	/v1/remote/folders:
+		Post: List the folders in a folder on a freehold instance, to pick a
+			profile's remote path from
+*/
+
+type apiHandlerFunc func(w http.ResponseWriter, r *http.Request, args []string)
+
+// apiRoute is a /v1/ path, relative to /v1/, with * in place of each argument
+type apiRoute struct {
+	path    string
+	methods map[string]apiHandlerFunc
+}
+
+var apiRoutes = []apiRoute{
+	{"profiles", map[string]apiHandlerFunc{
+		"GET":  apiProfilesGet,
+		"POST": apiProfilesPost,
+	}},
+	// before profiles/*, profile IDs are never just "test", "export" or "import"
+	{"profiles/test", map[string]apiHandlerFunc{
+		"POST": apiTestPost,
+	}},
+	{"profiles/export", map[string]apiHandlerFunc{
+		"POST": apiExportPost,
+	}},
+	{"profiles/import", map[string]apiHandlerFunc{
+		"POST": apiImportPost,
+	}},
+	{"profiles/*", map[string]apiHandlerFunc{
+		"GET":    apiProfileGet,
+		"PUT":    apiProfilePut,
+		"DELETE": apiProfileDelete,
+	}},
+	{"profiles/*/status", map[string]apiHandlerFunc{
+		"GET": apiStatusGet,
+	}},
+	{"profiles/*/stats", map[string]apiHandlerFunc{
+		"GET": apiProfileStatsGet,
+	}},
+	{"profiles/*/pause", map[string]apiHandlerFunc{
+		"POST": apiPausePost,
+	}},
+	{"profiles/*/resume", map[string]apiHandlerFunc{
+		"POST": apiResumePost,
+	}},
+	{"profiles/*/sync", map[string]apiHandlerFunc{
+		"POST": apiSyncPost,
+	}},
+	{"profiles/*/test", map[string]apiHandlerFunc{
+		"POST": apiProfileTestPost,
+	}},
+	{"profiles/*/conflicts", map[string]apiHandlerFunc{
+		"GET": apiConflictsGet,
+	}},
+	{"profiles/*/conflicts/*", map[string]apiHandlerFunc{
+		"POST": apiConflictPost,
+	}},
+	{"profiles/*/quarantine", map[string]apiHandlerFunc{
+		"GET": apiQuarantineGet,
+	}},
+	{"profiles/*/quarantine/*", map[string]apiHandlerFunc{
+		"DELETE": apiQuarantineDelete,
+	}},
+	{"profiles/*/queue", map[string]apiHandlerFunc{
+		"GET": apiQueueGet,
+	}},
+	{"profiles/*/queue/*", map[string]apiHandlerFunc{
+		"DELETE": apiQueueDelete,
+	}},
+	{"profiles/*/template", map[string]apiHandlerFunc{
+		"POST": apiProfileTemplatePost,
+	}},
+	{"profiles/*/clone", map[string]apiHandlerFunc{
+		"POST": apiClonePost,
+	}},
+	{"templates", map[string]apiHandlerFunc{
+		"GET":  apiTemplatesGet,
+		"POST": apiTemplatesPost,
+	}},
+	{"templates/*", map[string]apiHandlerFunc{
+		"GET":    apiTemplateGet,
+		"PUT":    apiTemplatePut,
+		"DELETE": apiTemplateDelete,
+	}},
+	{"templates/*/profiles", map[string]apiHandlerFunc{
+		"POST": apiTemplateProfilesPost,
+	}},
+	{"stats", map[string]apiHandlerFunc{
+		"GET": apiStatsGet,
+	}},
+	{"log", map[string]apiHandlerFunc{
+		"GET": apiLogGet,
+	}},
+	{"log/config", map[string]apiHandlerFunc{
+		"GET": apiLogConfigGet,
+		"PUT": apiLogConfigPut,
+	}},
+	{"local/folders", map[string]apiHandlerFunc{
+		"GET": apiLocalFoldersGet,
+	}},
+	{"remote/folders", map[string]apiHandlerFunc{
+		"POST": apiRemoteFoldersPost,
+	}},
+}
+
+// apiProfile is a profile as it's sent and received by the /v1/ API.  It's
+// kept apart from how profiles are stored, so the API doesn't change when the
+// datastore does.  Secrets are accepted, but never sent back
+type apiProfile struct {
+	ID                      string            `json:"id"`
+	Name                    string            `json:"name"`
+	LocalPath               string            `json:"localPath"`
+	RemotePath              string            `json:"remotePath"`
+	Remote                  *apiRemote        `json:"remote"`
+	Active                  bool              `json:"active"`
+	Paused                  bool              `json:"paused"`
+	DryRun                  bool              `json:"dryRun"`
+	Direction               int               `json:"direction"`
+	ConflictResolution      int               `json:"conflictResolution"`
+	ConflictDurationSeconds int               `json:"conflictDurationSeconds"`
+	ConflictName            string            `json:"conflictName"`
+	Ignore                  []string          `json:"ignore"`
+	Filters                 []string          `json:"filters"`
+	Folders                 []string          `json:"folders"`
+	MaxFileSizeMB           int               `json:"maxFileSizeMB"`
+	UploadLimitKB           int               `json:"uploadLimitKB"`
+	DownloadLimitKB         int               `json:"downloadLimitKB"`
+	Schedule                string            `json:"schedule"`
+	ScheduleWindowMinutes   int               `json:"scheduleWindowMinutes"`
+	KeepVersions            int               `json:"keepVersions"`
+	Trash                   bool              `json:"trash"`
+	TrashDays               int               `json:"trashDays"`
+	Verify                  bool              `json:"verify"`
+	Symlinks                int               `json:"symlinks"`
+	MaxDeletes              int               `json:"maxDeletes"`
+	MaxDeletePercent        int               `json:"maxDeletePercent"`
+	MinFreeSpaceMB          int               `json:"minFreeSpaceMB"`
+	PollSeconds             int               `json:"pollSeconds"`
+	LocalMonitor            int               `json:"localMonitor"`
+	Compress                bool              `json:"compress"`
+	CompressExclude         []string          `json:"compressExclude"`
+	Encrypt                 bool              `json:"encrypt"`
+	EncryptNames            bool              `json:"encryptNames"`
+	Passphrase              string            `json:"passphrase,omitempty"`
+	ReportEmail             string            `json:"reportEmail"`
+	ReportFrequency         string            `json:"reportFrequency"`
+	ReportAlerts            bool              `json:"reportAlerts"`
+	PreSyncHook             string            `json:"preSyncHook"`
+	PostSyncHook            string            `json:"postSyncHook"`
+	ErrorHook               string            `json:"errorHook"`
+	Destinations            []*apiDestination `json:"destinations"`
+}
+
+// apiDestination is another remote folder a profile's local folder is synced
+// to, along with its own.  The ID is set by freehold-sync
+type apiDestination struct {
+	ID         string     `json:"id"`
+	RemotePath string     `json:"remotePath"`
+	Remote     *apiRemote `json:"remote"`
+}
+
+// apiRemote is how a profile connects to its freehold instance
+type apiRemote struct {
+	URL           string `json:"url"`
+	User          string `json:"user"`
+	Password      string `json:"password,omitempty"`
+	Token         string `json:"token,omitempty"`
+	CAFile        string `json:"caFile"`
+	CertFile      string `json:"certFile"`
+	KeyFile       string `json:"keyFile"`
+	Pins          string `json:"pins"`
+	Proxy         string `json:"proxy"`
+	ProxyUser     string `json:"proxyUser"`
+	ProxyPassword string `json:"proxyPassword,omitempty"`
+}
+
+// apiFolder is a local folder, or a folder on a freehold instance
+type apiFolder struct {
+	Name string `json:"name"`
+	Path string `json:"path"` // for the profile's local or remote path, or to list its folders
+}
+
+type apiStatus struct {
+	Status       string                  `json:"status"`
+	Pending      int                     `json:"pending"` // number of changes waiting to run
+	Warning      string                  `json:"warning,omitempty"`
+	Destinations []*apiDestinationStatus `json:"destinations,omitempty"`
+}
+
+// apiDestinationStatus is the sync status of one of a profile's destinations,
+// which each have their own queue
+type apiDestinationStatus struct {
+	ID         string `json:"id"`
+	URL        string `json:"url"`
+	RemotePath string `json:"remotePath"`
+	Status     string `json:"status"`
+	Pending    int    `json:"pending"`
+}
+
+// apiStats are counts of what was synced since freehold-sync started.  Uploads
+// are files written to the freehold instance, and downloads are files written
+// locally
+type apiStats struct {
+	FilesUploaded   int64      `json:"filesUploaded"`
+	BytesUploaded   int64      `json:"bytesUploaded"`
+	FilesDownloaded int64      `json:"filesDownloaded"`
+	BytesDownloaded int64      `json:"bytesDownloaded"`
+	Conflicts       int64      `json:"conflicts"`
+	Errors          int64      `json:"errors"`
+	LastSync        *time.Time `json:"lastSync"` // when a change last finished, null if none have
+	LastError       *time.Time `json:"lastError"`
+	Queued          int        `json:"queued"` // number of pending and running changes
+	Since           time.Time  `json:"since"`
+}
+
+type apiProfileStats struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	*apiStats
+}
+
+type apiChange struct {
+	ID      uint64    `json:"id"`
+	Action  string    `json:"action"`
+	Path    string    `json:"path"`
+	Side    string    `json:"side"` // local or remote
+	Size    int64     `json:"size"`
+	Queued  time.Time `json:"queued"`
+	Running bool      `json:"running"`
+}
+
+func newAPIStats(s syncer.Stats) *apiStats {
+	a := &apiStats{
+		FilesUploaded:   s.FilesUploaded,
+		BytesUploaded:   s.BytesUploaded,
+		FilesDownloaded: s.FilesDownloaded,
+		BytesDownloaded: s.BytesDownloaded,
+		Conflicts:       s.Conflicts,
+		Errors:          s.Errors,
+		Queued:          s.Queued,
+		Since:           s.Since,
+	}
+	if !s.LastSync.IsZero() {
+		a.LastSync = &s.LastSync
+	}
+	if !s.LastError.IsZero() {
+		a.LastError = &s.LastError
+	}
+	return a
+}
+
+func newAPIProfile(p *profileStore) *apiProfile {
+	a := &apiProfile{
+		ID:                      p.ID,
+		Name:                    p.Name,
+		LocalPath:               p.LocalPath,
+		RemotePath:              p.RemotePath,
+		Active:                  p.Active,
+		Paused:                  p.Paused,
+		DryRun:                  p.DryRun,
+		Direction:               p.Direction,
+		ConflictResolution:      p.ConflictResolution,
+		ConflictDurationSeconds: p.ConflictDurationSeconds,
+		ConflictName:            p.ConflictName,
+		Ignore:                  p.Ignore,
+		Filters:                 p.Filters,
+		Folders:                 p.Folders,
+		MaxFileSizeMB:           p.MaxFileSizeMB,
+		UploadLimitKB:           p.UploadLimitKB,
+		DownloadLimitKB:         p.DownloadLimitKB,
+		Schedule:                p.Schedule,
+		ScheduleWindowMinutes:   p.ScheduleWindowMinutes,
+		KeepVersions:            p.KeepVersions,
+		Trash:                   p.Trash,
+		TrashDays:               p.TrashDays,
+		Verify:                  p.Verify,
+		Symlinks:                p.Symlinks,
+		MaxDeletes:              p.MaxDeletes,
+		MaxDeletePercent:        p.MaxDeletePercent,
+		MinFreeSpaceMB:          p.MinFreeSpaceMB,
+		PollSeconds:             p.PollSeconds,
+		LocalMonitor:            p.LocalMonitor,
+		Compress:                p.Compress,
+		CompressExclude:         p.CompressExclude,
+		Encrypt:                 p.Encrypt,
+		EncryptNames:            p.EncryptNames,
+		ReportEmail:             p.ReportEmail,
+		ReportFrequency:         p.ReportFrequency,
+		ReportAlerts:            p.ReportAlerts,
+		PreSyncHook:             p.PreSyncHook,
+		PostSyncHook:            p.PostSyncHook,
+		ErrorHook:               p.ErrorHook,
+		Remote:                  newAPIRemote(p.Client),
+		Destinations:            make([]*apiDestination, 0, len(p.Destinations)),
+	}
+	for _, d := range p.Destinations {
+		a.Destinations = append(a.Destinations, &apiDestination{
+			ID:         d.ID,
+			RemotePath: d.RemotePath,
+			Remote:     newAPIRemote(d.Client),
+		})
+	}
+	return a
+}
+
+// newAPIRemote returns how the client connects, without its secrets
+func newAPIRemote(c *client) *apiRemote {
+	if c == nil {
+		return nil
+	}
+	return &apiRemote{
+		URL:       optional(c.URL),
+		User:      optional(c.User),
+		CAFile:    optional(c.CAFile),
+		CertFile:  optional(c.CertFile),
+		KeyFile:   optional(c.KeyFile),
+		Pins:      optional(c.Pins),
+		Proxy:     optional(c.Proxy),
+		ProxyUser: optional(c.ProxyUser),
+	}
+}
+
+// client returns the client the remote connects with
+func (r *apiRemote) client() *client {
+	if r == nil {
+		return nil
+	}
+	return &client{
+		URL:           apiOptional(r.URL),
+		User:          apiOptional(r.User),
+		Password:      apiOptional(r.Password),
+		Token:         apiOptional(r.Token),
+		CAFile:        apiOptional(r.CAFile),
+		CertFile:      apiOptional(r.CertFile),
+		KeyFile:       apiOptional(r.KeyFile),
+		Pins:          apiOptional(r.Pins),
+		Proxy:         apiOptional(r.Proxy),
+		ProxyUser:     apiOptional(r.ProxyUser),
+		ProxyPassword: apiOptional(r.ProxyPassword),
+	}
+}
+
+// profileStore converts the profile to how it's stored.  Secrets which are
+// left out are filled in from the ones already stored, if there are any
+func (a *apiProfile) profileStore(id string) (*profileStore, error) {
+	p := &profileStore{
+		ID:                      id,
+		Name:                    a.Name,
+		LocalPath:               a.LocalPath,
+		RemotePath:              a.RemotePath,
+		Active:                  a.Active,
+		Paused:                  a.Paused,
+		DryRun:                  a.DryRun,
+		Direction:               a.Direction,
+		ConflictResolution:      a.ConflictResolution,
+		ConflictDurationSeconds: a.ConflictDurationSeconds,
+		ConflictName:            a.ConflictName,
+		Ignore:                  a.Ignore,
+		Filters:                 a.Filters,
+		Folders:                 a.Folders,
+		MaxFileSizeMB:           a.MaxFileSizeMB,
+		UploadLimitKB:           a.UploadLimitKB,
+		DownloadLimitKB:         a.DownloadLimitKB,
+		Schedule:                a.Schedule,
+		ScheduleWindowMinutes:   a.ScheduleWindowMinutes,
+		KeepVersions:            a.KeepVersions,
+		Trash:                   a.Trash,
+		TrashDays:               a.TrashDays,
+		Verify:                  a.Verify,
+		Symlinks:                a.Symlinks,
+		MaxDeletes:              a.MaxDeletes,
+		MaxDeletePercent:        a.MaxDeletePercent,
+		MinFreeSpaceMB:          a.MinFreeSpaceMB,
+		PollSeconds:             a.PollSeconds,
+		LocalMonitor:            a.LocalMonitor,
+		Compress:                a.Compress,
+		CompressExclude:         a.CompressExclude,
+		Encrypt:                 a.Encrypt,
+		EncryptNames:            a.EncryptNames,
+		ReportEmail:             a.ReportEmail,
+		ReportFrequency:         a.ReportFrequency,
+		ReportAlerts:            a.ReportAlerts,
+		PreSyncHook:             a.PreSyncHook,
+		PostSyncHook:            a.PostSyncHook,
+		ErrorHook:               a.ErrorHook,
+		Passphrase:              a.Passphrase,
+		Client:                  a.Remote.client(),
+	}
+	for _, d := range a.Destinations {
+		p.Destinations = append(p.Destinations, &destination{
+			ID:         d.ID,
+			RemotePath: d.RemotePath,
+			Client:     d.Remote.client(),
+		})
+	}
+	err := p.loadSecrets()
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func apiOptional(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+// apiServe routes /v1/ requests
+func apiServe(w http.ResponseWriter, r *http.Request) {
+	var segments []string
+	for _, s := range strings.Split(strings.Trim(strings.TrimPrefix(r.URL.EscapedPath(), "/v1/"), "/"), "/") {
+		segment, err := url.PathUnescape(s)
+		if err != nil {
+			apiFail(w, http.StatusBadRequest, err)
+			return
+		}
+		segments = append(segments, segment)
+	}
+
+	for _, route := range apiRoutes {
+		pattern := strings.Split(route.path, "/")
+		if len(pattern) != len(segments) {
+			continue
+		}
+		var args []string
+		match := true
+		for i := range pattern {
+			if pattern[i] == "*" {
+				args = append(args, segments[i])
+			} else if pattern[i] != segments[i] {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+
+		handler, ok := route.methods[r.Method]
+		if !ok {
+			allowed := make([]string, 0, len(route.methods))
+			for method := range route.methods {
+				allowed = append(allowed, method)
+			}
+			sort.Strings(allowed)
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			apiFail(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+			return
+		}
+		handler(w, r, args)
+		return
+	}
+
+	apiFail(w, http.StatusNotFound, errors.New("Not found"))
+}
+
+// apiRespond writes a jsend response with the HTTP status code
+func apiRespond(w http.ResponseWriter, code int, response *jsend) {
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/json")
+	result, err := json.Marshal(response)
+	if err != nil {
+		code = http.StatusInternalServerError
+		result, _ = json.Marshal(&jsend{
+			Status:  statusError,
+			Message: "An internal error occurred, and we'll look into it.",
+		})
+	}
+	w.WriteHeader(code)
+	w.Write(result)
+}
+
+func apiSuccess(w http.ResponseWriter, code int, data interface{}) {
+	apiRespond(w, code, &jsend{
+		Status: statusSuccess,
+		Data:   data,
+	})
+}
+
+// apiFail responds with a client error, or a server error for 500 and up
+func apiFail(w http.ResponseWriter, code int, err error) {
+	status := statusFail
+	if code >= http.StatusInternalServerError {
+		status = statusError
+	}
+	apiRespond(w, code, &jsend{
+		Status:  status,
+		Message: err.Error(),
+	})
+}
+
+// apiGetProfile returns the profile, or responds with why it couldn't
+func apiGetProfile(w http.ResponseWriter, id string) (*profileStore, bool) {
+	p, err := getProfile(id)
+	if err == datastore.ErrNotFound {
+		apiFail(w, http.StatusNotFound, errors.New("No profile found with that ID"))
+		return nil, false
+	}
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return p, true
+}
+
+func apiProfilesGet(w http.ResponseWriter, r *http.Request, args []string) {
+	all, err := allProfiles()
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	profiles := make([]*apiProfile, 0, len(all))
+	for i := range all {
+		profiles = append(profiles, newAPIProfile(all[i]))
+	}
+	apiSuccess(w, http.StatusOK, profiles)
+}
+
+func apiProfilesPost(w http.ResponseWriter, r *http.Request, args []string) {
+	input := &apiProfile{}
+	err := json.NewDecoder(r.Body).Decode(input)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	ps, err := input.profileStore("")
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	ps, err = newProfile(ps)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	apiSuccess(w, http.StatusCreated, newAPIProfile(ps))
+}
+
+// apiTestPost tests a profile before it's created.  Failed checks are part of
+// the result, so the test itself succeeds whether or not the profile would
+func apiTestPost(w http.ResponseWriter, r *http.Request, args []string) {
+	input := &apiProfile{}
+	err := json.NewDecoder(r.Body).Decode(input)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	ps, err := input.profileStore("")
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiSuccess(w, http.StatusOK, ps.testConnection())
+}
+
+// apiExportPost exports the profiles with the passed in IDs, or every profile if
+// there are none, with their secrets sealed if a passphrase is passed in
+func apiExportPost(w http.ResponseWriter, r *http.Request, args []string) {
+	input := &struct {
+		IDs        []string `json:"ids"`
+		Passphrase string   `json:"passphrase"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(input)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	e, err := exportProfiles(input.IDs, input.Passphrase)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiSuccess(w, http.StatusOK, e)
+}
+
+// apiImportPost adds exported profiles.  Profiles which can't be added are
+// part of the result, so the import succeeds as long as it could be read
+func apiImportPost(w http.ResponseWriter, r *http.Request, args []string) {
+	input := &struct {
+		Export     *profileExport `json:"export"`
+		Passphrase string         `json:"passphrase"`
+		Paused     bool           `json:"paused"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(input)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	if input.Export == nil {
+		apiFail(w, http.StatusBadRequest, errors.New("No exported profiles to import"))
+		return
+	}
+	results, err := importProfiles(input.Export, input.Passphrase, input.Paused)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	apiSuccess(w, http.StatusOK, results)
+}
+
+func apiProfileGet(w http.ResponseWriter, r *http.Request, args []string) {
+	p, ok := apiGetProfile(w, args[0])
+	if !ok {
+		return
+	}
+	apiSuccess(w, http.StatusOK, newAPIProfile(p))
+}
+
+func apiProfilePut(w http.ResponseWriter, r *http.Request, args []string) {
+	if _, ok := apiGetProfile(w, args[0]); !ok {
+		return
+	}
+	input := &apiProfile{}
+	err := json.NewDecoder(r.Body).Decode(input)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	ps, err := input.profileStore(args[0])
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = ps.update()
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	apiSuccess(w, http.StatusOK, newAPIProfile(ps))
+}
+
+func apiProfileDelete(w http.ResponseWriter, r *http.Request, args []string) {
+	p, ok := apiGetProfile(w, args[0])
+	if !ok {
+		return
+	}
+	err := p.delete()
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiSuccess(w, http.StatusOK, nil)
+}
+
+func apiStatusGet(w http.ResponseWriter, r *http.Request, args []string) {
+	p, ok := apiGetProfile(w, args[0])
+	if !ok {
+		return
+	}
+	pending, status := p.status()
+	apiSuccess(w, http.StatusOK, &apiStatus{
+		Status:       status,
+		Pending:      pending,
+		Warning:      local.ProfileWarning(p.ID),
+		Destinations: p.destinationStatus(),
+	})
+}
+
+func apiProfileStatsGet(w http.ResponseWriter, r *http.Request, args []string) {
+	p, ok := apiGetProfile(w, args[0])
+	if !ok {
+		return
+	}
+	apiSuccess(w, http.StatusOK, newAPIStats(syncer.ProfileStats(p.ID)))
+}
+
+// apiStatsGet returns the stats of every profile, and all of them added
+// together
+func apiStatsGet(w http.ResponseWriter, r *http.Request, args []string) {
+	all, err := storedProfiles()
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	ids := make([]string, 0, len(all))
+	profiles := make([]*apiProfileStats, 0, len(all))
+	for i := range all {
+		ids = append(ids, all[i].ID)
+		profiles = append(profiles, &apiProfileStats{
+			ID:       all[i].ID,
+			Name:     all[i].Name,
+			apiStats: newAPIStats(syncer.ProfileStats(all[i].ID)),
+		})
+	}
+	apiSuccess(w, http.StatusOK, &struct {
+		Total    *apiStats          `json:"total"`
+		Profiles []*apiProfileStats `json:"profiles"`
+	}{newAPIStats(syncer.TotalStats(ids)), profiles})
+}
+
+func apiPausePost(w http.ResponseWriter, r *http.Request, args []string) {
+	apiSetPaused(w, args[0], true)
+}
+
+func apiResumePost(w http.ResponseWriter, r *http.Request, args []string) {
+	apiSetPaused(w, args[0], false)
+}
+
+func apiSetPaused(w http.ResponseWriter, id string, paused bool) {
+	p, ok := apiGetProfile(w, id)
+	if !ok {
+		return
+	}
+	if !p.Active {
+		apiFail(w, http.StatusConflict, errors.New("Profile is not active"))
+		return
+	}
+	err := p.setPaused(paused)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiSuccess(w, http.StatusOK, nil)
+}
+
+// apiSyncPost starts a rescan of the profile, responding before it finishes
+func apiSyncPost(w http.ResponseWriter, r *http.Request, args []string) {
+	p, ok := apiGetProfile(w, args[0])
+	if !ok {
+		return
+	}
+	if !p.Active {
+		apiFail(w, http.StatusConflict, errors.New("Profile is not active"))
+		return
+	}
+	if p.Paused {
+		apiFail(w, http.StatusConflict, errors.New("Profile is paused"))
+		return
+	}
+	err := p.syncNow()
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiSuccess(w, http.StatusAccepted, nil)
+}
+
+func apiProfileTestPost(w http.ResponseWriter, r *http.Request, args []string) {
+	p, ok := apiGetProfile(w, args[0])
+	if !ok {
+		return
+	}
+	apiSuccess(w, http.StatusOK, p.testConnection())
+}
+
+func apiConflictsGet(w http.ResponseWriter, r *http.Request, args []string) {
+	p, ok := apiGetProfile(w, args[0])
+	if !ok {
+		return
+	}
+	list := syncer.ProfileConflicts
+	if r.URL.Query().Get("all") == "true" {
+		list = syncer.ProfileConflictLog
+	}
+	conflicts, err := list(p.ID)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiSuccess(w, http.StatusOK, conflicts)
+}
+
+// apiConflictPost starts resolving a conflict, responding before the chosen
+// file has been copied over
+func apiConflictPost(w http.ResponseWriter, r *http.Request, args []string) {
+	p, ok := apiGetProfile(w, args[0])
+	if !ok {
+		return
+	}
+	input := &struct {
+		Resolution string `json:"resolution"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(input)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	if !validResolution(input.Resolution) {
+		apiFail(w, http.StatusBadRequest, errors.New("Resolution must be local, remote or both"))
+		return
+	}
+	err = p.resolveConflict(args[1], input.Resolution)
+	if err == syncer.ErrNoConflict {
+		apiFail(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		apiFail(w, http.StatusConflict, err)
+		return
+	}
+	apiSuccess(w, http.StatusAccepted, nil)
+}
+
+func apiQuarantineGet(w http.ResponseWriter, r *http.Request, args []string) {
+	p, ok := apiGetProfile(w, args[0])
+	if !ok {
+		return
+	}
+	quarantined, err := syncer.ProfileQuarantined(p.ID)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiSuccess(w, http.StatusOK, quarantined)
+}
+
+// apiQuarantineDelete releases a quarantined file, responding before it has
+// been synced again
+func apiQuarantineDelete(w http.ResponseWriter, r *http.Request, args []string) {
+	p, ok := apiGetProfile(w, args[0])
+	if !ok {
+		return
+	}
+	err := p.releaseQuarantined(args[1])
+	if err == syncer.ErrNotQuarantined {
+		apiFail(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		apiFail(w, http.StatusConflict, err)
+		return
+	}
+	apiSuccess(w, http.StatusAccepted, nil)
+}
+
+func apiQueueGet(w http.ResponseWriter, r *http.Request, args []string) {
+	p, ok := apiGetProfile(w, args[0])
+	if !ok {
+		return
+	}
+	queue, err := syncer.ProfileQueue(p.ID)
+	if err != nil {
+		apiFail(w, http.StatusConflict, err)
+		return
+	}
+	changes := make([]*apiChange, 0, len(queue))
+	for _, c := range queue {
+		changes = append(changes, &apiChange{
+			ID:      c.ID,
+			Action:  c.Action,
+			Path:    c.Path,
+			Side:    c.Side,
+			Size:    c.Size,
+			Queued:  c.Queued,
+			Running: c.Running,
+		})
+	}
+	apiSuccess(w, http.StatusOK, changes)
+}
+
+func apiQueueDelete(w http.ResponseWriter, r *http.Request, args []string) {
+	p, ok := apiGetProfile(w, args[0])
+	if !ok {
+		return
+	}
+	change, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, errors.New("Invalid change ID"))
+		return
+	}
+	err = syncer.CancelChange(p.ID, change)
+	if err != nil {
+		apiFail(w, http.StatusNotFound, err)
+		return
+	}
+	apiSuccess(w, http.StatusOK, nil)
+}
+
+// apiProfileTemplatePost saves the profile's settings as a template
+func apiProfileTemplatePost(w http.ResponseWriter, r *http.Request, args []string) {
+	p, ok := apiGetProfile(w, args[0])
+	if !ok {
+		return
+	}
+	input := &struct {
+		Name string `json:"name"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(input)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	t := newTemplate(input.Name, p)
+	err = t.put()
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	apiSuccess(w, http.StatusCreated, t)
+}
+
+// apiClonePost creates a copy of the profile which syncs the passed in folders
+func apiClonePost(w http.ResponseWriter, r *http.Request, args []string) {
+	p, ok := apiGetProfile(w, args[0])
+	if !ok {
+		return
+	}
+	input := &struct {
+		Name       string `json:"name"`
+		LocalPath  string `json:"localPath"`
+		RemotePath string `json:"remotePath"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(input)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	ps, err := p.clone(input.Name, input.LocalPath, input.RemotePath)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	apiSuccess(w, http.StatusCreated, newAPIProfile(ps))
+}
+
+// apiGetTemplate returns the template, or responds with why it couldn't
+func apiGetTemplate(w http.ResponseWriter, name string) (*profileTemplate, bool) {
+	t, err := getTemplate(name)
+	if err == datastore.ErrNotFound {
+		apiFail(w, http.StatusNotFound, errors.New("No template found with that name"))
+		return nil, false
+	}
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return t, true
+}
+
+func apiTemplatesGet(w http.ResponseWriter, r *http.Request, args []string) {
+	all, err := allTemplates()
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	if all == nil {
+		all = []*profileTemplate{}
+	}
+	apiSuccess(w, http.StatusOK, all)
+}
+
+func apiTemplatesPost(w http.ResponseWriter, r *http.Request, args []string) {
+	input := &profileTemplate{}
+	err := json.NewDecoder(r.Body).Decode(input)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	err = input.put()
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	apiSuccess(w, http.StatusCreated, input)
+}
+
+func apiTemplateGet(w http.ResponseWriter, r *http.Request, args []string) {
+	t, ok := apiGetTemplate(w, args[0])
+	if !ok {
+		return
+	}
+	apiSuccess(w, http.StatusOK, t)
+}
+
+func apiTemplatePut(w http.ResponseWriter, r *http.Request, args []string) {
+	if _, ok := apiGetTemplate(w, args[0]); !ok {
+		return
+	}
+	input := &profileTemplate{}
+	err := json.NewDecoder(r.Body).Decode(input)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	input.Name = args[0]
+	err = input.put()
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	apiSuccess(w, http.StatusOK, input)
+}
+
+func apiTemplateDelete(w http.ResponseWriter, r *http.Request, args []string) {
+	if _, ok := apiGetTemplate(w, args[0]); !ok {
+		return
+	}
+	err := deleteTemplate(args[0])
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiSuccess(w, http.StatusOK, nil)
+}
+
+// apiTemplateProfilesPost creates a profile from the template.  The template's
+// settings replace the same settings of the profile passed in
+func apiTemplateProfilesPost(w http.ResponseWriter, r *http.Request, args []string) {
+	t, ok := apiGetTemplate(w, args[0])
+	if !ok {
+		return
+	}
+	input := &apiProfile{}
+	err := json.NewDecoder(r.Body).Decode(input)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	t.apply(input)
+	ps, err := input.profileStore("")
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	ps, err = newProfile(ps)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	apiSuccess(w, http.StatusCreated, newAPIProfile(ps))
+}
+
+// default and largest number of log entries returned by /v1/log
+const (
+	apiLogLimit    = 100
+	apiLogMaxLimit = 1000
+)
+
+// apiLogTime parses a time passed to /v1/log, either an RFC 3339 time, or a
+// duration before now
+func apiLogTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time %q, it must be an RFC 3339 time or a duration such as 24h", value)
+	}
+	return t, nil
+}
+
+func apiLogInt(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid number %q", value)
+	}
+	return n, nil
+}
+
+func apiLogGet(w http.ResponseWriter, r *http.Request, args []string) {
+	values := r.URL.Query()
+	q := log.Query{
+		Type:    values.Get("module"),
+		Level:   values.Get("level"),
+		Profile: values.Get("profile"),
+		Path:    values.Get("path"),
+	}
+	if q.Level != "" && !log.ValidLevel(q.Level) {
+		apiFail(w, http.StatusBadRequest, fmt.Errorf("Invalid log level %q, it must be debug, info, warn or error",
+			q.Level))
+		return
+	}
+	var err error
+	q.Since, err = apiLogTime(values.Get("since"))
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	q.Until, err = apiLogTime(values.Get("until"))
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	limit, err := apiLogInt(values.Get("limit"), apiLogLimit)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	if limit == 0 || limit > apiLogMaxLimit {
+		limit = apiLogMaxLimit
+	}
+	offset, err := apiLogInt(values.Get("offset"), 0)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+
+	logs, err := log.Find(q, offset, limit)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiSuccess(w, http.StatusOK, logs)
+}
+
+func apiLogConfigGet(w http.ResponseWriter, r *http.Request, args []string) {
+	apiSuccess(w, http.StatusOK, log.CurrentConfig())
+}
+
+// apiLogConfigPut replaces the log config.  It isn't saved to the settings
+// file, so turning on debug logging to track down a problem doesn't outlast
+// the problem
+func apiLogConfigPut(w http.ResponseWriter, r *http.Request, args []string) {
+	input := log.CurrentConfig()
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	err = log.Configure(input)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	logger.Infof("The log level was changed to %s", input.Level)
+	apiSuccess(w, http.StatusOK, log.CurrentConfig())
+}
+
+// apiLocalFoldersGet lists the folders in a local folder.  Only the folders in
+// the localRoots setting can be browsed, and they're listed when no path is given
+func apiLocalFoldersGet(w http.ResponseWriter, r *http.Request, args []string) {
+	dirPath := r.URL.Query().Get("path")
+	paths := localRoots
+	if dirPath != "" {
+		var err error
+		paths, err = localFolders(dirPath)
+		if err == errOutsideRoots {
+			apiFail(w, http.StatusForbidden, err)
+			return
+		}
+		if err != nil {
+			apiFail(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	apiSuccess(w, http.StatusOK, apiFolders(paths))
+}
+
+// apiRemoteFoldersPost lists the folders on a freehold instance, starting from
+// the top of its files.  It's a post, as the connection's secrets are sent in
+// the body.  Secrets which are left out are filled in from the ones stored for
+// the same url and user, so the remote path of an existing profile can be
+// changed without sending them again
+func apiRemoteFoldersPost(w http.ResponseWriter, r *http.Request, args []string) {
+	input := &struct {
+		Remote *apiRemote `json:"remote"`
+		Path   string     `json:"path"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(input)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	if input.Remote == nil {
+		apiFail(w, http.StatusBadRequest, errors.New("The remote to connect to is required"))
+		return
+	}
+	if input.Path == "" {
+		input.Path = remoteRoot
+	}
+
+	ps, err := (&apiProfile{Remote: input.Remote}).profileStore("")
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	c, err := remoteClient(ps.Client)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	f, err := remote.New(c, input.Path)
+	if remote.IsOffline(err) {
+		apiFail(w, http.StatusBadGateway, err)
+		return
+	}
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	if !f.Exists() {
+		apiFail(w, http.StatusNotFound, errors.New("Path does not exist"))
+		return
+	}
+	if !f.IsDir() {
+		apiFail(w, http.StatusBadRequest, errors.New("Path is not a folder"))
+		return
+	}
+
+	paths, err := remoteFolders(f)
+	if remote.IsOffline(err) {
+		apiFail(w, http.StatusBadGateway, err)
+		return
+	}
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiSuccess(w, http.StatusOK, apiFolders(paths))
+}
+
+// apiFolders returns the folders at the paths, sorted by name
+func apiFolders(paths []string) []*apiFolder {
+	folders := make([]*apiFolder, 0, len(paths))
+	for i := range paths {
+		folders = append(folders, &apiFolder{
+			Name: filepath.Base(filepath.FromSlash(paths[i])),
+			Path: paths[i],
+		})
+	}
+	sort.Slice(folders, func(i, j int) bool {
+		return strings.ToLower(folders[i].Name) < strings.ToLower(folders[j].Name)
+	})
+	return folders
+}
@@ -0,0 +1,391 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"bitbucket.org/tshannon/freehold-sync/credentials"
+)
+
+const (
+	sessionCookie   = "freehold-sync-session"
+	csrfHeader      = "X-CSRF-Token"
+	passwordAccount = "ui/password" // credential the bcrypt hash of the password is stored under
+)
+
+// sessionAge is how long a session lasts without being used
+var sessionAge = 24 * time.Hour
+
+// failedLoginDelay slows down guessing the password
+const failedLoginDelay = time.Second
+
+var errNotLoggedIn = errors.New("You must log in first")
+
+var (
+	sessions   sessionStore
+	uiPassword passwordCache
+)
+
+func init() {
+	sessions = sessionStore{
+		all: make(map[string]*session),
+	}
+}
+
+type session struct {
+	csrf    string
+	expires time.Time
+}
+
+type sessionStore struct {
+	sync.Mutex
+	all map[string]*session
+}
+
+func (s *sessionStore) add() (string, *session, error) {
+	id, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	csrf, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	ses := &session{
+		csrf:    csrf,
+		expires: time.Now().Add(sessionAge),
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.all[id] = ses
+	return id, ses, nil
+}
+
+// get returns the session, and keeps it from expiring for another sessionAge
+func (s *sessionStore) get(id string) (*session, bool) {
+	s.Lock()
+	defer s.Unlock()
+	ses, ok := s.all[id]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(ses.expires) {
+		delete(s.all, id)
+		return nil, false
+	}
+	ses.expires = time.Now().Add(sessionAge)
+	return ses, true
+}
+
+func (s *sessionStore) remove(id string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.all, id)
+}
+
+func (s *sessionStore) clear() {
+	s.Lock()
+	defer s.Unlock()
+	s.all = make(map[string]*session)
+}
+
+// passwordCache keeps the password hash in memory, so it isn't read from the
+// keyring on every request
+type passwordCache struct {
+	sync.RWMutex
+	hash   string
+	loaded bool
+}
+
+func (p *passwordCache) get() (string, error) {
+	p.RLock()
+	hash, loaded := p.hash, p.loaded
+	p.RUnlock()
+	if loaded {
+		return hash, nil
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if p.loaded {
+		return p.hash, nil
+	}
+	hash, err := credentials.Get(passwordAccount)
+	if err == credentials.ErrNotFound {
+		hash, err = "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	p.hash = hash
+	p.loaded = true
+	return hash, nil
+}
+
+// set changes the password, or removes it if it's empty
+func (p *passwordCache) set(password string) error {
+	p.Lock()
+	defer p.Unlock()
+	p.loaded = false
+	if password == "" {
+		err := credentials.Delete(passwordAccount)
+		if err != nil {
+			return err
+		}
+		p.hash = ""
+		p.loaded = true
+		return nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	err = credentials.Set(passwordAccount, string(hash))
+	if err != nil {
+		return err
+	}
+	p.hash = string(hash)
+	p.loaded = true
+	return nil
+}
+
+// matches returns whether or not the password is the web interface's password
+func (p *passwordCache) matches(password string) (bool, error) {
+	hash, err := p.get()
+	if err != nil || hash == "" {
+		return false, err
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil, nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// publicPath returns whether the path can be requested without logging in.  The
+// page itself is public, so it can show the login form, and so are the health
+// checks, so monitors don't need the password.  /readyz only says whether it's
+// ready unless the request is authenticated
+func publicPath(path string) bool {
+	if path == "/" || path == "/auth/" || path == "/auth/login/" || path == "/healthz" || path == "/readyz" {
+		return true
+	}
+	for _, prefix := range []string{"/css/", "/js/", "/fonts/", "/trayIcon."} {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorized returns whether the request is allowed through, responding to it
+// if it isn't.  Requests are let in by a session cookie, along with its CSRF
+// token for anything but reads, by the password with basic auth, or by an API
+// token, neither of which browsers send on their own.  A token is checked even
+// when no password is set, so a revoked one is refused
+func authorized(w http.ResponseWriter, r *http.Request) bool {
+	if token, ok := bearerToken(r); ok {
+		return tokenAuthorized(w, r, token)
+	}
+
+	hash, err := uiPassword.get()
+	if errHandled(err, w) {
+		return false
+	}
+	if hash == "" || publicPath(r.URL.Path) {
+		return true
+	}
+
+	if _, password, ok := r.BasicAuth(); ok {
+		match, err := uiPassword.matches(password)
+		if errHandled(err, w) {
+			return false
+		}
+		if match {
+			return true
+		}
+		time.Sleep(failedLoginDelay)
+		apiFail(w, http.StatusUnauthorized, errors.New("Invalid password"))
+		return false
+	}
+
+	ses, ok := requestSession(r)
+	if !ok {
+		apiFail(w, http.StatusUnauthorized, errNotLoggedIn)
+		return false
+	}
+	if r.Method != "GET" && r.Method != "HEAD" &&
+		subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(ses.csrf)) != 1 {
+		apiFail(w, http.StatusForbidden, errors.New("Invalid CSRF token"))
+		return false
+	}
+	return true
+}
+
+// authenticated returns whether the request is logged in, or has the password
+// or a valid API token, without responding to it either way.  It's for public
+// paths which show more to those who can log in
+func authenticated(r *http.Request) bool {
+	if token, ok := bearerToken(r); ok {
+		_, err := checkToken(token)
+		return err == nil
+	}
+
+	hash, err := uiPassword.get()
+	if err != nil {
+		return false
+	}
+	if hash == "" {
+		return true
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		match, err := uiPassword.matches(password)
+		return err == nil && match
+	}
+	_, ok := requestSession(r)
+	return ok
+}
+
+func requestSession(r *http.Request) (*session, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, false
+	}
+	return sessions.get(cookie.Value)
+}
+
+// authStatus is whether a password is set, and if so whether the request is
+// logged in
+type authStatus struct {
+	PasswordSet bool   `json:"passwordSet"`
+	LoggedIn    bool   `json:"loggedIn"`
+	CSRF        string `json:"csrf,omitempty"` // sent as the X-CSRF-Token header with every change
+}
+
+func authGet(w http.ResponseWriter, r *http.Request) {
+	hash, err := uiPassword.get()
+	if errHandled(err, w) {
+		return
+	}
+	status := &authStatus{
+		PasswordSet: hash != "",
+	}
+	if ses, ok := requestSession(r); ok {
+		status.LoggedIn = true
+		status.CSRF = ses.csrf
+	}
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+		Data:   status,
+	})
+}
+
+func authLoginPost(w http.ResponseWriter, r *http.Request) {
+	input := &struct {
+		Password string `json:"password"`
+	}{}
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	match, err := uiPassword.matches(input.Password)
+	if errHandled(err, w) {
+		return
+	}
+	if !match {
+		time.Sleep(failedLoginDelay)
+		apiFail(w, http.StatusUnauthorized, errors.New("Invalid password"))
+		return
+	}
+
+	id, ses, err := sessions.add()
+	if errHandled(err, w) {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+		Data: &authStatus{
+			PasswordSet: true,
+			LoggedIn:    true,
+			CSRF:        ses.csrf,
+		},
+	})
+}
+
+func authLogoutPost(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		sessions.remove(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   sessionCookie,
+		Path:   "/",
+		MaxAge: -1,
+	})
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+	})
+}
+
+// authPasswordPut sets, changes or removes the password.  Every session is
+// logged out when it changes
+func authPasswordPut(w http.ResponseWriter, r *http.Request) {
+	input := &struct {
+		Current  string `json:"current"`
+		Password string `json:"password"`
+	}{}
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	hash, err := uiPassword.get()
+	if errHandled(err, w) {
+		return
+	}
+	if hash != "" {
+		match, err := uiPassword.matches(input.Current)
+		if errHandled(err, w) {
+			return
+		}
+		if !match {
+			time.Sleep(failedLoginDelay)
+			apiFail(w, http.StatusForbidden, errors.New("The current password is wrong"))
+			return
+		}
+	}
+
+	if errHandled(uiPassword.set(input.Password), w) {
+		return
+	}
+	sessions.clear()
+
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+	})
+}
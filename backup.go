@@ -0,0 +1,82 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+)
+
+// stopProfiles stops every active profile, so nothing is synced while the
+// datastore is replaced
+func stopProfiles() error {
+	all, err := allProfiles()
+	if err != nil {
+		return err
+	}
+	for i := range all {
+		if !all[i].Active {
+			continue
+		}
+		profile, err := all[i].makeProfile()
+		if err != nil {
+			// couldn't have been started either
+			continue
+		}
+		err = profile.Stop()
+		if err != nil {
+			logger.Profile(all[i].Name).Errorf("Error stopping profile %s: %s", all[i].Name, err)
+		}
+	}
+	return nil
+}
+
+func datastoreBackupGet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="sync-%s.ds"`,
+		time.Now().Format("2006-01-02")))
+
+	_, err := datastore.Backup(w)
+	if err != nil {
+		// part of the snapshot has likely been sent already
+		logger.Errorf("Error backing up the datastore: %s", err)
+	}
+}
+
+func datastoreRestorePost(w http.ResponseWriter, r *http.Request) {
+	if errHandled(stopProfiles(), w) {
+		return
+	}
+
+	err := datastore.Restore(r.Body)
+
+	// whichever datastore is in place now, its profiles carry on from where it
+	// left them
+	all, aerr := allProfiles()
+	if aerr == nil {
+		startProfiles(all)
+	}
+	if errHandled(err, w) || errHandled(aerr, w) {
+		return
+	}
+
+	logger.Infof("The datastore has been restored from a backup")
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+	})
+}
+
+func datastoreExportGet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/json")
+
+	err := datastore.Export(w)
+	if err != nil {
+		logger.Errorf("Error exporting the datastore: %s", err)
+	}
+}
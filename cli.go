@@ -0,0 +1,1229 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// commands are run against an already running instance of freehold-sync
+var commands = map[string]func(c *cliClient, args []string) error{
+	"verify":             cmdVerify,
+	"repair":             cmdRepair,
+	"history":            cmdHistory,
+	"conflicts":          cmdConflicts,
+	"resolve":            cmdResolve,
+	"quarantined":        cmdQuarantined,
+	"release":            cmdRelease,
+	"test":               cmdTest,
+	"report":             cmdReport,
+	"status":             cmdStatus,
+	"list-profiles":      cmdListProfiles,
+	"add-profile":        cmdAddProfile,
+	"pause":              cmdPause,
+	"resume":             cmdResume,
+	"sync-now":           cmdSyncNow,
+	"password":           cmdPassword,
+	"token":              cmdToken,
+	"gc":                 cmdGC,
+	"compact":            cmdCompact,
+	"backup":             cmdBackup,
+	"restore":            cmdRestore,
+	"export":             cmdExport,
+	"export-profiles":    cmdExportProfiles,
+	"import-profiles":    cmdImportProfiles,
+	"templates":          cmdTemplates,
+	"save-template":      cmdSaveTemplate,
+	"delete-template":    cmdDeleteTemplate,
+	"clone-profile":      cmdCloneProfile,
+	"add-destination":    cmdAddDestination,
+	"remove-destination": cmdRemoveDestination,
+}
+
+// runCommand runs the command in args, returning the exit code
+func runCommand(port, dataDir string, args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "Unknown command %s, the commands are:\n\t%s\n", args[0],
+			strings.Join(names, "\n\t"))
+		return 2
+	}
+
+	c, err := newCLIClient(port, dataDir)
+	if err == nil {
+		err = cmd(c, args[1:])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+type cliClient struct {
+	rootURL string
+	client  *http.Client
+}
+
+// newCLIClient connects to the running instance the way it serves the web
+// interface: over its unix socket if it has one, otherwise on localhost over
+// HTTPS, trusting only its own certificate, or HTTP
+func newCLIClient(port, dataDir string) (*cliClient, error) {
+	if socketFile != "" {
+		return &cliClient{
+			rootURL: "http://freehold-sync",
+			client: &http.Client{
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						var d net.Dialer
+						return d.DialContext(ctx, "unix", socketFile)
+					},
+				},
+			},
+		}, nil
+	}
+	if !useTLS {
+		return &cliClient{
+			rootURL: webURL(port),
+			client:  http.DefaultClient,
+		}, nil
+	}
+
+	certFile, _ := certificateFiles(dataDir)
+	config, err := pinnedTLS(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading freehold-sync's certificate: %s", err)
+	}
+	return &cliClient{
+		rootURL: webURL(port),
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: config},
+		},
+	}, nil
+}
+
+// passwordEnv is the environment variable commands read the web interface's
+// password from, if one is set
+const passwordEnv = "FREEHOLD_SYNC_PASSWORD"
+
+func (c *cliClient) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.rootURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if password := os.Getenv(passwordEnv); password != "" {
+		req.SetBasicAuth("", password)
+	}
+	return req, nil
+}
+
+type cliResponse struct {
+	Status  string          `json:"status"`
+	Data    json.RawMessage `json:"data"`
+	Message string          `json:"message"`
+}
+
+// call makes a request against the running instance's web API
+func (c *cliClient) call(method, path string, input, result interface{}) error {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	req, err := c.newRequest(method, path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error connecting to freehold-sync, make sure it's running: %s", err)
+	}
+	defer res.Body.Close()
+
+	response := &cliResponse{}
+	err = json.NewDecoder(res.Body).Decode(response)
+	if err != nil {
+		return err
+	}
+	if response.Status != statusSuccess {
+		return errors.New(response.Message)
+	}
+	if result == nil || len(response.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(response.Data, result)
+}
+
+// transfer makes a request against the running instance's web API with a raw
+// body, and copies the raw response into out
+func (c *cliClient) transfer(method, path string, body io.Reader, out io.Writer) error {
+	req, err := c.newRequest(method, path, body)
+	if err != nil {
+		return err
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error connecting to freehold-sync, make sure it's running: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		response := &cliResponse{}
+		err = json.NewDecoder(res.Body).Decode(response)
+		if err != nil {
+			return fmt.Errorf("Error from freehold-sync. Status: %s", res.Status)
+		}
+		return errors.New(response.Message)
+	}
+	_, err = io.Copy(out, res.Body)
+	return err
+}
+
+// findProfile finds a profile by name or ID
+func (c *cliClient) findProfile(nameOrID string) (*profileStore, error) {
+	var all []*profileStore
+	err := c.call("GET", "/profile/", nil, &all)
+	if err != nil {
+		return nil, err
+	}
+	for i := range all {
+		if all[i].ID == nameOrID || strings.EqualFold(all[i].Name, nameOrID) {
+			return all[i], nil
+		}
+	}
+	return nil, fmt.Errorf("No profile found named %s", nameOrID)
+}
+
+// cmdVerify compares every file in a profile and prints the files that are out of sync
+func cmdVerify(c *cliClient, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: freehold-sync verify <profile name or id>")
+	}
+	profile, err := c.findProfile(args[0])
+	if err != nil {
+		return err
+	}
+
+	input := map[string]string{"id": profile.ID}
+	err = c.call("POST", "/profile/verify/", input, nil)
+	if err != nil {
+		return err
+	}
+
+	report := &syncer.AuditReport{}
+	for {
+		time.Sleep(time.Second)
+		err = c.call("GET", "/profile/verify/", input, report)
+		if err != nil {
+			return err
+		}
+		if !report.Running {
+			break
+		}
+	}
+
+	if report.Error != "" {
+		return fmt.Errorf("Error verifying %s: %s", profile.Name, report.Error)
+	}
+
+	for _, item := range report.Items {
+		fmt.Printf("%-10s %s\n", item.Problem, item.Path)
+	}
+	fmt.Printf("Checked %d files in %s\n", report.Checked, report.Finished.Sub(report.Started))
+	if len(report.Items) > 0 {
+		return fmt.Errorf("%d files are out of sync", len(report.Items))
+	}
+	return nil
+}
+
+// cmdRepair re-syncs the files found out of sync by the last verify of a profile
+func cmdRepair(c *cliClient, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: freehold-sync repair <profile name or id>")
+	}
+	profile, err := c.findProfile(args[0])
+	if err != nil {
+		return err
+	}
+
+	err = c.call("POST", "/profile/repair/", map[string]string{"id": profile.ID}, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Repairing %s\n", profile.Name)
+	return nil
+}
+
+// cmdHistory prints every change made to a file in a profile, and why
+func cmdHistory(c *cliClient, args []string) error {
+	if len(args) != 2 {
+		return errors.New("Usage: freehold-sync history <profile name or id> <path>")
+	}
+	profile, err := c.findProfile(args[0])
+	if err != nil {
+		return err
+	}
+
+	var history []*syncer.HistoryEntry
+	err = c.call("GET", "/profile/history/", map[string]string{"id": profile.ID, "path": args[1]}, &history)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range history {
+		file := entry.Path
+		if entry.From != "" {
+			file = entry.From + " -> " + entry.Path
+		}
+		fmt.Printf("%s  %-6s  %-8s  %s (%s)\n", entry.When.Format(time.RFC3339), entry.Side, entry.Action, file,
+			entry.Reason)
+	}
+	if len(history) == 0 {
+		fmt.Printf("No changes have been made to %s\n", args[1])
+	}
+	return nil
+}
+
+// cmdConflicts prints the conflicts a profile is waiting to have resolved
+func cmdConflicts(c *cliClient, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: freehold-sync conflicts <profile name or id>")
+	}
+	profile, err := c.findProfile(args[0])
+	if err != nil {
+		return err
+	}
+
+	var conflicts []*syncer.Conflict
+	err = c.call("GET", "/profile/conflicts/", map[string]string{"id": profile.ID}, &conflicts)
+	if err != nil {
+		return err
+	}
+
+	for _, conflict := range conflicts {
+		fmt.Printf("%s\n\tlocal:  %s  %d bytes\n\tremote: %s  %d bytes\n", conflict.Path,
+			conflict.LocalModified.Format(time.RFC3339), conflict.LocalSize,
+			conflict.RemoteModified.Format(time.RFC3339), conflict.RemoteSize)
+	}
+	if len(conflicts) == 0 {
+		fmt.Printf("No conflicts are waiting to be resolved in %s\n", profile.Name)
+	}
+	return nil
+}
+
+// cmdResolve resolves a conflict by keeping the local file, the remote file, or both
+func cmdResolve(c *cliClient, args []string) error {
+	if len(args) != 3 {
+		return errors.New("Usage: freehold-sync resolve <profile name or id> <path> <local | remote | both>")
+	}
+	profile, err := c.findProfile(args[0])
+	if err != nil {
+		return err
+	}
+
+	input := map[string]string{
+		"id":         profile.ID,
+		"path":       args[1],
+		"resolution": args[2],
+	}
+	err = c.call("POST", "/profile/conflicts/", input, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Resolving %s\n", args[1])
+	return nil
+}
+
+// cmdQuarantined prints the files a profile quarantined for being synced back
+// and forth, and why
+func cmdQuarantined(c *cliClient, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: freehold-sync quarantined <profile name or id>")
+	}
+	profile, err := c.findProfile(args[0])
+	if err != nil {
+		return err
+	}
+
+	var quarantined []*syncer.Quarantine
+	err = c.call("GET", apiPath(profile.ID, "quarantine"), nil, &quarantined)
+	if err != nil {
+		return err
+	}
+
+	for _, q := range quarantined {
+		fmt.Printf("%s\n\tfound: %s\n\t%s\n", q.Path, q.Found.Format(time.RFC3339), q.Diagnostic)
+	}
+	if len(quarantined) == 0 {
+		fmt.Printf("No files are quarantined in %s\n", profile.Name)
+	}
+	return nil
+}
+
+// cmdRelease lets a quarantined file be synced again
+func cmdRelease(c *cliClient, args []string) error {
+	if len(args) != 2 {
+		return errors.New("Usage: freehold-sync release <profile name or id> <path>")
+	}
+	profile, err := c.findProfile(args[0])
+	if err != nil {
+		return err
+	}
+
+	err = c.call("DELETE", apiPath(profile.ID, "quarantine", url.PathEscape(args[1])), nil, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Released %s\n", args[1])
+	return nil
+}
+
+// cmdTest tests a profile's connection and paths, failing if the profile can't
+// sync
+func cmdTest(c *cliClient, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: freehold-sync test <profile name or id>")
+	}
+	profile, err := c.findProfile(args[0])
+	if err != nil {
+		return err
+	}
+
+	result := &connectionTest{}
+	err = c.call("POST", "/profile/test/", map[string]string{"id": profile.ID}, result)
+	if err != nil {
+		return err
+	}
+
+	for _, check := range result.Checks {
+		status := "ok"
+		if check.Skipped {
+			status = "skipped"
+		} else if !check.OK && check.Required {
+			status = "FAILED"
+		} else if !check.OK {
+			status = "failed"
+		}
+		fmt.Printf("%-15s %s\n", check.Name, status)
+		if check.Error != "" {
+			fmt.Printf("\t%s\n", check.Error)
+		}
+		if check.Detail != "" {
+			fmt.Printf("\t%s\n", check.Detail)
+		}
+	}
+	if !result.OK {
+		return fmt.Errorf("%s can't sync until the failed checks are fixed", profile.Name)
+	}
+	return nil
+}
+
+// cmdReport emails a profile's summary report right away
+func cmdReport(c *cliClient, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: freehold-sync report <profile name or id>")
+	}
+	profile, err := c.findProfile(args[0])
+	if err != nil {
+		return err
+	}
+
+	var to string
+	err = c.call("POST", "/profile/report/", map[string]string{"id": profile.ID}, &to)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Sent the report of %s to %s\n", profile.Name, to)
+	return nil
+}
+
+// cmdPassword sets, changes or removes the web interface's password.  The new
+// password is read from standard in, so it doesn't end up in the shell's history
+func cmdPassword(c *cliClient, args []string) error {
+	flags := flag.NewFlagSet("password", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	remove := flags.Bool("remove", false, "")
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() != 0 {
+		return errors.New("Usage: freehold-sync password [-remove]")
+	}
+
+	password := ""
+	if !*remove {
+		password, err = readPassword("New password: ")
+		if err != nil {
+			return err
+		}
+		if password == "" {
+			return errors.New("The password can't be empty, use -remove to remove it")
+		}
+	}
+
+	input := map[string]string{
+		"current":  os.Getenv(passwordEnv),
+		"password": password,
+	}
+	err = c.call("PUT", "/auth/password/", input, nil)
+	if err != nil {
+		return err
+	}
+	if *remove {
+		fmt.Println("Removed the web interface's password")
+	} else {
+		fmt.Println("Changed the web interface's password")
+	}
+	return nil
+}
+
+const tokenUsage = "Usage: freehold-sync token [list | create [-read-only] <name> | revoke <id>]"
+
+// cmdToken lists, creates or revokes API tokens
+func cmdToken(c *cliClient, args []string) error {
+	if len(args) == 0 || args[0] == "list" {
+		var all []*apiToken
+		err := c.call("GET", "/auth/token/", nil, &all)
+		if err != nil {
+			return err
+		}
+		for _, t := range all {
+			access := "read/write"
+			if t.ReadOnly {
+				access = "read only"
+			}
+			used := "never used"
+			if !t.LastUsed.IsZero() {
+				used = "last used " + t.LastUsed.Format(time.RFC3339)
+			}
+			fmt.Printf("%s  %-10s  %s (%s)\n", t.ID, access, t.Name, used)
+		}
+		if len(all) == 0 {
+			fmt.Println("No API tokens have been created")
+		}
+		return nil
+	}
+
+	switch args[0] {
+	case "create":
+		readOnly := len(args) == 3 && args[1] == "-read-only"
+		if len(args) != 2 && !readOnly {
+			return errors.New(tokenUsage)
+		}
+		result := &struct {
+			Token string `json:"token"`
+		}{}
+		input := map[string]interface{}{
+			"name":     args[len(args)-1],
+			"readOnly": readOnly,
+		}
+		err := c.call("POST", "/auth/token/", input, result)
+		if err != nil {
+			return err
+		}
+		fmt.Println(result.Token)
+		return nil
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New(tokenUsage)
+		}
+		err := c.call("DELETE", "/auth/token/", map[string]string{"id": args[1]}, nil)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Revoked API token %s\n", args[1])
+		return nil
+	}
+	return errors.New(tokenUsage)
+}
+
+// cmdGC removes stale entries from the datastore
+func cmdGC(c *cliClient, args []string) error {
+	report := &gcReport{}
+	err := c.call("POST", "/datastore/gc/", nil, report)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d stale entries from the datastore\n", report.total())
+	return nil
+}
+
+// cmdCompact rewrites the datastore without the free space left by removed entries
+func cmdCompact(c *cliClient, args []string) error {
+	sizes := &struct {
+		Before int64 `json:"before"`
+		After  int64 `json:"after"`
+	}{}
+	err := c.call("POST", "/datastore/compact/", nil, sizes)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Compacted the datastore from %d to %d bytes\n", sizes.Before, sizes.After)
+	return nil
+}
+
+// cmdBackup saves a snapshot of the datastore to a file
+func cmdBackup(c *cliClient, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: freehold-sync backup <file>")
+	}
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	err = c.transfer("GET", "/datastore/backup/", nil, f)
+	cerr := f.Close()
+	if err != nil {
+		os.Remove(args[0])
+		return err
+	}
+	if cerr != nil {
+		return cerr
+	}
+	fmt.Printf("Saved a backup of the datastore to %s\n", args[0])
+	return nil
+}
+
+// cmdRestore replaces the datastore with a snapshot saved by backup
+func cmdRestore(c *cliClient, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: freehold-sync restore <file>")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = c.transfer("POST", "/datastore/restore/", f, ioutil.Discard)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored the datastore from %s\n", args[0])
+	return nil
+}
+
+// cmdExport writes the contents of the datastore as JSON to a file, or stdout
+func cmdExport(c *cliClient, args []string) error {
+	if len(args) > 1 {
+		return errors.New("Usage: freehold-sync export [file]")
+	}
+	if len(args) == 0 {
+		return c.transfer("GET", "/datastore/export/", nil, os.Stdout)
+	}
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	err = c.transfer("GET", "/datastore/export/", nil, f)
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// apiPath is the /v1/ path of a profile, followed by the passed in parts
+func apiPath(profileID string, parts ...string) string {
+	return "/v1/profiles/" + url.PathEscape(profileID) + "/" + strings.Join(parts, "/")
+}
+
+// cmdListProfiles prints every profile and where it syncs
+func cmdListProfiles(c *cliClient, args []string) error {
+	if len(args) != 0 {
+		return errors.New("Usage: freehold-sync list-profiles")
+	}
+	var all []*apiProfile
+	err := c.call("GET", "/v1/profiles", nil, &all)
+	if err != nil {
+		return err
+	}
+	for _, p := range all {
+		state := "active"
+		switch {
+		case !p.Active:
+			state = "inactive"
+		case p.Paused:
+			state = "paused"
+		case p.DryRun:
+			state = "dry run"
+		}
+		remoteURL := ""
+		if p.Remote != nil {
+			remoteURL = p.Remote.URL
+		}
+		fmt.Printf("%s (%s)\n", p.Name, state)
+		fmt.Printf("\tid:     %s\n", p.ID)
+		fmt.Printf("\tlocal:  %s\n", p.LocalPath)
+		fmt.Printf("\tremote: %s %s\n", remoteURL, p.RemotePath)
+	}
+	if len(all) == 0 {
+		fmt.Println("No profiles have been added")
+	}
+	return nil
+}
+
+// cmdStatus prints the sync status of every profile, or of one
+func cmdStatus(c *cliClient, args []string) error {
+	if len(args) > 1 {
+		return errors.New("Usage: freehold-sync status [profile name or id]")
+	}
+	var all []*apiProfile
+	if len(args) == 1 {
+		profile, err := c.findProfile(args[0])
+		if err != nil {
+			return err
+		}
+		all = append(all, &apiProfile{ID: profile.ID, Name: profile.Name})
+	} else {
+		err := c.call("GET", "/v1/profiles", nil, &all)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, p := range all {
+		status := &apiStatus{}
+		err := c.call("GET", apiPath(p.ID, "status"), nil, status)
+		if err != nil {
+			return err
+		}
+		stats := &apiStats{}
+		err = c.call("GET", apiPath(p.ID, "stats"), nil, stats)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s: %s, %d pending\n", p.Name, status.Status, status.Pending)
+		if status.Warning != "" {
+			fmt.Printf("\twarning: %s\n", status.Warning)
+		}
+		for _, d := range status.Destinations {
+			fmt.Printf("\tdestination %s%s: %s, %d pending\n", d.URL, d.RemotePath, d.Status, d.Pending)
+		}
+		fmt.Printf("\tuploaded %d files (%s), downloaded %d files (%s), %d conflicts, %d errors\n",
+			stats.FilesUploaded, formatBytes(stats.BytesUploaded), stats.FilesDownloaded,
+			formatBytes(stats.BytesDownloaded), stats.Conflicts, stats.Errors)
+		if stats.LastSync != nil {
+			fmt.Printf("\tlast synced %s\n", stats.LastSync.Format(time.RFC1123))
+		}
+	}
+	if len(all) == 0 {
+		fmt.Println("No profiles have been added")
+	}
+	return nil
+}
+
+// directionNames are the directions add-profile accepts
+var directionNames = map[string]int{
+	"both":          syncer.DirectionBoth,
+	"upload":        syncer.DirectionRemoteOnly,
+	"download":      syncer.DirectionLocalOnly,
+	"mirror-remote": syncer.DirectionMirrorRemote,
+	"mirror-local":  syncer.DirectionMirrorLocal,
+	"backup":        syncer.DirectionBackup,
+}
+
+// defaultIgnore skips hidden files, the same as new profiles in the web interface
+const defaultIgnore = `(/\.|^\.{1}.+$)`
+
+// remotePasswordEnv is the environment variable add-profile reads the password
+// of the freehold instance from, instead of asking for it
+const remotePasswordEnv = "FREEHOLD_SYNC_REMOTE_PASSWORD"
+
+const addProfileUsage = "Usage: freehold-sync add-profile -name <name> -local <folder> -url <freehold url> " +
+	"-user <user> [-remote <folder>] [-direction both|upload|download|mirror-remote|mirror-local|backup] [-paused] " +
+	"[-template <name>]"
+
+// cmdAddProfile tests and adds a profile.  The password of the freehold
+// instance is read from standard in, and swapped for a token, which is stored
+// instead
+func cmdAddProfile(c *cliClient, args []string) error {
+	flags := flag.NewFlagSet("add-profile", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	name := flags.String("name", "", "")
+	localPath := flags.String("local", "", "")
+	remoteURL := flags.String("url", "", "")
+	user := flags.String("user", "", "")
+	remotePath := flags.String("remote", "/", "")
+	direction := flags.String("direction", "both", "")
+	paused := flags.Bool("paused", false, "")
+	template := flags.String("template", "", "")
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() != 0 || *name == "" || *localPath == "" || *remoteURL == "" || *user == "" {
+		return errors.New(addProfileUsage)
+	}
+	dir, ok := directionNames[*direction]
+	if !ok {
+		return errors.New(addProfileUsage)
+	}
+	localFolder, err := filepath.Abs(*localPath)
+	if err != nil {
+		return err
+	}
+	var t *profileTemplate
+	if *template != "" {
+		t = &profileTemplate{}
+		err = c.call("GET", "/v1/templates/"+url.PathEscape(*template), nil, t)
+		if err != nil {
+			return err
+		}
+	}
+
+	token, err := c.signIn(*name, *remoteURL, *user)
+	if err != nil {
+		return err
+	}
+
+	profile := &apiProfile{
+		Name:       *name,
+		LocalPath:  localFolder,
+		RemotePath: *remotePath,
+		Remote: &apiRemote{
+			URL:   *remoteURL,
+			User:  *user,
+			Token: token,
+		},
+		Active:    true,
+		Paused:    *paused,
+		Direction: dir,
+		Ignore:    []string{defaultIgnore},
+		TrashDays: 30,
+	}
+	if t != nil {
+		t.apply(profile)
+	}
+
+	test := &connectionTest{}
+	err = c.call("POST", "/v1/profiles/test", profile, test)
+	if err != nil {
+		return err
+	}
+	if !test.OK {
+		for _, check := range test.Checks {
+			if !check.OK && check.Required && !check.Skipped {
+				fmt.Fprintf(os.Stderr, "%-15s FAILED\n\t%s\n", check.Name, check.Error)
+			}
+		}
+		return fmt.Errorf("%s wasn't added, it can't sync until the failed checks are fixed", *name)
+	}
+
+	added := &apiProfile{}
+	err = c.call("POST", "/v1/profiles", profile, added)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added %s (%s)\n", added.Name, added.ID)
+	return nil
+}
+
+// signIn swaps the password of the user on the freehold instance, read from
+// standard in, for a token for the profile with the name
+func (c *cliClient) signIn(name, remoteURL, user string) (string, error) {
+	password, err := readSecret(remotePasswordEnv, fmt.Sprintf("Password for %s on %s: ", user, remoteURL))
+	if err != nil {
+		return "", err
+	}
+
+	token := &struct {
+		Token string `json:"token"`
+	}{}
+	err = c.call("POST", "/remote/token/", map[string]interface{}{
+		"name": name,
+		"client": map[string]string{
+			"url":      remoteURL,
+			"user":     user,
+			"password": password,
+		},
+	}, token)
+	if err != nil {
+		return "", fmt.Errorf("Error signing in to %s: %s", remoteURL, err)
+	}
+	return token.Token, nil
+}
+
+// readSecret reads a secret from the environment variable, or asks for it on
+// standard in if it isn't set
+func readSecret(env, prompt string) (string, error) {
+	if secret := os.Getenv(env); secret != "" {
+		return secret, nil
+	}
+	return readPassword(prompt)
+}
+
+// readPassword asks for a password on standard in, without echoing it if
+// standard in is a terminal
+func readPassword(prompt string) (string, error) {
+	fmt.Print(prompt)
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		password, err := term.ReadPassword(fd)
+		fmt.Println()
+		return string(password), err
+	}
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(password, "\r\n"), nil
+}
+
+// exportPassphraseEnv is the environment variable export-profiles and
+// import-profiles read the passphrase secrets are sealed with from, instead of
+// asking for it
+const exportPassphraseEnv = "FREEHOLD_SYNC_EXPORT_PASSPHRASE"
+
+const exportProfilesUsage = "Usage: freehold-sync export-profiles [-secrets] [-o file] [profile name or id...]"
+
+// cmdExportProfiles exports profiles to a file, or stdout, to be imported by
+// another freehold-sync
+func cmdExportProfiles(c *cliClient, args []string) error {
+	flags := flag.NewFlagSet("export-profiles", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	secrets := flags.Bool("secrets", false, "")
+	file := flags.String("o", "", "")
+	err := flags.Parse(args)
+	if err != nil {
+		return errors.New(exportProfilesUsage)
+	}
+
+	input := &struct {
+		IDs        []string `json:"ids"`
+		Passphrase string   `json:"passphrase,omitempty"`
+	}{IDs: []string{}}
+	for _, nameOrID := range flags.Args() {
+		p, err := c.findProfile(nameOrID)
+		if err != nil {
+			return err
+		}
+		input.IDs = append(input.IDs, p.ID)
+	}
+	if *secrets {
+		input.Passphrase, err = readSecret(exportPassphraseEnv, "Passphrase to encrypt the secrets with: ")
+		if err != nil {
+			return err
+		}
+		if input.Passphrase == "" {
+			return errors.New("A passphrase is required to export secrets")
+		}
+	}
+
+	var e json.RawMessage
+	err = c.call("POST", "/v1/profiles/export", input, &e)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	err = json.Indent(&out, e, "", "\t")
+	if err != nil {
+		return err
+	}
+	out.WriteString("\n")
+
+	if *file == "" {
+		_, err = out.WriteTo(os.Stdout)
+		return err
+	}
+	// secrets or not, the file says where everything is
+	return ioutil.WriteFile(*file, out.Bytes(), 0600)
+}
+
+// cmdImportProfiles adds the profiles exported to a file
+func cmdImportProfiles(c *cliClient, args []string) error {
+	flags := flag.NewFlagSet("import-profiles", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	paused := flags.Bool("paused", false, "")
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() != 1 {
+		return errors.New("Usage: freehold-sync import-profiles [-paused] file")
+	}
+
+	data, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	e := &profileExport{}
+	err = json.Unmarshal(data, e)
+	if err != nil {
+		return fmt.Errorf("Error reading exported profiles from %s: %s", flags.Arg(0), err)
+	}
+
+	passphrase := ""
+	if len(e.Salt) > 0 {
+		passphrase, err = readSecret(exportPassphraseEnv, "Passphrase the secrets were encrypted with: ")
+		if err != nil {
+			return err
+		}
+	}
+
+	var results []*importResult
+	err = c.call("POST", "/v1/profiles/import", map[string]interface{}{
+		"export":     json.RawMessage(data),
+		"passphrase": passphrase,
+		"paused":     *paused,
+	}, &results)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.Error != "" {
+			failed++
+			fmt.Fprintf(os.Stderr, "%s wasn't imported: %s\n", r.Name, r.Error)
+			continue
+		}
+		fmt.Printf("Imported %s (%s)\n", r.Name, r.ID)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d profiles weren't imported", failed, len(results))
+	}
+	return nil
+}
+
+// conflictNames describe how a template resolves conflicts
+var conflictNames = map[int]string{
+	syncer.ConResKeepNewest: "keep newest",
+	syncer.ConResKeepBoth:   "keep both",
+	syncer.ConResKeepLocal:  "keep local",
+	syncer.ConResKeepRemote: "keep remote",
+	syncer.ConResAsk:        "ask",
+}
+
+// cmdTemplates prints every template and its settings
+func cmdTemplates(c *cliClient, args []string) error {
+	if len(args) != 0 {
+		return errors.New("Usage: freehold-sync templates")
+	}
+	var all []*profileTemplate
+	err := c.call("GET", "/v1/templates", nil, &all)
+	if err != nil {
+		return err
+	}
+	for _, t := range all {
+		fmt.Println(t.Name)
+		fmt.Printf("	ignore:     %s\n", strings.Join(t.Ignore, ", "))
+		fmt.Printf("	filters:    %s\n", strings.Join(t.Filters, ", "))
+		fmt.Printf("	max size:   %d MB\n", t.MaxFileSizeMB)
+		fmt.Printf("	limits:     %d KB/s up, %d KB/s down\n", t.UploadLimitKB, t.DownloadLimitKB)
+		fmt.Printf("	conflicts:  %s\n", conflictNames[t.ConflictResolution])
+	}
+	if len(all) == 0 {
+		fmt.Println("No templates have been saved")
+	}
+	return nil
+}
+
+// cmdSaveTemplate saves a profile's filter rules, throttles and conflict
+// settings as a template
+func cmdSaveTemplate(c *cliClient, args []string) error {
+	if len(args) != 2 {
+		return errors.New("Usage: freehold-sync save-template <profile name or id> <template name>")
+	}
+	profile, err := c.findProfile(args[0])
+	if err != nil {
+		return err
+	}
+	t := &profileTemplate{}
+	err = c.call("POST", apiPath(profile.ID, "template"), map[string]string{"name": args[1]}, t)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Saved the settings of %s as template %s\n", profile.Name, t.Name)
+	return nil
+}
+
+// cmdDeleteTemplate removes a template
+func cmdDeleteTemplate(c *cliClient, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: freehold-sync delete-template <template name>")
+	}
+	err := c.call("DELETE", "/v1/templates/"+url.PathEscape(args[0]), nil, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed template %s\n", args[0])
+	return nil
+}
+
+const cloneProfileUsage = "Usage: freehold-sync clone-profile -name <name> -local <folder> -remote <folder> " +
+	"<profile name or id>"
+
+// cmdCloneProfile adds a profile with the same settings and secrets as another
+// profile, syncing a different pair of folders
+func cmdCloneProfile(c *cliClient, args []string) error {
+	flags := flag.NewFlagSet("clone-profile", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	name := flags.String("name", "", "")
+	localPath := flags.String("local", "", "")
+	remotePath := flags.String("remote", "", "")
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() != 1 || *name == "" || *localPath == "" || *remotePath == "" {
+		return errors.New(cloneProfileUsage)
+	}
+	localFolder, err := filepath.Abs(*localPath)
+	if err != nil {
+		return err
+	}
+	profile, err := c.findProfile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	added := &apiProfile{}
+	err = c.call("POST", apiPath(profile.ID, "clone"), map[string]string{
+		"name":       *name,
+		"localPath":  localFolder,
+		"remotePath": *remotePath,
+	}, added)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added %s (%s), cloned from %s\n", added.Name, added.ID, profile.Name)
+	return nil
+}
+
+const addDestinationUsage = "Usage: freehold-sync add-destination -url <freehold url> -user <user> " +
+	"[-remote <folder>] <profile name or id>"
+
+// cmdAddDestination adds another freehold instance for a profile's local folder
+// to be synced to.  The password is swapped for a token, the same as with
+// add-profile
+func cmdAddDestination(c *cliClient, args []string) error {
+	flags := flag.NewFlagSet("add-destination", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	remoteURL := flags.String("url", "", "")
+	user := flags.String("user", "", "")
+	remotePath := flags.String("remote", "/", "")
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() != 1 || *remoteURL == "" || *user == "" {
+		return errors.New(addDestinationUsage)
+	}
+	found, err := c.findProfile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	profile := &apiProfile{}
+	err = c.call("GET", apiPath(found.ID), nil, profile)
+	if err != nil {
+		return err
+	}
+
+	token, err := c.signIn(profile.Name, *remoteURL, *user)
+	if err != nil {
+		return err
+	}
+	profile.Destinations = append(profile.Destinations, &apiDestination{
+		RemotePath: *remotePath,
+		Remote: &apiRemote{
+			URL:   *remoteURL,
+			User:  *user,
+			Token: token,
+		},
+	})
+
+	updated := &apiProfile{}
+	err = c.call("PUT", apiPath(profile.ID), profile, updated)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added destination %s (%s) to %s\n", *remoteURL+*remotePath,
+		updated.Destinations[len(updated.Destinations)-1].ID, updated.Name)
+	return nil
+}
+
+// cmdRemoveDestination stops syncing a profile's local folder to one of its
+// destinations, by the destination's ID or url
+func cmdRemoveDestination(c *cliClient, args []string) error {
+	if len(args) != 2 {
+		return errors.New("Usage: freehold-sync remove-destination <profile name or id> <destination id or url>")
+	}
+	found, err := c.findProfile(args[0])
+	if err != nil {
+		return err
+	}
+	profile := &apiProfile{}
+	err = c.call("GET", apiPath(found.ID), nil, profile)
+	if err != nil {
+		return err
+	}
+
+	var kept []*apiDestination
+	for _, d := range profile.Destinations {
+		if d.ID == args[1] || (d.Remote != nil && strings.TrimRight(d.Remote.URL, "/") == strings.TrimRight(args[1], "/")) {
+			continue
+		}
+		kept = append(kept, d)
+	}
+	switch len(profile.Destinations) - len(kept) {
+	case 0:
+		return fmt.Errorf("Profile %s has no destination %s", profile.Name, args[1])
+	case 1:
+	default:
+		return fmt.Errorf("Profile %s has more than one destination on %s, remove it by its ID", profile.Name, args[1])
+	}
+	profile.Destinations = kept
+
+	err = c.call("PUT", apiPath(profile.ID), profile, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed destination %s from %s\n", args[1], profile.Name)
+	return nil
+}
+
+// cmdPause pauses a profile
+func cmdPause(c *cliClient, args []string) error {
+	return profileAction(c, args, "pause", "pause", "Paused %s\n")
+}
+
+// cmdResume resumes a paused profile
+func cmdResume(c *cliClient, args []string) error {
+	return profileAction(c, args, "resume", "resume", "Resumed %s\n")
+}
+
+// cmdSyncNow rescans a profile and syncs what's changed right away
+func cmdSyncNow(c *cliClient, args []string) error {
+	return profileAction(c, args, "sync-now", "sync", "Syncing %s\n")
+}
+
+// profileAction posts to the profile's /v1/ action, and prints done with the
+// profile's name once it succeeds
+func profileAction(c *cliClient, args []string, command, action, done string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: freehold-sync %s <profile name or id>", command)
+	}
+	profile, err := c.findProfile(args[0])
+	if err != nil {
+		return err
+	}
+	err = c.call("POST", apiPath(profile.ID, action), nil, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf(done, profile.Name)
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+
+	"bitbucket.org/tshannon/freehold-sync/local"
+	"bitbucket.org/tshannon/freehold-sync/log"
+	"bitbucket.org/tshannon/freehold-sync/remote"
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// caseCollision returns whether the local and remote files were only paired
+// up because one side is case insensitive, while the other side has two
+// files whose names differ only by case.  Syncing the pair would overwrite
+// one of the two files with the other, so the collision is logged instead
+func caseCollision(p *syncer.Profile, l *local.File, r *remote.File) (bool, error) {
+	remoteName := path.Base(strings.TrimSuffix(r.URL, "/"))
+
+	if actual, ok := l.CaseMismatch(); ok {
+		// local file system is case insensitive
+		other, err := remote.New(r.Client(), path.Join(path.Dir(strings.TrimSuffix(r.URL, "/")), actual))
+		if err != nil {
+			return false, err
+		}
+		if other.Exists() && path.Base(strings.TrimSuffix(other.URL, "/")) == actual {
+			logCollision(p, remoteName, actual, "local")
+			return true, nil
+		}
+		return false, nil
+	}
+
+	localName := filepath.Base(l.ID())
+	if !r.Exists() || localName == remoteName || !strings.EqualFold(localName, remoteName) {
+		return false, nil
+	}
+
+	// remote is case insensitive
+	other, err := local.New(filepath.Join(filepath.Dir(l.ID()), remoteName))
+	if err != nil {
+		return false, err
+	}
+	if _, mismatch := other.CaseMismatch(); other.Exists() && !mismatch {
+		logCollision(p, localName, remoteName, "remote")
+		return true, nil
+	}
+	return false, nil
+}
+
+func logCollision(p *syncer.Profile, name, other, side string) {
+	log.Module(syncer.LogType).Profile(p.Name).Warnf("%s and %s in profile %s differ only by case, and can't both be stored on the %s side. "+
+		"Neither will be synced until one of them is renamed.", name, other, p.Name, side)
+}
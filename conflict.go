@@ -0,0 +1,68 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"bitbucket.org/tshannon/freehold-sync/log"
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// resolveConflict settles the conflict held for the file at the slash
+// separated path in the profile, with one of the syncer.Resolve resolutions.
+// The chosen side is copied over in the background, and the conflict is gone
+// once it's done
+func (p *profileStore) resolveConflict(relPath, resolution string) error {
+	if !p.Active {
+		return errors.New("Profile is not active")
+	}
+	if p.Paused {
+		return errors.New("Profile is paused")
+	}
+	if !validResolution(resolution) {
+		return fmt.Errorf("Invalid conflict resolution %s", resolution)
+	}
+
+	conflicts, err := syncer.ProfileConflicts(p.ID)
+	if err != nil {
+		return err
+	}
+	relPath = strings.Trim(filepath.ToSlash(relPath), "/")
+	found := false
+	for i := range conflicts {
+		if conflicts[i].Path == relPath {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return syncer.ErrNoConflict
+	}
+
+	profile, err := p.makeProfile()
+	if err != nil {
+		return err
+	}
+	lFile, rFile, err := profileFiles(profile, relPath)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		err := profile.Resolve(lFile, rFile, resolution)
+		if err != nil && err != syncer.ErrCanceled {
+			log.Module(syncer.LogType).Errorf("Error resolving conflict of %s Error: %s", relPath, err)
+		}
+	}()
+	return nil
+}
+
+func validResolution(resolution string) bool {
+	return resolution == syncer.ResolveLocal || resolution == syncer.ResolveRemote || resolution == syncer.ResolveBoth
+}
@@ -0,0 +1,261 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/local"
+	"bitbucket.org/tshannon/freehold-sync/remote"
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// names of the checks in a connection test
+const (
+	checkAuthentication = "authentication"
+	checkRemotePath     = "remotePath"
+	checkRemoteRead     = "remoteRead"
+	checkRemoteWrite    = "remoteWrite"
+	checkLocalPath      = "localPath"
+	checkLocalRead      = "localRead"
+	checkLocalWrite     = "localWrite"
+	checkClock          = "clock"
+)
+
+// testFilePrefix starts the name of the file written and removed to check a
+// path can be written to
+const testFilePrefix = ".fhs-test-"
+
+// clockSkewWarning is the smallest clock offset the syncer compensates for,
+// which is worth mentioning, but isn't a problem
+const clockSkewWarning = 2 * time.Second
+
+var errStopListing = errors.New("Stop listing")
+
+// connectionCheck is the result of one thing a connection test checked
+type connectionCheck struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Required bool   `json:"required"` // whether the profile can't sync if it fails
+	Skipped  bool   `json:"skipped"`  // not run, because a check it depends on failed
+	Error    string `json:"error,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// connectionTest is the result of testing a profile's paths and connection
+// before it's saved.  OK is whether every required check passed
+type connectionTest struct {
+	OK                 bool               `json:"ok"`
+	ClockOffsetSeconds float64            `json:"clockOffsetSeconds"` // how far the remote clock is ahead of the local one
+	Checks             []*connectionCheck `json:"checks"`
+}
+
+func (t *connectionTest) add(name string, required bool) *connectionCheck {
+	c := &connectionCheck{
+		Name:     name,
+		Required: required,
+	}
+	t.Checks = append(t.Checks, c)
+	return c
+}
+
+func (c *connectionCheck) result(err error) bool {
+	if err != nil {
+		c.Error = err.Error()
+		return false
+	}
+	c.OK = true
+	return true
+}
+
+func (c *connectionCheck) skip() {
+	c.Skipped = true
+}
+
+// testConnection checks that the profile's freehold instance can be logged in
+// to, and that both of its paths exist and can be read from, and written to
+// in the directions the profile syncs.  Nothing is stored, and every check is
+// run that can be, so all of a profile's problems are found at once
+func (p *profileStore) testConnection() *connectionTest {
+	// a profile only writes to the side files are synced to
+	localWrites := p.Direction != syncer.DirectionRemoteOnly &&
+		p.Direction != syncer.DirectionMirrorRemote &&
+		p.Direction != syncer.DirectionBackup
+	remoteWrites := p.Direction != syncer.DirectionLocalOnly &&
+		p.Direction != syncer.DirectionMirrorLocal
+
+	t := &connectionTest{}
+	p.testLocal(t, localWrites)
+	p.testRemote(t, remoteWrites)
+
+	t.OK = true
+	for i := range t.Checks {
+		if t.Checks[i].Required && !t.Checks[i].OK {
+			t.OK = false
+		}
+	}
+	return t
+}
+
+func (p *profileStore) testLocal(t *connectionTest, writes bool) {
+	exists := t.add(checkLocalPath, true)
+	read := t.add(checkLocalRead, true)
+	write := t.add(checkLocalWrite, writes)
+
+	if !exists.result(localDirectory(p.LocalPath)) {
+		read.skip()
+		write.skip()
+		return
+	}
+
+	read.result(localReadable(p.LocalPath))
+	write.result(localWritable(p.LocalPath))
+}
+
+func localDirectory(dirPath string) error {
+	if strings.TrimSpace(dirPath) == "" {
+		return errors.New("Local path not set")
+	}
+	f, err := local.New(dirPath)
+	if err != nil {
+		return err
+	}
+	if !f.Exists() {
+		return errors.New("Local sync path does not exist!")
+	}
+	if !f.IsDir() {
+		return errors.New("Local sync path is not a folder")
+	}
+	return nil
+}
+
+func localReadable(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	_, err = dir.Readdirnames(1)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func localWritable(dirPath string) error {
+	f, err := ioutil.TempFile(dirPath, testFilePrefix)
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_, err = f.Write([]byte(testFilePrefix))
+	closeErr := f.Close()
+	removeErr := os.Remove(name)
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return removeErr
+}
+
+func (p *profileStore) testRemote(t *connectionTest, writes bool) {
+	auth := t.add(checkAuthentication, true)
+	exists := t.add(checkRemotePath, true)
+	read := t.add(checkRemoteRead, true)
+	write := t.add(checkRemoteWrite, writes)
+	clock := t.add(checkClock, false)
+
+	rFile, err := p.testAuthentication()
+	if !auth.result(err) {
+		exists.skip()
+		read.skip()
+		write.skip()
+		clock.skip()
+		return
+	}
+
+	offset, err := rFile.ClockOffset()
+	if clock.result(err) {
+		t.ClockOffsetSeconds = offset.Seconds()
+		if offset >= clockSkewWarning || offset <= -clockSkewWarning {
+			clock.Detail = fmt.Sprintf("The remote clock is off from the local clock by %s, which will be compensated for",
+				offset)
+		}
+	}
+
+	dir, err := remoteDirectory(rFile, p.RemotePath)
+	if !exists.result(err) {
+		read.skip()
+		write.skip()
+		return
+	}
+
+	read.result(remoteReadable(dir))
+	write.result(remoteWritable(rFile, p.RemotePath))
+}
+
+// testAuthentication logs in to the freehold instance, and returns the top of
+// its files
+func (p *profileStore) testAuthentication() (*remote.File, error) {
+	c, err := remoteClient(p.Client)
+	if err != nil {
+		return nil, err
+	}
+	return remote.New(c, remoteRoot)
+}
+
+func remoteDirectory(root *remote.File, dirPath string) (*remote.File, error) {
+	if strings.TrimSpace(dirPath) == "" {
+		return nil, errors.New("Remote path not set")
+	}
+	f, err := remote.New(root.Client(), dirPath)
+	if err != nil {
+		return nil, err
+	}
+	if !f.Exists() {
+		return nil, errors.New("Remote sync path does not exist!")
+	}
+	if !f.IsDir() {
+		return nil, errors.New("Remote sync path is not a folder")
+	}
+	return f, nil
+}
+
+// remoteReadable lists the first page of the folder's files
+func remoteReadable(dir *remote.File) error {
+	err := dir.ChildrenIter(func(page []syncer.Syncer) error {
+		return errStopListing
+	})
+	if err == errStopListing {
+		return nil
+	}
+	return err
+}
+
+func remoteWritable(root *remote.File, dirPath string) error {
+	name, err := randomToken()
+	if err != nil {
+		return err
+	}
+	f, err := remote.New(root.Client(), path.Join(dirPath, testFilePrefix+name[:16]))
+	if err != nil {
+		return err
+	}
+	err = f.Write(ioutil.NopCloser(strings.NewReader(testFilePrefix)), int64(len(testFilePrefix)), time.Now())
+	if err != nil {
+		return err
+	}
+	return f.Delete()
+}
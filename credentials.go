@@ -0,0 +1,254 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bitbucket.org/tshannon/freehold-sync/credentials"
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+	"bitbucket.org/tshannon/freehold-sync/log"
+)
+
+// account is the name a client's secrets are stored under, the same for every
+// profile which connects as the same user
+func (c *client) account() string {
+	if c == nil || c.URL == nil || c.User == nil {
+		return ""
+	}
+	return *c.User + "@" + *c.URL
+}
+
+func passphraseAccount(id string) string {
+	return "passphrase/" + id
+}
+
+// storeSecrets moves the profile's password, token and passphrase, and those of
+// its destinations, into the credentials provider, and returns a copy of the
+// profile without them to be stored in the datastore
+func (p *profileStore) storeSecrets() (*profileStore, error) {
+	stored := *p
+
+	var err error
+	stored.Client, err = storeClientSecrets(p.Client)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.Destinations) > 0 {
+		stored.Destinations = make([]*destination, len(p.Destinations))
+		for i := range p.Destinations {
+			d := *p.Destinations[i]
+			d.Client, err = storeClientSecrets(d.Client)
+			if err != nil {
+				return nil, err
+			}
+			stored.Destinations[i] = &d
+		}
+	}
+
+	if p.Passphrase != "" {
+		err := credentials.Set(passphraseAccount(p.ID), p.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+		stored.Passphrase = ""
+	}
+
+	return &stored, nil
+}
+
+// storeClientSecrets moves the client's password, token and proxy password into
+// the credentials provider, and returns a copy of the client without them
+func storeClientSecrets(c *client) (*client, error) {
+	account := c.account()
+	if account == "" {
+		return c, nil
+	}
+	stored := *c
+	token := ""
+	if c.Token != nil {
+		token = *c.Token
+	}
+	password := ""
+	if c.Password != nil {
+		password = *c.Password
+	}
+
+	if token != "" {
+		err := credentials.Set("token/"+account, token)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if password != "" {
+		err := credentials.Set("password/"+account, password)
+		if err != nil {
+			return nil, err
+		}
+	} else if token != "" {
+		// a token without a password isn't renewed when it expires
+		err := credentials.Delete("password/" + account)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.ProxyPassword != nil && *c.ProxyPassword != "" {
+		err := credentials.Set("proxy/"+account, *c.ProxyPassword)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stored.Password = nil
+	stored.Token = nil
+	stored.ProxyPassword = nil
+	return &stored, nil
+}
+
+// loadSecrets fills in the secrets of a profile read from the datastore
+func (p *profileStore) loadSecrets() error {
+	err := loadClientSecrets(p.Client)
+	if err != nil {
+		return err
+	}
+	for i := range p.Destinations {
+		err = loadClientSecrets(p.Destinations[i].Client)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.Encrypt && p.Passphrase == "" {
+		passphrase, err := getSecret(passphraseAccount(p.ID))
+		if err != nil {
+			return err
+		}
+		p.Passphrase = passphrase
+	}
+	return nil
+}
+
+// loadClientSecrets fills in the client's password, token and proxy password
+// from the credentials provider, unless it already has them
+func loadClientSecrets(c *client) error {
+	account := c.account()
+	if account == "" {
+		return nil
+	}
+	if (c.Token == nil || *c.Token == "") &&
+		(c.Password == nil || *c.Password == "") {
+		token, err := getSecret("token/" + account)
+		if err != nil {
+			return err
+		}
+		if token != "" {
+			c.Token = &token
+		}
+		password, err := getSecret("password/" + account)
+		if err != nil {
+			return err
+		}
+		if password != "" {
+			c.Password = &password
+		}
+	}
+	if c.ProxyPassword == nil || *c.ProxyPassword == "" {
+		password, err := getSecret("proxy/" + account)
+		if err != nil {
+			return err
+		}
+		if password != "" {
+			c.ProxyPassword = &password
+		}
+	}
+	return nil
+}
+
+// getSecret returns the stored secret, an empty string if there isn't one
+func getSecret(account string) (string, error) {
+	secret, err := credentials.Get(account)
+	if err == credentials.ErrNotFound {
+		return "", nil
+	}
+	log.AddSecret(secret)
+	return secret, err
+}
+
+// deleteSecrets removes the profile's passphrase, and the secrets of its
+// clients, and its destinations' clients, which no other profile connects with
+func (p *profileStore) deleteSecrets() error {
+	err := credentials.Delete(passphraseAccount(p.ID))
+	if err != nil {
+		return err
+	}
+
+	all, err := storedProfiles()
+	if err != nil {
+		return err
+	}
+	inUse := make(map[string]bool)
+	for i := range all {
+		if all[i].ID != p.ID {
+			for _, account := range all[i].accounts() {
+				inUse[account] = true
+			}
+		}
+	}
+
+	for _, account := range p.accounts() {
+		if inUse[account] {
+			continue
+		}
+		for _, secret := range []string{"token/", "password/", "proxy/"} {
+			err = credentials.Delete(secret + account)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// accounts returns the accounts the secrets of the profile's client, and its
+// destinations' clients, are stored under
+func (p *profileStore) accounts() []string {
+	var accounts []string
+	if account := p.Client.account(); account != "" {
+		accounts = append(accounts, account)
+	}
+	for i := range p.Destinations {
+		if account := p.Destinations[i].Client.account(); account != "" {
+			accounts = append(accounts, account)
+		}
+	}
+	return accounts
+}
+
+// moveSecrets moves any secrets still stored in profiles in the datastore
+// into the credentials provider
+func moveSecrets() error {
+	all, err := storedProfiles()
+	if err != nil {
+		return err
+	}
+
+	for i := range all {
+		p := all[i]
+		if p.Passphrase == "" && (p.Client == nil ||
+			(optional(p.Client.Token) == "" && optional(p.Client.Password) == "" && optional(p.Client.ProxyPassword) == "")) {
+			continue
+		}
+		stored, err := p.storeSecrets()
+		if err != nil {
+			return err
+		}
+		err = datastore.Put(bucket, p.ID, stored)
+		if err != nil {
+			return err
+		}
+		logger.Profile(p.Name).Infof("Moved the credentials of profile %s to the %s credentials provider", p.Name,
+			credentials.Current())
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+// Package credentials stores the passwords, tokens and passphrases freehold-sync
+// needs, by default in the keyring of the operating system, so they aren't kept
+// in the sync datastore
+package credentials
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// service is the name the credentials are stored under in the OS keyring
+const service = "freehold-sync"
+
+// Supported providers
+const (
+	ProviderKeyring   = "keyring"
+	ProviderDatastore = "datastore"
+)
+
+// ErrNotFound is returned when no credential is stored for the account
+var ErrNotFound = errors.New("Credential not found")
+
+// Provider stores secrets by account name
+type Provider interface {
+	Available() bool                    // Whether or not the provider can be used on this machine
+	Get(account string) (string, error) // Returns ErrNotFound if there is no secret stored for the account
+	Set(account, secret string) error
+	Delete(account string) error // Deleting an account which isn't stored isn't an error
+}
+
+var providers providerList
+
+func init() {
+	providers = providerList{
+		all: make(map[string]Provider),
+	}
+}
+
+type providerList struct {
+	sync.RWMutex
+	all     map[string]Provider
+	current string
+}
+
+// Register adds a provider which can be picked with Use
+func Register(name string, p Provider) {
+	providers.Lock()
+	defer providers.Unlock()
+	providers.all[name] = p
+}
+
+// Use sets which provider credentials are stored with. An empty name uses the
+// OS keyring if there is one, and the datastore if there isn't
+func Use(name string) error {
+	providers.Lock()
+	defer providers.Unlock()
+
+	if name == "" {
+		name = ProviderDatastore
+		if p, ok := providers.all[ProviderKeyring]; ok && p.Available() {
+			name = ProviderKeyring
+		}
+	}
+
+	p, ok := providers.all[name]
+	if !ok {
+		return fmt.Errorf("Unknown credentials provider %s", name)
+	}
+	if !p.Available() {
+		return fmt.Errorf("The %s credentials provider isn't available on this machine", name)
+	}
+	providers.current = name
+	return nil
+}
+
+// Current is the name of the provider credentials are stored with
+func Current() string {
+	providers.RLock()
+	defer providers.RUnlock()
+	return providers.current
+}
+
+func provider() (Provider, error) {
+	providers.RLock()
+	defer providers.RUnlock()
+	p, ok := providers.all[providers.current]
+	if !ok {
+		return nil, errors.New("No credentials provider is set")
+	}
+	return p, nil
+}
+
+// Get returns the secret stored for the account
+func Get(account string) (string, error) {
+	p, err := provider()
+	if err != nil {
+		return "", err
+	}
+	return p.Get(account)
+}
+
+// Set stores the secret for the account, replacing any already stored
+func Set(account, secret string) error {
+	p, err := provider()
+	if err != nil {
+		return err
+	}
+	return p.Set(account, secret)
+}
+
+// Delete removes the secret stored for the account
+func Delete(account string) error {
+	p, err := provider()
+	if err != nil {
+		return err
+	}
+	return p.Delete(account)
+}
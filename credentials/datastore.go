@@ -0,0 +1,39 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package credentials
+
+import "bitbucket.org/tshannon/freehold-sync/datastore"
+
+const bucket = datastore.BucketCredential
+
+func init() {
+	Register(ProviderDatastore, &datastoreProvider{})
+}
+
+// datastoreProvider keeps credentials in their own bucket in the sync datastore,
+// for machines without a keyring.  They aren't encrypted, so the datastore file
+// should be treated as a secret on those machines
+type datastoreProvider struct{}
+
+func (d *datastoreProvider) Available() bool {
+	return true
+}
+
+func (d *datastoreProvider) Get(account string) (string, error) {
+	secret := ""
+	err := datastore.Get(bucket, account, &secret)
+	if err == datastore.ErrNotFound {
+		return "", ErrNotFound
+	}
+	return secret, err
+}
+
+func (d *datastoreProvider) Set(account, secret string) error {
+	return datastore.Put(bucket, account, secret)
+}
+
+func (d *datastoreProvider) Delete(account string) error {
+	return datastore.Delete(bucket, account)
+}
@@ -0,0 +1,76 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package credentials
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// errItemNotFound is the exit status of the security command when the keychain
+// has no matching item
+const errItemNotFound = 44
+
+func init() {
+	Register(ProviderKeyring, &keychain{})
+}
+
+// keychain stores credentials in the user's login keychain through the
+// security command
+type keychain struct{}
+
+func (k *keychain) Available() bool {
+	_, err := exec.LookPath("security")
+	return err == nil
+}
+
+func (k *keychain) Get(account string) (string, error) {
+	out, err := security("", "find-generic-password", "-s", service, "-a", account, "-w")
+	if exitCode(err) == errItemNotFound {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+func (k *keychain) Set(account, secret string) error {
+	// run interactively, so the secret is read from stdin and never shows up in
+	// the process list
+	_, err := security(fmt.Sprintf("add-generic-password -U -s %s -a %s -X %s\n",
+		strconv.Quote(service), strconv.Quote(account), hex.EncodeToString([]byte(secret))), "-i")
+	return err
+}
+
+func (k *keychain) Delete(account string) error {
+	_, err := security("", "delete-generic-password", "-s", service, "-a", account)
+	if exitCode(err) == errItemNotFound {
+		return nil
+	}
+	return err
+}
+
+func security(stdin string, args ...string) ([]byte, error) {
+	cmd := exec.Command("security", args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err == nil && stderr.Len() > 0 && stdin != "" {
+		// interactive mode exits cleanly even when the command in it fails
+		return out, fmt.Errorf("Error accessing the keyring: %s", strings.TrimSpace(stderr.String()))
+	}
+	if err != nil && stderr.Len() > 0 {
+		return out, &toolError{err: err, msg: strings.TrimSpace(stderr.String())}
+	}
+	return out, err
+}
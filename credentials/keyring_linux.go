@@ -0,0 +1,70 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package credentials
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+func init() {
+	Register(ProviderKeyring, &secretService{})
+}
+
+// secretService stores credentials with the Secret Service (GNOME Keyring, KWallet)
+// through the secret-tool command from libsecret
+type secretService struct{}
+
+func (s *secretService) Available() bool {
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+		return false
+	}
+	_, err := exec.LookPath("secret-tool")
+	return err == nil
+}
+
+func (s *secretService) Get(account string) (string, error) {
+	out, err := secretTool(nil, "lookup", "service", service, "account", account)
+	if exitCode(err) == 1 && len(out) == 0 {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+func (s *secretService) Set(account, secret string) error {
+	_, err := secretTool(strings.NewReader(secret), "store", "--label", service+" "+account,
+		"service", service, "account", account)
+	return err
+}
+
+func (s *secretService) Delete(account string) error {
+	_, err := secretTool(nil, "clear", "service", service, "account", account)
+	if exitCode(err) == 1 {
+		// nothing to clear
+		return nil
+	}
+	return err
+}
+
+// secretTool runs secret-tool, the secret is passed on stdin so it never shows
+// up in the process list
+func secretTool(stdin *strings.Reader, args ...string) ([]byte, error) {
+	cmd := exec.Command("secret-tool", args...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil && stderr.Len() > 0 {
+		return out, &toolError{err: err, msg: strings.TrimSpace(stderr.String())}
+	}
+	return out, err
+}
@@ -0,0 +1,34 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package credentials
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// toolError keeps the exit status of a keyring command along with what it
+// printed about the failure
+type toolError struct {
+	err error
+	msg string
+}
+
+func (t *toolError) Error() string {
+	return fmt.Sprintf("Error accessing the keyring: %s", t.msg)
+}
+
+func exitCode(err error) int {
+	if t, ok := err.(*toolError); ok {
+		err = t.err
+	}
+	if exit, ok := err.(*exec.ExitError); ok {
+		return exit.ExitCode()
+	}
+	return 0
+}
@@ -0,0 +1,204 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Backup writes a consistent snapshot of the whole datastore to w, which can
+// be restored later.  Syncing carries on while it's written
+func Backup(w io.Writer) (int64, error) {
+	lock.RLock()
+	defer lock.RUnlock()
+	var written int64
+	err := ds.View(func(tx *bolt.Tx) error {
+		var err error
+		written, err = tx.WriteTo(w)
+		return err
+	})
+	return written, err
+}
+
+// Restore replaces the datastore with a snapshot written by Backup, upgrading
+// it if it's from an older schema version.  The datastore it replaces is kept
+// next to it, with .before-restore on the end of its name
+func Restore(r io.Reader) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	filename := ds.Path()
+	tmp := filename + ".restore"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = checkSnapshot(tmp)
+	}
+	if err == nil {
+		err = validate(tmp)
+		if _, ok := err.(*corruptError); ok {
+			err = fmt.Errorf("The snapshot is corrupt: %s", err)
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = ds.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	previous := filename + ".before-restore"
+	err = os.Rename(filename, previous)
+	if err != nil {
+		os.Remove(tmp)
+		return reopen(filename, err)
+	}
+	err = os.Rename(tmp, filename)
+	if err != nil {
+		os.Rename(previous, filename)
+		return reopen(filename, err)
+	}
+
+	err = open(filename)
+	if err != nil {
+		// put back the datastore that worked
+		os.Rename(previous, filename)
+		return reopen(filename, err)
+	}
+	return nil
+}
+
+// reopen opens the datastore again after a failed restore, and returns the
+// error the restore failed with
+func reopen(filename string, restoreErr error) error {
+	err := open(filename)
+	if err != nil {
+		return fmt.Errorf("Error reopening datastore after failing to restore it: %s. Restore error: %s",
+			err, restoreErr)
+	}
+	return restoreErr
+}
+
+// checkSnapshot makes sure the file is a datastore this version of freehold-sync
+// can use
+func checkSnapshot(filename string) error {
+	db, err := bolt.Open(filename, 0666, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("Not a freehold-sync datastore: %s", err)
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(BucketProfile)) == nil {
+			return errors.New("Not a freehold-sync datastore")
+		}
+		version, err := storedVersion(tx)
+		if err != nil {
+			return err
+		}
+		if version > SchemaVersion() {
+			return fmt.Errorf("The datastore is at schema version %d, which is newer than this version of "+
+				"freehold-sync supports (%d)", version, SchemaVersion())
+		}
+		return nil
+	})
+}
+
+// Export writes the contents of the datastore to w as JSON, for debugging.  Each
+// bucket is an object of its entries by key, with the buckets of each profile
+// nested inside by profile ID.  Credentials and API tokens are left out
+func Export(w io.Writer) error {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	out := bufio.NewWriter(w)
+	err := ds.View(func(tx *bolt.Tx) error {
+		out.WriteString("{")
+		first := true
+		for i := range buckets {
+			if buckets[i] == BucketCredential || buckets[i] == BucketToken {
+				continue
+			}
+			if !first {
+				out.WriteString(",")
+			}
+			first = false
+			err := writeJSONString(out, buckets[i])
+			if err != nil {
+				return err
+			}
+			out.WriteString(":")
+			err = exportBucket(out, tx.Bucket([]byte(buckets[i])))
+			if err != nil {
+				return err
+			}
+		}
+		out.WriteString("}\n")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// exportBucket writes the bucket as a JSON object.  Keys and values are already
+// stored as JSON, so they're written as is
+func exportBucket(out *bufio.Writer, b *bolt.Bucket) error {
+	out.WriteString("{")
+	first := true
+	err := b.ForEach(func(k, v []byte) error {
+		if !first {
+			out.WriteString(",")
+		}
+		first = false
+		if v == nil {
+			// a profile's bucket, named by the profile's ID as is
+			err := writeJSONString(out, string(k))
+			if err != nil {
+				return err
+			}
+			out.WriteString(":")
+			return exportBucket(out, b.Bucket(k))
+		}
+		out.Write(k)
+		out.WriteString(":")
+		_, err := out.Write(v)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = out.WriteString("}")
+	return err
+}
+
+func writeJSONString(out *bufio.Writer, s string) error {
+	str, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(str)
+	return err
+}
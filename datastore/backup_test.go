@@ -0,0 +1,62 @@
+package datastore
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestRestore(t *testing.T) {
+	filename, cleanup := tempDatastore(t)
+	defer cleanup()
+
+	err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = PutIn(BucketState, "docs", "report.txt", "backed up")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := &bytes.Buffer{}
+	_, err = Backup(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = PutIn(BucketState, "docs", "report.txt", "changed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Restore(bytes.NewReader([]byte("not a datastore")))
+	if err == nil {
+		t.Fatal("Expected an error restoring a corrupt snapshot")
+	}
+	var value string
+	err = GetIn(BucketState, "docs", "report.txt", &value)
+	if err != nil {
+		t.Fatalf("Datastore isn't usable after a failed restore: %s", err)
+	}
+	if value != "changed" {
+		t.Fatalf("Expected a failed restore to leave the datastore as it was, got %s", value)
+	}
+
+	err = Restore(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = GetIn(BucketState, "docs", "report.txt", &value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "backed up" {
+		t.Fatalf("Expected the restored value, got %s", value)
+	}
+
+	_, err = os.Stat(filename + ".before-restore")
+	if err != nil {
+		t.Fatalf("Expected the replaced datastore to be kept: %s", err)
+	}
+}
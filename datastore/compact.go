@@ -0,0 +1,75 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"os"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// compactTxSize is how much is copied into the compacted datastore before
+// each commit, so large datastores aren't held in memory all at once
+const compactTxSize = 64 * 1024 * 1024
+
+// Compact rewrites the datastore into a new file, without the free space left
+// behind by removed entries, which bolt otherwise keeps and reuses but never
+// gives back.  Every other transaction waits until it's done.  Returns the size
+// of the datastore file before and after
+func Compact() (before, after int64, err error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	filename := ds.Path()
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	before = info.Size()
+
+	tmp := filename + ".compact"
+	err = os.Remove(tmp)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, 0, err
+	}
+
+	dst, err := bolt.Open(tmp, 0666, openOptions)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = bolt.Compact(dst, ds, compactTxSize)
+	cerr := dst.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, 0, err
+	}
+
+	err = ds.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return 0, 0, err
+	}
+	rerr := os.Rename(tmp, filename)
+
+	// reopened whether or not the compacted copy replaced it
+	db, err := bolt.Open(filename, 0666, openOptions)
+	if err != nil {
+		return 0, 0, err
+	}
+	ds = db
+	if rerr != nil {
+		os.Remove(tmp)
+		return 0, 0, rerr
+	}
+
+	info, err = os.Stat(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	return before, info.Size(), nil
+}
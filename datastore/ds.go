@@ -9,105 +9,256 @@ package datastore
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 
-	"github.com/boltdb/bolt"
+	bolt "go.etcd.io/bbolt"
 )
 
-var ds *bolt.DB
+var (
+	ds *bolt.DB
+	// lock is held for writing while the datastore is swapped out for a
+	// compacted copy, and for reading by every transaction
+	lock sync.RWMutex
+)
+
+var openOptions = &bolt.Options{Timeout: 1 * time.Minute}
 
 // Supported Buckets
 const (
-	BucketProfile = "profiles"
-	BucketLog     = "log"
-	BucketRemote  = "remote"
+	BucketProfile    = "profiles"
+	BucketLog        = "log"
+	BucketRemote     = "remote"
+	BucketState      = "state"
+	BucketTransfer   = "transfer"
+	BucketHash       = "hash"
+	BucketRetry      = "retry"
+	BucketJournal    = "journal"
+	BucketCredential = "credentials"
+	BucketHistory    = "history"
+	BucketToken      = "tokens"
+	BucketConflict   = "conflicts"
+	BucketReport     = "reports"
+	BucketPending    = "pending"
+	BucketTemplate   = "templates"
+	BucketQuarantine = "quarantine"
 )
 
+var buckets = []string{
+	BucketProfile,
+	BucketLog,
+	BucketRemote,
+	BucketState,
+	BucketTransfer,
+	BucketHash,
+	BucketRetry,
+	BucketJournal,
+	BucketCredential,
+	BucketHistory,
+	BucketToken,
+	BucketConflict,
+	BucketReport,
+	BucketPending,
+	BucketTemplate,
+	BucketQuarantine,
+	BucketMeta,
+}
+
 // ErrNotFound is returned when a value isn't found for the passed in key
 var ErrNotFound = errors.New("Value not found")
 
-// Open opens a the bolt datastore
+// Open opens a the bolt datastore, upgrading it to the current schema version
+// if it was written by an older version of freehold-sync.  A corrupt datastore
+// is rebuilt, and a *RebuiltError returned once the new one is open
 func Open(filename string) error {
-	db, err := bolt.Open(filename, 0666, &bolt.Options{Timeout: 1 * time.Minute})
+	err := validate(filename)
+	if cerr, ok := err.(*corruptError); ok {
+		return rebuildCorrupt(filename, cerr)
+	}
+	if err != nil {
+		return err
+	}
+	return open(filename)
+}
+
+func open(filename string) error {
+	db, err := bolt.Open(filename, 0666, openOptions)
 
 	if err != nil {
 		return err
 	}
 	ds = db
-	return ds.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(BucketProfile))
-		if err != nil {
-			return err
-		}
-		_, err = tx.CreateBucketIfNotExists([]byte(BucketLog))
-		if err != nil {
-			return err
-		}
-		_, err = tx.CreateBucketIfNotExists([]byte(BucketRemote))
-		if err != nil {
-			return err
-		}
 
-		return nil
+	err = setup(filename)
+	if err != nil {
+		// release the file lock, so the datastore can be opened again
+		db.Close()
+		ds = nil
+		return err
+	}
+	return nil
+}
+
+// setup creates any missing buckets in the newly opened datastore, and
+// migrates it to the current schema version
+func setup(filename string) error {
+	err := backupForMigration(filename)
+	if err != nil {
+		return fmt.Errorf("Error backing up datastore before migrating it: %s", err)
+	}
+
+	err = ds.Update(func(tx *bolt.Tx) error {
+		for i := range buckets {
+			_, err := tx.CreateBucketIfNotExists([]byte(buckets[i]))
+			if err != nil {
+				return err
+			}
+		}
+		return migrate(tx)
 	})
+	if err != nil {
+		return err
+	}
+
+	return readRebuild()
 }
 
 // Close closes the bolt datastore
 func Close() error {
+	lock.Lock()
+	defer lock.Unlock()
 	if ds != nil {
 		return ds.Close()
 	}
 	return nil
 }
 
-// Get gets a value from the DS for the passed in key
-func Get(bucket string, key interface{}, result interface{}) error {
+// Tx is a datastore transaction.  Everything written in an update transaction
+// is stored all at once when it returns without an error, or not at all, so
+// a value read and then written back in the same transaction can't be
+// changed by anyone else in between, or left half written by a crash
+type Tx struct {
+	tx *bolt.Tx
+}
+
+// View runs fn in a read only transaction
+func View(fn func(tx *Tx) error) error {
+	lock.RLock()
+	defer lock.RUnlock()
 	return ds.View(func(tx *bolt.Tx) error {
-		dsKey, err := json.Marshal(key)
+		return fn(&Tx{tx: tx})
+	})
+}
+
+// Update runs fn in a read write transaction.  If fn returns an error nothing it
+// wrote is kept
+func Update(fn func(tx *Tx) error) error {
+	lock.RLock()
+	defer lock.RUnlock()
+	return ds.Update(func(tx *bolt.Tx) error {
+		return fn(&Tx{tx: tx})
+	})
+}
+
+// Get gets a value from the bucket for the passed in key
+func (t *Tx) Get(bucket string, key interface{}, result interface{}) error {
+	return get(t.tx.Bucket([]byte(bucket)), key, result)
+}
+
+// Put puts a new value in the bucket at the given key
+func (t *Tx) Put(bucket string, key interface{}, value interface{}) error {
+	return put(t.tx.Bucket([]byte(bucket)), key, value)
+}
+
+// Delete removes the value from the bucket for the given key
+func (t *Tx) Delete(bucket string, key interface{}) error {
+	return del(t.tx.Bucket([]byte(bucket)), key)
+}
+
+// Each calls fn with each key and value in the bucket, in key order.  Values are
+// only valid until the transaction ends
+func (t *Tx) Each(bucket string, fn func(key string, value []byte) error) error {
+	return t.tx.Bucket([]byte(bucket)).ForEach(func(k, v []byte) error {
+		if v == nil {
+			// a profile's bucket
+			return nil
+		}
+		var key string
+		err := json.Unmarshal(k, &key)
 		if err != nil {
 			return err
 		}
+		return fn(key, v)
+	})
+}
 
-		dsValue := tx.Bucket([]byte(bucket)).Get(dsKey)
+// Cursor returns a cursor over the raw keys and values of the bucket
+func (t *Tx) Cursor(bucket string) *bolt.Cursor {
+	return t.tx.Bucket([]byte(bucket)).Cursor()
+}
 
-		if dsValue == nil {
-			return ErrNotFound
-		}
+func get(b *bolt.Bucket, key interface{}, result interface{}) error {
+	if b == nil {
+		return ErrNotFound
+	}
+	dsKey, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	dsValue := b.Get(dsKey)
+
+	if dsValue == nil {
+		return ErrNotFound
+	}
 
-		return json.Unmarshal(dsValue, result)
+	return json.Unmarshal(dsValue, result)
+}
+
+func put(b *bolt.Bucket, key interface{}, value interface{}) error {
+	dsKey, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	dsValue, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(dsKey, dsValue)
+}
+
+func del(b *bolt.Bucket, key interface{}) error {
+	if b == nil {
+		return nil
+	}
+	dsKey, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	return b.Delete(dsKey)
+}
+
+// Get gets a value from the DS for the passed in key
+func Get(bucket string, key interface{}, result interface{}) error {
+	return View(func(tx *Tx) error {
+		return tx.Get(bucket, key, result)
 	})
 }
 
 // Put puts a new value in the DS at the given key
 func Put(bucket string, key interface{}, value interface{}) error {
-	return ds.Update(func(tx *bolt.Tx) error {
-		dsKey, err := json.Marshal(key)
-		if err != nil {
-			return err
-		}
-
-		dsValue, err := json.Marshal(value)
-		if err != nil {
-			return err
-		}
-
-		return tx.Bucket([]byte(bucket)).Put(dsKey, dsValue)
+	return Update(func(tx *Tx) error {
+		return tx.Put(bucket, key, value)
 	})
 }
 
 // Delete removes the value from the DS for the given key
 func Delete(bucket string, key interface{}) error {
-	return ds.Update(func(tx *bolt.Tx) error {
-		dsKey, err := json.Marshal(key)
-		if err != nil {
-			return err
-		}
-
-		return tx.Bucket([]byte(bucket)).Delete(dsKey)
+	return Update(func(tx *Tx) error {
+		return tx.Delete(bucket, key)
 	})
 }
-
-// DB returns the underlying bolt DB
-func DB() *bolt.DB {
-	return ds
-}
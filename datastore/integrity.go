@@ -0,0 +1,248 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const rebuiltKey = "rebuilt"
+
+// salvaged are the buckets copied out of a corrupt datastore into the one that
+// replaces it.  Everything else is rebuilt by scanning the profiles again
+var salvaged = []string{
+	BucketProfile,
+	BucketCredential,
+	BucketToken,
+}
+
+// rebuild is when the datastore was rebuilt after being found corrupt, and
+// the profiles that lost their synced state when it was
+type rebuild struct {
+	When     time.Time `json:"when"`
+	Profiles []string  `json:"profiles"`
+}
+
+var lastRebuild rebuild // read from the meta bucket when the datastore is opened
+
+// RebuiltError is returned by Open when the datastore was found corrupt and
+// has been rebuilt.  The rebuilt datastore is open and ready to use
+type RebuiltError struct {
+	Cause    error  // what was wrong with the datastore
+	Kept     string // file the corrupt datastore was moved to
+	Profiles int    // number of profiles recovered from the corrupt datastore
+}
+
+func (e *RebuiltError) Error() string {
+	return fmt.Sprintf("The datastore was corrupt (%s) and has been rebuilt, recovering %d profiles. The corrupt "+
+		"datastore was kept as %s", e.Cause, e.Profiles, e.Kept)
+}
+
+// corruptError is a problem found in the datastore file itself, rather than
+// with opening it
+type corruptError struct {
+	err error
+}
+
+func (e *corruptError) Error() string {
+	return e.err.Error()
+}
+
+// Rebuilt returns when the datastore was rebuilt after being found corrupt, if
+// the profile lost its synced state when it was, or the zero time if not
+func Rebuilt(profileID string) time.Time {
+	lock.RLock()
+	defer lock.RUnlock()
+	for i := range lastRebuild.Profiles {
+		if lastRebuild.Profiles[i] == profileID {
+			return lastRebuild.When
+		}
+	}
+	return time.Time{}
+}
+
+// validate checks the datastore file for corruption before it's opened for
+// writing, by reading every bucket and checking bolt's page bookkeeping
+func validate(filename string) (err error) {
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) || (err == nil && info.Size() == 0) {
+		// brand new datastore
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		// bolt panics on some corrupt pages rather than returning an error
+		if r := recover(); r != nil {
+			err = &corruptError{fmt.Errorf("%v", r)}
+		}
+	}()
+
+	db, err := bolt.Open(filename, 0666, &bolt.Options{Timeout: openOptions.Timeout, ReadOnly: true})
+	if err == bolt.ErrInvalid || err == bolt.ErrVersionMismatch || err == bolt.ErrChecksum {
+		return &corruptError{err}
+	}
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			return walk(b)
+		})
+		if err != nil {
+			return &corruptError{err}
+		}
+
+		// every error has to be read, or the check never finishes
+		var first error
+		for err := range tx.Check() {
+			if first == nil {
+				first = err
+			}
+		}
+		if first != nil {
+			return &corruptError{first}
+		}
+		return nil
+	})
+}
+
+// walk reads every key and value in the bucket and the buckets inside it
+func walk(b *bolt.Bucket) error {
+	return b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return walk(b.Bucket(k))
+		}
+		return nil
+	})
+}
+
+// rebuildCorrupt moves the corrupt datastore out of the way, and opens a new
+// one in its place with whatever profiles, credentials and tokens can still be read
+// from the corrupt one.  The synced state of the recovered profiles is rebuilt
+// as they're scanned again
+func rebuildCorrupt(filename string, cause error) error {
+	kept := filename + ".corrupt"
+	err := os.Rename(filename, kept)
+	if err != nil {
+		return fmt.Errorf("Error moving corrupt datastore out of the way: %s", err)
+	}
+
+	err = open(filename)
+	if err != nil {
+		return err
+	}
+
+	profiles := salvage(kept)
+
+	err = ds.Update(func(tx *bolt.Tx) error {
+		return put(tx.Bucket([]byte(BucketMeta)), rebuiltKey, &rebuild{
+			When:     time.Now(),
+			Profiles: profiles,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	err = readRebuild()
+	if err != nil {
+		return err
+	}
+
+	return &RebuiltError{
+		Cause:    cause,
+		Kept:     kept,
+		Profiles: len(profiles),
+	}
+}
+
+// salvage copies what can still be read of the salvaged buckets out of the
+// corrupt datastore, and returns the IDs of the profiles it recovered
+func salvage(filename string) []string {
+	db, err := salvageOpen(filename)
+	if err != nil {
+		return nil
+	}
+	defer db.Close()
+
+	var profiles []string
+	for i := range salvaged {
+		keys, values := salvageBucket(db, salvaged[i])
+		err = ds.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(salvaged[i]))
+			for j := range keys {
+				err := b.Put(keys[j], values[j])
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil || salvaged[i] != BucketProfile {
+			continue
+		}
+		for j := range keys {
+			var id string
+			if json.Unmarshal(keys[j], &id) == nil {
+				profiles = append(profiles, id)
+			}
+		}
+	}
+	return profiles
+}
+
+func salvageOpen(filename string) (db *bolt.DB, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return bolt.Open(filename, 0666, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+}
+
+// salvageBucket reads as many keys and values out of the bucket as it can
+// before running into corruption
+func salvageBucket(db *bolt.DB, bucket string) (keys, values [][]byte) {
+	defer func() {
+		recover()
+	}()
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return nil
+			}
+			// copied, because they're only valid until the transaction ends
+			keys = append(keys, append([]byte(nil), k...))
+			values = append(values, append([]byte(nil), v...))
+			return nil
+		})
+	})
+	return keys, values
+}
+
+// readRebuild loads when the datastore was last rebuilt, if it ever was
+func readRebuild() error {
+	return ds.View(func(tx *bolt.Tx) error {
+		lastRebuild = rebuild{}
+		err := get(tx.Bucket([]byte(BucketMeta)), rebuiltKey, &lastRebuild)
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
+	})
+}
@@ -0,0 +1,67 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRebuildCorrupt(t *testing.T) {
+	filename, cleanup := tempDatastore(t)
+	defer cleanup()
+
+	state := make(map[string]string)
+	for i := 0; i < 2000; i++ {
+		state[fmt.Sprintf("docs_file%04d.txt", i)] = `"synced"`
+	}
+	writeRaw(t, filename, map[string]map[string]string{
+		BucketProfile: {"docs": `{"name":"docs"}`},
+		BucketState:   state,
+	})
+
+	// break the leaf page holding one of the state entries
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := bytes.Index(data, []byte("docs_file1000.txt"))
+	if at < 0 {
+		t.Fatal("State entry not found in the datastore file")
+	}
+	pageSize := os.Getpagesize()
+	page := at - at%pageSize
+	binary.LittleEndian.PutUint16(data[page+10:], 0xffff) // entry count
+	err = ioutil.WriteFile(filename, data, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Open(filename)
+	rebuilt, ok := err.(*RebuiltError)
+	if !ok {
+		t.Fatalf("Expected the corrupt datastore to be rebuilt, got %v", err)
+	}
+	if rebuilt.Profiles != 1 {
+		t.Fatalf("Expected 1 profile to be recovered, got %d", rebuilt.Profiles)
+	}
+
+	var profile map[string]string
+	err = Get(BucketProfile, "docs", &profile)
+	if err != nil {
+		t.Fatalf("Profile wasn't salvaged: %s", err)
+	}
+	if profile["name"] != "docs" {
+		t.Fatalf("Expected the salvaged profile to be named docs, got %v", profile)
+	}
+	if Rebuilt("docs").IsZero() {
+		t.Fatal("Expected the profile to be marked as having lost its synced state")
+	}
+
+	_, err = os.Stat(rebuilt.Kept)
+	if err != nil {
+		t.Fatalf("Expected the corrupt datastore to be kept: %s", err)
+	}
+}
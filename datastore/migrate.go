@@ -0,0 +1,87 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BucketMeta holds information about the datastore itself, such as its schema version
+const BucketMeta = "meta"
+
+const versionKey = "schemaVersion"
+
+// migration upgrades the datastore from the previous schema version to the next
+type migration func(tx *bolt.Tx) error
+
+// migrations upgrade existing datastores in place, in order.  A datastore at
+// schema version n has had the first n run.  New migrations are only ever
+// added to the end
+var migrations = []migration{
+	splitProfileBuckets, // 1: per-profile state and journal buckets
+}
+
+// SchemaVersion is the schema version of datastores written by this version
+// of freehold-sync
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+func storedVersion(tx *bolt.Tx) (int, error) {
+	b := tx.Bucket([]byte(BucketMeta))
+	if b == nil {
+		return 0, nil
+	}
+	version := 0
+	err := get(b, versionKey, &version)
+	if err == ErrNotFound {
+		return 0, nil
+	}
+	return version, err
+}
+
+// backupForMigration copies a datastore which needs migrating to a file next to
+// it first, so nothing is lost if a migration goes wrong
+func backupForMigration(filename string) error {
+	return ds.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(BucketProfile)) == nil {
+			// brand new datastore, nothing to keep
+			return nil
+		}
+		version, err := storedVersion(tx)
+		if err != nil {
+			return err
+		}
+		if version >= SchemaVersion() {
+			return nil
+		}
+		return tx.CopyFile(fmt.Sprintf("%s.v%d.bak", filename, version), 0600)
+	})
+}
+
+// migrate runs the migrations the datastore hasn't had yet, and records the
+// version it's now at.  They're run in the same transaction, so a datastore is
+// either fully migrated or left as it was
+func migrate(tx *bolt.Tx) error {
+	version, err := storedVersion(tx)
+	if err != nil {
+		return fmt.Errorf("Error reading datastore schema version: %s", err)
+	}
+	if version > SchemaVersion() {
+		return fmt.Errorf("The datastore is at schema version %d, which is newer than this version of "+
+			"freehold-sync supports (%d)", version, SchemaVersion())
+	}
+
+	for ; version < SchemaVersion(); version++ {
+		err = migrations[version](tx)
+		if err != nil {
+			return fmt.Errorf("Error migrating datastore to schema version %d: %s", version+1, err)
+		}
+	}
+
+	return put(tx.Bucket([]byte(BucketMeta)), versionKey, version)
+}
@@ -0,0 +1,146 @@
+package datastore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// tempDatastore returns the name of a datastore file in a new temp folder, and
+// a func which closes the datastore and removes the folder
+func tempDatastore(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "freehold-sync-datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "freehold-sync.ds"), func() {
+		Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// writeRaw writes the keys and values into the buckets of the datastore file
+// as is, with keys JSON encoded the way the datastore stores them
+func writeRaw(t *testing.T, filename string, entries map[string]map[string]string) {
+	db, err := bolt.Open(filename, 0666, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for bucket, values := range entries {
+			b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+			if err != nil {
+				return err
+			}
+			for key, value := range values {
+				k, err := json.Marshal(key)
+				if err != nil {
+					return err
+				}
+				err = b.Put(k, []byte(value))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	filename, cleanup := tempDatastore(t)
+	defer cleanup()
+
+	// a schema version 0 datastore kept every profile's entries together
+	writeRaw(t, filename, map[string]map[string]string{
+		BucketProfile: {
+			"docs":      `{}`,
+			"docs_work": `{}`,
+		},
+		BucketState: {
+			"docs_report.txt":        `"docs"`,
+			"docs_work_plan.txt":     `"docs_work"`,
+			"removed_old.txt":        `"removed"`,
+			"docs_folder/report.txt": `"nested"`,
+		},
+	})
+
+	err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		profile, key, value string
+	}{
+		{"docs", "report.txt", "docs"},
+		{"docs", "folder/report.txt", "nested"},
+		{"docs_work", "plan.txt", "docs_work"},
+	}
+	for _, test := range tests {
+		var value string
+		err = GetIn(BucketState, test.profile, test.key, &value)
+		if err != nil {
+			t.Fatalf("Error getting %s from profile %s: %s", test.key, test.profile, err)
+		}
+		if value != test.value {
+			t.Fatalf("Expected %s in profile %s to be %s, got %s", test.key, test.profile, test.value, value)
+		}
+	}
+
+	err = View(func(tx *Tx) error {
+		return tx.Each(BucketState, func(key string, value []byte) error {
+			t.Errorf("Expected no entries outside of the profiles' buckets, found %s", key)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var version int
+	err = Get(BucketMeta, versionKey, &version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != SchemaVersion() {
+		t.Fatalf("Expected schema version %d, got %d", SchemaVersion(), version)
+	}
+
+	_, err = os.Stat(filename + ".v0.bak")
+	if err != nil {
+		t.Fatalf("Expected the datastore to be backed up before migrating it: %s", err)
+	}
+}
+
+func TestMigrateNewer(t *testing.T) {
+	filename, cleanup := tempDatastore(t)
+	defer cleanup()
+
+	writeRaw(t, filename, map[string]map[string]string{
+		BucketProfile: {},
+		BucketMeta:    {versionKey: "99"},
+	})
+
+	err := Open(filename)
+	if err == nil {
+		t.Fatal("Expected an error opening a datastore from a newer version")
+	}
+
+	// the failed open can't keep holding the file
+	db, err := bolt.Open(filename, 0666, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("Datastore is still locked after failing to open it: %s", err)
+	}
+	db.Close()
+}
@@ -0,0 +1,231 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// profileBuckets hold a bucket for each profile, named by the profile's ID, so
+// each profile's entries are kept apart from every other profile's, and can be
+// read or removed together
+var profileBuckets = []string{
+	BucketState,
+	BucketJournal,
+	BucketHistory,
+	BucketConflict,
+	BucketPending,
+	BucketQuarantine,
+}
+
+func (t *Tx) profileBucket(bucket, profileID string, create bool) (*bolt.Bucket, error) {
+	parent := t.tx.Bucket([]byte(bucket))
+	if !create {
+		return parent.Bucket([]byte(profileID)), nil
+	}
+	return parent.CreateBucketIfNotExists([]byte(profileID))
+}
+
+// GetIn gets a value from the profile's bucket for the passed in key
+func (t *Tx) GetIn(bucket, profileID string, key interface{}, result interface{}) error {
+	b, err := t.profileBucket(bucket, profileID, false)
+	if err != nil {
+		return err
+	}
+	return get(b, key, result)
+}
+
+// PutIn puts a new value in the profile's bucket at the given key
+func (t *Tx) PutIn(bucket, profileID string, key interface{}, value interface{}) error {
+	b, err := t.profileBucket(bucket, profileID, true)
+	if err != nil {
+		return err
+	}
+	return put(b, key, value)
+}
+
+// DeleteIn removes the value from the profile's bucket for the given key
+func (t *Tx) DeleteIn(bucket, profileID string, key interface{}) error {
+	b, err := t.profileBucket(bucket, profileID, false)
+	if err != nil {
+		return err
+	}
+	return del(b, key)
+}
+
+// EachIn calls fn with each key and value in the profile's bucket, in key order.
+// Values are only valid until the transaction ends
+func (t *Tx) EachIn(bucket, profileID string, fn func(key string, value []byte) error) error {
+	b, err := t.profileBucket(bucket, profileID, false)
+	if err != nil || b == nil {
+		return err
+	}
+	return b.ForEach(func(k, v []byte) error {
+		var key string
+		err := json.Unmarshal(k, &key)
+		if err != nil {
+			return err
+		}
+		return fn(key, v)
+	})
+}
+
+// EachPrefixIn calls fn with each key starting with prefix, and its value, in the
+// profile's bucket, in key order.  Values are only valid until the transaction ends
+func (t *Tx) EachPrefixIn(bucket, profileID, prefix string, fn func(key string, value []byte) error) error {
+	b, err := t.profileBucket(bucket, profileID, false)
+	if err != nil || b == nil {
+		return err
+	}
+	// keys are JSON strings, so the prefix is matched against its encoding
+	// without the closing quote
+	dsPrefix, err := json.Marshal(prefix)
+	if err != nil {
+		return err
+	}
+	dsPrefix = dsPrefix[:len(dsPrefix)-1]
+
+	c := b.Cursor()
+	for k, v := c.Seek(dsPrefix); k != nil && bytes.HasPrefix(k, dsPrefix); k, v = c.Next() {
+		var key string
+		err = json.Unmarshal(k, &key)
+		if err != nil {
+			return err
+		}
+		err = fn(key, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Profiles returns the IDs of the profiles with entries in the bucket
+func (t *Tx) Profiles(bucket string) ([]string, error) {
+	var ids []string
+	err := t.tx.Bucket([]byte(bucket)).ForEach(func(k, v []byte) error {
+		if v == nil {
+			ids = append(ids, string(k))
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// CountIn is the number of values in the profile's bucket
+func (t *Tx) CountIn(bucket, profileID string) (int, error) {
+	b, err := t.profileBucket(bucket, profileID, false)
+	if err != nil || b == nil {
+		return 0, err
+	}
+	return b.Stats().KeyN, nil
+}
+
+// GetIn gets a value from the profile's bucket for the passed in key
+func GetIn(bucket, profileID string, key interface{}, result interface{}) error {
+	return View(func(tx *Tx) error {
+		return tx.GetIn(bucket, profileID, key, result)
+	})
+}
+
+// PutIn puts a new value in the profile's bucket at the given key
+func PutIn(bucket, profileID string, key interface{}, value interface{}) error {
+	return Update(func(tx *Tx) error {
+		return tx.PutIn(bucket, profileID, key, value)
+	})
+}
+
+// DeleteIn removes the value from the profile's bucket for the given key
+func DeleteIn(bucket, profileID string, key interface{}) error {
+	return Update(func(tx *Tx) error {
+		return tx.DeleteIn(bucket, profileID, key)
+	})
+}
+
+// DeleteProfile removes all of the profile's entries
+func (t *Tx) DeleteProfile(profileID string) error {
+	for i := range profileBuckets {
+		err := t.tx.Bucket([]byte(profileBuckets[i])).DeleteBucket([]byte(profileID))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitProfileBuckets moves entries from datastores which kept every profile's
+// entries together, keyed by the profile's ID and an underscore, into the
+// profiles' own buckets.  Entries of profiles which no longer exist are dropped
+func splitProfileBuckets(tx *bolt.Tx) error {
+	var profileIDs []string
+	err := tx.Bucket([]byte(BucketProfile)).ForEach(func(k, v []byte) error {
+		var id string
+		err := json.Unmarshal(k, &id)
+		if err != nil {
+			return err
+		}
+		profileIDs = append(profileIDs, id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range profileBuckets {
+		parent := tx.Bucket([]byte(profileBuckets[i]))
+		var keys, values [][]byte
+		err = parent.ForEach(func(k, v []byte) error {
+			if v == nil {
+				// already a profile's bucket
+				return nil
+			}
+			// copied, because they're changed before the transaction ends
+			keys = append(keys, append([]byte(nil), k...))
+			values = append(values, append([]byte(nil), v...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for j := range keys {
+			var key string
+			err = json.Unmarshal(keys[j], &key)
+			if err != nil {
+				return err
+			}
+			profileID := ""
+			for _, id := range profileIDs {
+				// IDs can contain underscores, so the longest match wins
+				if strings.HasPrefix(key, id+"_") && len(id) > len(profileID) {
+					profileID = id
+				}
+			}
+			if profileID != "" {
+				b, err := parent.CreateBucketIfNotExists([]byte(profileID))
+				if err != nil {
+					return err
+				}
+				newKey, err := json.Marshal(strings.TrimPrefix(key, profileID+"_"))
+				if err != nil {
+					return err
+				}
+				err = b.Put(newKey, values[j])
+				if err != nil {
+					return err
+				}
+			}
+			err = parent.Delete(keys[j])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,348 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+	"bitbucket.org/tshannon/freehold-sync/log"
+	"github.com/BurntSushi/toml"
+)
+
+// profilesFile is the TOML file profiles are declared in, for provisioning
+// freehold-sync with configuration management instead of the web interface
+var profilesFile string
+
+// declaredFile is the layout of the profiles file.  Each profile has the same
+// fields as a profile in the /v1/ API
+type declaredFile struct {
+	Profile []map[string]interface{} `toml:"profile"`
+}
+
+// readDeclared reads the profiles in the profiles file, with their secrets filled
+// in.  Returns nil if there is no profiles file
+func readDeclared(file string) ([]*profileStore, error) {
+	f := &declaredFile{}
+	md, err := toml.DecodeFile(file, f)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading profiles file %s: %s", file, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("Unknown setting %s in profiles file %s", undecoded[0], file)
+	}
+
+	names := make(map[string]bool)
+	declared := make([]*profileStore, 0, len(f.Profile))
+	for i, values := range f.Profile {
+		ps, err := declaredProfile(values)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid profile %d in profiles file %s: %s", i+1, file, err)
+		}
+		if names[ps.Name] {
+			return nil, fmt.Errorf("More than one profile in profiles file %s is named %s", file, ps.Name)
+		}
+		names[ps.Name] = true
+		declared = append(declared, ps)
+	}
+	return declared, nil
+}
+
+// declaredProfile builds a profile from its values in the profiles file.
+// Profiles are active unless they say otherwise
+func declaredProfile(values map[string]interface{}) (*profileStore, error) {
+	if _, ok := values["active"]; !ok {
+		values["active"] = true
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	a := &apiProfile{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(a)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(a.Name) == "" {
+		return nil, errors.New("No Name specified for this Sync Profile")
+	}
+
+	a.Passphrase, err = secretRef(a.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	remotes := []*apiRemote{a.Remote}
+	for i := range a.Destinations {
+		remotes = append(remotes, a.Destinations[i].Remote)
+	}
+	for _, r := range remotes {
+		if r == nil {
+			continue
+		}
+		r.Password, err = secretRef(r.Password)
+		if err != nil {
+			return nil, err
+		}
+		r.Token, err = secretRef(r.Token)
+		if err != nil {
+			return nil, err
+		}
+		r.ProxyPassword, err = secretRef(r.ProxyPassword)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ps, err := a.profileStore("")
+	if err != nil {
+		return nil, err
+	}
+	ps.Declared = true
+	return ps, nil
+}
+
+// secretRef reads a secret referenced in the profiles file, env:NAME for an
+// environment variable or file:path for the contents of a file, so the profiles
+// file itself doesn't have to hold any secrets.  Anything else is the secret
+func secretRef(value string) (string, error) {
+	var secret string
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		var ok bool
+		secret, ok = os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("The environment variable %s isn't set", name)
+		}
+	case strings.HasPrefix(value, "file:"):
+		data, err := os.ReadFile(strings.TrimPrefix(value, "file:"))
+		if err != nil {
+			return "", err
+		}
+		secret = strings.TrimSpace(string(data))
+	default:
+		secret = value
+	}
+	log.AddSecret(secret)
+	return secret, nil
+}
+
+// applyDeclared brings the stored profiles in line with the profiles file.
+// Declared profiles are added or updated, and ones which were declared before
+// but have been removed from the file are deleted.  Running profiles are only
+// restarted with their changes if restart is set, otherwise the profiles are
+// left to be started as usual
+func applyDeclared(file string, restart bool) error {
+	declared, err := readDeclared(file)
+	if err != nil || declared == nil {
+		return err
+	}
+
+	ids := make(map[string]bool)
+	failed := false
+	for _, ps := range declared {
+		err = ps.applyDeclared(restart, ids)
+		if err != nil {
+			logger.Profile(ps.Name).Errorf("Error applying profile %s from profiles file %s: %s", ps.Name, file, err)
+			failed = true
+			continue
+		}
+		ids[ps.ID] = true
+	}
+	if failed {
+		// a profile which can't be built has no ID to tell it apart from one
+		// which was removed from the file
+		return errors.New("Some declared profiles couldn't be applied, no profiles were removed")
+	}
+
+	all, err := storedProfiles()
+	if err != nil {
+		return err
+	}
+	for _, stored := range all {
+		if !stored.Declared || ids[stored.ID] {
+			continue
+		}
+		ps, err := getProfile(stored.ID)
+		if err != nil {
+			return err
+		}
+		logger.Profile(ps.Name).Infof("Removing profile %s, it's no longer in profiles file %s", ps.Name, file)
+		err = ps.delete()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyDeclared stores the declared profile, unless it's already stored as is.
+// Applied are the IDs of the declared profiles already applied from the file
+func (p *profileStore) applyDeclared(restart bool, applied map[string]bool) error {
+	profile, err := p.makeProfile()
+	if err != nil {
+		return err
+	}
+	destinations, err := p.makeDestinations()
+	if err != nil {
+		return err
+	}
+	err = p.checkDestinations()
+	if err != nil {
+		return err
+	}
+
+	existing, err := getProfile(p.ID)
+	if err != nil && err != datastore.ErrNotFound {
+		return err
+	}
+	if existing != nil {
+		if existing.Encrypt != p.Encrypt || existing.EncryptNames != p.EncryptNames {
+			return errors.New("Encryption can't be turned on or off for an existing profile")
+		}
+		if p.sameAs(existing) {
+			return nil
+		}
+		if restart {
+			err = profile.Stop()
+			if err != nil {
+				return err
+			}
+		}
+		err = p.stopDestinations(p.ID, existing)
+		if err != nil {
+			return err
+		}
+	}
+
+	// declared profiles which aren't applied yet are checked once they are, and
+	// ones which aren't applied at all are being removed from the file
+	err = p.checkOverlap(func(other *profileStore) bool {
+		return other.ID == p.ID || (other.Declared && !applied[other.ID])
+	})
+	if err != nil {
+		return err
+	}
+
+	err = p.put()
+	if err != nil {
+		return err
+	}
+	logger.Profile(p.Name).Infof("Applied profile %s from the profiles file", p.Name)
+	if !restart || !p.Active {
+		return nil
+	}
+	err = startProfile(profile, p.Paused)
+	if err != nil {
+		return err
+	}
+	for i := range destinations {
+		err = startProfile(destinations[i], p.Paused)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameAs is whether the declared profile has the same settings as the stored
+// one.  Secrets only differ if the declared profile sets them, since the stored
+// profile may have more, such as a token from logging in with the password
+func (p *profileStore) sameAs(stored *profileStore) bool {
+	if p.Passphrase != "" && p.Passphrase != stored.Passphrase {
+		return false
+	}
+	if changedClientSecrets(p.Client, stored.Client) {
+		return false
+	}
+	if len(p.Destinations) == len(stored.Destinations) {
+		for i := range p.Destinations {
+			if changedClientSecrets(p.Destinations[i].Client, stored.Destinations[i].Client) {
+				return false
+			}
+		}
+	}
+
+	a, err := json.Marshal(p.withoutSecrets())
+	if err != nil {
+		return false
+	}
+	b, err := json.Marshal(stored.withoutSecrets())
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(a, b)
+}
+
+func changedClientSecrets(declared, stored *client) bool {
+	if declared == nil || stored == nil {
+		return false
+	}
+	return changedSecret(declared.Password, stored.Password) ||
+		changedSecret(declared.Token, stored.Token) ||
+		changedSecret(declared.ProxyPassword, stored.ProxyPassword)
+}
+
+func changedSecret(declared, stored *string) bool {
+	return optional(declared) != "" && optional(declared) != optional(stored)
+}
+
+// withoutSecrets returns a copy of the profile without its passwords, tokens
+// and passphrase
+func (p *profileStore) withoutSecrets() *profileStore {
+	c := *p
+	c.Passphrase = ""
+	c.Client = p.Client.withoutSecrets()
+	if len(p.Destinations) > 0 {
+		c.Destinations = make([]*destination, len(p.Destinations))
+		for i := range p.Destinations {
+			d := *p.Destinations[i]
+			d.Client = d.Client.withoutSecrets()
+			c.Destinations[i] = &d
+		}
+	}
+	return &c
+}
+
+// withoutSecrets returns a copy of the client without its password, token and
+// proxy password
+func (c *client) withoutSecrets() *client {
+	if c == nil {
+		return nil
+	}
+	stripped := *c
+	stripped.Password = nil
+	stripped.Token = nil
+	stripped.ProxyPassword = nil
+	return &stripped
+}
+
+// reloadOnHangup applies the profiles file again whenever freehold-sync gets
+// a SIGHUP
+func reloadOnHangup(file string) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			logger.Infof("Reloading profiles file %s", file)
+			err := applyDeclared(file, true)
+			if err != nil {
+				logger.Errorf("Error reloading profiles file %s: %s", file, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,224 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+// Package delta implements an rsync style rolling checksum algorithm
+// for only transferring the blocks of a file which have changed.
+// A Signature is built from the file being overwritten, the new file is
+// compared against that signature to build a list of operations, and those
+// operations are applied to the old file to recreate the new one
+package delta
+
+import (
+	"bufio"
+	"crypto/md5"
+	"errors"
+	"io"
+)
+
+// DefaultBlockSize is the block size used when one isn't specified
+const DefaultBlockSize = 64 * 1024
+
+// Block is the signature of a single block in a file
+type Block struct {
+	Index  int
+	Weak   uint32
+	Strong [md5.Size]byte
+}
+
+// Signature is the list of block checksums for a file
+type Signature struct {
+	BlockSize int
+	Blocks    []Block
+}
+
+// Op is a single operation for rebuilding a file.  If Data is nil,
+// then the block at Index is copied from the old file, otherwise
+// Data is written as is
+type Op struct {
+	Index int
+	Data  []byte
+}
+
+// NewSignature builds the signature of the data in the passed in reader
+func NewSignature(r io.Reader, blockSize int) (*Signature, error) {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	sig := &Signature{
+		BlockSize: blockSize,
+	}
+
+	buf := make([]byte, blockSize)
+	for i := 0; ; i++ {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			a, b := weakSum(buf[:n])
+			sig.Blocks = append(sig.Blocks, Block{
+				Index:  i,
+				Weak:   weak(a, b),
+				Strong: md5.Sum(buf[:n]),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sig, nil
+}
+
+// Diff compares the data in the reader against the passed in signature
+// and returns the operations needed to turn the signature's file into
+// the reader's data
+func Diff(sig *Signature, r io.Reader) ([]Op, error) {
+	if sig == nil || sig.BlockSize <= 0 {
+		return nil, errors.New("Invalid delta signature")
+	}
+	bs := sig.BlockSize
+
+	lookup := make(map[uint32][]Block, len(sig.Blocks))
+	for i := range sig.Blocks {
+		lookup[sig.Blocks[i].Weak] = append(lookup[sig.Blocks[i].Weak], sig.Blocks[i])
+	}
+
+	var ops []Op
+	var literal []byte
+
+	flush := func() {
+		if len(literal) > 0 {
+			ops = append(ops, Op{Index: -1, Data: literal})
+			literal = nil
+		}
+	}
+
+	br := bufio.NewReaderSize(r, bs*2)
+	window := make([]byte, 0, bs)
+
+	fill := func() error {
+		for len(window) < bs {
+			c, err := br.ReadByte()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			window = append(window, c)
+		}
+		return nil
+	}
+
+	err := fill()
+	if err != nil {
+		return nil, err
+	}
+	a, b := weakSum(window)
+
+	for len(window) > 0 {
+		if idx, ok := match(lookup, weak(a, b), window); ok {
+			flush()
+			ops = append(ops, Op{Index: idx})
+			window = window[:0]
+			err = fill()
+			if err != nil {
+				return nil, err
+			}
+			a, b = weakSum(window)
+			continue
+		}
+
+		// no match, roll the window forward one byte
+		out := uint32(window[0])
+		l := uint32(len(window))
+		literal = append(literal, window[0])
+		if len(literal) >= bs {
+			flush()
+		}
+
+		c, err := br.ReadByte()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		if err == io.EOF {
+			window = window[1:]
+			a -= out
+			b -= l * out
+			continue
+		}
+
+		window = append(window[1:], c)
+		a = a - out + uint32(c)
+		b = b - l*out + a
+	}
+
+	flush()
+	return ops, nil
+}
+
+// Patch applies the operations to the old file and writes the result to w
+func Patch(old io.ReaderAt, blockSize int, ops []Op, w io.Writer) error {
+	buf := make([]byte, blockSize)
+	for i := range ops {
+		if ops[i].Data != nil {
+			_, err := w.Write(ops[i].Data)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		n, err := old.ReadAt(buf, int64(ops[i].Index)*int64(blockSize))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			return errors.New("Delta block is outside of the old file")
+		}
+		_, err = w.Write(buf[:n])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Literal returns the number of bytes of new data in the operations
+func Literal(ops []Op) int64 {
+	var size int64
+	for i := range ops {
+		size += int64(len(ops[i].Data))
+	}
+	return size
+}
+
+func match(lookup map[uint32][]Block, weak uint32, window []byte) (int, bool) {
+	blocks, ok := lookup[weak]
+	if !ok {
+		return 0, false
+	}
+	strong := md5.Sum(window)
+	for i := range blocks {
+		if blocks[i].Strong == strong {
+			return blocks[i].Index, true
+		}
+	}
+	return 0, false
+}
+
+func weakSum(data []byte) (a, b uint32) {
+	l := uint32(len(data))
+	for i := range data {
+		a += uint32(data[i])
+		b += (l - uint32(i)) * uint32(data[i])
+	}
+	return a, b
+}
+
+func weak(a, b uint32) uint32 {
+	return (a & 0xffff) | (b&0xffff)<<16
+}
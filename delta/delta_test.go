@@ -0,0 +1,64 @@
+package delta
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestDelta(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	old := make([]byte, 10000)
+	rnd.Read(old)
+
+	changed := make([]byte, 0, len(old)+100)
+	changed = append(changed, old[:3000]...)
+	changed = append(changed, []byte("inserted data that wasn't in the old file")...)
+	changed = append(changed, old[3000:7000]...)
+	changed = append(changed, old[7500:]...)
+
+	sig, err := NewSignature(bytes.NewReader(old), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ops, err := Diff(sig, bytes.NewReader(changed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if Literal(ops) >= int64(len(changed)/2) {
+		t.Fatalf("Delta sent %d of %d bytes, expected most blocks to be reused", Literal(ops), len(changed))
+	}
+
+	result := &bytes.Buffer{}
+	err = Patch(bytes.NewReader(old), sig.BlockSize, ops, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(result.Bytes(), changed) {
+		t.Fatal("Patched file doesn't match the changed file")
+	}
+}
+
+func TestDeltaEmpty(t *testing.T) {
+	sig, err := NewSignature(bytes.NewReader(nil), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ops, err := Diff(sig, bytes.NewReader([]byte("new file")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := &bytes.Buffer{}
+	err = Patch(bytes.NewReader(nil), sig.BlockSize, ops, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.String() != "new file" {
+		t.Fatalf("Expected 'new file' got %s", result.String())
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+	"bitbucket.org/tshannon/freehold-sync/local"
+	"bitbucket.org/tshannon/freehold-sync/log"
+	"bitbucket.org/tshannon/freehold-sync/remote"
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// destination is another remote folder, usually on another freehold instance,
+// a profile's local folder is synced to along with its own remote folder.  Each
+// destination is synced as a profile of its own, with its own queue, synced
+// state and status, but with the profile's settings and the profile's watch on
+// the local folder
+type destination struct {
+	ID         string  `json:"id"` // of the profile syncing with the destination, set when the profile is stored
+	RemotePath string  `json:"remotePath"`
+	Client     *client `json:"client"`
+}
+
+// name is how the destination is told apart from the profile's other remote
+// folders in messages
+func (d *destination) name() string {
+	if d.Client == nil {
+		return d.RemotePath
+	}
+	return optional(d.Client.URL) + d.RemotePath
+}
+
+var fanOut fanOutProfiles // running profiles of profiles with destinations
+
+func init() {
+	fanOut = fanOutProfiles{
+		profiles: make(map[string]*syncer.Profile),
+	}
+}
+
+type fanOutProfiles struct {
+	sync.Mutex
+	profiles map[string]*syncer.Profile // by ID
+}
+
+func (f *fanOutProfiles) started(p *syncer.Profile) {
+	f.Lock()
+	defer f.Unlock()
+	f.profiles[p.ID()] = p
+}
+
+func (f *fanOutProfiles) stopped(id string) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.profiles, id)
+}
+
+func (f *fanOutProfiles) get(id string) (*syncer.Profile, bool) {
+	f.Lock()
+	defer f.Unlock()
+	p, ok := f.profiles[id]
+	return p, ok
+}
+
+// others returns the running profiles syncing the same local folder as the
+// passed in profile.  Profiles can't overlap, so they're the profile it belongs
+// to and that profile's other destinations
+func (f *fanOutProfiles) others(p *syncer.Profile) []*syncer.Profile {
+	f.Lock()
+	defer f.Unlock()
+	var others []*syncer.Profile
+	for id, other := range f.profiles {
+		if id != p.ID() && other.Local.ID() == p.Local.ID() {
+			others = append(others, other)
+		}
+	}
+	return others
+}
+
+// passOnLocal syncs a local file changed by one of a profile's remote folders
+// to the rest of them.  The change was made by this process, so it isn't seen
+// by the watch on the local folder they share
+func passOnLocal(p *syncer.Profile, relPath string) {
+	for _, other := range fanOut.others(p) {
+		l, err := local.New(local.Join(other.Local.Path(other), relPath))
+		if err != nil {
+			log.Module(local.LogType).Profile(other.Name).Errorf("Error building local syncer for %s: %s", relPath, err)
+			continue
+		}
+		if !l.Exists() {
+			l.SetDeleted(true)
+		}
+		go localChanges(other, l)
+	}
+}
+
+// forDestination returns a copy of the profile which syncs with the
+// destination in place of the profile's own remote folder
+func (p *profileStore) forDestination(d *destination) *profileStore {
+	c := *p
+	c.RemotePath = d.RemotePath
+	c.Client = d.Client
+	c.Destinations = nil
+	return &c
+}
+
+// makeDestination returns the profile syncing with the destination, and sets
+// the destination's ID
+func (p *profileStore) makeDestination(d *destination) (*syncer.Profile, error) {
+	view := p.forDestination(d)
+	profile, err := view.makeProfile()
+	if err != nil {
+		return nil, err
+	}
+	profile.LocalChanged = passOnLocal
+	d.ID = view.ID
+	return profile, nil
+}
+
+// makeDestinations returns the profiles syncing with each of the profile's
+// destinations, in order
+func (p *profileStore) makeDestinations() ([]*syncer.Profile, error) {
+	profiles := make([]*syncer.Profile, 0, len(p.Destinations))
+	for i := range p.Destinations {
+		profile, err := p.makeDestination(p.Destinations[i])
+		if err != nil {
+			return nil, fmt.Errorf("Error with destination %s: %s", p.Destinations[i].name(), err)
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+// checkDestinations refuses destinations which overlap each other, or the
+// profile's own remote folder.  The destinations' IDs must be set
+func (p *profileStore) checkDestinations() error {
+	if len(p.Destinations) == 0 {
+		return nil
+	}
+	if p.ConflictResolution == syncer.ConResAsk {
+		return errors.New("Conflicts in a profile's destinations can't wait to be resolved by hand, pick another " +
+			"conflict resolution")
+	}
+
+	_, remotes, err := p.rootIDs()
+	if err != nil {
+		return err
+	}
+	for i := range remotes {
+		for j := i + 1; j < len(remotes); j++ {
+			if within(remotes[i], remotes[j], "/") || within(remotes[j], remotes[i], "/") {
+				return fmt.Errorf("The destination %s overlaps another remote folder of the profile",
+					p.Destinations[j-1].name())
+			}
+		}
+	}
+	return nil
+}
+
+// syncIDs returns the IDs the profile syncs as, its own and its destinations'
+func (p *profileStore) syncIDs() []string {
+	ids := []string{p.ID}
+	for i := range p.Destinations {
+		ids = append(ids, p.Destinations[i].ID)
+	}
+	return ids
+}
+
+// destination returns the profile's destination with the ID, nil if it doesn't
+// have one
+func (p *profileStore) destination(id string) *destination {
+	for i := range p.Destinations {
+		if p.Destinations[i].ID == id {
+			return p.Destinations[i]
+		}
+	}
+	return nil
+}
+
+// syncProfile returns the profile syncing as the ID, the profile's own or
+// the one for one of its destinations
+func (p *profileStore) syncProfile(id string) (*syncer.Profile, error) {
+	if d := p.destination(id); d != nil {
+		return p.makeDestination(d)
+	}
+	return p.makeProfile()
+}
+
+// profileOf returns the profile which syncs as the ID, either with its own
+// remote folder or with one of its destinations
+func profileOf(id string) (*profileStore, error) {
+	ps, err := getProfile(id)
+	if err != datastore.ErrNotFound {
+		return ps, err
+	}
+	all, err := storedProfiles()
+	if err != nil {
+		return nil, err
+	}
+	for i := range all {
+		if all[i].destination(id) != nil {
+			return getProfile(all[i].ID)
+		}
+	}
+	return nil, datastore.ErrNotFound
+}
+
+// startDestinations starts syncing with each of the profile's destinations.  A
+// destination which can't be reached starts once it can be, without holding up
+// the profile or its other destinations
+func (p *profileStore) startDestinations() {
+	for _, d := range p.Destinations {
+		if offline.has(d.ID) {
+			// already waiting to start
+			continue
+		}
+		err := p.startDestination(d)
+		if remote.IsOffline(err) {
+			logger.Profile(p.Name).Warnf("The destination %s of profile %s can't be reached, it will start once it "+
+				"can be: %s", d.name(), p.Name, err)
+			go destinationWhenOnline(p.ID, d.ID)
+			continue
+		}
+		if err != nil {
+			logger.Profile(p.Name).Errorf("Error starting destination %s of profile %s: %s", d.name(), p.Name, err)
+		}
+	}
+}
+
+// startDestination starts syncing with the destination where it left off
+func (p *profileStore) startDestination(d *destination) error {
+	prf, err := p.makeDestination(d)
+	if err != nil {
+		return err
+	}
+	err = prf.ReplayJournal(func(relPath string) (syncer.Syncer, syncer.Syncer, error) {
+		return profileFiles(prf, relPath)
+	})
+	if err != nil {
+		log.Module(syncer.LogType).Profile(prf.Name).Errorf("Error replaying journal for destination %s of profile %s: %s",
+			d.name(), prf.Name, err)
+	}
+	return startProfile(prf, p.Paused)
+}
+
+// destinationWhenOnline keeps trying to start a destination which couldn't be
+// reached, until it starts, or it or its profile is removed or no longer active
+func destinationWhenOnline(profileID, id string) {
+	offline.set(id, true)
+	defer offline.set(id, false)
+
+	for {
+		time.Sleep(offlineInterval)
+
+		current, err := getProfile(profileID)
+		if err == datastore.ErrNotFound || (err == nil && !current.Active) {
+			return
+		}
+		if err != nil {
+			logger.Errorf("Error reading profile %s: %s", profileID, err)
+			continue
+		}
+		d := current.destination(id)
+		if d == nil {
+			return
+		}
+
+		err = current.startDestination(d)
+		if remote.IsOffline(err) {
+			continue
+		}
+		if err != nil {
+			logger.Profile(current.Name).Errorf("Error starting destination %s of profile %s: %s", d.name(),
+				current.Name, err)
+			return
+		}
+		logger.Profile(current.Name).Infof("The destination %s of profile %s is reachable again, and has started",
+			d.name(), current.Name)
+		return
+	}
+}
+
+// stopRunning stops the running profiles with the IDs, which share their local
+// folder with destinations
+func stopRunning(ids []string) error {
+	for _, id := range ids {
+		profile, ok := fanOut.get(id)
+		if !ok {
+			continue
+		}
+		err := profile.Stop()
+		if err != nil {
+			return err
+		}
+		fanOut.stopped(id)
+	}
+	return nil
+}
+
+// runningDestinations returns the profiles syncing with the profile's
+// destinations which are running.  Destinations waiting to be reached aren't
+func (p *profileStore) runningDestinations() []*syncer.Profile {
+	var running []*syncer.Profile
+	for i := range p.Destinations {
+		if profile, ok := fanOut.get(p.Destinations[i].ID); ok {
+			running = append(running, profile)
+		}
+	}
+	return running
+}
+
+// destinationStatus returns the sync status of each of the profile's
+// destinations
+func (p *profileStore) destinationStatus() []*apiDestinationStatus {
+	var statuses []*apiDestinationStatus
+	for _, d := range p.Destinations {
+		pending, status := p.statusOf(d.ID)
+		statuses = append(statuses, &apiDestinationStatus{
+			ID:         d.ID,
+			URL:        optional(d.Client.URL),
+			RemotePath: d.RemotePath,
+			Status:     status,
+			Pending:    pending,
+		})
+	}
+	return statuses
+}
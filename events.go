@@ -0,0 +1,117 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"bitbucket.org/tshannon/freehold-sync/local"
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// statusInterval is how often profile statuses are checked for changes to
+// send to event streams
+const statusInterval = time.Second
+
+// eventStatus is sent on an event stream when a profile's status changes
+const eventStatus = "status"
+
+// statusEvent is a profile's status, as sent on an event stream
+type statusEvent struct {
+	Type    string    `json:"type"`
+	Profile string    `json:"profile"`
+	Status  string    `json:"status"`
+	Count   int       `json:"count"`
+	Warning string    `json:"warning,omitempty"`
+	When    time.Time `json:"when"`
+}
+
+var eventsHandler = websocket.Server{
+	Handshake: eventsHandshake,
+	Handler:   eventsStream,
+}
+
+// eventsHandshake lets in scripts, which don't send an Origin, and pages served
+// by freehold-sync itself, but not other sites open in the same browser
+func eventsHandshake(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	if origin != nil && origin.Host != r.Host {
+		return errors.New("Cross origin event streams are not allowed")
+	}
+	config.Origin = origin
+	return nil
+}
+
+// eventsStream sends sync events and profile status changes to the websocket
+// until it's closed.  The status of every profile is sent when it opens
+func eventsStream(ws *websocket.Conn) {
+	defer ws.Close()
+
+	events, unsubscribe := syncer.Subscribe()
+	defer unsubscribe()
+
+	// nothing is read from the client, other than noticing it go away
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, ws)
+		close(closed)
+	}()
+
+	statuses := make(map[string]statusEvent)
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+
+	err := sendStatuses(ws, statuses)
+	for err == nil {
+		select {
+		case <-closed:
+			return
+		case e := <-events:
+			err = websocket.JSON.Send(ws, e)
+		case <-ticker.C:
+			err = sendStatuses(ws, statuses)
+		}
+	}
+}
+
+// sendStatuses sends the status of every profile whose status changed since it
+// was last sent
+func sendStatuses(ws *websocket.Conn, last map[string]statusEvent) error {
+	profiles, err := storedProfiles()
+	if err != nil {
+		return err
+	}
+	for _, p := range profiles {
+		count, status := p.status()
+		e := statusEvent{
+			Type:    eventStatus,
+			Profile: p.ID,
+			Status:  status,
+			Count:   count,
+			Warning: local.ProfileWarning(p.ID),
+		}
+		previous := last[p.ID]
+		previous.When = time.Time{}
+		if previous == e {
+			continue
+		}
+		e.When = time.Now()
+		err = websocket.JSON.Send(ws, &e)
+		if err != nil {
+			return err
+		}
+		last[p.ID] = e
+	}
+	return nil
+}
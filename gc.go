@@ -0,0 +1,299 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+	"bitbucket.org/tshannon/freehold-sync/log"
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// gcInterval is how often stale entries are removed from the datastore
+var gcInterval = 24 * time.Hour
+
+// historyAge is how long changes are kept in the history of the files they were made to
+var historyAge = 90 * 24 * time.Hour
+
+var gcTimer *time.Timer
+
+// gcReport is how many stale entries of each kind were removed from the datastore
+type gcReport struct {
+	Profiles  int `json:"profiles"`  // synced state, journals, history and conflicts of removed profiles
+	Retries   int `json:"retries"`   // retries of removed profiles
+	Reports   int `json:"reports"`   // when the last reports of removed profiles were sent
+	Snapshots int `json:"snapshots"` // remote folder snapshots outside of every profile
+	Hashes    int `json:"hashes"`    // hashes of deleted files, or files outside of every profile
+	Transfers int `json:"transfers"` // interrupted downloads outside of every profile
+	History   int `json:"history"`   // changes older than historyAge
+	Log       int `json:"log"`       // log entries older than the logDays setting, or beyond logMaxEntries
+}
+
+func (g *gcReport) total() int {
+	return g.Profiles + g.Retries + g.Reports + g.Snapshots + g.Hashes + g.Transfers + g.History + g.Log
+}
+
+// gcPoll removes stale entries from the datastore every gcInterval
+func gcPoll() {
+	gcTimer = time.AfterFunc(gcInterval, func() {
+		report, err := collectGarbage()
+		if err != nil {
+			logger.Errorf("Error removing stale entries from the datastore: %s", err)
+		} else if report.total() > 0 {
+			logger.Infof("Removed %d stale entries from the datastore", report.total())
+		}
+		gcPoll()
+	})
+}
+
+func stopGC() {
+	if gcTimer != nil {
+		gcTimer.Stop()
+	}
+}
+
+// profileRoots are the local and remote roots of every profile, active or not,
+// as the IDs of the files they're made of
+type profileRoots struct {
+	ids    map[string]bool
+	local  []string
+	remote []string
+}
+
+func allRoots() (*profileRoots, error) {
+	profiles, err := storedProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	roots := &profileRoots{
+		ids: make(map[string]bool, len(profiles)),
+	}
+	for _, ps := range profiles {
+		for _, id := range ps.syncIDs() {
+			roots.ids[id] = true
+		}
+		l, r, err := ps.rootIDs()
+		if err != nil {
+			return nil, err
+		}
+		roots.local = append(roots.local, l)
+		roots.remote = append(roots.remote, r...)
+	}
+	return roots, nil
+}
+
+func (r *profileRoots) hasLocal(id string) bool {
+	for _, root := range r.local {
+		if within(id, root, string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *profileRoots) hasRemote(id string) bool {
+	for _, root := range r.remote {
+		if within(id, root, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// collectGarbage removes datastore entries nothing will ever read again.  Only
+// entries which are rebuilt as needed, or which belong to nothing, are removed.
+// The synced state of files in existing profiles is always kept, since it's
+// what tells a delete apart from a new file
+func collectGarbage() (*gcReport, error) {
+	roots, err := allRoots()
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := make(map[string]bool)    // removed profiles with entries left
+	stale := make(map[string][]string)   // keys to remove, by bucket
+	history := make(map[string][]string) // old history to remove, by profile
+	historyCount := 0
+	cutoff := time.Now().Add(-historyAge)
+
+	// files are checked in a read only transaction, and the stale entries removed
+	// in a short write transaction after, so checking them doesn't hold up
+	// everything else writing to the datastore
+	err = datastore.View(func(tx *datastore.Tx) error {
+		for _, bucket := range []string{datastore.BucketState, datastore.BucketJournal, datastore.BucketHistory,
+			datastore.BucketConflict, datastore.BucketPending, datastore.BucketQuarantine} {
+			ids, err := tx.Profiles(bucket)
+			if err != nil {
+				return err
+			}
+			for i := range ids {
+				if !roots.ids[ids[i]] {
+					profiles[ids[i]] = true
+				}
+			}
+		}
+
+		for id := range roots.ids {
+			err := tx.EachIn(datastore.BucketHistory, id, func(key string, value []byte) error {
+				entry := &syncer.HistoryEntry{}
+				err := json.Unmarshal(value, entry)
+				if err != nil {
+					return err
+				}
+				if entry.When.Before(cutoff) {
+					history[id] = append(history[id], key)
+					historyCount++
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		err := tx.Each(datastore.BucketRetry, func(key string, value []byte) error {
+			s := &syncRetry{}
+			err := json.Unmarshal(value, s)
+			if err != nil {
+				return err
+			}
+			if !roots.ids[s.ProfileID] {
+				stale[datastore.BucketRetry] = append(stale[datastore.BucketRetry], key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Each(datastore.BucketReport, func(key string, value []byte) error {
+			if !roots.ids[key] {
+				stale[datastore.BucketReport] = append(stale[datastore.BucketReport], key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Each(datastore.BucketRemote, func(key string, value []byte) error {
+			if !roots.hasRemote(key) {
+				stale[datastore.BucketRemote] = append(stale[datastore.BucketRemote], key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Each(datastore.BucketHash, func(key string, value []byte) error {
+			if roots.hasRemote(key) {
+				return nil
+			}
+			if roots.hasLocal(key) {
+				_, err := os.Lstat(key)
+				if !os.IsNotExist(err) {
+					return nil
+				}
+			}
+			stale[datastore.BucketHash] = append(stale[datastore.BucketHash], key)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Each(datastore.BucketTransfer, func(key string, value []byte) error {
+			if !roots.hasLocal(key) {
+				stale[datastore.BucketTransfer] = append(stale[datastore.BucketTransfer], key)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = datastore.Update(func(tx *datastore.Tx) error {
+		for id := range profiles {
+			err := tx.DeleteProfile(id)
+			if err != nil {
+				return err
+			}
+		}
+		for id, keys := range history {
+			for i := range keys {
+				err := tx.DeleteIn(datastore.BucketHistory, id, keys[i])
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for bucket, keys := range stale {
+			for i := range keys {
+				err := tx.Delete(bucket, keys[i])
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logs, err := log.Trim()
+	if err != nil {
+		return nil, err
+	}
+
+	return &gcReport{
+		Profiles:  len(profiles),
+		Retries:   len(stale[datastore.BucketRetry]),
+		Reports:   len(stale[datastore.BucketReport]),
+		Snapshots: len(stale[datastore.BucketRemote]),
+		Hashes:    len(stale[datastore.BucketHash]),
+		Transfers: len(stale[datastore.BucketTransfer]),
+		History:   historyCount,
+		Log:       logs,
+	}, nil
+}
+
+func datastoreGCPost(w http.ResponseWriter, r *http.Request) {
+	report, err := collectGarbage()
+	if errHandled(err, w) {
+		return
+	}
+
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+		Data:   report,
+	})
+}
+
+func datastoreCompactPost(w http.ResponseWriter, r *http.Request) {
+	before, after, err := datastore.Compact()
+	if errHandled(err, w) {
+		return
+	}
+
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+		Data: struct {
+			Before int64 `json:"before"` // size of the datastore file in bytes
+			After  int64 `json:"after"`
+		}{
+			Before: before,
+			After:  after,
+		},
+	})
+}
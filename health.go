@@ -0,0 +1,107 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/remote"
+)
+
+// profile connectivity reported by /readyz
+const (
+	connectivityOnline        = "online"
+	connectivityDegraded      = "degraded"
+	connectivityOffline       = "offline"
+	connectivityVolumeMissing = "volumeMissing"
+	connectivityStopped       = "stopped" // not active, or paused
+)
+
+var started = time.Now()
+
+// readiness is what /readyz reports.  Ready is whether the datastore can be
+// read, and every running profile can reach both of its locations
+type readiness struct {
+	Ready     bool                `json:"ready"`
+	Datastore string              `json:"datastore"` // the error reading it, or ok
+	Profiles  []*profileReadiness `json:"profiles"`
+}
+
+type profileReadiness struct {
+	Name         string `json:"name"`
+	Status       string `json:"status"`
+	Connectivity string `json:"connectivity"`
+}
+
+func (p *profileStore) connectivity() string {
+	switch {
+	case !p.Active || p.Paused:
+		return connectivityStopped
+	case offline.has(p.ID):
+		return connectivityOffline
+	case unmounted.has(p.ID):
+		return connectivityVolumeMissing
+	case remote.ProfileDegraded(p.ID):
+		return connectivityDegraded
+	}
+	return connectivityOnline
+}
+
+// healthzGet responds as long as the web server is running, for liveness
+// checks
+func healthzGet(w http.ResponseWriter, r *http.Request) {
+	apiSuccess(w, http.StatusOK, &struct {
+		Started       time.Time `json:"started"`
+		UptimeSeconds int64     `json:"uptimeSeconds"`
+	}{started, int64(time.Since(started).Seconds())})
+}
+
+// readyzGet responds with 503 Service Unavailable when the datastore can't be
+// read, or a running profile can't reach its freehold instance or local volume.
+// What was checked is only listed for authenticated requests, anyone else just
+// gets whether it's ready
+func readyzGet(w http.ResponseWriter, r *http.Request) {
+	report := &readiness{
+		Ready:     true,
+		Datastore: "ok",
+		Profiles:  []*profileReadiness{},
+	}
+
+	all, err := storedProfiles()
+	if err != nil {
+		report.Ready = false
+		report.Datastore = err.Error()
+	}
+	for i := range all {
+		_, status := all[i].status()
+		pr := &profileReadiness{
+			Name:         all[i].Name,
+			Status:       status,
+			Connectivity: all[i].connectivity(),
+		}
+		if pr.Connectivity == connectivityOffline || pr.Connectivity == connectivityVolumeMissing {
+			report.Ready = false
+		}
+		report.Profiles = append(report.Profiles, pr)
+	}
+
+	var data interface{} = report
+	if !authenticated(r) {
+		data = &struct {
+			Ready bool `json:"ready"`
+		}{report.Ready}
+	}
+
+	if !report.Ready {
+		apiRespond(w, http.StatusServiceUnavailable, &jsend{
+			Status:  statusError,
+			Data:    data,
+			Message: "Not ready",
+		})
+		return
+	}
+	apiSuccess(w, http.StatusOK, data)
+}
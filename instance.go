@@ -0,0 +1,71 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// errLocked is returned when another process already holds the lock
+var errLocked = errors.New("Lock is held by another process")
+
+var instance instanceLocks // locks held by this process until it exits
+
+func init() {
+	instance = instanceLocks{
+		files: make(map[string]*os.File),
+	}
+}
+
+// instanceLocks are lock files which keep a second freehold-sync process from
+// using the same data folder, or syncing the same local folders.  The locks are
+// released by the operating system when the process exits, even if it crashes
+type instanceLocks struct {
+	sync.Mutex
+	files map[string]*os.File
+}
+
+// lock takes the lock on the file, if this process doesn't hold it already
+func (l *instanceLocks) lock(filename string) error {
+	l.Lock()
+	defer l.Unlock()
+	if _, ok := l.files[filename]; ok {
+		return nil
+	}
+	f, err := lockFile(filename)
+	if err != nil {
+		return err
+	}
+	l.files[filename] = f
+	return nil
+}
+
+// lockDataDir keeps any other freehold-sync process from using the data folder,
+// and the datastore in it, while this one is running
+func lockDataDir(dataDir string) error {
+	err := instance.lock(filepath.Join(dataDir, "sync.lock"))
+	if err == errLocked {
+		return fmt.Errorf("Freehold-Sync is already running with the data folder %s", dataDir)
+	}
+	return err
+}
+
+// lockLocalRoot keeps any other freehold-sync process, even one with its own
+// data folder, from syncing the profile's local folder at the same time as
+// this one.  The lock is kept until freehold-sync stops
+func lockLocalRoot(dir string) error {
+	hash := sha256.Sum256([]byte(filepath.Clean(dir)))
+	err := instance.lock(filepath.Join(os.TempDir(), "freehold-sync-"+hex.EncodeToString(hash[:8])+".lock"))
+	if err == errLocked {
+		return fmt.Errorf("Another Freehold-Sync process is already syncing %s", dir)
+	}
+	return err
+}
@@ -8,10 +8,109 @@ import (
 	"errors"
 	"net/http"
 	"os/user"
+	"path/filepath"
+	"strings"
 
 	"bitbucket.org/tshannon/freehold-sync/local"
+	"bitbucket.org/tshannon/freehold-sync/syncer"
 )
 
+// localRoots are the folders the local folder browser is limited to, so the
+// web interface can't be used to look around the rest of the file system
+var localRoots []string
+
+var errOutsideRoots = errors.New("Path is outside of the folders which can be browsed")
+
+// setLocalRoots sets the folders which can be browsed from a list separated
+// like the PATH environment variable, defaulting to the user's home folder
+func setLocalRoots(list string) error {
+	roots := filepath.SplitList(list)
+	if strings.TrimSpace(list) == "" {
+		usr, err := user.Current()
+		if err != nil {
+			return err
+		}
+		roots = []string{usr.HomeDir}
+	}
+
+	localRoots = nil
+	for i := range roots {
+		root := strings.TrimSpace(roots[i])
+		if root == "" {
+			continue
+		}
+		root, err := filepath.Abs(root)
+		if err != nil {
+			return err
+		}
+		// a root on a drive that isn't plugged in is kept as is
+		if real, err := filepath.EvalSymlinks(root); err == nil {
+			root = real
+		}
+		// the same as the paths the browser lists
+		f, err := local.New(root)
+		if err != nil {
+			return err
+		}
+		localRoots = append(localRoots, f.ID())
+	}
+	return nil
+}
+
+// localAllowed returns whether the local path is inside one of the local roots.
+// Links are followed first, so a link can't be used to get out of them
+func localAllowed(dirPath string) bool {
+	real, err := filepath.EvalSymlinks(dirPath)
+	if err != nil {
+		return false
+	}
+	real, err = filepath.Abs(real)
+	if err != nil {
+		return false
+	}
+	for i := range localRoots {
+		rel, err := filepath.Rel(localRoots[i], real)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// localFolders returns the paths of the folders in the local folder
+func localFolders(dirPath string) ([]string, error) {
+	if !localAllowed(dirPath) {
+		return nil, errOutsideRoots
+	}
+
+	f, err := local.New(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !f.Exists() {
+		return nil, errors.New("Path does not exist!")
+	}
+
+	if !f.IsDir() {
+		return nil, errors.New("Path is not a directory!")
+	}
+
+	dirList := []string{}
+	err = f.ChildrenIter(func(children []syncer.Syncer) error {
+		for i := range children {
+			if children[i].IsDir() {
+				dirList = append(dirList, children[i].ID())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dirList, nil
+}
+
 type dirListInput struct {
 	DirPath *string `json:"dirPath"`
 	Client  *client `json:"client"`
@@ -22,11 +121,19 @@ func localRootGet(w http.ResponseWriter, r *http.Request) {
 	if errHandled(err, w) {
 		return
 	}
-	f, err := local.New(usr.HomeDir)
+	start := usr.HomeDir
+	if !localAllowed(start) {
+		if len(localRoots) == 0 {
+			errHandled(errOutsideRoots, w)
+			return
+		}
+		start = localRoots[0]
+	}
+	f, err := local.New(start)
 	if errHandled(err, w) {
 		return
 	}
-	//start browsing at user home dir
+	//start browsing at user home dir, if it can be browsed
 	respondJsend(w, &jsend{
 		Status: statusSuccess,
 		Data:   f.ID(),
@@ -46,34 +153,21 @@ func localGet(w http.ResponseWriter, r *http.Request) {
 		dirPath = *input.DirPath
 	}
 
-	f, err := local.New(dirPath)
-	if errHandled(err, w) {
-		return
-	}
-
-	if !f.Exists() {
-		errHandled(errors.New("Path does not exist!"), w)
-		return
-	}
-
-	if !f.IsDir() {
-		errHandled(errors.New("Path is not a directory!"), w)
-		return
-	}
-
-	children, err := f.Children()
+	dirList, err := localFolders(dirPath)
 	if errHandled(err, w) {
 		return
 	}
-	dirList := make([]string, 0, len(children))
-	for i := range children {
-		if children[i].IsDir() {
-			dirList = append(dirList, children[i].ID())
-		}
-	}
 
 	respondJsend(w, &jsend{
 		Status: statusSuccess,
 		Data:   dirList,
 	})
 }
+
+// localRootsGet lists the folders the local folder browser is limited to
+func localRootsGet(w http.ResponseWriter, r *http.Request) {
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+		Data:   localRoots,
+	})
+}
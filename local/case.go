@@ -0,0 +1,64 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package local
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// CaseMismatch returns the name the file is actually stored under, if the
+// local file system is case insensitive and it's stored under a name that
+// differs from the file's by case.  Returns false if the name matches exactly
+func (f *File) CaseMismatch() (string, bool) {
+	if !f.exists {
+		return "", false
+	}
+
+	base := filepath.Base(f.filepath)
+	swapped := strings.Map(swapCase, base)
+	if swapped == base {
+		return "", false
+	}
+
+	// if the same file can be found with the case swapped, the file system
+	// is case insensitive
+	info, err := os.Stat(filepath.Join(filepath.Dir(f.filepath), swapped))
+	if err != nil || !os.SameFile(info, f.info) {
+		return "", false
+	}
+
+	d, err := os.Open(filepath.Dir(f.filepath))
+	if err != nil {
+		return "", false
+	}
+	defer d.Close()
+
+	names, err := d.Readdirnames(0)
+	if err != nil {
+		return "", false
+	}
+
+	for i := range names {
+		if names[i] == base {
+			return "", false
+		}
+	}
+	for i := range names {
+		if strings.EqualFold(names[i], base) {
+			return names[i], true
+		}
+	}
+	return "", false
+}
+
+func swapCase(r rune) rune {
+	if unicode.IsUpper(r) {
+		return unicode.ToLower(r)
+	}
+	return unicode.ToUpper(r)
+}
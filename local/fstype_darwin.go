@@ -0,0 +1,43 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package local
+
+import (
+	"strings"
+	"syscall"
+)
+
+// names of the network and FUSE filesystems whose events can't be relied on
+var unreliableFS = map[string]bool{
+	"nfs":     true,
+	"smbfs":   true,
+	"afpfs":   true,
+	"webdav":  true,
+	"cifs":    true,
+	"osxfuse": true,
+	"macfuse": true,
+	"fusefs":  true,
+}
+
+// unreliableEvents is whether or not the folder is on a filesystem which
+// doesn't send change events, or only sends them for changes made from this
+// machine
+func unreliableEvents(path string) bool {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return false
+	}
+
+	var name strings.Builder
+	for _, c := range stat.Fstypename {
+		if c == 0 {
+			break
+		}
+		name.WriteByte(byte(c))
+	}
+	fsType := name.String()
+	return unreliableFS[fsType] || strings.HasPrefix(fsType, "osxfuse") || strings.HasPrefix(fsType, "macfuse")
+}
@@ -0,0 +1,33 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package local
+
+import "syscall"
+
+// magic numbers of the network and FUSE filesystems whose events can't be
+// relied on, from statfs(2)
+var unreliableFS = map[uint32]bool{
+	0x6969:     true, // NFS
+	0x517B:     true, // SMB
+	0xFF534D42: true, // CIFS
+	0xFE534D42: true, // SMB2
+	0x65735546: true, // FUSE
+	0x01021997: true, // 9P
+	0x5346414F: true, // AFS
+	0x73757245: true, // Coda
+	0x564C:     true, // NCP
+}
+
+// unreliableEvents is whether or not the folder is on a filesystem which
+// doesn't send change events, or only sends them for changes made from this
+// machine
+func unreliableEvents(path string) bool {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return false
+	}
+	return unreliableFS[uint32(stat.Type)]
+}
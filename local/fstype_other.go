@@ -0,0 +1,14 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package local
+
+// unreliableEvents is whether or not the folder is on a filesystem whose change
+// events can't be relied on, which isn't known on this platform
+func unreliableEvents(path string) bool {
+	return false
+}
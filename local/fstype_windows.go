@@ -0,0 +1,26 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package local
+
+import (
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+const driveRemote = 4 // DRIVE_REMOTE
+
+var getDriveType = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDriveTypeW")
+
+// unreliableEvents is whether or not the folder is on a network drive, whose
+// change notifications can't be relied on
+func unreliableEvents(path string) bool {
+	root, err := syscall.UTF16PtrFromString(filepath.VolumeName(path) + `\`)
+	if err != nil {
+		return false
+	}
+	driveType, _, _ := getDriveType.Call(uintptr(unsafe.Pointer(root)))
+	return driveType == driveRemote
+}
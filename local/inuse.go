@@ -0,0 +1,23 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package local
+
+import "time"
+
+// inUseRetries is how many more times opening or replacing a file another
+// process has open is tried before giving up, leaving the change to the
+// retry queue
+const inUseRetries = 5
+
+// retryInUse runs fn, and while it fails because another process has the file
+// open, waits for QuietPeriod and runs it again
+func retryInUse(fn func() error) error {
+	err := fn()
+	for i := 0; i < inUseRetries && isInUse(err); i++ {
+		time.Sleep(QuietPeriod)
+		err = fn()
+	}
+	return err
+}
@@ -12,6 +12,7 @@ import (
 	"strings"
 	"time"
 
+	"bitbucket.org/tshannon/freehold-sync/delta"
 	"bitbucket.org/tshannon/freehold-sync/syncer"
 )
 
@@ -22,32 +23,50 @@ type File struct {
 	info     os.FileInfo
 	exists   bool
 	deleted  bool
+	link     bool // file is a symbolic link, info is of its target
+
+	expectHash string // hash the next write must match, see ExpectHash
 }
 
 // New Returns a File from the local machine for use in syncing
 func New(filePath string) (*File, error) {
+	filePath = cleanPath(filePath)
 	f := &File{
 		filepath: filePath,
 		exists:   true,
 	}
 
 	info, err := os.Stat(filePath)
+	if err != nil && hasUnicode(filePath) {
+		// may exist under a differently normalized name
+		if found, ok := findNormalized(filePath); ok {
+			f.filepath = found
+			info, err = os.Stat(found)
+		}
+	}
 	if err != nil {
 		f.exists = false
 	} else {
 		f.info = info
 	}
 
+	if linfo, err := os.Lstat(f.filepath); err == nil && linfo.Mode()&os.ModeSymlink != 0 {
+		f.link = true
+	}
+
 	return f, nil
 }
 
 func (f *File) refresh() error {
 	//additional changes may have happened since
 	//this file was queued for changes, refresh file info
-	f, err := New(f.filepath)
+	n, err := New(f.filepath)
 	if err != nil {
 		return err
 	}
+	f.info = n.info
+	f.exists = n.exists
+	f.link = n.link
 	return nil
 }
 
@@ -58,7 +77,7 @@ func (f *File) ID() string {
 
 // Modified is the date the file was last modified
 func (f *File) Modified() time.Time {
-	if !f.IsDir() {
+	if !f.IsDir() && f.exists {
 		//Rounded to the nearest second, because remote
 		// is rounded to the nearest second
 		return f.info.ModTime().Round(time.Second)
@@ -70,39 +89,89 @@ func (f *File) Modified() time.Time {
 // Children returns the child files for this given File, will only return
 // records if the file is a Dir
 func (f *File) Children() ([]*File, error) {
-	err := f.refresh()
+	var children []*File
+	err := f.eachChildPage(func(page []*File) error {
+		children = append(children, page...)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	if !f.IsDir() {
-		return nil, nil
-	}
+	return children, nil
+}
 
-	file, err := os.Open(f.ID())
-	defer file.Close()
+// ChildrenIter calls fn with each page of the child files of the directory, see
+// syncer.ChildIterator
+func (f *File) ChildrenIter(fn func(page []syncer.Syncer) error) error {
+	return f.eachChildPage(func(page []*File) error {
+		list := make([]syncer.Syncer, len(page))
+		for i := range page {
+			list[i] = page[i]
+		}
+		return fn(list)
+	})
+}
 
+// eachChildPage reads the directory syncer.ChildPageSize names at a time, and
+// calls fn with the child files of each batch
+func (f *File) eachChildPage(fn func(page []*File) error) error {
+	err := f.refresh()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if !f.IsDir() {
+		return nil
 	}
 
-	childNames, err := file.Readdirnames(0)
+	file, err := os.Open(f.ID())
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer file.Close()
 
-	children := make([]*File, 0, len(childNames))
-
-	for i := range childNames {
-		n, err := New(filepath.Join(f.ID(), childNames[i]))
+	for {
+		childNames, err := file.Readdirnames(syncer.ChildPageSize)
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
-			return nil, err
+			return err
+		}
+
+		children := make([]*File, 0, len(childNames))
+		for i := range childNames {
+			if isStaged(childNames[i]) {
+				continue
+			}
+			n, err := New(filepath.Join(f.ID(), childNames[i]))
+			if err != nil {
+				return err
+			}
+			if n.Exists() {
+				children = append(children, n)
+			}
 		}
-		if n.Exists() {
-			children = append(children, n)
+
+		if len(children) > 0 {
+			err = fn(children)
+			if err != nil {
+				return err
+			}
 		}
 	}
+}
 
-	return children, nil
+// List returns the children of the directory as Syncers
+func (f *File) List() ([]syncer.Syncer, error) {
+	children, err := f.Children()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]syncer.Syncer, len(children))
+	for i := range children {
+		list[i] = children[i]
+	}
+	return list, nil
 }
 
 // Open returns a readcloser for reading from the file
@@ -115,7 +184,10 @@ func (f *File) Open() (io.ReadCloser, error) {
 	if !f.exists {
 		return nil, os.ErrNotExist
 	}
-	file, err = os.Open(f.ID())
+	err = retryInUse(func() error {
+		file, err = os.Open(f.ID())
+		return err
+	})
 
 	if err != nil {
 		return nil, err
@@ -125,7 +197,8 @@ func (f *File) Open() (io.ReadCloser, error) {
 
 // Write writes from the reader to the Syncer
 func (f *File) Write(r io.ReadCloser, size int64, modTime time.Time) error {
-	var wf *os.File
+	defer r.Close()
+
 	err := f.refresh()
 	if err != nil {
 		return err
@@ -135,29 +208,144 @@ func (f *File) Write(r io.ReadCloser, size int64, modTime time.Time) error {
 	ignore.add(f.ID())
 	defer ignore.remove(f.ID())
 
-	if f.exists {
-		wf, err = os.Open(f.ID())
-	} else {
-		wf, err = os.Create(f.ID())
-	}
+	// write to a staging file, so an interrupted download never leaves
+	// behind a truncated file that looks like a real change
+	tmpName := f.tmpName()
+	ignore.add(tmpName)
+	defer ignore.remove(tmpName)
+
+	wf, err := os.Create(tmpName)
 	if err != nil {
 		return err
 	}
 
 	written, err := io.Copy(wf, r)
 	if err != nil {
+		wf.Close()
+		os.Remove(tmpName)
 		return err
 	}
+
+	err = wf.Close()
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
 	if written != size {
+		os.Remove(tmpName)
+		return io.ErrShortWrite
+	}
+
+	err = f.checkStaged(tmpName)
+	if err != nil {
+		return err
+	}
+
+	err = f.keepMode(tmpName)
+	if err != nil {
+		return err
+	}
+
+	err = os.Chtimes(tmpName, time.Now(), modTime)
+	if err != nil {
+		return err
+	}
+
+	// the file being replaced may be open in another process
+	err = retryInUse(func() error {
+		return os.Rename(tmpName, f.target())
+	})
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return f.refresh()
+}
+
+// Signature returns the block signature of the current file for delta writes
+func (f *File) Signature() (*delta.Signature, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return delta.NewSignature(r, delta.DefaultBlockSize)
+}
+
+// WriteDelta rebuilds the file from the current file and the passed in
+// delta operations.  The new file is built next to the current one, and
+// is only moved into place once it is complete
+func (f *File) WriteDelta(ops []delta.Op, size int64, modTime time.Time) error {
+	err := f.refresh()
+	if err != nil {
+		return err
+	}
+
+	//ignore fsnotify events for this change
+	ignore.add(f.ID())
+	defer ignore.remove(f.ID())
+
+	old, err := os.Open(f.ID())
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+
+	tmpName := f.tmpName()
+	ignore.add(tmpName)
+	defer ignore.remove(tmpName)
+
+	tmp, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+
+	err = delta.Patch(old, delta.DefaultBlockSize, ops, tmp)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	info, err := os.Stat(tmpName)
+	if err != nil {
+		return err
+	}
+	if info.Size() != size {
+		os.Remove(tmpName)
 		return io.ErrShortWrite
 	}
 
-	err = os.Chtimes(f.filepath, time.Now(), modTime)
+	err = f.checkStaged(tmpName)
+	if err != nil {
+		return err
+	}
+
+	err = f.keepMode(tmpName)
+	if err != nil {
+		return err
+	}
+
+	err = os.Chtimes(tmpName, time.Now(), modTime)
 	if err != nil {
 		return err
 	}
 
-	return r.Close()
+	err = os.Rename(tmpName, f.target())
+	if err != nil {
+		return err
+	}
+
+	return f.refresh()
 }
 
 // IsDir is whether or not the file is a directory
@@ -194,12 +382,14 @@ func (f *File) Delete() error {
 		}
 	}
 
-	return os.RemoveAll(f.filepath)
+	return retryInUse(func() error {
+		return os.RemoveAll(f.filepath)
+	})
 }
 
 // Rename renames the file based on the filename and the time
 // the rename function is called
-func (f *File) Rename() error {
+func (f *File) Rename(p *syncer.Profile) error {
 	err := f.refresh()
 	if err != nil {
 		return err
@@ -211,12 +401,60 @@ func (f *File) Rename() error {
 	ignore.add(f.ID())
 	defer ignore.remove(f.ID())
 
-	ext := filepath.Ext(f.filepath)
-	newName := strings.TrimSuffix(f.filepath, ext)
+	dir := filepath.Dir(f.filepath)
+	newName, err := p.ConflictName(filepath.Base(f.filepath), func(name string) (bool, error) {
+		_, err := os.Lstat(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = retryInUse(func() error {
+		return os.Rename(f.filepath, filepath.Join(dir, newName))
+	})
+	if err != nil {
+		return err
+	}
+	// the original name is now free for the conflicting file to be written to
+	return f.refresh()
+}
+
+// Move moves the file to the location of the passed in, non-existent file
+func (f *File) Move(to syncer.Syncer) error {
+	dest, ok := to.(*File)
+	if !ok {
+		return errors.New("Can't move a local file to a non-local location")
+	}
+	err := dest.refresh()
+	if err != nil {
+		return err
+	}
+	if dest.exists {
+		return errors.New("Can't move file, destination already exists")
+	}
 
-	newName += time.Now().Format(time.Stamp) + ext
+	//ignore fsnotify events for this change
+	ignore.add(f.ID())
+	defer ignore.remove(f.ID())
+	ignore.add(dest.ID())
+	defer ignore.remove(dest.ID())
 
-	return os.Rename(f.filepath, newName)
+	err = retryInUse(func() error {
+		return os.Rename(f.filepath, dest.filepath)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = f.refresh()
+	if err != nil {
+		return err
+	}
+	return dest.refresh()
 }
 
 // Size returns the size of the file
@@ -227,6 +465,21 @@ func (f *File) Size() int64 {
 	return f.info.Size()
 }
 
+// Hash returns the SHA-256 hash of the file's content
+func (f *File) Hash() (string, error) {
+	if f.IsDir() {
+		return "", errors.New("Can't hash a directory")
+	}
+	return syncer.CachedHash(f, func() (string, error) {
+		file, err := os.Open(f.ID())
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		return syncer.HashReader(file)
+	})
+}
+
 // Deleted - If the file doesn't exist was it deleted
 func (f *File) Deleted() bool {
 	return f.deleted
@@ -265,7 +518,8 @@ func (f *File) Path(p *syncer.Profile) string {
 	if f.ID() == p.Local.ID() {
 		return f.filepath
 	}
-	return strings.TrimPrefix(f.filepath, p.Local.Path(p))
+	rel := strings.TrimPrefix(f.filepath, p.Local.Path(p))
+	return syncer.NormalizeName(filepath.FromSlash(mapPath(rel, decodeName)))
 }
 
 // StartMonitor starts Monitoring this syncer for changes (Dir's only), calls profile.Sync method on all changes, and initial startup
@@ -283,19 +537,27 @@ func (f *File) StartMonitor(p *syncer.Profile) error {
 		return nil
 	}
 
-	// Start watching, and sync all children of this folder
-	children, err := f.Children()
-	if err != nil {
-		return err
+	if f.ID() == p.Local.ID() {
+		volumes.add(p.ID(), f.ID())
 	}
 
+	// Start watching, and sync all children of this folder a page at a
+	// time, so huge folders aren't held in memory all at once
 	// Trigger initial change event to make sure all
 	// child folders are monitored recursively and all
-	// files are in sync
-	for i := range children {
-		go func(child *File) {
-			queueChange(child)
-		}(children[i])
+	// files are in sync.  Files which haven't changed since they were last
+	// synced are skipped, so restarting doesn't compare every file again
+	err = f.eachChildPage(func(children []*File) error {
+		for i := range children {
+			if p.Excluded(children[i]) || p.Unchanged(children[i]) {
+				continue
+			}
+			queueChange(children[i])
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	return watching.add(p, f)
@@ -308,35 +570,37 @@ func (f *File) StopMonitor(p *syncer.Profile) error {
 
 func (f *File) stopWatcherRecursive(p *syncer.Profile) error {
 	// Recursively stop watching all children dirs
-	children, err := f.Children()
-	if err != nil {
-		return err
-	}
-
-	for i := range children {
-		if children[i].IsDir() {
-			err = children[i].stopWatcherRecursive(p)
-			if err != nil {
-				return err
+	err := f.eachChildPage(func(children []*File) error {
+		for i := range children {
+			if children[i].IsDir() {
+				err := children[i].stopWatcherRecursive(p)
+				if err != nil {
+					return err
+				}
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 	return watching.remove(p, f)
 }
 
 // waitInUse will try to determine if the file is currently being
 // written to, and will wait until it appears to free
-// For Linux, there is no file locks, so to prevent copying incomplete files
+// Most programs don't lock files they write to, so to prevent copying incomplete files
 // we use use this mechanism to try to make sure the entire
-// file is available before we try to copy it
+// file is available before we try to copy it.  Files which are locked are
+// checked for separately, see locked
 func (f *File) waitInUse() {
 	if !f.exists || f.info == nil {
 		return
 	}
 
 	for {
-		// wait 3 seconds and see if the size or modified date has changed
-		time.Sleep(3 * time.Second)
+		// wait and see if the size or modified date has changed
+		time.Sleep(QuietPeriod)
 		current, err := os.Stat(f.ID())
 		if err != nil {
 			//if file was deleted, or some other error happens
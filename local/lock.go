@@ -0,0 +1,70 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package local
+
+import (
+	"sync"
+	"time"
+)
+
+// LockedWait is how long the sync of a file another program has locked is put
+// off before it's checked again
+var LockedWait = time.Minute
+
+var locked lockedFiles // files whose sync is put off because they're locked
+
+func init() {
+	locked = lockedFiles{
+		files: make(map[string]struct{}),
+	}
+}
+
+type lockedFiles struct {
+	sync.Mutex
+	files map[string]struct{}
+}
+
+// add returns true if the file wasn't already known to be locked
+func (l *lockedFiles) add(filePath string) bool {
+	l.Lock()
+	defer l.Unlock()
+	if _, ok := l.files[filePath]; ok {
+		return false
+	}
+	l.files[filePath] = struct{}{}
+	return true
+}
+
+func (l *lockedFiles) remove(filePath string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.files, filePath)
+}
+
+// locked is whether or not another program holds a lock on the file for
+// writing to it, such as a database which is open
+func (f *File) locked() bool {
+	if !f.exists || f.IsDir() {
+		return false
+	}
+	return isLocked(f.ID())
+}
+
+// deferChange puts off syncing the locked file for LockedWait, so it isn't
+// synced part way through being written
+func deferChange(f *File) {
+	if locked.add(f.ID()) {
+		logger.Infof("%s is locked by another program, syncing it is put off until it's released",
+			f.ID())
+	}
+
+	changes.Lock()
+	defer changes.Unlock()
+	if _, ok := changes.files[f.ID()]; ok {
+		// already changed again since
+		return
+	}
+	sendAfter(f.ID(), LockedWait)
+}
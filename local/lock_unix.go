@@ -0,0 +1,44 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package local
+
+import (
+	"os"
+	"syscall"
+)
+
+// isLocked is whether or not another process holds a write lock on the file,
+// either a POSIX record lock (as databases like SQLite use) or an exclusive
+// flock.  Only shared locks are tried, so a reader is never kept out
+func isLocked(filePath string) bool {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	lock := &syscall.Flock_t{
+		Type:   syscall.F_RDLCK,
+		Whence: 0,
+		Start:  0,
+		Len:    0, // the whole file
+	}
+	err = syscall.FcntlFlock(file.Fd(), syscall.F_GETLK, lock)
+	if err == nil && lock.Type != syscall.F_UNLCK {
+		return true
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return true
+	}
+	if err == nil {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	}
+	return false
+}
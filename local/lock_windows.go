@@ -0,0 +1,23 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package local
+
+import "syscall"
+
+// isLocked is whether or not another process has the file open for writing,
+// which is found by opening it without letting anyone else write to it
+func isLocked(filePath string) bool {
+	name, err := syscall.UTF16PtrFromString(longPath(filePath))
+	if err != nil {
+		return false
+	}
+	handle, err := syscall.CreateFile(name, syscall.GENERIC_READ, syscall.FILE_SHARE_READ, nil,
+		syscall.OPEN_EXISTING, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return isInUse(err)
+	}
+	syscall.CloseHandle(handle)
+	return false
+}
@@ -0,0 +1,46 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package local
+
+import (
+	"os"
+	"runtime"
+
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// Mode returns the POSIX permission bits of the file.  Windows doesn't have
+// them, so 0 is returned there
+func (f *File) Mode(p *syncer.Profile) (os.FileMode, error) {
+	if runtime.GOOS == "windows" || !f.exists {
+		return 0, nil
+	}
+	return f.info.Mode().Perm(), nil
+}
+
+// SetMode sets the POSIX permission bits of the file, 0 leaves them as is
+func (f *File) SetMode(p *syncer.Profile, mode os.FileMode) error {
+	if runtime.GOOS == "windows" || mode == 0 {
+		return nil
+	}
+
+	ignore.add(f.ID())
+	defer ignore.remove(f.ID())
+
+	err := os.Chmod(f.target(), mode.Perm())
+	if err != nil {
+		return err
+	}
+	return f.refresh()
+}
+
+// keepMode gives the staged file the same permissions as the file it's
+// replacing, which would otherwise be lost when it's moved into place
+func (f *File) keepMode(staged string) error {
+	if !f.exists || f.info == nil {
+		return nil
+	}
+	return os.Chmod(staged, f.info.Mode().Perm())
+}
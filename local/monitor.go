@@ -5,8 +5,10 @@
 package local
 
 import (
+	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"bitbucket.org/tshannon/freehold-sync/log"
 	"bitbucket.org/tshannon/freehold-sync/syncer"
@@ -16,12 +18,19 @@ import (
 // LogType is the log type for local syncing
 const LogType = "local"
 
+var logger = log.Module(LogType)
+
+// QuietPeriod is how long a file must go without another change event
+// before it is synced
+var QuietPeriod = 3 * time.Second
+
 var (
 	watcher       *fsnotify.Watcher
 	changeHandler ChangeHandler
+	scanOnly      bool         // folders are scanned once, but not watched, see StartScanner
 	watching      profileFiles // folders being watched for changes
 	ignore        ignoreFiles  //File changes to ignore because they are from this process
-	changes       changeMap    //queued up changes to a given file, makes sure excessive calls to sync don't happen
+	changes       changeMap    //debounced changes to a given file, makes sure excessive calls to sync don't happen
 )
 
 func init() {
@@ -30,9 +39,10 @@ func init() {
 	}
 	ignore = ignoreFiles{
 		files: make(map[string]struct{}),
+		done:  make(map[string]*ownChange),
 	}
 	changes = changeMap{
-		files: make(map[string]struct{}),
+		files: make(map[string]*time.Timer),
 	}
 }
 
@@ -64,7 +74,26 @@ func (p *profileFiles) add(profile *syncer.Profile, file *File) error {
 	p.Lock()
 	defer p.Unlock()
 
-	err := watcher.Add(file.ID())
+	var err error
+	switch {
+	case scanOnly:
+		// scanned once by StartMonitor, nothing keeps watching it
+	case profile.LocalMonitor == syncer.LocalMonitorScan ||
+		(profile.LocalMonitor == syncer.LocalMonitorAuto && unreliableEvents(file.ID())):
+		err = scanned.add(profile, file.ID(), false)
+	case streams.covers(file.ID()):
+		// already watched by the recursive stream of a parent folder
+	default:
+		var started bool
+		started, err = streams.start(file.ID())
+		if err == nil && !started {
+			err = watcher.Add(longPath(file.ID()))
+			if isWatchLimit(err) {
+				// out of watches, scan the folder for changes instead of missing them
+				err = scanned.add(profile, file.ID(), true)
+			}
+		}
+	}
 	if err != nil {
 		return err
 	}
@@ -111,7 +140,7 @@ func (p *profileFiles) remove(profile *syncer.Profile, file *File) error {
 
 		if profile == nil {
 			delete(p.files, file.ID())
-			return watcher.Remove(file.ID())
+			return unwatch(file.ID())
 		}
 
 		for i := range profiles {
@@ -123,7 +152,7 @@ func (p *profileFiles) remove(profile *syncer.Profile, file *File) error {
 		}
 		if len(profiles) == 0 {
 			delete(p.files, file.ID())
-			return watcher.Remove(file.ID())
+			return unwatch(file.ID())
 		}
 	}
 	p.RUnlock()
@@ -131,9 +160,38 @@ func (p *profileFiles) remove(profile *syncer.Profile, file *File) error {
 	return nil
 }
 
+// unwatch stops watching or scanning the folder
+func unwatch(folder string) error {
+	if scanOnly {
+		return nil
+	}
+	if scanned.has(folder) {
+		scanned.remove(folder)
+		return nil
+	}
+	if streams.remove(folder) {
+		return nil
+	}
+	return watcher.Remove(longPath(folder))
+}
+
+// echoWindow is how long after this process changes a file that events
+// matching the change are still treated as echoes of it
+const echoWindow = time.Minute
+
 type ignoreFiles struct {
 	sync.RWMutex
-	files map[string]struct{}
+	files map[string]struct{}   // changes in progress
+	done  map[string]*ownChange // finished changes, and the state they left the file in
+}
+
+// ownChange is the state a file was left in by a change from this process.
+// Events which still find the file in that state were caused by the change
+type ownChange struct {
+	exists   bool
+	modified time.Time
+	size     int64
+	expires  time.Time
 }
 
 func (i *ignoreFiles) add(file string) {
@@ -142,18 +200,68 @@ func (i *ignoreFiles) add(file string) {
 	i.files[file] = struct{}{}
 }
 
+// remove marks the change to the file as finished, recording the state
+// it left the file in, so late events caused by the change are still ignored
 func (i *ignoreFiles) remove(file string) {
+	change := &ownChange{
+		expires: time.Now().Add(echoWindow),
+	}
+	info, err := os.Stat(file)
+	if err == nil {
+		change.exists = true
+		change.modified = info.ModTime()
+		change.size = info.Size()
+	}
+
 	i.Lock()
 	defer i.Unlock()
 	delete(i.files, file)
+
+	now := time.Now()
+	for k, v := range i.done {
+		if now.After(v.expires) {
+			delete(i.done, k)
+		}
+	}
+	i.done[file] = change
 }
 
-func (i *ignoreFiles) has(file string) bool {
+// has returns whether the event on the file was caused by this process, either
+// because the change is still in progress, or because the file is still in the
+// state the change left it in
+func (i *ignoreFiles) has(f *File) bool {
 	i.RLock()
 	defer i.RUnlock()
-	_, ok := i.files[file]
+	if _, ok := i.files[f.ID()]; ok {
+		return true
+	}
 
-	return ok
+	change, ok := i.done[f.ID()]
+	if !ok || time.Now().After(change.expires) {
+		return !f.exists && i.parentRemoved(f.ID())
+	}
+	if change.exists != f.exists {
+		return false
+	}
+	if !f.exists {
+		return true
+	}
+	return change.modified.Equal(f.info.ModTime()) && change.size == f.info.Size()
+}
+
+// parentRemoved returns whether one of the file's parent folders was just
+// removed or moved by this process, taking the file with it
+func (i *ignoreFiles) parentRemoved(file string) bool {
+	now := time.Now()
+	for dir := filepath.Dir(file); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if _, ok := i.files[dir]; ok {
+			return true
+		}
+		if change, ok := i.done[dir]; ok && !change.exists && now.Before(change.expires) {
+			return true
+		}
+	}
+	return false
 }
 
 // ChangeHandler is the function called when a change occurs in a monitored folder
@@ -168,24 +276,19 @@ func StartWatcher(handler ChangeHandler) error {
 	go func() {
 		for {
 			select {
-			case event := <-watcher.Events:
-				file, err := New(event.Name)
-				if err != nil {
-					log.New(err.Error(), LogType)
-					continue
+			case event, ok := <-watcher.Events:
+				if !ok {
+					// watcher stopped
+					return
 				}
-				if ignore.has(file.ID()) {
-					continue
-				}
-				if event.Op == fsnotify.Rename || event.Op == fsnotify.Remove {
-					file.deleted = true
-				}
-
-				queueChange(file)
+				handleEvent(event.Name)
 
-			case err := <-watcher.Errors:
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
 				if err != nil {
-					log.New(err.Error(), LogType)
+					logger.Errorf("%s", err)
 				}
 			}
 		}
@@ -193,8 +296,33 @@ func StartWatcher(handler ChangeHandler) error {
 	return err
 }
 
+// handleEvent queues a change for the file an event came in for, unless the
+// event was caused by this process
+func handleEvent(filePath string) {
+	file, err := New(filePath)
+	if err != nil {
+		logger.Errorf("%s", err)
+		return
+	}
+	if ignore.has(file) || isStaged(file.ID()) {
+		return
+	}
+	queueChange(file)
+}
+
+// StartScanner sends the changes found when folders are first monitored to
+// the handler, like StartWatcher, but doesn't watch the folders for changes
+// after, for syncing once
+func StartScanner(handler ChangeHandler) {
+	changeHandler = handler
+	scanOnly = true
+}
+
 // StopWatcher stops the local file system monitoring
 func StopWatcher() error {
+	if scanOnly {
+		return nil
+	}
 	watching.RLock()
 	defer watching.RUnlock()
 	if len(watching.files) > 0 {
@@ -204,53 +332,91 @@ func StopWatcher() error {
 	return nil
 }
 
-type changeMap struct {
-	sync.RWMutex
-	files map[string]struct{}
+// StopChanges stops sending the changes still waiting out their quiet period,
+// and returns them by the profiles they're in, so they can be kept when
+// freehold-sync stops
+func StopChanges() map[*syncer.Profile][]*File {
+	changes.Lock()
+	paths := make([]string, 0, len(changes.files))
+	for filePath, timer := range changes.files {
+		timer.Stop()
+		paths = append(paths, filePath)
+	}
+	changes.files = make(map[string]*time.Timer)
+	changes.Unlock()
+
+	stopped := make(map[*syncer.Profile][]*File)
+	for _, filePath := range paths {
+		f, err := New(filePath)
+		if err != nil {
+			logger.Errorf("%s", err)
+			continue
+		}
+		f.deleted = !f.exists
+		for _, p := range watching.profiles(f) {
+			if p.Excluded(f) {
+				continue
+			}
+			stopped[p] = append(stopped[p], f)
+		}
+	}
+	return stopped
 }
 
-func (c *changeMap) add(f *File) {
-	c.Lock()
-	defer c.Unlock()
-	c.files[f.ID()] = struct{}{}
+type changeMap struct {
+	sync.Mutex
+	files map[string]*time.Timer
 }
 
-func (c *changeMap) remove(f *File) {
-	c.Lock()
-	defer c.Unlock()
-	delete(c.files, f.ID())
-}
+// queueChange debounces a change, the change handlers are only called once the
+// file has gone QuietPeriod without another event.  Bursts of events for the same
+// file, such as from editors and build tools, are grouped into one change
+func queueChange(f *File) {
+	changes.Lock()
+	defer changes.Unlock()
 
-func (c *changeMap) has(f *File) bool {
-	c.RLock()
-	defer c.RUnlock()
-	_, ok := c.files[f.ID()]
-	return ok
+	if timer, ok := changes.files[f.ID()]; ok {
+		timer.Reset(QuietPeriod)
+		return
+	}
+	sendAfter(f.ID(), QuietPeriod)
 }
 
-// queueChange queues up a change and waits for the file to stop
-// changing to before sending the changeHandler signal
-// Subsequent queued events for the same file will group together
-// into one change event until the change handler is called
-func queueChange(f *File) {
-	if !changes.has(f) {
-		changes.add(f)
-		defer changes.remove(f)
-		f.waitInUse() // wait for the file to stop changing
+// sendAfter sends the change to the file once the wait is over, changes must
+// be locked
+func sendAfter(filePath string, wait time.Duration) {
+	changes.files[filePath] = time.AfterFunc(wait, func() {
+		changes.Lock()
+		delete(changes.files, filePath)
+		changes.Unlock()
+		sendChange(filePath)
+	})
+}
 
-		profiles := watching.profiles(f)
-		for i := range profiles {
-			changeHandler(profiles[i], f)
+// sendChange calls the change handlers for the current state of the file
+func sendChange(filePath string) {
+	f, err := New(filePath)
+	if err != nil {
+		logger.Errorf("%s", err)
+		return
+	}
+	// the file existed when the first event came in
+	f.deleted = !f.exists
+	f.waitInUse() // wait for the file to stop changing
+	if f.locked() {
+		deferChange(f)
+		return
+	}
+	locked.remove(filePath)
 
-			if f.deleted {
-				f.StopMonitor(profiles[i])
-			}
+	profiles := watching.profiles(f)
+	for i := range profiles {
+		if profiles[i].Excluded(f) {
+			continue
 		}
-	} else if f.Deleted() {
-		//call immediatly
-		profiles := watching.profiles(f)
-		for i := range profiles {
-			changeHandler(profiles[i], f)
+		changeHandler(profiles[i], f)
+
+		if f.deleted {
 			f.StopMonitor(profiles[i])
 		}
 	}
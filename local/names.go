@@ -0,0 +1,97 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package local
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// invalidChars are the characters which can't be used in local file names,
+// but can be in remote ones.  Each is stored locally as its full width
+// equivalent, which looks the same but is allowed, and is translated back
+// when the file is synced to the remote side
+var invalidChars = ""
+
+func init() {
+	if runtime.GOOS == "windows" {
+		invalidChars = `<>:"\|?*`
+	}
+}
+
+// fullWidth is the offset between ASCII punctuation and the full width forms block
+const fullWidth = 0xFF00 - 0x20
+
+// ideographicSpace stands in for a trailing space.  The full width forms block
+// starts at ! so it has no space of its own
+const ideographicSpace = '\u3000'
+
+// trailingChars maps the characters windows drops from the end of names to
+// the ones they're stored as
+var trailingChars = map[rune]rune{
+	'.': '.' + fullWidth,
+	' ': ideographicSpace,
+}
+
+// encodeName returns the name a remote file is stored under locally
+func encodeName(name string) string {
+	if invalidChars == "" {
+		return name
+	}
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(invalidChars, r) {
+			return r + fullWidth
+		}
+		return r
+	}, name)
+
+	// windows drops trailing dots and spaces
+	trimmed := strings.TrimRight(name, ". ")
+	for _, r := range name[len(trimmed):] {
+		trimmed += string(trailingChars[r])
+	}
+	return trimmed
+}
+
+// decodeName returns the remote name of a file stored locally, the
+// reverse of encodeName
+func decodeName(name string) string {
+	if invalidChars == "" {
+		return name
+	}
+	name = strings.Map(func(r rune) rune {
+		if r > fullWidth && strings.ContainsRune(invalidChars, r-fullWidth) {
+			return r - fullWidth
+		}
+		return r
+	}, name)
+
+	trimmed := strings.TrimRight(name, string([]rune{trailingChars['.'], trailingChars[' ']}))
+	for _, r := range name[len(trimmed):] {
+		for from, to := range trailingChars {
+			if r == to {
+				trimmed += string(from)
+			}
+		}
+	}
+	return trimmed
+}
+
+// mapPath applies the name mapping to each element of the slash separated path
+func mapPath(relPath string, mapName func(string) string) string {
+	names := strings.Split(filepath.ToSlash(relPath), "/")
+	for i := range names {
+		names[i] = mapName(names[i])
+	}
+	return strings.Join(names, "/")
+}
+
+// Join returns the local path of the file at the slash separated path
+// relative to root, which is what the file is called on the remote side.
+// Names which aren't valid locally are mapped to ones that are
+func Join(root, relPath string) string {
+	return filepath.Join(root, filepath.FromSlash(mapPath(relPath, encodeName)))
+}
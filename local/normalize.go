@@ -0,0 +1,56 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package local
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// hasUnicode returns whether the path contains any non ASCII characters, which
+// could be normalized differently
+func hasUnicode(filePath string) bool {
+	return strings.IndexFunc(filePath, func(r rune) bool { return r > unicode.MaxASCII }) >= 0
+}
+
+// findNormalized looks for an existing file whose path only differs from
+// filePath by its Unicode normalization, such as a decomposed name created on
+// Mac OS when the path was built from the composed name on the remote side
+func findNormalized(filePath string) (string, bool) {
+	dir, base := filepath.Dir(filePath), filepath.Base(filePath)
+	if dir == filePath {
+		return "", false
+	}
+
+	if _, err := os.Stat(dir); err != nil {
+		var ok bool
+		dir, ok = findNormalized(dir)
+		if !ok {
+			return "", false
+		}
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return "", false
+	}
+	defer d.Close()
+
+	names, err := d.Readdirnames(0)
+	if err != nil {
+		return "", false
+	}
+
+	for i := range names {
+		if syncer.SameName(names[i], base) {
+			return filepath.Join(dir, names[i]), true
+		}
+	}
+	return "", false
+}
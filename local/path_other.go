@@ -0,0 +1,30 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package local
+
+// cleanPath puts a local path in the form used for file IDs, which it is
+// already in outside of Windows
+func cleanPath(filePath string) string {
+	return filePath
+}
+
+// longPath is only needed on Windows
+func longPath(filePath string) string {
+	return filePath
+}
+
+// shortPath is only needed on Windows
+func shortPath(filePath string) string {
+	return filePath
+}
+
+// isInUse is whether or not the error is from another process holding a lock
+// on the file, which only stops it from being opened on Windows
+func isInUse(err error) bool {
+	return false
+}
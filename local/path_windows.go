@@ -0,0 +1,62 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package local
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	errorSharingViolation syscall.Errno = 32 // ERROR_SHARING_VIOLATION
+	errorLockViolation    syscall.Errno = 33 // ERROR_LOCK_VIOLATION
+
+	// maxPath is the longest path Windows APIs accept without the \\?\ prefix,
+	// leaving room for the 8.3 file name CreateDirectory needs
+	maxPath = 248
+)
+
+// cleanPath puts a local path in the form used for file IDs, with backslashes
+// and an upper case drive letter, so the same folder always has the same ID
+func cleanPath(filePath string) string {
+	if filePath == "" {
+		return filePath
+	}
+	filePath = filepath.Clean(shortPath(filePath))
+	if len(filePath) >= 2 && filePath[1] == ':' {
+		filePath = strings.ToUpper(filePath[:1]) + filePath[1:]
+	}
+	return filePath
+}
+
+// longPath adds the \\?\ prefix to long absolute paths passed straight to the
+// Windows API, which otherwise fails on paths longer than MAX_PATH.  The os
+// package already does this for its own calls
+func longPath(filePath string) string {
+	if len(filePath) < maxPath || !filepath.IsAbs(filePath) || strings.HasPrefix(filePath, `\\?\`) {
+		return filePath
+	}
+	if strings.HasPrefix(filePath, `\\`) {
+		// UNC path, \\server\share
+		return `\\?\UNC\` + filePath[2:]
+	}
+	return `\\?\` + filePath
+}
+
+// shortPath removes the \\?\ prefix added by longPath
+func shortPath(filePath string) string {
+	if strings.HasPrefix(filePath, `\\?\UNC\`) {
+		return `\\` + filePath[len(`\\?\UNC\`):]
+	}
+	return strings.TrimPrefix(filePath, `\\?\`)
+}
+
+// isInUse is whether or not the error is from another process having the file
+// open in a way that doesn't let it be shared
+func isInUse(err error) bool {
+	return errors.Is(err, errorSharingViolation) || errors.Is(err, errorLockViolation)
+}
@@ -0,0 +1,178 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package local
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+const (
+	bucket        = datastore.BucketTransfer
+	partialSuffix = ".fhs-part"
+	chunkSize     = 4 * 1024 * 1024
+)
+
+// partial is the progress of an interrupted write to a local file
+type partial struct {
+	Source   string    `json:"source"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Offset   int64     `json:"offset"`
+}
+
+// partialName is the hidden file data is written to until it's complete
+func (f *File) partialName() string {
+	target := f.target()
+	return filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+partialSuffix)
+}
+
+func isPartial(filePath string) bool {
+	return strings.HasSuffix(filePath, partialSuffix)
+}
+
+// Resume returns how much of the from file has already been written
+// by an earlier, interrupted write.  If from has changed since then
+// the old partial data is thrown out
+func (f *File) Resume(from syncer.Syncer) (int64, error) {
+	part := &partial{}
+	err := datastore.Get(bucket, f.ID(), part)
+	if err != nil && err != datastore.ErrNotFound {
+		return 0, err
+	}
+
+	if err == nil && part.Source == from.ID() && part.Size == from.Size() && part.Modified.Equal(from.Modified()) {
+		info, err := os.Stat(f.partialName())
+		if err == nil {
+			offset := part.Offset
+			if info.Size() < offset {
+				offset = info.Size()
+			}
+			// anything past the last recorded chunk may not have been flushed
+			err = os.Truncate(f.partialName(), offset)
+			if err != nil {
+				return 0, err
+			}
+			return offset, nil
+		}
+	}
+
+	// new write
+	err = os.Remove(f.partialName())
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	return 0, datastore.Put(bucket, f.ID(), &partial{
+		Source:   from.ID(),
+		Size:     from.Size(),
+		Modified: from.Modified(),
+	})
+}
+
+// WriteAt writes from the reader to the file starting at offset.  Progress is
+// recorded after every chunk, so if the write is interrupted it can be resumed
+// later.  The file is only moved into place once all of the data is written
+func (f *File) WriteAt(r io.ReadCloser, offset, size int64, modTime time.Time) error {
+	defer r.Close()
+
+	err := f.refresh()
+	if err != nil {
+		return err
+	}
+
+	part := &partial{}
+	err = datastore.Get(bucket, f.ID(), part)
+	if err != nil {
+		return err
+	}
+
+	//ignore fsnotify events for this change
+	ignore.add(f.ID())
+	defer ignore.remove(f.ID())
+	ignore.add(f.partialName())
+	defer ignore.remove(f.partialName())
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if offset == 0 {
+		flag |= os.O_TRUNC
+	}
+
+	wf, err := os.OpenFile(f.partialName(), flag, 0666)
+	if err != nil {
+		return err
+	}
+
+	for offset < size {
+		n, err := io.CopyN(wf, r, chunkSize)
+		offset += n
+		if n > 0 {
+			serr := wf.Sync()
+			if serr != nil {
+				wf.Close()
+				return serr
+			}
+			part.Offset = offset
+			serr = datastore.Put(bucket, f.ID(), part)
+			if serr != nil {
+				wf.Close()
+				return serr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			wf.Close()
+			return err
+		}
+	}
+
+	err = wf.Close()
+	if err != nil {
+		return err
+	}
+
+	if offset != size {
+		// source doesn't match what we expected, start over next time
+		os.Remove(f.partialName())
+		datastore.Delete(bucket, f.ID())
+		return io.ErrShortWrite
+	}
+
+	err = f.checkStaged(f.partialName())
+	if err != nil {
+		datastore.Delete(bucket, f.ID())
+		return err
+	}
+
+	err = f.keepMode(f.partialName())
+	if err != nil {
+		return err
+	}
+
+	err = os.Chtimes(f.partialName(), time.Now(), modTime)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(f.partialName(), f.target())
+	if err != nil {
+		return err
+	}
+
+	err = datastore.Delete(bucket, f.ID())
+	if err != nil {
+		return err
+	}
+
+	return f.refresh()
+}
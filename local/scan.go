@@ -0,0 +1,223 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package local
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// ScanInterval is how often folders which aren't watched for changes are
+// scanned for them instead
+var ScanInterval = 30 * time.Second
+
+var scanned scanFolders // folders scanned for changes instead of being watched
+
+func init() {
+	scanned = scanFolders{
+		folders: make(map[string]*scanFolder),
+		warned:  make(map[string]bool),
+	}
+}
+
+type scanFolder struct {
+	entries map[string]scanEntry // last scan of the folder, by file name
+	limited bool                 // scanned because it couldn't be watched
+}
+
+// scanEntry is what a file in a scanned folder looked like on the last scan
+type scanEntry struct {
+	modified time.Time
+	size     int64
+	isDir    bool
+}
+
+type scanFolders struct {
+	sync.Mutex
+	folders map[string]*scanFolder
+	warned  map[string]bool // profiles already warned about
+	start   sync.Once
+}
+
+// add starts scanning the folder, instead of watching it.  Limited is whether
+// or not that's because it couldn't be watched
+func (s *scanFolders) add(profile *syncer.Profile, folder string, limited bool) error {
+	entries, err := scanDir(folder)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.folders[folder] = &scanFolder{
+		entries: entries,
+		limited: limited,
+	}
+	if limited && !s.warned[profile.ID()] {
+		s.warned[profile.ID()] = true
+		logger.Profile(profile.Name).Warnf("Profile %s has more folders than can be watched for changes, the rest are scanned "+
+			"every %s instead. %s", profile.Name, ScanInterval, raiseLimit())
+	}
+	s.start.Do(func() {
+		go s.run()
+	})
+	return nil
+}
+
+func (s *scanFolders) remove(folder string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.folders, folder)
+}
+
+func (s *scanFolders) has(folder string) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.folders[folder]
+	return ok
+}
+
+func (s *scanFolders) limited(folder string) bool {
+	s.Lock()
+	defer s.Unlock()
+	f, ok := s.folders[folder]
+	return ok && f.limited
+}
+
+func (s *scanFolders) list() []string {
+	s.Lock()
+	defer s.Unlock()
+	list := make([]string, 0, len(s.folders))
+	for folder := range s.folders {
+		list = append(list, folder)
+	}
+	return list
+}
+
+// run scans the folders every ScanInterval, for as long as the process runs
+func (s *scanFolders) run() {
+	for {
+		time.Sleep(ScanInterval)
+		for _, folder := range s.list() {
+			s.scan(folder)
+		}
+	}
+}
+
+// scan queues a change for every file in the folder which is new, gone, or
+// has a different modified time or size than the last scan
+func (s *scanFolders) scan(folder string) {
+	entries, err := scanDir(folder)
+	if os.IsNotExist(err) {
+		// the folder's parent sees it go
+		return
+	}
+	if err != nil {
+		logger.Errorf("Error scanning %s for changes: %s", folder, err)
+		return
+	}
+
+	s.Lock()
+	var last map[string]scanEntry
+	f, ok := s.folders[folder]
+	if ok {
+		last = f.entries
+		f.entries = entries
+	}
+	s.Unlock()
+	if !ok {
+		// stopped scanning in the meantime
+		return
+	}
+
+	var changed []string
+	for name, entry := range entries {
+		if old, ok := last[name]; !ok || old != entry {
+			changed = append(changed, name)
+		}
+	}
+	for name := range last {
+		if _, ok := entries[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+
+	for i := range changed {
+		file, err := New(filepath.Join(folder, changed[i]))
+		if err != nil {
+			logger.Errorf("%s", err)
+			continue
+		}
+		if ignore.has(file) || isStaged(file.ID()) {
+			continue
+		}
+		queueChange(file)
+	}
+}
+
+// scanDir reads what the files in the folder currently look like
+func scanDir(folder string) (map[string]scanEntry, error) {
+	dir, err := os.Open(folder)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	entries := make(map[string]scanEntry)
+	for {
+		infos, err := dir.Readdir(syncer.ChildPageSize)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i := range infos {
+			entry := scanEntry{
+				modified: infos[i].ModTime(),
+				isDir:    infos[i].IsDir(),
+			}
+			if !entry.isDir {
+				entry.size = infos[i].Size()
+			}
+			entries[infos[i].Name()] = entry
+		}
+	}
+}
+
+func raiseLimit() string {
+	if watchLimitSetting == "" {
+		return ""
+	}
+	return fmt.Sprintf("Raise %s to watch them all.", watchLimitSetting)
+}
+
+// ProfileWarning returns a warning about how the profile's local folder is
+// being monitored, or an empty string if every folder is watched
+func ProfileWarning(profileID string) string {
+	count := 0
+	watching.RLock()
+	for folder, profiles := range watching.files {
+		for i := range profiles {
+			if profiles[i].ID() == profileID && scanned.limited(folder) {
+				count++
+				break
+			}
+		}
+	}
+	watching.RUnlock()
+
+	if count == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d folders are over the limit of folders which can be watched for changes, "+
+		"and are scanned every %s instead. %s", count, ScanInterval, raiseLimit())
+}
@@ -0,0 +1,31 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package local
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// FreeSpace returns the number of bytes available on the volume the file
+// is on, or will be written to if it doesn't exist yet
+func (f *File) FreeSpace() (int64, error) {
+	dir := f.target()
+	for {
+		_, err := os.Stat(dir)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return 0, err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return 0, err
+		}
+		dir = parent
+	}
+	return freeSpace(dir)
+}
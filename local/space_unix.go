@@ -0,0 +1,21 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package local
+
+import "syscall"
+
+func freeSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	// Bavail is the space available to unprivileged users, which excludes
+	// the blocks reserved for root
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package local
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// tmpSuffix marks the hidden file a download is staged in until it's
+// complete and can be renamed into place
+const tmpSuffix = ".fhs-tmp"
+
+func (f *File) tmpName() string {
+	target := f.target()
+	return filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+tmpSuffix)
+}
+
+// isStaged returns whether the file is one of the hidden files writes are
+// staged in, which are never synced
+func isStaged(filePath string) bool {
+	return isPartial(filePath) || strings.HasSuffix(filePath, tmpSuffix)
+}
+
+// ExpectHash sets the hash the next write to the file must match before
+// it's moved into place
+func (f *File) ExpectHash(hash string) {
+	f.expectHash = hash
+}
+
+// checkStaged checks the staged file against the expected hash, if there
+// is one.  The staged file is removed if it doesn't match
+func (f *File) checkStaged(staged string) error {
+	if f.expectHash == "" {
+		return nil
+	}
+	expected := f.expectHash
+	f.expectHash = ""
+
+	file, err := os.Open(staged)
+	if err != nil {
+		return err
+	}
+	hash, err := syncer.HashReader(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	if hash != expected {
+		os.Remove(staged)
+		return syncer.ErrHashMismatch
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+//go:build cgo
+// +build cgo
+
+package local
+
+/*
+#cgo LDFLAGS: -framework CoreServices
+#include <CoreServices/CoreServices.h>
+#include <dispatch/dispatch.h>
+#include <stdlib.h>
+
+extern void goFSEvents(uintptr_t handle, size_t n, char **paths, FSEventStreamEventFlags *flags);
+
+static void fseventsCallback(ConstFSEventStreamRef ref, void *info, size_t n, void *paths,
+	const FSEventStreamEventFlags flags[], const FSEventStreamEventId ids[]) {
+	goFSEvents((uintptr_t)info, n, (char **)paths, (FSEventStreamEventFlags *)flags);
+}
+
+static FSEventStreamRef startStream(uintptr_t handle, const char *path, double latency) {
+	CFStringRef cfPath = CFStringCreateWithCString(NULL, path, kCFStringEncodingUTF8);
+	if (cfPath == NULL) {
+		return NULL;
+	}
+	CFArrayRef paths = CFArrayCreate(NULL, (const void **)&cfPath, 1, &kCFTypeArrayCallBacks);
+	FSEventStreamContext ctx = {0, (void *)handle, NULL, NULL, NULL};
+	FSEventStreamRef stream = FSEventStreamCreate(NULL, fseventsCallback, &ctx, paths,
+		kFSEventStreamEventIdSinceNow, latency,
+		kFSEventStreamCreateFlagFileEvents | kFSEventStreamCreateFlagNoDefer | kFSEventStreamCreateFlagWatchRoot);
+	CFRelease(paths);
+	CFRelease(cfPath);
+	if (stream == NULL) {
+		return NULL;
+	}
+
+	FSEventStreamSetDispatchQueue(stream, dispatch_get_global_queue(DISPATCH_QUEUE_PRIORITY_DEFAULT, 0));
+	if (!FSEventStreamStart(stream)) {
+		FSEventStreamInvalidate(stream);
+		FSEventStreamRelease(stream);
+		return NULL;
+	}
+	return stream;
+}
+
+static void stopStream(FSEventStreamRef stream) {
+	FSEventStreamStop(stream);
+	FSEventStreamInvalidate(stream);
+	FSEventStreamRelease(stream);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// streamLatency is how many seconds FSEvents collects events for before
+// sending them, events for the same file are debounced by queueChange anyway
+const streamLatency = 0.5
+
+// event flags from FSEvents.h
+const (
+	flagMustScanSubDirs = 0x00000001
+	flagRootChanged     = 0x00000020
+)
+
+var streams eventStreams // FSEvents streams watching whole trees
+
+func init() {
+	streams = eventStreams{
+		roots:   make(map[string]*eventStream),
+		handles: make(map[uintptr]*eventStream),
+	}
+}
+
+type eventStream struct {
+	root   string
+	handle uintptr
+	ref    C.FSEventStreamRef
+}
+
+// eventStreams watch a folder and everything under it with a single FSEvents
+// stream, rather than a watch per folder, which scales poorly on large trees
+// and misses changes to folders created before their watch is added
+type eventStreams struct {
+	sync.Mutex
+	roots   map[string]*eventStream
+	handles map[uintptr]*eventStream
+	next    uintptr
+}
+
+// covers is whether or not a stream already watches the folder
+func (e *eventStreams) covers(folder string) bool {
+	e.Lock()
+	defer e.Unlock()
+	return e.coveredBy(folder) != nil
+}
+
+func (e *eventStreams) coveredBy(folder string) *eventStream {
+	for root, stream := range e.roots {
+		if folder == root || strings.HasPrefix(folder, strings.TrimSuffix(root, string(filepath.Separator))+
+			string(filepath.Separator)) {
+			return stream
+		}
+	}
+	return nil
+}
+
+// start starts a stream watching the folder and everything under it
+func (e *eventStreams) start(folder string) (bool, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.next++
+	stream := &eventStream{
+		root:   folder,
+		handle: e.next,
+	}
+
+	path := C.CString(folder)
+	defer C.free(unsafe.Pointer(path))
+	stream.ref = C.startStream(C.uintptr_t(stream.handle), path, C.double(streamLatency))
+	if stream.ref == nil {
+		return false, fmt.Errorf("Error starting an FSEvents stream for %s", folder)
+	}
+
+	e.roots[folder] = stream
+	e.handles[stream.handle] = stream
+	return true, nil
+}
+
+// remove stops the stream for the folder if it is the root of one, and returns
+// whether or not the folder was watched by a stream
+func (e *eventStreams) remove(folder string) bool {
+	e.Lock()
+	defer e.Unlock()
+
+	stream := e.coveredBy(folder)
+	if stream == nil {
+		return false
+	}
+	if stream.root == folder {
+		C.stopStream(stream.ref)
+		delete(e.roots, folder)
+		delete(e.handles, stream.handle)
+	}
+	return true
+}
+
+func (e *eventStreams) get(handle uintptr) *eventStream {
+	e.Lock()
+	defer e.Unlock()
+	return e.handles[handle]
+}
+
+// streamEvent handles an event from an FSEvents stream
+func streamEvent(handle uintptr, filePath string, flags uint32) {
+	stream := streams.get(handle)
+	if stream == nil {
+		// stopped in the meantime
+		return
+	}
+
+	if flags&flagRootChanged != 0 {
+		logger.Warnf("The watched folder %s was moved or deleted", stream.root)
+		handleEvent(stream.root)
+		return
+	}
+
+	if flags&flagMustScanSubDirs != 0 {
+		// events were dropped, look at everything under the folder instead
+		filepath.Walk(filePath, func(walkPath string, info os.FileInfo, err error) error {
+			if err == nil {
+				handleEvent(walkPath)
+			}
+			return nil
+		})
+		return
+	}
+	handleEvent(filePath)
+}
@@ -0,0 +1,27 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+//go:build cgo
+// +build cgo
+
+package local
+
+/*
+#include <CoreServices/CoreServices.h>
+*/
+import "C"
+
+import "unsafe"
+
+// goFSEvents is called by the FSEvents stream callback, kept apart from the
+// stream code since files with exports can't define C functions
+//
+//export goFSEvents
+func goFSEvents(handle C.uintptr_t, n C.size_t, paths **C.char, flags *C.FSEventStreamEventFlags) {
+	pathList := unsafe.Slice(paths, int(n))
+	flagList := unsafe.Slice(flags, int(n))
+	for i := range pathList {
+		streamEvent(uintptr(handle), C.GoString(pathList[i]), uint32(flagList[i]))
+	}
+}
@@ -0,0 +1,26 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+//go:build !darwin || !cgo
+// +build !darwin !cgo
+
+package local
+
+var streams eventStreams
+
+// eventStreams watch a folder and everything under it at once, which is only
+// possible with FSEvents on Mac OS.  Elsewhere each folder gets its own watch
+type eventStreams struct{}
+
+func (e *eventStreams) covers(folder string) bool {
+	return false
+}
+
+func (e *eventStreams) start(folder string) (bool, error) {
+	return false, nil
+}
+
+func (e *eventStreams) remove(folder string) bool {
+	return false
+}
@@ -0,0 +1,51 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package local
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// IsSymlink returns whether the file is a symbolic link.  The rest of the
+// file's information is of the link's target
+func (f *File) IsSymlink() bool {
+	return f.link
+}
+
+// LinkLoops returns whether the file is a symbolic link to one of its own
+// parent folders, which would be followed forever
+func (f *File) LinkLoops() bool {
+	if !f.link {
+		return false
+	}
+	target, err := filepath.EvalSymlinks(f.filepath)
+	if err != nil {
+		return false
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(f.filepath))
+	if err != nil {
+		return false
+	}
+
+	rel, err := filepath.Rel(target, dir)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// target is the path the file's content is written to.  Writing to a
+// symbolic link updates the file it points to, rather than replacing the link
+func (f *File) target() string {
+	if !f.link {
+		return f.filepath
+	}
+	target, err := filepath.EvalSymlinks(f.filepath)
+	if err != nil {
+		return f.filepath
+	}
+	return target
+}
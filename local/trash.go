@@ -0,0 +1,108 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package local
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// trashTimeFormat is the name of the folder each trashed file is put under
+// in the profile's trash folder
+const trashTimeFormat = "20060102-150405.000"
+
+// Trash moves the file or directory into the profile's trash folder under
+// the time it was deleted, keeping its path relative to the profile
+func (f *File) Trash(p *syncer.Profile) error {
+	err := f.refresh()
+	if err != nil {
+		return err
+	}
+	if !f.exists {
+		return nil
+	}
+	if f.ID() == p.Local.ID() {
+		return errors.New("Can't trash the root of a profile")
+	}
+
+	//ignore fsnotify events for this change
+	ignore.add(f.ID())
+	defer ignore.remove(f.ID())
+
+	if f.IsDir() {
+		//Remove monitor
+		err := f.stopWatcherRecursive(nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	trash := trashDir(p)
+	dest := filepath.Join(trash, time.Now().Format(trashTimeFormat), f.Path(p))
+	err = os.MkdirAll(filepath.Dir(dest), 0777)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(f.filepath, dest)
+	if err != nil {
+		return err
+	}
+
+	err = f.refresh()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		err := EmptyTrash(p)
+		if err != nil {
+			logger.Errorf("Error emptying trash %s: %s", trash, err)
+		}
+	}()
+	return nil
+}
+
+func trashDir(p *syncer.Profile) string {
+	return filepath.Join(p.Local.Path(p), syncer.TrashFolder)
+}
+
+// EmptyTrash removes everything in the profile's trash folder that was deleted
+// longer ago than the profile's trash retention
+func EmptyTrash(p *syncer.Profile) error {
+	if p.TrashRetention <= 0 {
+		return nil
+	}
+
+	trash := trashDir(p)
+	entries, err := ioutil.ReadDir(trash)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	expired := time.Now().Add(-1 * p.TrashRetention)
+	for i := range entries {
+		deleted, err := time.ParseInLocation(trashTimeFormat, entries[i].Name(), time.Local)
+		if err != nil {
+			// not put there by freehold-sync
+			continue
+		}
+		if deleted.Before(expired) {
+			err = os.RemoveAll(filepath.Join(trash, entries[i].Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package local
+
+import (
+	"path/filepath"
+	"sync"
+
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+var volumes volumeMap // volumes the local folders of profiles are on, by profile
+
+func init() {
+	volumes = volumeMap{
+		roots: make(map[string]*volume),
+	}
+}
+
+// volume is where a profile's local folder is mounted.  When the folder is on a
+// separate volume from the one it's mounted on, such as a removable drive or a
+// network share, the folder is left behind as an empty mount point or gone
+// entirely when the volume is unmounted
+type volume struct {
+	root     string
+	separate bool   // the folder is on a different volume than its mount point
+	outer    uint64 // device of the volume the folder is mounted on
+}
+
+type volumeMap struct {
+	sync.Mutex
+	roots map[string]*volume
+}
+
+func (v *volumeMap) add(profileID, root string) {
+	vol := newVolume(root)
+	v.Lock()
+	defer v.Unlock()
+	v.roots[profileID] = vol
+}
+
+func (v *volumeMap) get(profileID string) (*volume, bool) {
+	v.Lock()
+	defer v.Unlock()
+	vol, ok := v.roots[profileID]
+	return vol, ok
+}
+
+func newVolume(root string) *volume {
+	vol := &volume{root: root}
+	dev, err := deviceID(root)
+	if err != nil {
+		return vol
+	}
+	mount := root
+	for {
+		parent := filepath.Dir(mount)
+		if parent == mount {
+			// reached the top of the filesystem without leaving the volume
+			return vol
+		}
+		parentDev, err := deviceID(parent)
+		if err != nil {
+			return vol
+		}
+		if parentDev != dev {
+			vol.separate = true
+			vol.outer = parentDev
+			return vol
+		}
+		mount = parent
+	}
+}
+
+// missing is whether or not the folder is gone, or is now on the volume it was
+// mounted on, because its own volume was unmounted
+func (v *volume) missing() bool {
+	dev, err := deviceID(v.root)
+	if err != nil {
+		return true
+	}
+	return v.separate && dev == v.outer
+}
+
+// VolumeMissing is whether or not the volume the profile's local folder is on has
+// been unmounted or disconnected since the profile started.  Its files look
+// deleted while it's gone, but they aren't
+func VolumeMissing(profileID string) bool {
+	vol, ok := volumes.get(profileID)
+	return ok && vol.missing()
+}
+
+// Forget stops watching all of the profile's folders without reading them, for
+// when they can no longer be read because their volume is gone.  Watching them
+// again rescans them from scratch
+func Forget(p *syncer.Profile) {
+	watching.Lock()
+	defer watching.Unlock()
+	for folder, profiles := range watching.files {
+		for i := range profiles {
+			if profiles[i].ID() != p.ID() {
+				continue
+			}
+			profiles = append(profiles[:i], profiles[i+1:]...)
+			if len(profiles) == 0 {
+				delete(watching.files, folder)
+				// the watch is likely already gone with the volume
+				unwatch(folder)
+			} else {
+				watching.files[folder] = profiles
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package local
+
+import "syscall"
+
+// deviceID is the ID of the volume the file is on
+func deviceID(path string) (uint64, error) {
+	var stat syscall.Stat_t
+	err := syscall.Stat(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(stat.Dev), nil
+}
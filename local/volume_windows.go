@@ -0,0 +1,15 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package local
+
+import "os"
+
+// deviceID is the ID of the volume the file is on.  Volumes on Windows are
+// drives which vanish along with their folders when they're removed, so only
+// whether or not the file is still there matters
+func deviceID(path string) (uint64, error) {
+	_, err := os.Stat(longPath(path))
+	return 0, err
+}
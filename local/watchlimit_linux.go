@@ -0,0 +1,19 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package local
+
+import (
+	"errors"
+	"syscall"
+)
+
+// watchLimitSetting is the setting to raise when watches run out
+const watchLimitSetting = "fs.inotify.max_user_watches"
+
+// isWatchLimit is whether or not adding a watch failed because inotify is out
+// of watches
+func isWatchLimit(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
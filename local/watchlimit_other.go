@@ -0,0 +1,16 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package local
+
+const watchLimitSetting = ""
+
+// isWatchLimit is whether or not adding a watch failed because the system is
+// out of watches, which only happens with inotify
+func isWatchLimit(err error) bool {
+	return false
+}
@@ -6,13 +6,59 @@ package main
 
 import (
 	"net/http"
+	"time"
 
 	"bitbucket.org/tshannon/freehold-sync/log"
 )
 
+// logTypeBoth is the log type of entries which aren't about just the local or
+// remote side
+const logTypeBoth = "Both"
+
+var logger = log.Module(logTypeBoth)
+
+const logPageSize = 25
+
+// logTrimInterval is how often log entries past logDays or logMaxEntries are
+// removed from the datastore
+var logTrimInterval = 10 * time.Minute
+
+var logTrimStop chan struct{}
+
+// logTrimPoll trims the log every logTrimInterval in the background, so
+// entries being logged never wait on it
+func logTrimPoll() {
+	logTrimStop = make(chan struct{})
+	ticker := time.NewTicker(logTrimInterval)
+	go func(stop chan struct{}) {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_, err := log.Trim()
+				if err != nil {
+					logger.Errorf("Error trimming old log entries: %s", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(logTrimStop)
+}
+
+func stopLogTrim() {
+	if logTrimStop != nil {
+		close(logTrimStop)
+		logTrimStop = nil
+	}
+}
+
 type logInput struct {
-	Type string `json:"type"`
-	Page int    `json:"page"`
+	Type       string `json:"type"`
+	Page       int    `json:"page"`
+	Level      string `json:"level"`      // least severe level of the entries
+	Profile    string `json:"profile"`    // name of the profile the entries are about
+	SinceHours int    `json:"sinceHours"` // only entries from the last number of hours
 }
 
 func logGet(w http.ResponseWriter, r *http.Request) {
@@ -22,7 +68,16 @@ func logGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	logs, err := log.Get(input.Type, input.Page)
+	q := log.Query{
+		Type:    input.Type,
+		Level:   input.Level,
+		Profile: input.Profile,
+	}
+	if input.SinceHours > 0 {
+		q.Since = time.Now().Add(-time.Duration(input.SinceHours) * time.Hour)
+	}
+
+	logs, err := log.Find(q, input.Page*logPageSize, logPageSize)
 	if errHandled(err, w) {
 		return
 	}
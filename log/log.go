@@ -2,109 +2,474 @@
 // Use of this source code is governed by the MIT license
 // that can be found in the LICENSE file.
 
-// Package log will log last 1000 items in a datstore file
-// an the system log.  New records will push old records out
-// of the datastore, but they will remain in the system log for
-// the users system to manage
+// Package log will log items in a datstore file an the system log.
+// Entries older than Retention, or beyond the newest MaxEntries, are trimmed
+// from the datastore, but they will remain in the system log for
+// the users system to manage.
+//
+// Entries have a level, the module they're from, and optionally the profile
+// and file they're about along with other fields.  Credentials and tokens in
+// URLs are redacted before anything is written
 package log
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/boltdb/bolt"
-
 	"bitbucket.org/tshannon/freehold-sync/datastore"
 )
 
 const (
 	bucket   = datastore.BucketLog
-	maxRows  = 10000
 	pageSize = 25
+	// keyTime is the format of the UTC time entries are keyed by, fine enough
+	// that entries of the same module are never logged at the same time
+	keyTime = "2006-01-02T15:04:05.000000000Z07:00"
+)
+
+// Retention is how long entries are kept in the datastore
+var Retention = 30 * 24 * time.Hour
+
+// MaxEntries is the most entries kept in the datastore, the oldest are trimmed
+// first
+var MaxEntries = 50000
+
+// Levels, from least to most severe
+const (
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
 )
 
+var severity = map[string]int{
+	LevelDebug: 0,
+	LevelInfo:  1,
+	LevelWarn:  2,
+	LevelError: 3,
+}
+
+var output outputData
+
+func init() {
+	output = outputData{
+		w: os.Stderr,
+		config: Config{
+			Level: LevelInfo,
+		},
+	}
+}
+
+// Config is which entries are logged, and how they're written to the system log
+type Config struct {
+	Level   string            `json:"level"`   // entries below this level are dropped
+	Modules map[string]string `json:"modules"` // levels of individual modules, overriding Level
+	JSON    bool              `json:"json"`    // write the system log as a JSON object per line
+}
+
+// ValidLevel returns whether the level is one of the log levels
+func ValidLevel(level string) bool {
+	_, ok := severity[level]
+	return ok
+}
+
+func (c *Config) validate() error {
+	if !ValidLevel(c.Level) {
+		return fmt.Errorf("Invalid log level %q, it must be debug, info, warn or error", c.Level)
+	}
+	for module, level := range c.Modules {
+		if !ValidLevel(level) {
+			return fmt.Errorf("Invalid log level %q for module %s, it must be debug, info, warn or error",
+				level, module)
+		}
+	}
+	return nil
+}
+
+type outputData struct {
+	sync.RWMutex
+	w      io.Writer
+	system func(level, line string) // replaces w when set
+	config Config
+}
+
+// enabled returns whether entries of the module at the level are logged
+func (o *outputData) enabled(module, level string) bool {
+	o.RLock()
+	defer o.RUnlock()
+	min, ok := o.config.Modules[module]
+	if !ok {
+		min = o.config.Level
+	}
+	return severity[level] >= severity[min]
+}
+
+// Configure sets which entries are logged, and how, from then on
+func Configure(c Config) error {
+	err := c.validate()
+	if err != nil {
+		return err
+	}
+	modules := make(map[string]string, len(c.Modules))
+	for module, level := range c.Modules {
+		modules[module] = level
+	}
+	c.Modules = modules
+
+	output.Lock()
+	defer output.Unlock()
+	output.config = c
+	return nil
+}
+
+// CurrentConfig returns how entries are currently logged
+func CurrentConfig() Config {
+	output.RLock()
+	defer output.RUnlock()
+	c := output.config
+	c.Modules = make(map[string]string, len(output.config.Modules))
+	for module, level := range output.config.Modules {
+		c.Modules[module] = level
+	}
+	return c
+}
+
+// ParseModules parses module levels written as module=level, separated by
+// commas, such as remote=debug,local=warn
+func ParseModules(value string) (map[string]string, error) {
+	modules := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Invalid module log level %q, it must be written as module=level", item)
+		}
+		modules[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return modules, nil
+}
+
+// SetOutput sets where the system log is written, standard error by default
+func SetOutput(w io.Writer) {
+	output.Lock()
+	defer output.Unlock()
+	output.w = w
+}
+
+// SetSystemOutput sends the system log to fn instead of the output, with each
+// entry's level, for system logs which record the level themselves, such as the
+// Windows event log
+func SetSystemOutput(fn func(level, line string)) {
+	output.Lock()
+	defer output.Unlock()
+	output.system = fn
+}
+
 // Log is a log entry
 type Log struct {
-	When string `json:"when"`
-	Type string `json:"type"`
-	Log  string `json:"log"`
+	When    string            `json:"when"`
+	Level   string            `json:"level"`
+	Type    string            `json:"type"` // module the entry is from
+	Profile string            `json:"profile,omitempty"`
+	Path    string            `json:"path,omitempty"` // slash separated path of the file, relative to the profile
+	Log     string            `json:"log"`
+	Error   string            `json:"error,omitempty"`
+	Fields  map[string]string `json:"fields,omitempty"`
 }
 
-// New inserts a new log entry
-func New(entry, Type string) {
-	when := time.Now().Format(time.RFC3339)
+// text formats the entry as a line of the system log
+func (l *Log) text() string {
+	line := fmt.Sprintf("%s %-5s [%s] %s", l.When, strings.ToUpper(l.Level), l.Type, l.Log)
+	if l.Profile != "" {
+		line += " profile=" + quoteField(l.Profile)
+	}
+	if l.Path != "" {
+		line += " path=" + quoteField(l.Path)
+	}
+	if l.Error != "" {
+		line += " error=" + quoteField(l.Error)
+	}
+	keys := make([]string, 0, len(l.Fields))
+	for key := range l.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		line += " " + key + "=" + quoteField(l.Fields[key])
+	}
+	return line
+}
 
-	log := &Log{
-		When: when,
-		Type: Type,
-		Log:  entry,
+func quoteField(value string) string {
+	if strings.ContainsAny(value, " \t\n\"=") {
+		return fmt.Sprintf("%q", value)
 	}
+	return value
+}
+
+// Logger writes entries for a module, along with the fields added to it
+type Logger struct {
+	module  string
+	profile string
+	path    string
+	err     string
+	fields  map[string]string
+}
 
-	err := datastore.Put(bucket, when+"_"+Type, log)
+// Module returns a logger for entries from the module
+func Module(name string) *Logger {
+	return &Logger{module: name}
+}
+
+// Profile returns a copy of the logger for entries about the profile
+func (l *Logger) Profile(name string) *Logger {
+	c := l.copy()
+	c.profile = name
+	return c
+}
+
+// Path returns a copy of the logger for entries about the file at the slash
+// separated path, relative to the profile
+func (l *Logger) Path(path string) *Logger {
+	c := l.copy()
+	c.path = path
+	return c
+}
+
+// Err returns a copy of the logger which adds the error's detail to its entries
+func (l *Logger) Err(err error) *Logger {
+	c := l.copy()
 	if err != nil {
-		panic("Error can't log entry to freehold-sync log. Entry: " +
-			entry + " error: " + err.Error())
+		c.err = err.Error()
+	}
+	return c
+}
+
+// With returns a copy of the logger which adds the field to its entries
+func (l *Logger) With(key string, value interface{}) *Logger {
+	c := l.copy()
+	c.fields[key] = fmt.Sprint(value)
+	return c
+}
+
+func (l *Logger) copy() *Logger {
+	c := &Logger{
+		module:  l.module,
+		profile: l.profile,
+		path:    l.path,
+		err:     l.err,
+		fields:  make(map[string]string, len(l.fields)+1),
+	}
+	for key, value := range l.fields {
+		c.fields[key] = value
+	}
+	return c
+}
+
+// Debugf logs detail which is only useful when tracking down a problem
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.write(LevelDebug, format, args)
+}
+
+// Infof logs something worth knowing which needs nothing done about it
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.write(LevelInfo, format, args)
+}
+
+// Warnf logs something which may need looking into, but which isn't an error
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.write(LevelWarn, format, args)
+}
+
+// Errorf logs something which failed
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.write(LevelError, format, args)
+}
+
+func (l *Logger) write(level, format string, args []interface{}) {
+	if !output.enabled(l.module, level) {
 		return
 	}
 
-	err = trimOldLogs()
-	if err != nil {
-		panic("Error can't trim old log entries: " +
-			entry + " error: " + err.Error())
+	entry := &Log{
+		When:    time.Now().Format(time.RFC3339),
+		Level:   level,
+		Type:    l.module,
+		Profile: l.profile,
+		Path:    l.path,
+		Log:     Redact(fmt.Sprintf(format, args...)),
+		Error:   Redact(l.err),
+	}
+	if len(l.fields) > 0 {
+		entry.Fields = make(map[string]string, len(l.fields))
+		for key, value := range l.fields {
+			entry.Fields[key] = Redact(value)
+		}
+	}
+
+	writeSystem(entry)
+	store(entry)
+}
+
+// writeSystem writes the entry to the system log
+func writeSystem(entry *Log) {
+	output.RLock()
+	defer output.RUnlock()
+	line := entry.text()
+	if output.config.JSON {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+		line = string(data)
+	}
+	if output.system != nil {
+		output.system(entry.Level, line)
 		return
+	}
+	fmt.Fprintln(output.w, line)
+}
 
+// store adds the entry to the datastore
+func store(entry *Log) {
+	err := datastore.Put(bucket, time.Now().UTC().Format(keyTime)+"_"+entry.Type, entry)
+	if err != nil {
+		panic("Error can't log entry to freehold-sync log. Entry: " +
+			entry.Log + " error: " + err.Error())
 	}
 }
 
-type key []byte
+// rawKey returns the start of the keys of entries logged at the time, as
+// they're stored in the datastore, JSON encoded
+func rawKey(t time.Time) string {
+	return `"` + t.UTC().Format(keyTime)
+}
+
+// Trim removes the entries older than Retention, and the oldest entries beyond
+// MaxEntries, from the datastore, and returns how many were removed
+func Trim() (int, error) {
+	cutoff := rawKey(time.Now().Add(-Retention))
+	var old []string
 
-func trimOldLogs() error {
-	return datastore.DB().Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucket))
-		c := b.Cursor()
+	// keys start with the time the entry was logged, so the oldest come first
+	err := datastore.View(func(tx *datastore.Tx) error {
+		c := tx.Cursor(bucket)
 		count := 0
 
-		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
 			count++
-			if count > maxRows {
-				err := c.Delete()
+			if count > MaxEntries || string(k) < cutoff {
+				var key string
+				err := json.Unmarshal(k, &key)
 				if err != nil {
 					return err
 				}
+				old = append(old, key)
 			}
 		}
+		return nil
+	})
+	if err != nil || len(old) == 0 {
+		return 0, err
+	}
 
+	err = datastore.Update(func(tx *datastore.Tx) error {
+		for i := range old {
+			err := tx.Delete(bucket, old[i])
+			if err != nil {
+				return err
+			}
+		}
 		return nil
 	})
+	if err != nil {
+		return 0, err
+	}
+	return len(old), nil
 }
 
-// Get retrieves the logs for a given type / page
-// if type is "" then return all logs of all types
-func Get(Type string, page int) ([]*Log, error) {
-	skip := page * pageSize
-	logs := make([]*Log, 0, pageSize)
+// Query filters the entries returned by Find.  Empty fields match every entry
+type Query struct {
+	Type    string    // module the entries are from
+	Level   string    // least severe level of the entries
+	Profile string    // name of the profile the entries are about
+	Path    string    // entries about the file, or the files in the folder, at the path
+	Since   time.Time // entries logged at or after
+	Until   time.Time // entries logged before
+}
+
+func (q *Query) matches(l *Log) bool {
+	switch {
+	case q.Type != "" && l.Type != q.Type,
+		q.Level != "" && severity[l.Level] < severity[q.Level],
+		q.Profile != "" && l.Profile != q.Profile:
+		return false
+	case q.Path != "":
+		path := strings.Trim(q.Path, "/")
+		if l.Path != path && !strings.HasPrefix(l.Path, path+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+// Find returns the entries matching the query, newest first, skipping the
+// first offset of them, and returning at most limit
+func Find(q Query, offset, limit int) ([]*Log, error) {
+	if q.Level != "" && !ValidLevel(q.Level) {
+		return nil, fmt.Errorf("Invalid log level %q, it must be debug, info, warn or error", q.Level)
+	}
+	logs := make([]*Log, 0, limit)
 
-	err := datastore.DB().View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucket))
-		c := b.Cursor()
+	err := datastore.View(func(tx *datastore.Tx) error {
+		c := tx.Cursor(bucket)
 
-		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+		var k, v []byte
+		if q.Until.IsZero() {
+			k, v = c.Last()
+		} else {
+			// first entry before Until
+			k, v = c.Seek([]byte(rawKey(q.Until)))
+			if k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+		since := ""
+		if !q.Since.IsZero() {
+			since = rawKey(q.Since)
+		}
+
+		for ; k != nil; k, v = c.Prev() {
+			if string(k) < since {
+				break
+			}
 			l := &Log{}
 			err := json.Unmarshal(v, l)
 			if err != nil {
 				return err
 			}
-			if Type != "" && l.Type != Type {
+			if !q.matches(l) {
 				continue
 			}
 
-			if skip <= 0 {
+			if offset <= 0 {
 				logs = append(logs, l)
-				if len(logs) >= pageSize {
+				if len(logs) >= limit {
 					break
 				}
 			} else {
-				skip--
+				offset--
 			}
 		}
 
@@ -116,3 +481,9 @@ func Get(Type string, page int) ([]*Log, error) {
 
 	return logs, nil
 }
+
+// Get retrieves the logs for a given type / page
+// if type is "" then return all logs of all types
+func Get(Type string, page int) ([]*Log, error) {
+	return Find(Query{Type: Type}, page*pageSize, pageSize)
+}
@@ -0,0 +1,36 @@
+package log
+
+import "testing"
+
+func TestQueryMatches(t *testing.T) {
+	entry := &Log{
+		Level:   LevelWarn,
+		Type:    "sync",
+		Profile: "docs",
+		Path:    "reports/2015/march.txt",
+	}
+
+	tests := []struct {
+		q       Query
+		matches bool
+	}{
+		{Query{}, true},
+		{Query{Type: "sync", Profile: "docs"}, true},
+		{Query{Type: "remote"}, false},
+		{Query{Profile: "photos"}, false},
+		{Query{Level: LevelInfo}, true},
+		{Query{Level: LevelWarn}, true},
+		{Query{Level: LevelError}, false},
+		{Query{Path: "reports/2015/march.txt"}, true},
+		{Query{Path: "reports"}, true},
+		{Query{Path: "/reports/2015/"}, true},
+		{Query{Path: "reports/2015/march"}, false},
+		{Query{Path: "report"}, false},
+	}
+
+	for _, test := range tests {
+		if got := test.q.matches(entry); got != test.matches {
+			t.Errorf("Expected %+v matching the entry to be %t", test.q, test.matches)
+		}
+	}
+}
@@ -5,8 +5,10 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -14,87 +16,206 @@ import (
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"syscall"
 	"time"
 
 	"bitbucket.org/tshannon/config"
+	"bitbucket.org/tshannon/freehold-sync/credentials"
 	"bitbucket.org/tshannon/freehold-sync/datastore"
 	"bitbucket.org/tshannon/freehold-sync/local"
 	"bitbucket.org/tshannon/freehold-sync/log"
 	"bitbucket.org/tshannon/freehold-sync/remote"
 	"bitbucket.org/tshannon/freehold-sync/syncer"
+	"bitbucket.org/tshannon/freehold-sync/throttle"
 	"bitbucket.org/tshannon/freehold-sync/trayhost"
 )
 
 var (
-	flagPort     = 6080
-	httpTimeout  time.Duration
-	server       *http.Server
-	retry        chan retrier
-	flagSkipTray = true
+	flagPort          = 6080
+	httpTimeout       time.Duration
+	transferWorkers   int
+	modifiedTolerance time.Duration
+	hooksEnabled      bool // whether profiles can run hook commands
+	server            *http.Server
+	flagSkipTray      = true
+	flagOnce          = false
 )
 
 func init() {
 	flag.IntVar(&flagPort, "port", 6080, "Default Port to host freehold-sync webserver on.")
 	flag.BoolVar(&flagSkipTray, "skipTray", false, "Whether or not to skip starting the system tray.")
+	flag.BoolVar(&flagOnce, "once", false, "Sync each active profile once and exit, such as when run from cron.")
 
-	//Capture program shutdown, to make sure everything shuts down nicely
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	//Capture program shutdown, to make sure everything shuts down nicely.  A
+	// second signal while shutting down stops right away
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		for sig := range c {
-			if sig == os.Interrupt {
-				halt("Freehold-Sync shutting down")
+		stopping := false
+		for range c {
+			if stopping {
+				halt("Freehold-Sync stopped before shutting down cleanly")
 			}
+			stopping = true
+			go shutdown()
 		}
 	}()
-	retry = make(chan retrier, 100)
 }
 
 func main() {
 	flag.Parse()
 
 	settingPaths := config.StandardFileLocations("freehold-sync/settings.json")
-	fmt.Println("Freehold-Sync will use settings files in the following locations (in order of priority):")
-	for i := range settingPaths {
-		fmt.Println("\t", settingPaths[i])
-	}
 	cfg, err := config.LoadOrCreate(settingPaths...)
 	if err != nil {
 		halt(err.Error())
 	}
 
 	port := strconv.Itoa(cfg.Int("port", flagPort))
+	dataDir := filepath.Dir(cfg.FileName())
+	tlsCert = cfg.String("tlsCert", "")
+	tlsKey = cfg.String("tlsKey", "")
+	useTLS = cfg.Bool("tls", false) || tlsCert != ""
+	socketFile = cfg.String("socket", "")
+
+	if flag.NArg() > 0 && flag.Arg(0) == "daemon" {
+		// headless, managed through the API and commands, such as on a server over SSH
+		if flag.NArg() > 1 {
+			halt("Usage: freehold-sync [flags] daemon")
+		}
+		flagSkipTray = true
+	} else if flag.NArg() > 0 && serviceCommands[flag.Arg(0)] != nil {
+		// manages the installed service, rather than talking to a running instance
+		err = serviceCommands[flag.Arg(0)](flag.Args()[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	} else if flag.NArg() > 0 {
+		os.Exit(runCommand(port, dataDir, flag.Args()))
+	}
+	if flagOnce {
+		flagSkipTray = true
+	} else {
+		fmt.Println("Freehold-Sync will use settings files in the following locations (in order of priority):")
+		for i := range settingPaths {
+			fmt.Println("\t", settingPaths[i])
+		}
+	}
 	remotePolling := time.Duration(cfg.Int("remotePollingSeconds", 30)) * time.Second
 	httpTimeout = time.Duration(cfg.Int("httpTimeoutSeconds", 0)) * time.Second
-	dataDir := filepath.Dir(cfg.FileName())
+	transferWorkers = cfg.Int("transferWorkers", 4)
+	modifiedTolerance = time.Duration(cfg.Int("modifiedToleranceSeconds", 2)) * time.Second
+	retryMaxAttempts = cfg.Int("retryMaxAttempts", 5)
+	notifications = cfg.Bool("notifications", !flagSkipTray)
+	smtpServer = smtpSettings{
+		Host:     cfg.String("smtpHost", ""),
+		Port:     cfg.Int("smtpPort", 587),
+		User:     cfg.String("smtpUser", ""),
+		Password: cfg.String("smtpPassword", ""),
+		From:     cfg.String("smtpFrom", ""),
+	}
+	log.AddSecret(smtpServer.Password)
+	reportHour = cfg.Int("reportHour", 8)
+	hooksEnabled = cfg.Bool("hooks", false)
+	profilesFile = cfg.String("profilesFile", "profiles.toml")
+	if !filepath.IsAbs(profilesFile) {
+		profilesFile = filepath.Join(dataDir, profilesFile)
+	}
+	syncer.HookTimeout = time.Duration(cfg.Int("hookTimeoutMinutes", 10)) * time.Minute
+	remote.MaxTransfers = cfg.Int("remoteTransfers", 4)
+	remote.MaxRequests = cfg.Int("remoteRequestsPerSecond", 20)
+	remote.MaxIdleBackoff = cfg.Int("remoteIdleBackoff", 16)
+	local.QuietPeriod = time.Duration(cfg.Int("localQuietSeconds", 3)) * time.Second
+	local.ScanInterval = time.Duration(cfg.Int("localScanSeconds", 30)) * time.Second
+	gcInterval = time.Duration(cfg.Int("datastoreGCHours", 24)) * time.Hour
+	historyAge = time.Duration(cfg.Int("historyDays", 90)) * 24 * time.Hour
+	sessionAge = time.Duration(cfg.Int("sessionHours", 24)) * time.Hour
+	shutdownTimeout = time.Duration(cfg.Int("shutdownTimeoutSeconds", 30)) * time.Second
+
+	log.Retention = time.Duration(cfg.Int("logDays", 30)) * 24 * time.Hour
+	log.MaxEntries = cfg.Int("logMaxEntries", 50000)
+
+	logModules, err := log.ParseModules(cfg.String("logModules", ""))
+	if err != nil {
+		halt(err.Error())
+	}
+	err = log.Configure(log.Config{
+		Level:   cfg.String("logLevel", log.LevelInfo),
+		Modules: logModules,
+		JSON:    cfg.Bool("logJSON", false),
+	})
+	if err != nil {
+		halt(err.Error())
+	}
+
+	err = setLocalRoots(cfg.String("localRoots", ""))
+	if err != nil {
+		halt(err.Error())
+	}
+
+	err = credentials.Use(cfg.String("credentials", ""))
+	if err != nil {
+		halt(err.Error())
+	}
+
+	schedule, err := throttle.ParseSchedule(cfg.String("bandwidthSchedule", ""))
+	if err != nil {
+		halt(err.Error())
+	}
+	throttle.StartSchedule(schedule, int64(cfg.Int("uploadLimitKB", 0))*1024,
+		int64(cfg.Int("downloadLimitKB", 0))*1024)
+
+	if flagOnce {
+		os.Exit(syncOnce(dataDir))
+	}
 
 	fmt.Printf("Freehold-Sync is currently using the file %s for settings.\n", cfg.FileName())
 
+	if runningAsService() {
+		runService(func() {
+			startServer(port, dataDir, remotePolling)
+		})
+		return
+	}
+
 	if flagSkipTray {
 		startServer(port, dataDir, remotePolling)
 	} else {
 		runtime.LockOSThread()
 
 		go func() {
-			trayhost.SetURL("http://localhost:" + port)
+			trayhost.SetURL(webURL(port))
 			startServer(port, dataDir, remotePolling)
 		}()
 
 		trayhost.EnterLoop("Freehold-Sync", getIconData())
 		//tray is exited
-		halt("Freehold-Sync shutting down")
+		shutdown()
 	}
 }
 
 func startServer(port, dataDir string, remotePolling time.Duration) {
-	err := datastore.Open(filepath.Join(dataDir, "sync.ds"))
+	openDatastore(dataDir)
+	err := applyDeclared(profilesFile, false)
 	if err != nil {
-		halt(err.Error())
+		logger.Errorf("%s", err)
 	}
+	reloadOnHangup(profilesFile)
 
-	server := &http.Server{
+	server = &http.Server{
 		Addr:    ":" + port,
-		Handler: rootHandler,
+		Handler: http.HandlerFunc(serveRoot),
+	}
+
+	certFile, keyFile := certificateFiles(dataDir)
+	if useTLS {
+		err = ensureCertificate(certFile, keyFile)
+		if err != nil {
+			halt("Error setting up HTTPS certificate: " + err.Error())
+		}
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
 	}
 
 	err = local.StartWatcher(localChanges)
@@ -113,77 +234,200 @@ func startServer(port, dataDir string, remotePolling time.Duration) {
 	}
 
 	retryPoll()
+	gcPoll()
+	logTrimPoll()
+	reportPoll()
+	notifyEvents()
+	alertQuarantines()
 
+	startProfiles(all)
+
+	if socketFile != "" {
+		go func() {
+			err := serveSocket(server, socketFile)
+			if err != nil && err != http.ErrServerClosed {
+				halt("Error serving on socket " + socketFile + ": " + err.Error())
+			}
+		}()
+	}
+
+	listeners, err := webListeners(port)
+	if err != nil {
+		halt("Error listening for the web interface: " + err.Error())
+	}
+	serve := func(l net.Listener) error {
+		if useTLS {
+			return server.ServeTLS(l, certFile, keyFile)
+		}
+		return server.Serve(l)
+	}
+	for _, l := range listeners[1:] {
+		go func(l net.Listener) {
+			err := serve(l)
+			if err != nil && err != http.ErrServerClosed {
+				halt("Error serving on socket " + l.Addr().String() + ": " + err.Error())
+			}
+		}(l)
+	}
+
+	err = sdNotify("READY=1")
+	if err != nil {
+		logger.Errorf("Error notifying systemd that Freehold-Sync is ready: %s", err)
+	}
+	sdWatchdog()
+
+	err = serve(listeners[0])
+	if err == http.ErrServerClosed {
+		// shutting down, which exits once it's done
+		select {}
+	}
+	if err != nil {
+		halt(err.Error())
+	}
+
+}
+
+// openDatastore opens the datastore in the data directory, halting if it can't be
+func openDatastore(dataDir string) {
+	err := lockDataDir(dataDir)
+	if err != nil {
+		halt(err.Error())
+	}
+
+	err = datastore.Open(filepath.Join(dataDir, "sync.ds"))
+	if rebuilt, ok := err.(*datastore.RebuiltError); ok {
+		logger.Warnf("%s. Files are scanned again, and any that differ on both sides are treated as conflicts.", rebuilt)
+		err = nil
+	}
+	if err != nil {
+		halt(err.Error())
+	}
+
+	err = moveSecrets()
+	if err != nil {
+		halt("Error moving credentials out of the datastore: " + err.Error())
+	}
+}
+
+// webURL is the address of the web interface on this machine
+func webURL(port string) string {
+	if useTLS {
+		return "https://localhost:" + port
+	}
+	return "http://localhost:" + port
+}
+
+// startProfiles starts each of the active profiles
+func startProfiles(all []*profileStore) {
+	logOverlaps(all)
 	for i := range all {
 		if all[i].Active {
-			prf, err := all[i].makeProfile()
-			if err != nil {
-				log.New(fmt.Sprintf("Error starting profile: %s", err.Error()), "Both")
+			err := resumeProfile(all[i])
+			if remote.IsOffline(err) {
+				logger.Profile(all[i].Name).Warnf("The remote location of profile %s can't be reached, it will start once it can be: %s",
+					all[i].Name, err)
+				go startWhenOnline(all[i])
 				continue
 			}
-			err = prf.Start()
 			if err != nil {
-				log.New(fmt.Sprintf("Error starting profile: %s", err.Error()), "Both")
+				logger.Errorf("Error starting profile: %s", err.Error())
 				continue
 			}
 		}
 	}
+}
 
-	err = server.ListenAndServe()
+// resumeProfile starts a stored profile where it left off when freehold-sync last stopped
+func resumeProfile(ps *profileStore) error {
+	prf, err := ps.makeProfile()
 	if err != nil {
-		halt(err.Error())
+		return err
 	}
-
+	// finish any changes interrupted by a crash before syncing picks them up
+	err = prf.ReplayJournal(func(relPath string) (syncer.Syncer, syncer.Syncer, error) {
+		return profileFiles(prf, relPath)
+	})
+	if err != nil {
+		log.Module(syncer.LogType).Profile(prf.Name).Errorf("Error replaying journal for profile %s: %s", prf.Name, err)
+	}
+	err = startProfile(prf, ps.Paused)
+	if err != nil {
+		return err
+	}
+	ps.startDestinations()
+	return nil
 }
 
 func localChanges(p *syncer.Profile, s syncer.Syncer) {
+	if volumeGone(p) {
+		// the files only look deleted, the rescan once the volume is back
+		// picks up what really changed
+		return
+	}
 	// get path relative to local profile
 	rPath := path.Join(p.Remote.Path(p), filepath.ToSlash(s.Path(p)))
 
 	r, err := remote.New(p.Remote.(*remote.File).Client(), rPath)
+	if remote.IsOffline(err) {
+		queueOffline(p, s, rPath, err)
+		return
+	}
 	if err != nil {
-		log.New(fmt.Sprintf("Error building remote syncer for local syncer %s Error: %s", s.ID(), err.Error()), local.LogType)
+		log.Module(local.LogType).Errorf("Error building remote syncer for local syncer %s Error: %s", s.ID(), err.Error())
 		return
 	}
 
-	err = p.Sync(s, r)
+	collision, err := caseCollision(p, s.(*local.File), r)
 	if err != nil {
-		retry <- &syncRetry{
-			profile:       p,
-			local:         s,
-			remote:        r,
-			logType:       local.LogType,
-			originalError: err,
-		}
+		log.Module(local.LogType).Errorf("Error checking %s for case collisions: %s", s.ID(), err)
+		return
+	}
+	if collision {
+		return
+	}
+
+	err = p.Sync(s, r)
+	if err != nil && err != syncer.ErrCanceled {
+		queueRetry(p, s, r, local.LogType, err)
 	}
 }
 
 func remoteChanges(p *syncer.Profile, s syncer.Syncer) {
+	if volumeGone(p) {
+		return
+	}
 	// get path relative to remote profile
-	lPath := filepath.Join(p.Local.Path(p), s.Path(p))
+	lPath := local.Join(p.Local.Path(p), s.Path(p))
 
 	l, err := local.New(lPath)
 	if err != nil {
-		log.New(fmt.Sprintf("Error building local syncer for remote syncer %s Error: %s", s.ID(), err.Error()), remote.LogType)
+		log.Module(remote.LogType).Errorf("Error building local syncer for remote syncer %s Error: %s", s.ID(), err.Error())
 		return
 	}
-	err = p.Sync(l, s)
+	collision, err := caseCollision(p, l, s.(*remote.File))
 	if err != nil {
-		retry <- &syncRetry{
-			profile:       p,
-			local:         l,
-			remote:        s,
-			logType:       remote.LogType,
-			originalError: err,
-		}
+		log.Module(remote.LogType).Errorf("Error checking %s for case collisions: %s", s.ID(), err)
+		return
+	}
+	if collision {
+		return
+	}
+
+	err = p.Sync(l, s)
+	if err != nil && err != syncer.ErrCanceled {
+		queueRetry(p, l, s, remote.LogType, err)
 	}
 }
 
 func halt(msg string) {
 	time.Sleep(1 * time.Second)
 	fmt.Fprintln(os.Stderr, msg)
+	logHalt(msg)
 	datastore.Close()
-	close(retry)
+	stopRetry()
+	stopGC()
+	stopLogTrim()
+	stopReports()
 	local.StopWatcher()
 	remote.StopWatcher()
 	os.Exit(1)
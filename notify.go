@@ -0,0 +1,110 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// notifyDelay is how long notifications are held to gather up others with the
+// same title, so a burst of conflicts shows as one notification
+const notifyDelay = 5 * time.Second
+
+// notifications is whether desktop notifications are shown
+var notifications = true
+
+var notifier notifierData
+
+func init() {
+	notifier = notifierData{
+		pending: make(map[string][]string),
+	}
+}
+
+type notifierData struct {
+	sync.Mutex
+	pending map[string][]string // messages waiting to be shown, by title
+	order   []string            // titles, in the order they first came in
+	timer   *time.Timer
+	failed  bool // showing a notification failed, most likely for good
+}
+
+// notify shows a desktop notification, along with any others with the same
+// title which come in within notifyDelay
+func notify(title, message string) {
+	if !notifications {
+		return
+	}
+	notifier.Lock()
+	defer notifier.Unlock()
+
+	if _, ok := notifier.pending[title]; !ok {
+		notifier.order = append(notifier.order, title)
+	}
+	notifier.pending[title] = append(notifier.pending[title], message)
+	if notifier.timer == nil {
+		notifier.timer = time.AfterFunc(notifyDelay, notifier.flush)
+	}
+}
+
+func (n *notifierData) flush() {
+	n.Lock()
+	pending, order := n.pending, n.order
+	n.pending = make(map[string][]string)
+	n.order = nil
+	n.timer = nil
+	failed := n.failed
+	n.Unlock()
+
+	if failed {
+		return
+	}
+	for _, title := range order {
+		messages := pending[title]
+		message := messages[0]
+		if len(messages) > 1 {
+			message += fmt.Sprintf(", and %d more", len(messages)-1)
+		}
+		err := showNotification(title, message)
+		if err != nil {
+			logger.Warnf("Error showing a desktop notification, no more will be shown: %s", err)
+			n.Lock()
+			n.failed = true
+			n.Unlock()
+			return
+		}
+	}
+}
+
+// notifyEvents shows a notification for every conflict found while syncing, and
+// every file quarantined for being synced back and forth
+func notifyEvents() {
+	if !notifications {
+		return
+	}
+	events, _ := syncer.Subscribe()
+	go func() {
+		for e := range events {
+			if e.Type != syncer.EventConflict && e.Type != syncer.EventQuarantined {
+				continue
+			}
+			name := e.Profile
+			ps, err := profileOf(e.Profile)
+			if err == nil {
+				name = ps.Name
+			}
+			if e.Type == syncer.EventQuarantined {
+				notify("Quarantined in "+name, e.Path+" kept being synced back and forth, and won't be synced until "+
+					"it's released")
+				continue
+			}
+			notify("Conflict in "+name, e.Path+" was changed on both sides")
+		}
+	}()
+}
@@ -0,0 +1,19 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import "os/exec"
+
+// notifyScript shows a notification in the notification center.  The text is
+// passed as arguments so it never needs escaping
+var notifyScript = []string{
+	"-e", "on run argv",
+	"-e", "display notification (item 2 of argv) with title \"Freehold-Sync\" subtitle (item 1 of argv)",
+	"-e", "end run",
+}
+
+func showNotification(title, message string) error {
+	return exec.Command("osascript", append(notifyScript, title, message)...).Run()
+}
@@ -0,0 +1,14 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import "os/exec"
+
+// showNotification shows the notification through notify-send, which passes it
+// on to the desktop's notification daemon over D-Bus
+func showNotification(title, message string) error {
+	return exec.Command("notify-send", "--app-name=Freehold-Sync", "--icon=dialog-warning",
+		title, message).Run()
+}
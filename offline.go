@@ -0,0 +1,95 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+	"bitbucket.org/tshannon/freehold-sync/local"
+	"bitbucket.org/tshannon/freehold-sync/remote"
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// offlineInterval is how often a profile which couldn't start because its
+// remote location was unreachable tries again
+const offlineInterval = 30 * time.Second
+
+var offline offlineProfiles // profiles waiting for their remote location to be reachable to start
+
+func init() {
+	offline = offlineProfiles{
+		profiles: make(map[string]bool),
+	}
+}
+
+type offlineProfiles struct {
+	sync.Mutex
+	profiles map[string]bool
+}
+
+func (o *offlineProfiles) set(id string, waiting bool) {
+	o.Lock()
+	defer o.Unlock()
+	if waiting {
+		o.profiles[id] = true
+		return
+	}
+	delete(o.profiles, id)
+}
+
+func (o *offlineProfiles) has(id string) bool {
+	o.Lock()
+	defer o.Unlock()
+	return o.profiles[id]
+}
+
+// queueOffline stores a local change which couldn't be synced because the remote
+// location is unreachable in the retry queue, where it survives restarts and
+// is synced once the remote location is back.  Changes made to the remote file
+// in the meantime are caught as conflicts when it's synced
+func queueOffline(p *syncer.Profile, l syncer.Syncer, remotePath string, err error) {
+	putRetry(&syncRetry{
+		ProfileID:    p.ID(),
+		LocalPath:    l.ID(),
+		LocalDeleted: l.Deleted(),
+		RemoteURL:    remotePath,
+		LogType:      local.LogType,
+		Error:        err.Error(),
+	}, err)
+}
+
+// startWhenOnline keeps trying to start a profile whose remote location
+// couldn't be reached, until it starts or is no longer active
+func startWhenOnline(ps *profileStore) {
+	offline.set(ps.ID, true)
+	defer offline.set(ps.ID, false)
+
+	for {
+		time.Sleep(offlineInterval)
+
+		current, err := getProfile(ps.ID)
+		if err == datastore.ErrNotFound || (err == nil && !current.Active) {
+			return
+		}
+		if err != nil {
+			logger.Profile(ps.Name).Errorf("Error reading profile %s: %s", ps.Name, err)
+			continue
+		}
+
+		err = resumeProfile(current)
+		if remote.IsOffline(err) {
+			continue
+		}
+		if err != nil {
+			logger.Errorf("Error starting profile: %s", err.Error())
+			return
+		}
+		logger.Profile(current.Name).Infof("The remote location of profile %s is reachable again, and the profile has started",
+			current.Name)
+		return
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+	"bitbucket.org/tshannon/freehold-sync/local"
+	"bitbucket.org/tshannon/freehold-sync/log"
+	"bitbucket.org/tshannon/freehold-sync/remote"
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// Exit codes of -once, the worst result of all the profiles
+const (
+	onceSynced    = 0
+	onceConflicts = 2 // everything synced, but conflicts were found
+	onceErrors    = 3 // changes failed, or a profile couldn't be synced at all
+)
+
+// oncePolling keeps remote folders from being polled again during a one-shot
+// sync, they're listed when the sync starts
+const oncePolling = 24 * time.Hour
+
+// syncOnce syncs each active profile once without watching for changes after,
+// for running from cron, and returns the exit code
+func syncOnce(dataDir string) int {
+	openDatastore(dataDir)
+	defer datastore.Close()
+
+	code := onceSynced
+	err := applyDeclared(profilesFile, false)
+	if err != nil {
+		// the profiles which were applied still sync
+		fmt.Fprintln(os.Stderr, err)
+		code = onceErrors
+	}
+
+	// folders are scanned once, watching them would only hold on to watches
+	local.StartScanner(localChanges)
+
+	err = remote.StartWatcher(remoteChanges, oncePolling)
+	if err != nil {
+		halt("Error starting up remote file monitor: " + err.Error())
+	}
+	defer remote.StopWatcher()
+
+	all, err := allProfiles()
+	if err != nil {
+		halt(err.Error())
+	}
+
+	for _, ps := range all {
+		if !ps.Active || ps.Paused {
+			continue
+		}
+		result := ps.syncOnce()
+		if result > code {
+			code = result
+		}
+	}
+	return code
+}
+
+// syncOnce syncs the profile once, and then each of its destinations, printing
+// what it did, and returns the exit code for it
+func (p *profileStore) syncOnce() int {
+	prf, err := p.makeProfile()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading profile %s: %s\n", p.Name, err)
+		return onceErrors
+	}
+	err = lockLocalRoot(prf.Local.ID())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error syncing profile %s: %s\n", p.Name, err)
+		return onceErrors
+	}
+
+	code := syncProfileOnce(prf, p.Name)
+	for _, d := range p.Destinations {
+		name := p.Name + " (" + d.name() + ")"
+		dPrf, err := p.makeDestination(d)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading profile %s: %s\n", name, err)
+			code = onceErrors
+			continue
+		}
+		result := syncProfileOnce(dPrf, name)
+		if result > code {
+			code = result
+		}
+	}
+	return code
+}
+
+// syncProfileOnce syncs the profile once, printing what it did under the name,
+// and returns the exit code for it
+func syncProfileOnce(prf *syncer.Profile, name string) int {
+	l := log.Module(syncer.LogType).Profile(prf.Name)
+
+	err := prf.ReplayJournal(func(relPath string) (syncer.Syncer, syncer.Syncer, error) {
+		return profileFiles(prf, relPath)
+	})
+	if err != nil {
+		l.Errorf("Error replaying journal for profile %s: %s", name, err)
+	}
+
+	l.Infof("Syncing profile %s once", name)
+	stats, err := prf.SyncOnce()
+	fmt.Printf("%s: %d uploaded, %d downloaded, %d conflicts, %d errors\n", name, stats.FilesUploaded,
+		stats.FilesDownloaded, stats.Conflicts, stats.Errors)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error syncing profile %s: %s\n", name, log.Redact(err.Error()))
+		l.Err(err).Errorf("Error syncing profile %s", name)
+		return onceErrors
+	}
+
+	switch {
+	case stats.Errors > 0:
+		return onceErrors
+	case stats.Conflicts > 0:
+		return onceConflicts
+	}
+	return onceSynced
+}
@@ -0,0 +1,115 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"bitbucket.org/tshannon/freehold-sync/local"
+)
+
+// rootIDs returns the IDs of the profile's local root, and of its remote roots,
+// its own first and then its destinations'.  Profile IDs are the local root's ID
+// and the remote root's ID
+func (p *profileStore) rootIDs() (string, []string, error) {
+	l, err := local.New(p.LocalPath)
+	if err != nil {
+		return "", nil, err
+	}
+	var remotes []string
+	for _, id := range p.syncIDs() {
+		if !strings.HasPrefix(id, l.ID()+"_") {
+			return "", nil, fmt.Errorf("Can't find the roots of profile %s", p.Name)
+		}
+		remotes = append(remotes, strings.TrimPrefix(id, l.ID()+"_"))
+	}
+	return l.ID(), remotes, nil
+}
+
+// within is whether the ID is the root's ID, or the ID of a file inside it.
+// Folders are the same with or without a trailing separator
+func within(id, root, separator string) bool {
+	id = strings.TrimSuffix(id, separator)
+	root = strings.TrimSuffix(root, separator)
+	return id == root || strings.HasPrefix(id, root+separator)
+}
+
+// overlap returns the side, local or remote, on which one of one profile's roots
+// is the same as, inside of, or contains one of the other's, or an empty string
+// if they're apart on both sides
+func (p *profileStore) overlap(other *profileStore) (string, error) {
+	localRoot, remoteRoots, err := p.rootIDs()
+	if err != nil {
+		return "", err
+	}
+	otherLocal, otherRemotes, err := other.rootIDs()
+	if err != nil {
+		return "", err
+	}
+
+	sep := string(filepath.Separator)
+	if within(localRoot, otherLocal, sep) || within(otherLocal, localRoot, sep) {
+		return "local", nil
+	}
+	for _, remoteRoot := range remoteRoots {
+		for _, otherRemote := range otherRemotes {
+			if within(remoteRoot, otherRemote, "/") || within(otherRemote, remoteRoot, "/") {
+				return "remote", nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// checkOverlap refuses a profile whose local or remote root overlaps the same
+// side of another stored profile.  The profiles would sync the same files, and
+// undo each other's changes, often back and forth without end.  Stored profiles
+// skip returns true for aren't checked
+func (p *profileStore) checkOverlap(skip func(other *profileStore) bool) error {
+	all, err := storedProfiles()
+	if err != nil {
+		return err
+	}
+	for _, other := range all {
+		if skip(other) {
+			continue
+		}
+		side, err := p.overlap(other)
+		if err != nil {
+			return err
+		}
+		if side != "" {
+			return fmt.Errorf("The %s folder overlaps the %s folder of profile %s, profiles can't sync the same files",
+				side, side, other.Name)
+		}
+	}
+	return nil
+}
+
+// logOverlaps warns about active profiles which overlap each other, which could
+// be added before overlapping profiles were refused
+func logOverlaps(all []*profileStore) {
+	for i := range all {
+		if !all[i].Active {
+			continue
+		}
+		for j := i + 1; j < len(all); j++ {
+			if !all[j].Active {
+				continue
+			}
+			side, err := all[i].overlap(all[j])
+			if err != nil {
+				logger.Errorf("Error checking if profiles %s and %s overlap: %s", all[i].Name, all[j].Name, err)
+				continue
+			}
+			if side != "" {
+				logger.Profile(all[i].Name).Warnf("Profiles %s and %s sync overlapping %s folders, and can undo each other's "+
+					"changes. Change the folders of one of them, or deactivate it.", all[i].Name, all[j].Name, side)
+			}
+		}
+	}
+}
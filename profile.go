@@ -8,6 +8,9 @@ import (
 	"errors"
 	"net/http"
 	"strings"
+
+	"bitbucket.org/tshannon/freehold-sync/local"
+	"bitbucket.org/tshannon/freehold-sync/syncer"
 )
 
 /*profile:
@@ -51,8 +54,7 @@ func profilePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	profile, err := newProfile(input.Name, input.Direction, input.ConflictResolution, input.ConflictDurationSeconds, input.Active,
-		input.Ignore, input.LocalPath, input.RemotePath, input.Client)
+	profile, err := newProfile(input)
 	if errHandled(err, w) {
 		return
 	}
@@ -102,7 +104,12 @@ func profileStatusGet(w http.ResponseWriter, r *http.Request) {
 
 	respondJsend(w, &jsend{
 		Status: statusSuccess,
-		Data:   map[string]interface{}{"status": status, "count": count},
+		Data: map[string]interface{}{
+			"status":       status,
+			"count":        count,
+			"warning":      local.ProfileWarning(profile.ID),
+			"destinations": profile.destinationStatus(),
+		},
 	})
 }
 
@@ -130,3 +137,407 @@ func profileDelete(w http.ResponseWriter, r *http.Request) {
 		Status: statusSuccess,
 	})
 }
+
+func profilePlanGet(w http.ResponseWriter, r *http.Request) {
+	input := &profileStore{}
+
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	if strings.TrimSpace(input.ID) == "" {
+		errHandled(errors.New("No ID specified. You must specify a profile ID when getting a plan."), w)
+		return
+	}
+
+	profile, err := getProfile(input.ID)
+	if errHandled(err, w) {
+		return
+	}
+
+	if !profile.DryRun {
+		errHandled(errors.New("Profile is not running in dry run mode."), w)
+		return
+	}
+
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+		Data:   syncer.ProfilePlan(profile.ID),
+	})
+}
+
+func profileHistoryGet(w http.ResponseWriter, r *http.Request) {
+	input := &struct {
+		ID   string `json:"id"`
+		Path string `json:"path"`
+	}{}
+
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	if strings.TrimSpace(input.ID) == "" {
+		errHandled(errors.New("No ID specified. You must specify a profile ID when getting a file's history."), w)
+		return
+	}
+
+	profile, err := getProfile(input.ID)
+	if errHandled(err, w) {
+		return
+	}
+
+	history, err := syncer.ProfileHistory(profile.ID, input.Path)
+	if errHandled(err, w) {
+		return
+	}
+
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+		Data:   history,
+	})
+}
+
+func profilePausePut(w http.ResponseWriter, r *http.Request) {
+	input := &profileStore{}
+
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	if strings.TrimSpace(input.ID) == "" {
+		errHandled(errors.New("No ID specified. You must specify a profile ID."), w)
+		return
+	}
+
+	profile, err := getProfile(input.ID)
+	if errHandled(err, w) {
+		return
+	}
+
+	if errHandled(profile.setPaused(input.Paused), w) {
+		return
+	}
+
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+	})
+}
+
+type queueInput struct {
+	ID     string `json:"id"`
+	Change uint64 `json:"change"`
+}
+
+func profileQueueGet(w http.ResponseWriter, r *http.Request) {
+	input := &queueInput{}
+
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	if strings.TrimSpace(input.ID) == "" {
+		errHandled(errors.New("No ID specified. You must specify a profile ID when getting a queue."), w)
+		return
+	}
+
+	queue, err := syncer.ProfileQueue(input.ID)
+	if errHandled(err, w) {
+		return
+	}
+
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+		Data:   queue,
+	})
+}
+
+func profileQueueDelete(w http.ResponseWriter, r *http.Request) {
+	input := &queueInput{}
+
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	if strings.TrimSpace(input.ID) == "" {
+		errHandled(errors.New("No ID specified. You must specify a profile ID."), w)
+		return
+	}
+
+	if errHandled(syncer.CancelChange(input.ID, input.Change), w) {
+		return
+	}
+
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+	})
+}
+
+func profileVerifyGet(w http.ResponseWriter, r *http.Request) {
+	input := &profileStore{}
+
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	if strings.TrimSpace(input.ID) == "" {
+		errHandled(errors.New("No ID specified. You must specify a profile ID when getting a verify report."), w)
+		return
+	}
+
+	report, err := syncer.ProfileAudit(input.ID)
+	if errHandled(err, w) {
+		return
+	}
+
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+		Data:   report,
+	})
+}
+
+func profileVerifyPost(w http.ResponseWriter, r *http.Request) {
+	input := &profileStore{}
+
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	if strings.TrimSpace(input.ID) == "" {
+		errHandled(errors.New("No ID specified. You must specify a profile ID."), w)
+		return
+	}
+
+	ps, err := getProfile(input.ID)
+	if errHandled(err, w) {
+		return
+	}
+
+	profile, err := ps.makeProfile()
+	if errHandled(err, w) {
+		return
+	}
+
+	if errHandled(profile.StartAudit(), w) {
+		return
+	}
+
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+	})
+}
+
+func profileRepairPost(w http.ResponseWriter, r *http.Request) {
+	input := &profileStore{}
+
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	if strings.TrimSpace(input.ID) == "" {
+		errHandled(errors.New("No ID specified. You must specify a profile ID."), w)
+		return
+	}
+
+	ps, err := getProfile(input.ID)
+	if errHandled(err, w) {
+		return
+	}
+
+	if errHandled(ps.repair(), w) {
+		return
+	}
+
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+	})
+}
+
+func profileDeletesGet(w http.ResponseWriter, r *http.Request) {
+	input := &profileStore{}
+
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	if strings.TrimSpace(input.ID) == "" {
+		errHandled(errors.New("No ID specified. You must specify a profile ID."), w)
+		return
+	}
+
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+		Data:   syncer.ProfileHeldDeletes(input.ID),
+	})
+}
+
+func profileDeletesPost(w http.ResponseWriter, r *http.Request) {
+	input := &profileStore{}
+
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	if strings.TrimSpace(input.ID) == "" {
+		errHandled(errors.New("No ID specified. You must specify a profile ID."), w)
+		return
+	}
+
+	if errHandled(syncer.ConfirmDeletes(input.ID), w) {
+		return
+	}
+
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+	})
+}
+
+func profileDeletesDelete(w http.ResponseWriter, r *http.Request) {
+	input := &profileStore{}
+
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	if strings.TrimSpace(input.ID) == "" {
+		errHandled(errors.New("No ID specified. You must specify a profile ID."), w)
+		return
+	}
+
+	if errHandled(syncer.DiscardDeletes(input.ID), w) {
+		return
+	}
+
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+	})
+}
+
+func profileConflictsGet(w http.ResponseWriter, r *http.Request) {
+	input := &profileStore{}
+
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	if strings.TrimSpace(input.ID) == "" {
+		errHandled(errors.New("No ID specified. You must specify a profile ID."), w)
+		return
+	}
+
+	conflicts, err := syncer.ProfileConflicts(input.ID)
+	if errHandled(err, w) {
+		return
+	}
+
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+		Data:   conflicts,
+	})
+}
+
+func profileConflictsPost(w http.ResponseWriter, r *http.Request) {
+	input := &struct {
+		ID         string `json:"id"`
+		Path       string `json:"path"`
+		Resolution string `json:"resolution"`
+	}{}
+
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	if strings.TrimSpace(input.ID) == "" {
+		errHandled(errors.New("No ID specified. You must specify a profile ID."), w)
+		return
+	}
+
+	profile, err := getProfile(input.ID)
+	if errHandled(err, w) {
+		return
+	}
+
+	if errHandled(profile.resolveConflict(input.Path, input.Resolution), w) {
+		return
+	}
+
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+	})
+}
+
+func profileQuarantineGet(w http.ResponseWriter, r *http.Request) {
+	input := &profileStore{}
+
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	if strings.TrimSpace(input.ID) == "" {
+		errHandled(errors.New("No ID specified. You must specify a profile ID."), w)
+		return
+	}
+
+	quarantined, err := syncer.ProfileQuarantined(input.ID)
+	if errHandled(err, w) {
+		return
+	}
+
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+		Data:   quarantined,
+	})
+}
+
+func profileQuarantinePost(w http.ResponseWriter, r *http.Request) {
+	input := &struct {
+		ID   string `json:"id"`
+		Path string `json:"path"`
+	}{}
+
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	if strings.TrimSpace(input.ID) == "" {
+		errHandled(errors.New("No ID specified. You must specify a profile ID."), w)
+		return
+	}
+
+	profile, err := getProfile(input.ID)
+	if errHandled(err, w) {
+		return
+	}
+
+	if errHandled(profile.releaseQuarantined(input.Path), w) {
+		return
+	}
+
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+	})
+}
+
+// profileTestPost tests a profile's connection and paths, either the stored
+// profile with the passed in ID, or the passed in settings of a new one
+func profileTestPost(w http.ResponseWriter, r *http.Request) {
+	input := &profileStore{}
+
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	if input.ID != "" {
+		profile, err := getProfile(input.ID)
+		if errHandled(err, w) {
+			return
+		}
+		input = profile
+	} else if errHandled(input.loadSecrets(), w) {
+		return
+	}
+
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+		Data:   input.testConnection(),
+	})
+}
@@ -0,0 +1,255 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// profileExportVersion is the version of the export format, raised when
+// importing a newer export could lose settings
+const profileExportVersion = 1
+
+const exportSaltSize = 16
+
+// profileExport is a set of profile definitions, for moving them to another
+// freehold-sync.  Each profile has the same fields as a profile in the /v1/
+// API.  Secrets are left out, unless they're sealed with a passphrase
+type profileExport struct {
+	Version  int                `json:"version"`
+	Exported time.Time          `json:"exported"`
+	Salt     []byte             `json:"salt,omitempty"` // of the key the secrets are sealed with, if they were exported
+	Profiles []*exportedProfile `json:"profiles"`
+}
+
+// exportedProfile is a profile as it's exported
+type exportedProfile struct {
+	apiProfile
+	Secrets []byte `json:"secrets,omitempty"` // sealed exportedSecrets
+}
+
+// exportedSecrets are the secrets of a profile, which are sealed before
+// they're exported
+type exportedSecrets struct {
+	Passphrase    string `json:"passphrase,omitempty"`
+	Password      string `json:"password,omitempty"`
+	Token         string `json:"token,omitempty"`
+	ProxyPassword string `json:"proxyPassword,omitempty"`
+
+	Destinations []*exportedSecrets `json:"destinations,omitempty"` // of the profile's destinations, in order
+}
+
+// importResult is what happened to one of the profiles being imported
+type importResult struct {
+	Name  string `json:"name"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// exportCipher returns the cipher secrets are sealed with, from the passphrase
+func exportCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// exportProfiles exports the profiles with the passed in IDs, or every profile
+// if none are passed in.  Their secrets are sealed with the passphrase, or left
+// out if there isn't one
+func exportProfiles(ids []string, passphrase string) (*profileExport, error) {
+	var all []*profileStore
+	if len(ids) == 0 {
+		var err error
+		all, err = allProfiles()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range ids {
+		ps, err := getProfile(id)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading profile %s: %s", id, err)
+		}
+		all = append(all, ps)
+	}
+
+	e := &profileExport{
+		Version:  profileExportVersion,
+		Exported: time.Now(),
+		Profiles: make([]*exportedProfile, 0, len(all)),
+	}
+	var aead cipher.AEAD
+	if passphrase != "" {
+		e.Salt = make([]byte, exportSaltSize)
+		_, err := rand.Read(e.Salt)
+		if err != nil {
+			return nil, err
+		}
+		aead, err = exportCipher(passphrase, e.Salt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, ps := range all {
+		ep := &exportedProfile{apiProfile: *newAPIProfile(ps)}
+		if aead != nil {
+			secrets := clientSecrets(ps.Client)
+			secrets.Passphrase = ps.Passphrase
+			for i := range ps.Destinations {
+				secrets.Destinations = append(secrets.Destinations, clientSecrets(ps.Destinations[i].Client))
+			}
+			sealed, err := seal(aead, secrets)
+			if err != nil {
+				return nil, err
+			}
+			ep.Secrets = sealed
+		}
+		e.Profiles = append(e.Profiles, ep)
+	}
+	return e, nil
+}
+
+// clientSecrets returns the secrets the client connects with
+func clientSecrets(c *client) *exportedSecrets {
+	secrets := &exportedSecrets{}
+	if c != nil {
+		secrets.Password = optional(c.Password)
+		secrets.Token = optional(c.Token)
+		secrets.ProxyPassword = optional(c.ProxyPassword)
+	}
+	return secrets
+}
+
+func seal(aead cipher.AEAD, secrets *exportedSecrets) ([]byte, error) {
+	data, err := json.Marshal(secrets)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+func unseal(aead cipher.AEAD, sealed []byte) (*exportedSecrets, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("The exported secrets are corrupt")
+	}
+	data, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("Wrong passphrase for the exported secrets")
+	}
+	secrets := &exportedSecrets{}
+	err = json.Unmarshal(data, secrets)
+	if err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// importProfiles adds the exported profiles, with their secrets if they were
+// exported with them.  Paused imports the profiles paused, so their folders can
+// be checked before they start syncing on this machine.  A profile which can't
+// be added doesn't stop the rest from being imported
+func importProfiles(e *profileExport, passphrase string, paused bool) ([]*importResult, error) {
+	if e.Version > profileExportVersion {
+		return nil, errors.New("The profiles were exported from a newer version of Freehold-Sync")
+	}
+
+	var aead cipher.AEAD
+	if len(e.Salt) > 0 {
+		if passphrase == "" {
+			return nil, errors.New("The profiles were exported with their secrets, a passphrase is required " +
+				"to import them")
+		}
+		var err error
+		aead, err = exportCipher(passphrase, e.Salt)
+		if err != nil {
+			return nil, err
+		}
+		// a wrong passphrase is caught before any profiles are added
+		for _, ep := range e.Profiles {
+			if len(ep.Secrets) > 0 {
+				_, err = unseal(aead, ep.Secrets)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	results := make([]*importResult, 0, len(e.Profiles))
+	for _, ep := range e.Profiles {
+		result := &importResult{Name: ep.Name}
+		ps, err := ep.profileStore(aead, paused)
+		if err == nil {
+			ps, err = newProfile(ps)
+		}
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.ID = ps.ID
+			logger.Profile(ps.Name).Infof("Imported profile %s", ps.Name)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// profileStore converts the exported profile to how it's stored, with its
+// secrets unsealed
+func (ep *exportedProfile) profileStore(aead cipher.AEAD, paused bool) (*profileStore, error) {
+	a := ep.apiProfile
+	if paused {
+		a.Paused = true
+	}
+	if aead != nil && len(ep.Secrets) > 0 {
+		secrets, err := unseal(aead, ep.Secrets)
+		if err != nil {
+			return nil, err
+		}
+		a.Passphrase = secrets.Passphrase
+		a.Remote = secrets.apply(a.Remote)
+		if len(secrets.Destinations) == len(a.Destinations) {
+			destinations := make([]*apiDestination, len(a.Destinations))
+			for i := range a.Destinations {
+				d := *a.Destinations[i]
+				d.Remote = secrets.Destinations[i].apply(d.Remote)
+				destinations[i] = &d
+			}
+			a.Destinations = destinations
+		}
+	}
+	return a.profileStore("")
+}
+
+// apply returns a copy of the remote with the secrets
+func (s *exportedSecrets) apply(r *apiRemote) *apiRemote {
+	if r == nil {
+		return nil
+	}
+	remote := *r
+	remote.Password = s.Password
+	remote.Token = s.Token
+	remote.ProxyPassword = s.ProxyPassword
+	return &remote
+}
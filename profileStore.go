@@ -12,10 +12,10 @@ import (
 	"strings"
 	"time"
 
-	"github.com/boltdb/bolt"
-
+	"bitbucket.org/tshannon/freehold-sync/credentials"
 	"bitbucket.org/tshannon/freehold-sync/datastore"
 	"bitbucket.org/tshannon/freehold-sync/local"
+	"bitbucket.org/tshannon/freehold-sync/log"
 	"bitbucket.org/tshannon/freehold-sync/remote"
 	"bitbucket.org/tshannon/freehold-sync/syncer"
 )
@@ -25,32 +25,54 @@ const bucket = datastore.BucketProfile
 // profileStore is the structure of how profile
 // information will be stored in a local datastore file
 type profileStore struct {
-	Name                    string   `json:"name"`
-	Direction               int      `json:"direction"`
-	ConflictResolution      int      `json:"conflictResolution"`
-	Ignore                  []string `json:"ignore"`
-	ConflictDurationSeconds int      `json:"conflictDurationSeconds"`
-	LocalPath               string   `json:"localPath"`
-	RemotePath              string   `json:"remotePath"`
-	ID                      string   `json:"id"`
-	Active                  bool     `json:"active"`
-	Client                  *client  `json:"client"`
-}
-
-func newProfile(name string, direction, conflictResolution, conflictDurationSeconds int, active bool, ignore []string,
-	localPath, remotePath string, remoteClient *client) (*profileStore, error) {
-	ps := &profileStore{
-		ConflictResolution:      conflictResolution,
-		Direction:               direction,
-		Name:                    name,
-		Ignore:                  ignore,
-		Active:                  active,
-		LocalPath:               localPath,
-		RemotePath:              remotePath,
-		Client:                  remoteClient,
-		ConflictDurationSeconds: conflictDurationSeconds,
-	}
+	Name                    string         `json:"name"`
+	Direction               int            `json:"direction"`
+	ConflictResolution      int            `json:"conflictResolution"`
+	Ignore                  []string       `json:"ignore"`
+	Filters                 []string       `json:"filters"`
+	Folders                 []string       `json:"folders"`
+	MaxFileSizeMB           int            `json:"maxFileSizeMB"`
+	UploadLimitKB           int            `json:"uploadLimitKB"`
+	DownloadLimitKB         int            `json:"downloadLimitKB"`
+	ConflictDurationSeconds int            `json:"conflictDurationSeconds"`
+	ConflictName            string         `json:"conflictName"`
+	LocalPath               string         `json:"localPath"`
+	RemotePath              string         `json:"remotePath"`
+	ID                      string         `json:"id"`
+	Active                  bool           `json:"active"`
+	Client                  *client        `json:"client"`
+	DryRun                  bool           `json:"dryRun"`
+	Paused                  bool           `json:"paused"`
+	Schedule                string         `json:"schedule"`
+	ScheduleWindowMinutes   int            `json:"scheduleWindowMinutes"`
+	KeepVersions            int            `json:"keepVersions"`
+	Trash                   bool           `json:"trash"`
+	TrashDays               int            `json:"trashDays"`
+	Verify                  bool           `json:"verify"`
+	Symlinks                int            `json:"symlinks"`
+	MaxDeletes              int            `json:"maxDeletes"`
+	MaxDeletePercent        int            `json:"maxDeletePercent"`
+	MinFreeSpaceMB          int            `json:"minFreeSpaceMB"`
+	PollSeconds             int            `json:"pollSeconds"`
+	LocalMonitor            int            `json:"localMonitor"`
+	Compress                bool           `json:"compress"`
+	CompressExclude         []string       `json:"compressExclude"`
+	Encrypt                 bool           `json:"encrypt"`
+	Passphrase              string         `json:"passphrase"`
+	EncryptNames            bool           `json:"encryptNames"`
+	ReportEmail             string         `json:"reportEmail"`     // comma separated addresses reports and alerts are sent to
+	ReportFrequency         string         `json:"reportFrequency"` // daily, weekly, or empty for no reports
+	ReportAlerts            bool           `json:"reportAlerts"`    // email critical failures right away
+	PreSyncHook             string         `json:"preSyncHook"`
+	PostSyncHook            string         `json:"postSyncHook"`
+	ErrorHook               string         `json:"errorHook"`
+	Declared                bool           `json:"declared"`     // managed by the profiles file
+	Destinations            []*destination `json:"destinations"` // other remote folders the local folder is synced to
+}
 
+// newProfile validates and stores a new profile from the passed in settings
+func newProfile(ps *profileStore) (*profileStore, error) {
+	ps.ID = ""
 	_, err := ps.makeProfile()
 	if err != nil {
 		return nil, err
@@ -79,22 +101,41 @@ func getProfile(id string) (*profileStore, error) {
 		return nil, err
 	}
 
+	err = ps.loadSecrets()
+	if err != nil {
+		return nil, err
+	}
 	return ps, nil
 }
 
 func allProfiles() ([]*profileStore, error) {
+	all, err := storedProfiles()
+	if err != nil {
+		return nil, err
+	}
+	for i := range all {
+		err = all[i].loadSecrets()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return all, nil
+}
+
+// storedProfiles returns the profiles as they are in the datastore, without
+// their secrets
+func storedProfiles() ([]*profileStore, error) {
 	var all []*profileStore
-	err := datastore.DB().View(func(tx *bolt.Tx) error {
-		c := tx.Bucket([]byte(bucket)).Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
+	err := datastore.View(func(tx *datastore.Tx) error {
+		return tx.Each(bucket, func(key string, value []byte) error {
 			p := &profileStore{}
-			err := json.Unmarshal(v, p)
+			err := json.Unmarshal(value, p)
 			if err != nil {
 				return err
 			}
 			all = append(all, p)
-		}
-		return nil
+			return nil
+		})
 	})
 
 	if err != nil {
@@ -117,16 +158,33 @@ func (p *profileStore) makeProfile() (*syncer.Profile, error) {
 
 	if p.Direction != syncer.DirectionBoth &&
 		p.Direction != syncer.DirectionLocalOnly &&
-		p.Direction != syncer.DirectionRemoteOnly {
+		p.Direction != syncer.DirectionRemoteOnly &&
+		p.Direction != syncer.DirectionMirrorRemote &&
+		p.Direction != syncer.DirectionMirrorLocal &&
+		p.Direction != syncer.DirectionBackup {
 
 		return nil, errors.New("Invalid sync profile direction")
 	}
 
-	if p.ConflictResolution != syncer.ConResOverwrite &&
-		p.ConflictResolution != syncer.ConResRename {
+	if p.ConflictResolution != syncer.ConResKeepNewest &&
+		p.ConflictResolution != syncer.ConResKeepBoth &&
+		p.ConflictResolution != syncer.ConResKeepLocal &&
+		p.ConflictResolution != syncer.ConResKeepRemote &&
+		p.ConflictResolution != syncer.ConResAsk {
 		return nil, errors.New("Invalid sync profile conflict resolution")
 	}
 
+	if p.Symlinks != syncer.SymlinksSkip &&
+		p.Symlinks != syncer.SymlinksFollow &&
+		p.Symlinks != syncer.SymlinksError {
+		return nil, errors.New("Invalid sync profile symlink policy")
+	}
+
+	err := syncer.ValidateConflictName(p.ConflictName)
+	if err != nil {
+		return nil, err
+	}
+
 	var ignore []*regexp.Regexp
 
 	//validate regex
@@ -139,6 +197,77 @@ func (p *profileStore) makeProfile() (*syncer.Profile, error) {
 		ignore = append(ignore, rx)
 	}
 
+	filter, err := syncer.NewFilter(p.Filters)
+	if err != nil {
+		return nil, err
+	}
+
+	folders, err := syncer.CleanFolders(p.Folders)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.MaxFileSizeMB < 0 {
+		return nil, errors.New("Invalid max file size")
+	}
+
+	if p.UploadLimitKB < 0 || p.DownloadLimitKB < 0 {
+		return nil, errors.New("Invalid bandwidth limit")
+	}
+
+	var schedule *syncer.Cron
+	if strings.TrimSpace(p.Schedule) != "" {
+		schedule, err = syncer.ParseCron(p.Schedule)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.ScheduleWindowMinutes < 0 {
+		return nil, errors.New("Invalid schedule window")
+	}
+
+	if p.KeepVersions < 0 {
+		return nil, errors.New("Invalid number of versions to keep")
+	}
+
+	if p.TrashDays < 0 {
+		return nil, errors.New("Invalid number of days to keep trash")
+	}
+
+	if p.MaxDeletes < 0 || p.MaxDeletePercent < 0 || p.MaxDeletePercent > 100 {
+		return nil, errors.New("Invalid delete limit")
+	}
+
+	if p.MinFreeSpaceMB < 0 {
+		return nil, errors.New("Invalid minimum free space")
+	}
+
+	err = p.validateReport()
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := syncer.Hooks{
+		PreSync:  strings.TrimSpace(p.PreSyncHook),
+		PostSync: strings.TrimSpace(p.PostSyncHook),
+		OnError:  strings.TrimSpace(p.ErrorHook),
+	}
+	if hooks != (syncer.Hooks{}) && !hooksEnabled {
+		return nil, errors.New("Hook commands are turned off, set hooks to true in settings.json to use them")
+	}
+
+	if p.LocalMonitor != syncer.LocalMonitorAuto &&
+		p.LocalMonitor != syncer.LocalMonitorEvents &&
+		p.LocalMonitor != syncer.LocalMonitorScan {
+		return nil, errors.New("Invalid local monitoring method")
+	}
+
+	pollInterval := time.Duration(p.PollSeconds) * time.Second
+	if pollInterval != 0 && (pollInterval < remote.MinPollInterval || pollInterval > remote.MaxPollInterval) {
+		return nil, fmt.Errorf("Invalid remote polling interval, it must be between %s and %s",
+			remote.MinPollInterval, remote.MaxPollInterval)
+	}
+
 	lFile, err := local.New(p.LocalPath)
 	if err != nil {
 		return nil, fmt.Errorf("Error accessing the local sync path: %s", err)
@@ -160,15 +289,54 @@ func (p *profileStore) makeProfile() (*syncer.Profile, error) {
 		return nil, fmt.Errorf("Remote sync path does not exist!")
 	}
 
+	if p.Encrypt && p.Passphrase == "" {
+		return nil, errors.New("An encrypted profile must have a passphrase")
+	}
+	passphrase := ""
+	if p.Encrypt {
+		passphrase = p.Passphrase
+	}
+	err = remote.Encrypt(rFile, passphrase, p.Encrypt && p.EncryptNames)
+	if err != nil {
+		return nil, err
+	}
+
 	profile := &syncer.Profile{
 		Name:               p.Name,
 		Direction:          p.Direction,
 		ConflictResolution: p.ConflictResolution,
 		ConflictDuration:   time.Duration(p.ConflictDurationSeconds) * time.Second,
+		ConflictTemplate:   p.ConflictName,
 		Ignore:             ignore,
+		DryRun:             p.DryRun,
+		Filter:             filter,
+		Folders:            folders,
+		MaxFileSize:        int64(p.MaxFileSizeMB) * 1024 * 1024,
+		UploadLimit:        int64(p.UploadLimitKB) * 1024,
+		DownloadLimit:      int64(p.DownloadLimitKB) * 1024,
+		Workers:            transferWorkers,
+		ModifiedTolerance:  modifiedTolerance,
+		Schedule:           schedule,
+		ScheduleWindow:     time.Duration(p.ScheduleWindowMinutes) * time.Minute,
+		KeepVersions:       p.KeepVersions,
+		Trash:              p.Trash,
+		TrashRetention:     time.Duration(p.TrashDays) * 24 * time.Hour,
+		Verify:             p.Verify,
+		Symlinks:           p.Symlinks,
+		MaxDeletes:         p.MaxDeletes,
+		MaxDeletePercent:   p.MaxDeletePercent,
+		MinFreeSpace:       int64(p.MinFreeSpaceMB) * 1024 * 1024,
+		PollInterval:       pollInterval,
+		LocalMonitor:       p.LocalMonitor,
+		Compress:           p.Compress,
+		CompressExclude:    p.CompressExclude,
+		Hooks:              hooks,
 		Local:              lFile,
 		Remote:             rFile,
 	}
+	if len(p.Destinations) > 0 {
+		profile.LocalChanged = passOnLocal
+	}
 
 	p.ID = profile.ID()
 	return profile, nil
@@ -176,10 +344,37 @@ func (p *profileStore) makeProfile() (*syncer.Profile, error) {
 
 func (p *profileStore) update() error {
 	oldID := p.ID
+	var old *profileStore
+	if oldID != "" {
+		var err error
+		old, err = getProfile(oldID)
+		if err != nil && err != datastore.ErrNotFound {
+			return err
+		}
+		if old != nil && (old.Encrypt != p.Encrypt || old.EncryptNames != p.EncryptNames) {
+			return errors.New("Encryption can't be turned on or off for an existing profile")
+		}
+	}
+
 	profile, err := p.makeProfile()
 	if err != nil {
 		return err
 	}
+	destinations, err := p.makeDestinations()
+	if err != nil {
+		return err
+	}
+	err = p.checkDestinations()
+	if err != nil {
+		return err
+	}
+
+	err = p.checkOverlap(func(other *profileStore) bool {
+		return other.ID == oldID || other.ID == p.ID
+	})
+	if err != nil {
+		return err
+	}
 
 	if oldID != "" && oldID != profile.ID() {
 		//ID changed, check if an existing profile
@@ -199,21 +394,189 @@ func (p *profileStore) update() error {
 	if err != nil {
 		return err
 	}
+	err = p.stopDestinations(oldID, old)
+	if err != nil {
+		return err
+	}
 
-	err = datastore.Put(bucket, p.ID, p)
+	err = p.put()
 	if err != nil {
 		return err
 	}
+	if oldID != "" && oldID != p.ID {
+		err = credentials.Delete(passphraseAccount(oldID))
+		if err != nil {
+			return err
+		}
+	}
 
-	if p.Active {
-		return profile.Start()
+	if !p.Active {
+		return nil
+	}
+	err = startProfile(profile, p.Paused)
+	if err != nil {
+		return err
+	}
+	for i := range destinations {
+		err = startProfile(destinations[i], p.Paused)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stopDestinations stops the profile's destinations, and the ones it had as it
+// was stored with the old ID, before it's restarted with its current settings.
+// The synced state of destinations it no longer has is removed
+func (p *profileStore) stopDestinations(oldID string, old *profileStore) error {
+	fanOut.stopped(p.ID)
+	fanOut.stopped(oldID)
+	var removed []string
+	if old != nil {
+		for _, d := range old.Destinations {
+			if p.destination(d.ID) == nil {
+				removed = append(removed, d.ID)
+			}
+		}
+	}
+	err := stopRunning(append(p.syncIDs()[1:], removed...))
+	if err != nil {
+		return err
+	}
+	for _, id := range removed {
+		err = deleteProfile(id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startProfile starts the profile, pausing it right away if it was paused.
+// Fails if another freehold-sync process is syncing the same local folder
+func startProfile(profile *syncer.Profile, paused bool) error {
+	err := lockLocalRoot(profile.Local.ID())
+	if err != nil {
+		return err
+	}
+	err = profile.Start()
+	if err != nil {
+		return err
+	}
+	unmounted.started(profile)
+	if profile.LocalChanged != nil {
+		fanOut.started(profile)
+	}
+
+	go func() {
+		err := local.EmptyTrash(profile)
+		if err != nil {
+			log.Module(local.LogType).Profile(profile.Name).Errorf("Error emptying trash for profile %s: %s", profile.Name, err)
+		}
+	}()
+
+	if paused {
+		return profile.Pause()
 	}
 	return nil
 }
 
+// setPaused pauses or resumes a running profile
+func (p *profileStore) setPaused(paused bool) error {
+	if !p.Active {
+		return errors.New("Profile is not active")
+	}
+
+	profile, err := p.makeProfile()
+	if err != nil {
+		return err
+	}
+
+	for _, prf := range append([]*syncer.Profile{profile}, p.runningDestinations()...) {
+		if paused {
+			err = prf.Pause()
+		} else {
+			err = prf.Resume()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	p.Paused = paused
+	return p.put()
+}
+
+// syncNow rescans a running profile in the background, syncing anything that
+// changed without waiting for it to be noticed
+func (p *profileStore) syncNow() error {
+	profile, err := p.makeProfile()
+	if err != nil {
+		return err
+	}
+	for _, prf := range append([]*syncer.Profile{profile}, p.runningDestinations()...) {
+		go func(prf *syncer.Profile) {
+			err := prf.Rescan()
+			if err != nil && err != syncer.ErrCanceled {
+				log.Module(syncer.LogType).Profile(prf.Name).Errorf("Error syncing profile %s: %s", prf.Name, err)
+			}
+		}(prf)
+	}
+	return nil
+}
+
+// put stores the profile in the datastore, and its secrets with the credentials provider
+func (p *profileStore) put() error {
+	stored, err := p.storeSecrets()
+	if err != nil {
+		return err
+	}
+	return datastore.Put(bucket, p.ID, stored)
+}
+
 func (p *profileStore) status() (int, string) {
-	count := syncer.ProfileSyncCount(p.ID)
+	return p.statusOf(p.ID)
+}
+
+// statusOf returns the status of the profile syncing as the ID, the profile's
+// own or the one for one of its destinations
+func (p *profileStore) statusOf(id string) (int, string) {
+	count := syncer.ProfileSyncCount(id)
 	if p.Active {
+		if p.Paused {
+			return count, "Paused"
+		}
+		if offline.has(id) {
+			return count, "Offline"
+		}
+		if unmounted.has(id) {
+			return count, "Volume Missing"
+		}
+		if remote.ProfileDegraded(id) {
+			return count, "Degraded"
+		}
+		if len(syncer.ProfileHeldDeletes(id)) > 0 {
+			return count, "Deletes Held"
+		}
+		if syncer.ProfileConflictCount(id) > 0 {
+			return count, "Conflicts"
+		}
+		if syncer.ProfileQuarantineCount(id) > 0 {
+			return count, "Quarantined"
+		}
+		if syncer.ProfileLowSpace(id, "local") {
+			return count, "Low Disk Space"
+		}
+		if syncer.ProfileLowSpace(id, "remote") {
+			return count, "Remote Nearly Full"
+		}
+		if syncer.ProfileIdle(id) {
+			return count, "Scheduled"
+		}
+		if p.DryRun {
+			return count, "Dry Run"
+		}
 		if count > 0 {
 			return count, "Syncing"
 		}
@@ -227,8 +590,16 @@ func (p *profileStore) status() (int, string) {
 
 }
 
+// deleteProfile removes the profile, along with the synced state and journal
+// kept for it
 func deleteProfile(ID string) error {
-	return datastore.Delete(bucket, ID)
+	return datastore.Update(func(tx *datastore.Tx) error {
+		err := tx.Delete(bucket, ID)
+		if err != nil {
+			return err
+		}
+		return tx.DeleteProfile(ID)
+	})
 }
 
 func (p *profileStore) delete() error {
@@ -236,5 +607,19 @@ func (p *profileStore) delete() error {
 	if profile != nil {
 		profile.Stop()
 	}
+	err := stopRunning(p.syncIDs())
+	if err != nil {
+		return err
+	}
+	err = p.deleteSecrets()
+	if err != nil {
+		return err
+	}
+	for i := range p.Destinations {
+		err = deleteProfile(p.Destinations[i].ID)
+		if err != nil {
+			return err
+		}
+	}
 	return deleteProfile(p.ID)
 }
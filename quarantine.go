@@ -0,0 +1,72 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"bitbucket.org/tshannon/freehold-sync/log"
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// releaseQuarantined lets the quarantined file at the slash separated path in
+// the profile be synced again.  It's synced in the background, and quarantined
+// again if it's still being changed back after every sync
+func (p *profileStore) releaseQuarantined(relPath string) error {
+	if !p.Active {
+		return errors.New("Profile is not active")
+	}
+	if p.Paused {
+		return errors.New("Profile is paused")
+	}
+
+	quarantined, err := syncer.ProfileQuarantined(p.ID)
+	if err != nil {
+		return err
+	}
+	relPath = strings.Trim(filepath.ToSlash(relPath), "/")
+	found := false
+	for i := range quarantined {
+		if quarantined[i].Path == relPath {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return syncer.ErrNotQuarantined
+	}
+
+	profile, err := p.makeProfile()
+	if err != nil {
+		return err
+	}
+	lFile, rFile, err := profileFiles(profile, relPath)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		err := profile.Release(lFile, rFile)
+		if err != nil && err != syncer.ErrCanceled {
+			log.Module(syncer.LogType).Profile(profile.Name).Errorf("Error syncing released file %s: %s", relPath, err)
+		}
+	}()
+	return nil
+}
+
+// alertQuarantines sends an alert for every file quarantined for being synced
+// back and forth, since it isn't synced again until someone releases it
+func alertQuarantines() {
+	events, _ := syncer.Subscribe()
+	go func() {
+		for e := range events {
+			if e.Type == syncer.EventQuarantined {
+				alert(e.Profile, e.Error)
+			}
+		}
+	}()
+}
@@ -6,13 +6,17 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
 	fh "bitbucket.org/tshannon/freehold-client"
+	"bitbucket.org/tshannon/freehold-sync/credentials"
+	"bitbucket.org/tshannon/freehold-sync/log"
 	"bitbucket.org/tshannon/freehold-sync/remote"
+	"bitbucket.org/tshannon/freehold-sync/syncer"
 )
 
 type tokenInput struct {
@@ -21,14 +25,98 @@ type tokenInput struct {
 }
 
 type client struct {
-	URL      *string `json:"url"`
-	User     *string `json:"user"`
-	Password *string `json:"password"`
-	Token    *string `json:"token"`
+	URL           *string `json:"url"`
+	User          *string `json:"user"`
+	Password      *string `json:"password"`
+	Token         *string `json:"token"`
+	CAFile        *string `json:"caFile"`
+	CertFile      *string `json:"certFile"`
+	KeyFile       *string `json:"keyFile"`
+	Pins          *string `json:"pins"`  // comma separated
+	Proxy         *string `json:"proxy"` // http, https or socks5 url, direct to ignore the environment's proxy
+	ProxyUser     *string `json:"proxyUser"`
+	ProxyPassword *string `json:"proxyPassword"`
 }
 
+func optional(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return strings.TrimSpace(*value)
+}
+
+// httpClient builds the http client for connecting to the client's freehold instance
+func (c *client) httpClient() (*http.Client, error) {
+	opts := remote.TLSOptions{
+		CAFile:   optional(c.CAFile),
+		CertFile: optional(c.CertFile),
+		KeyFile:  optional(c.KeyFile),
+	}
+	for _, pin := range strings.Split(optional(c.Pins), ",") {
+		if strings.TrimSpace(pin) != "" {
+			opts.Pins = append(opts.Pins, pin)
+		}
+	}
+
+	cfg, err := remote.TLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := c.proxy()
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil && proxy == nil {
+		return &http.Client{Timeout: httpTimeout}, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+	if proxy != nil {
+		transport.Proxy = proxy
+	}
+	return &http.Client{
+		Timeout:   httpTimeout,
+		Transport: transport,
+	}, nil
+}
+
+// proxy returns the proxy the client's requests go through, nil to use the
+// one from the environment
+func (c *client) proxy() (func(*http.Request) (*url.URL, error), error) {
+	proxy := optional(c.Proxy)
+	if proxy == "" {
+		return nil, nil
+	}
+	if strings.ToLower(proxy) == "direct" {
+		return func(*http.Request) (*url.URL, error) { return nil, nil }, nil
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("Invalid proxy URL %s", proxy)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("Unsupported proxy type %s, it must be http, https or socks5", u.Scheme)
+	}
+
+	if user := optional(c.ProxyUser); user != "" {
+		if c.ProxyPassword != nil && *c.ProxyPassword != "" {
+			u.User = url.UserPassword(user, *c.ProxyPassword)
+		} else {
+			u.User = url.User(user)
+		}
+	}
+	return http.ProxyURL(u), nil
+}
+
+// remoteRoot is the path of the top of a freehold instance's files
+const remoteRoot = "/v1/file/"
+
 func remoteRootGet(w http.ResponseWriter, r *http.Request) {
-	defaultPath := "/v1/file/"
+	defaultPath := remoteRoot
 	input := &dirListInput{}
 
 	if errHandled(parseJSON(r, input), w) {
@@ -58,24 +146,69 @@ func remoteClient(input *client) (*fh.Client, error) {
 	}
 
 	pass := ""
+	password := ""
+	if input.Password != nil {
+		password = *input.Password
+	}
 
-	if input.Password != nil && *input.Password != "" {
-		pass = *input.Password
-	} else if input.Token != nil && *input.Token != "" {
+	if input.Token != nil && *input.Token != "" {
 		pass = *input.Token
+	} else {
+		pass = password
 	}
 
 	if input.Password == nil && input.Token == nil {
 		return nil, errors.New("Invalid input to retrieve a remote file.  You must provide a password or a token.")
 	}
+	log.AddSecret(pass)
+	log.AddSecret(password)
+	if input.ProxyPassword != nil {
+		log.AddSecret(*input.ProxyPassword)
+	}
 
-	c, err := fh.NewFromClient(&http.Client{Timeout: httpTimeout}, *input.URL, *input.User, pass)
+	httpClient, err := input.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	c, err := remote.NewClient(httpClient, *input.URL, *input.User, pass)
 	if err != nil {
 		return nil, err
 	}
+
+	if password != "" && pass != password {
+		// the password was kept to get a new token when this one expires
+		remote.SetReauthenticator(c, func() (string, error) {
+			return renewToken(input, password)
+		})
+	}
 	return c, nil
 }
 
+// renewToken gets a new token with the client's password, and stores it in
+// place of the old one
+func renewToken(input *client, password string) (string, error) {
+	// a plain client, so it doesn't replace the connection info of the one being renewed
+	httpClient, err := input.httpClient()
+	if err != nil {
+		return "", err
+	}
+	c, err := fh.NewFromClient(httpClient, *input.URL, *input.User, password)
+	if err != nil {
+		return "", err
+	}
+	t, err := c.NewToken("Freehold-Sync", "", "", time.Time{})
+	if err != nil {
+		return "", err
+	}
+
+	log.AddSecret(t.Token)
+	err = credentials.Set("token/"+input.account(), t.Token)
+	if err != nil {
+		return "", err
+	}
+	return t.Token, nil
+}
+
 func remoteGet(w http.ResponseWriter, r *http.Request) {
 	input := &dirListInput{}
 
@@ -113,16 +246,9 @@ func remoteGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	children, err := f.Children()
-	dirList := make([]string, 0, len(children))
-	for i := range children {
-		if children[i].IsDir() {
-			uri, err := url.Parse(children[i].ID())
-			if errHandled(err, w) {
-				return
-			}
-			dirList = append(dirList, uri.Path)
-		}
+	dirList, err := remoteFolders(f)
+	if errHandled(err, w) {
+		return
 	}
 
 	respondJsend(w, &jsend{
@@ -131,6 +257,27 @@ func remoteGet(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// remoteFolders returns the paths of the folders in the remote folder
+func remoteFolders(f *remote.File) ([]string, error) {
+	dirList := []string{}
+	err := f.ChildrenIter(func(children []syncer.Syncer) error {
+		for i := range children {
+			if children[i].IsDir() {
+				uri, err := url.Parse(children[i].ID())
+				if err != nil {
+					return err
+				}
+				dirList = append(dirList, uri.Path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dirList, nil
+}
+
 func tokenPost(w http.ResponseWriter, r *http.Request) {
 	input := &tokenInput{}
 	if errHandled(parseJSON(r, input), w) {
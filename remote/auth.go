@@ -0,0 +1,104 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"fmt"
+	"net/http"
+
+	fh "bitbucket.org/tshannon/freehold-client"
+)
+
+// Reauthenticator returns a new password or token for the client's user, for
+// when the one the client was built with is no longer accepted, such as an
+// expired token
+type Reauthenticator func() (string, error)
+
+// SetReauthenticator has requests from the client which are refused with
+// a 401 sign in again with the password or token from reauth, and be retried
+func SetReauthenticator(c *fh.Client, reauth Reauthenticator) {
+	info, ok := clients.get(c)
+	if !ok {
+		return
+	}
+	info.auth.Lock()
+	defer info.auth.Unlock()
+	info.reauth = reauth
+}
+
+// credentials are the user and password or token requests are currently made with
+func (i *clientInfo) credentials() (string, string) {
+	i.auth.Lock()
+	defer i.auth.Unlock()
+	return i.user, i.password
+}
+
+// refresh signs in again, unless another request already has since the
+// passed in password was refused
+func (i *clientInfo) refresh(refused string) (string, error) {
+	i.auth.Lock()
+	defer i.auth.Unlock()
+
+	if i.password != refused {
+		return i.password, nil
+	}
+	if i.reauth == nil {
+		return "", fmt.Errorf("The freehold instance refused the credentials for %s", i.user)
+	}
+	password, err := i.reauth()
+	if err != nil {
+		return "", err
+	}
+	i.password = password
+	logger.Infof("Signed in to the freehold instance again as %s", i.user)
+	return password, nil
+}
+
+// authTransport sends requests with the client's current credentials, and
+// signs in again when they are refused.  The freehold client sets the
+// credentials it was built with on its own requests, so this is the only place
+// they can be replaced once they change
+type authTransport struct {
+	base http.RoundTripper
+	info *clientInfo // set once the client is built
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.info == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	user, password := t.info.credentials()
+	signed := req.Clone(req.Context())
+	signed.SetBasicAuth(user, password)
+
+	res, err := t.base.RoundTrip(signed)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+
+	password, err = t.info.refresh(password)
+	if err != nil {
+		logger.Errorf("Error signing in to the freehold instance again: %s", err)
+		return res, nil
+	}
+
+	if req.Body != nil && req.GetBody == nil {
+		// the body has already been sent and can't be read again, the change
+		// will be retried with the new credentials from the retry queue
+		return res, nil
+	}
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return res, nil
+		}
+	}
+	res.Body.Close()
+	retry.SetBasicAuth(user, password)
+	return t.base.RoundTrip(retry)
+}
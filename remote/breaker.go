@@ -0,0 +1,226 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	fh "bitbucket.org/tshannon/freehold-client"
+)
+
+const (
+	breakerFailures = 5                // failures in a row before requests to an instance are stopped
+	breakerMinWait  = 30 * time.Second // wait before the first probe, doubled each time a probe fails
+	breakerMaxWait  = 10 * time.Minute
+)
+
+// ErrUnavailable is returned in place of making a request to a freehold instance
+// that has been failing, until it has been probed and is working again
+var ErrUnavailable = errors.New("The freehold instance is unavailable, waiting before trying it again")
+
+var breakers breakerMap // by instance
+
+func init() {
+	breakers = breakerMap{
+		instances: make(map[string]*breaker),
+	}
+}
+
+type breakerMap struct {
+	sync.Mutex
+	instances map[string]*breaker
+}
+
+// instanceKey is the scheme and host of the url, so every client of the same
+// instance shares a breaker
+func instanceKey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+func (b *breakerMap) get(key string) *breaker {
+	b.Lock()
+	defer b.Unlock()
+	br, ok := b.instances[key]
+	if !ok {
+		br = &breaker{instance: key}
+		b.instances[key] = br
+	}
+	return br
+}
+
+// breaker stops requests to an instance after it fails too many times in a row,
+// then lets a single request through now and then to see if it's back
+type breaker struct {
+	sync.Mutex
+	instance string
+	failures int
+	open     bool          // requests are stopped
+	wait     time.Duration // current wait between probes
+	probeAt  time.Time     // when the next request is let through
+	probing  bool          // a probe is in flight
+}
+
+// allow is whether or not a request can be made
+func (b *breaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+	if !b.open {
+		return true
+	}
+	if b.probing || time.Now().Before(b.probeAt) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *breaker) success() {
+	b.Lock()
+	defer b.Unlock()
+	if b.open {
+		logger.Infof("The freehold instance at %s is available again", b.instance)
+	}
+	b.failures = 0
+	b.open = false
+	b.probing = false
+	b.wait = 0
+}
+
+func (b *breaker) failure() {
+	b.Lock()
+	defer b.Unlock()
+	b.failures++
+
+	if b.open {
+		// probe failed
+		b.probing = false
+		b.wait *= 2
+		if b.wait > breakerMaxWait {
+			b.wait = breakerMaxWait
+		}
+		b.probeAt = time.Now().Add(b.wait)
+		return
+	}
+
+	if b.failures >= breakerFailures {
+		b.open = true
+		b.wait = breakerMinWait
+		b.probeAt = time.Now().Add(b.wait)
+		logger.Warnf("The freehold instance at %s has failed %d times in a row, requests to it are "+
+			"stopped until it responds again", b.instance, b.failures)
+	}
+}
+
+func (b *breaker) isOpen() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.open
+}
+
+// breakerTransport counts network errors and server errors from the instance,
+// and fails requests right away while its breaker is open
+type breakerTransport struct {
+	base http.RoundTripper
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	br := breakers.get(instanceKey(req.URL))
+	if !br.allow() {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, ErrUnavailable
+	}
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		if req.Context().Err() != nil {
+			// canceled by us, not a problem with the instance
+			br.Lock()
+			br.probing = false
+			br.Unlock()
+			return res, err
+		}
+		br.failure()
+		return res, err
+	}
+	// busy instances asking to wait are handled by limitTransport
+	if res.StatusCode >= http.StatusInternalServerError && res.Header.Get("Retry-After") == "" {
+		br.failure()
+	} else {
+		br.success()
+	}
+	return res, nil
+}
+
+// IsUnavailable is whether or not the error is from a request that wasn't made
+// because the instance's breaker is open
+func IsUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	// the freehold client doesn't always wrap the errors it gets back
+	return errors.Is(err, ErrUnavailable) || strings.Contains(err.Error(), ErrUnavailable.Error())
+}
+
+// offlineErrors are parts of the messages of errors from not being able to reach
+// an instance, for errors that don't keep their original type
+var offlineErrors = []string{
+	"connection refused",
+	"connection reset",
+	"no such host",
+	"no route to host",
+	"network is unreachable",
+	"i/o timeout",
+	"Client.Timeout exceeded",
+}
+
+// IsOffline is whether or not the error is from a freehold instance which can't
+// currently be reached, as opposed to one which refused the request
+func IsOffline(err error) bool {
+	if err == nil {
+		return false
+	}
+	if IsUnavailable(err) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	for i := range offlineErrors {
+		if strings.Contains(err.Error(), offlineErrors[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Degraded is whether or not requests to the client's instance are currently
+// stopped because it has been failing
+func Degraded(c *fh.Client) bool {
+	return breakers.get(instanceKey(c.RootURL())).isOpen()
+}
+
+// ProfileDegraded is whether or not the remote instance of the profile with
+// the passed in ID is degraded
+func ProfileDegraded(profileID string) bool {
+	watching.RLock()
+	defer watching.RUnlock()
+	for _, profiles := range watching.files {
+		for i := range profiles {
+			if profiles[i].ID() == profileID {
+				return Degraded(profiles[i].Remote.(*File).Client())
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	fh "bitbucket.org/tshannon/freehold-client"
+
+	"bitbucket.org/tshannon/freehold-sync/throttle"
+)
+
+var clients clientMap // connection info for requests the freehold client doesn't support
+
+// MaxTransfers is the most uploads and downloads that will run at once against
+// a single freehold instance.  Must be set before any clients are created
+var MaxTransfers = 4
+
+func init() {
+	clients = clientMap{
+		clients: make(map[string]*clientInfo),
+	}
+}
+
+// clientInfo is the connection information a freehold client was built with
+type clientInfo struct {
+	http        *http.Client
+	user        string
+	password    string
+	transfers   chan struct{} // limits concurrent transfers to MaxTransfers
+	probe       sync.Once     // guards asking the instance which encodings it accepts
+	gzip        bool          // whether the instance accepts gzipped uploads
+	auth        sync.Mutex    // guards password and reauth, which change when signing in again
+	reauth      Reauthenticator
+	requests    *throttle.Bucket // limits requests to MaxRequests per second
+	busyLock    sync.Mutex
+	busy        time.Time // requests wait until then after the instance said it was too busy
+	treeLock    sync.Mutex
+	treeChecked bool // whether or not the instance has been asked for a recursive listing
+	tree        bool // whether or not the instance supports recursive listings
+	copyLock    sync.Mutex
+	noCopy      bool // the instance turned down a copy, so it isn't asked again
+}
+
+type clientMap struct {
+	sync.RWMutex
+	clients map[string]*clientInfo
+}
+
+func clientKey(c *fh.Client) string {
+	return c.RootURL().String()
+}
+
+func (c *clientMap) add(client *fh.Client, info *clientInfo) {
+	c.Lock()
+	defer c.Unlock()
+	c.clients[clientKey(client)] = info
+}
+
+func (c *clientMap) get(client *fh.Client) (*clientInfo, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	info, ok := c.clients[clientKey(client)]
+	return info, ok
+}
+
+// NewClient returns a new freehold client, and keeps track of its connection
+// information so the remote package can make requests directly against
+// the freehold instance
+func NewClient(httpClient *http.Client, rootURL, user, passwordOrToken string) (*fh.Client, error) {
+	base := httpClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	limit := &limitTransport{base: &breakerTransport{base: &conditionTransport{base: &etagTransport{base: &gzipTransport{base: base}}}}}
+	auth := &authTransport{base: limit}
+	httpClient.Transport = auth
+
+	c, err := fh.NewFromClient(httpClient, rootURL, user, passwordOrToken)
+	if err != nil {
+		return nil, err
+	}
+
+	max := MaxTransfers
+	if max < 1 {
+		max = 1
+	}
+
+	info := &clientInfo{
+		http:      httpClient,
+		user:      user,
+		password:  passwordOrToken,
+		transfers: make(chan struct{}, max),
+		requests:  throttle.NewBucket(int64(MaxRequests)),
+	}
+	auth.info = info
+	limit.info = info
+	clients.add(c, info)
+
+	return c, nil
+}
+
+// fileURL is the full url for requesting the passed in freehold path
+func fileURL(c *fh.Client, filePath string) string {
+	uri := &url.URL{}
+	*uri = *c.RootURL()
+	uri.Path = filePath
+	return uri.String()
+}
+
+// newRequest builds a request against the freehold instance the client
+// points to
+func newRequest(c *fh.Client, method, filePath string, body io.Reader) (*http.Request, error) {
+	return http.NewRequest(method, fileURL(c, filePath), body)
+}
+
+// do runs the request with the http client and credentials the freehold
+// client was built with
+func do(c *fh.Client, req *http.Request) (*http.Response, error) {
+	info, ok := clients.get(c)
+	if !ok {
+		return nil, errors.New("Remote client was not built with remote.NewClient")
+	}
+
+	req.SetBasicAuth(info.credentials())
+	return info.http.Do(req)
+}
+
+// startTransfer blocks until the freehold instance the client points to has
+// room for another transfer. The returned func must be called once the
+// transfer is finished
+func startTransfer(c *fh.Client) func() {
+	info, ok := clients.get(c)
+	if !ok {
+		return func() {}
+	}
+
+	info.transfers <- struct{}{}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-info.transfers
+		})
+	}
+}
+
+// transferReader holds a transfer slot until the reader is closed
+type transferReader struct {
+	io.ReadCloser
+	done func()
+}
+
+func (t *transferReader) Close() error {
+	defer t.done()
+	return t.ReadCloser.Close()
+}
@@ -0,0 +1,42 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ClockOffset returns how far the freehold instance's clock is ahead of the
+// local clock, based on the Date header of a request to the instance.  The Date
+// header only has second precision, so small offsets should be ignored
+func (f *File) ClockOffset() (time.Duration, error) {
+	req, err := newRequest(f.client, "HEAD", f.client.RootURL().Path, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := time.Now()
+	res, err := do(f.client, req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	received := time.Now()
+
+	date := res.Header.Get("Date")
+	if date == "" {
+		return 0, errors.New("Freehold instance did not return the current date")
+	}
+	remote, err := http.ParseTime(date)
+	if err != nil {
+		return 0, err
+	}
+
+	// compare against the middle of the round trip
+	local := sent.Add(received.Sub(sent) / 2)
+	return remote.Sub(local), nil
+}
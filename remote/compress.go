@@ -0,0 +1,190 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	fh "bitbucket.org/tshannon/freehold-client"
+)
+
+var compressing compressMap // upload folders whose requests are currently being compressed
+
+func init() {
+	compressing = compressMap{
+		folders: make(map[string]int),
+	}
+}
+
+type compressMap struct {
+	sync.Mutex
+	folders map[string]int
+}
+
+func compressKey(urlPath string) string {
+	return strings.TrimSuffix(urlPath, "/")
+}
+
+func (c *compressMap) add(urlPath string) {
+	c.Lock()
+	defer c.Unlock()
+	c.folders[compressKey(urlPath)]++
+}
+
+func (c *compressMap) remove(urlPath string) {
+	c.Lock()
+	defer c.Unlock()
+	key := compressKey(urlPath)
+	c.folders[key]--
+	if c.folders[key] <= 0 {
+		delete(c.folders, key)
+	}
+}
+
+func (c *compressMap) has(urlPath string) bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.folders[compressKey(urlPath)] > 0
+}
+
+// gzipTransport compresses the body of uploads to folders in the compressing
+// list.  The freehold client builds its own upload requests, so this is the
+// only place the body can be compressed on the way out
+type gzipTransport struct {
+	base http.RoundTripper
+}
+
+func (t *gzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "POST" || req.Body == nil || !compressing.has(req.URL.Path) {
+		return t.base.RoundTrip(req)
+	}
+
+	body := req.Body
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, body)
+		body.Close()
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	compressed := req.Clone(req.Context())
+	compressed.Body = pr
+	compressed.ContentLength = -1
+	compressed.GetBody = nil
+	compressed.Header.Del("Content-Length")
+	compressed.Header.Set("Content-Encoding", "gzip")
+	return t.base.RoundTrip(compressed)
+}
+
+// acceptsGzip is whether or not the freehold instance accepts compressed
+// request bodies, which it advertises with an Accept-Encoding header in its
+// responses.  Only asked once per client
+func acceptsGzip(c *fh.Client) bool {
+	info, ok := clients.get(c)
+	if !ok {
+		return false
+	}
+
+	info.probe.Do(func() {
+		req, err := newRequest(c, "OPTIONS", c.RootURL().Path, nil)
+		if err != nil {
+			return
+		}
+		res, err := do(c, req)
+		if err != nil {
+			return
+		}
+		res.Body.Close()
+		info.gzip = strings.Contains(res.Header.Get("Accept-Encoding"), "gzip")
+	})
+	return info.gzip
+}
+
+// OpenCompressed opens the file for reading, letting the freehold instance
+// send the content gzipped if it is able to
+func (f *File) OpenCompressed() (io.ReadCloser, error) {
+	if !f.exists {
+		return nil, fmt.Errorf("Can't read file %s , because it doesn't exist.", f.ID())
+	}
+	if f.key() != nil {
+		// encrypted content doesn't compress
+		return f.Open()
+	}
+
+	req, err := newRequest(f.client, "GET", f.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	// setting the header ourselves means the response isn't decompressed automatically
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	done := startTransfer(f.client)
+	res, err := do(f.client, req)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		done()
+		return nil, fmt.Errorf("Error reading %s. Status: %s", f.ID(), res.Status)
+	}
+
+	if res.Header.Get("Content-Encoding") != "gzip" {
+		return &transferReader{
+			ReadCloser: res.Body,
+			done:       done,
+		}, nil
+	}
+
+	gz, err := gzip.NewReader(res.Body)
+	if err != nil {
+		res.Body.Close()
+		done()
+		return nil, err
+	}
+	return &transferReader{
+		ReadCloser: &gzipReader{
+			Reader: gz,
+			body:   res.Body,
+		},
+		done: done,
+	}, nil
+}
+
+// gzipReader closes the response body under the gzip reader
+type gzipReader struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (g *gzipReader) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
+}
+
+// WriteCompressed writes from the reader to the file, gzipping the upload
+// if the freehold instance accepts it
+func (f *File) WriteCompressed(r io.ReadCloser, size int64, modTime time.Time) error {
+	if f.key() != nil || !acceptsGzip(f.client) {
+		return f.Write(r, size, modTime)
+	}
+
+	folder := path.Dir(f.URL)
+	compressing.add(folder)
+	defer compressing.remove(folder)
+	return f.Write(r, size, modTime)
+}
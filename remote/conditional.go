@@ -0,0 +1,124 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	fh "bitbucket.org/tshannon/freehold-client"
+
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+var conditions conditionMap // files whose deletes are only made if they haven't changed
+
+func init() {
+	conditions = conditionMap{
+		files: make(map[string]*condition),
+	}
+}
+
+type condition struct {
+	since   time.Time // last modified time the file was read with
+	refused bool      // the instance refused the delete, because the file has changed since
+}
+
+type conditionMap struct {
+	sync.Mutex
+	files map[string]*condition
+}
+
+func (c *conditionMap) add(urlPath string, since time.Time) *condition {
+	c.Lock()
+	defer c.Unlock()
+	cond := &condition{since: since}
+	c.files[urlPath] = cond
+	return cond
+}
+
+func (c *conditionMap) remove(urlPath string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.files, urlPath)
+}
+
+func (c *conditionMap) get(urlPath string) *condition {
+	c.Lock()
+	defer c.Unlock()
+	return c.files[urlPath]
+}
+
+func (c *conditionMap) refuse(urlPath string) {
+	c.Lock()
+	defer c.Unlock()
+	if cond, ok := c.files[urlPath]; ok {
+		cond.refused = true
+	}
+}
+
+// conditionTransport adds an If-Unmodified-Since header to deletes of files in
+// the conditions list, so instances which support it refuse to delete a file
+// changed on the server after it was last read.  The freehold client builds its own
+// delete requests, so this is the only place the header can be added
+type conditionTransport struct {
+	base http.RoundTripper
+}
+
+func (t *conditionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "DELETE" {
+		return t.base.RoundTrip(req)
+	}
+	cond := conditions.get(req.URL.Path)
+	if cond == nil || cond.since.IsZero() {
+		return t.base.RoundTrip(req)
+	}
+
+	conditional := req.Clone(req.Context())
+	conditional.Header.Set("If-Unmodified-Since", cond.since.UTC().Format(http.TimeFormat))
+	res, err := t.base.RoundTrip(conditional)
+	if err == nil && res.StatusCode == http.StatusPreconditionFailed {
+		conditions.refuse(req.URL.Path)
+	}
+	return res, err
+}
+
+// Unchanged is whether or not the file on the freehold instance is the same as
+// when it was read
+func (f *File) Unchanged() (bool, error) {
+	if !f.exists || f.IsDir() {
+		return true, nil
+	}
+	current, err := f.client.GetFile(f.URL)
+	if fh.IsNotFound(err) {
+		// already gone, nothing to lose
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return current.ModifiedTime().Equal(f.file.ModifiedTime()) && current.Size == f.file.Size, nil
+}
+
+// deleteUnchanged deletes the file from the freehold instance, unless it was
+// changed there after it was read
+func (f *File) deleteUnchanged() error {
+	cond := conditions.add(f.URL, f.file.ModifiedTime())
+	defer conditions.remove(f.URL)
+
+	file, err := f.handle()
+	if err != nil {
+		return err
+	}
+	err = file.Delete()
+	if cond.refused {
+		return syncer.ErrChanged
+	}
+	if err != nil && !fh.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
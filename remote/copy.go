@@ -0,0 +1,93 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// CopyFrom has the freehold instance copy the file at relPath in the profile
+// to this file's location, rather than uploading the same content again.
+// Returns false if the source file has changed since it was synced, or the
+// instance doesn't support copying files.  Freehold itself can only move files,
+// so instances which turn down a copy aren't asked again
+func (f *File) CopyFrom(p *syncer.Profile, relPath string, size int64, modified time.Time) (bool, error) {
+	if f.exists {
+		return false, errors.New("Can't copy over a file which already exists")
+	}
+	info, ok := clients.get(f.client)
+	if !ok || !info.canCopy() {
+		return false, nil
+	}
+
+	src, err := New(f.client, path.Join(p.Remote.Path(p), relPath))
+	if err != nil {
+		return false, err
+	}
+	if !src.Exists() || src.IsDir() || src.Size() != size || !src.ModifiedTime.Equal(modified) {
+		return false, nil
+	}
+
+	body, err := json.Marshal(map[string]string{"copy": f.URL})
+	if err != nil {
+		return false, err
+	}
+
+	//ignore  events for this change
+	ignore.add(f.ID())
+	defer ignore.remove(f.ID())
+
+	req, err := newRequest(f.client, "PUT", src.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	res, err := do(f.client, req)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		// the instance can only move files, fall back to uploading it
+		info.copyUnsupported()
+		return false, nil
+	default:
+		return false, fmt.Errorf("Error copying %s to %s. Status: %s", src.ID(), f.ID(), res.Status)
+	}
+	quotas.used(f.client, size)
+
+	copied, err := New(f.client, f.URL)
+	if err != nil {
+		return false, err
+	}
+	if !copied.Exists() {
+		return false, fmt.Errorf("Copy of %s to %s could not be found", src.ID(), f.ID())
+	}
+	*f = *copied
+	return true, nil
+}
+
+// canCopy returns whether the instance may be able to copy files
+func (c *clientInfo) canCopy() bool {
+	c.copyLock.Lock()
+	defer c.copyLock.Unlock()
+	return !c.noCopy
+}
+
+func (c *clientInfo) copyUnsupported() {
+	c.copyLock.Lock()
+	defer c.copyLock.Unlock()
+	c.noCopy = true
+}
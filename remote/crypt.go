@@ -0,0 +1,385 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// Encrypted files are stored as a header, followed by the content split into
+// chunks which are each sealed with AES-256-GCM.  The nonce of each chunk is
+// the file's random prefix followed by the chunk number, and the last chunk
+// is marked so a file cut short at a chunk boundary doesn't decrypt.  Each
+// chunk ends with the length of the content in it, and the last chunk is
+// padded out to a power of two so the stored size doesn't give away the
+// size of the content
+//	header: magic (4 bytes) | version (1 byte) | nonce prefix (8 bytes)
+//	chunk:  sealed content (up to cryptBlock bytes) | padding | content length (4 bytes) | GCM tag (16 bytes)
+const (
+	cryptMagic    = "FHSE"
+	cryptVersion  = 1
+	cryptPrefix   = 8
+	cryptHeader   = len(cryptMagic) + 1 + cryptPrefix
+	cryptChunk    = 64 * 1024
+	cryptLength   = 4
+	cryptBlock    = cryptChunk - cryptLength // content in each chunk
+	cryptOverhead = 16
+	cryptMinPad   = 1024 // smallest last chunk
+)
+
+// ErrDecrypt is returned when a remote file can't be decrypted
+var ErrDecrypt = errors.New("Remote file is corrupt, or was encrypted with a different key")
+
+var sizes sizeCache // content sizes of encrypted files, read from their last chunk
+
+func init() {
+	sizes = sizeCache{
+		files: make(map[string]*cachedSize),
+	}
+}
+
+// cachedSize is the content size of an encrypted file, which is valid as long
+// as the stored size and modified time haven't changed
+type cachedSize struct {
+	stored   int64
+	modified time.Time
+	size     int64
+}
+
+type sizeCache struct {
+	sync.Mutex
+	files map[string]*cachedSize
+}
+
+func (s *sizeCache) get(id string, stored int64, modified time.Time) (int64, bool) {
+	s.Lock()
+	defer s.Unlock()
+	cached, ok := s.files[id]
+	if !ok || cached.stored != stored || !cached.modified.Equal(modified) {
+		return 0, false
+	}
+	return cached.size, true
+}
+
+func (s *sizeCache) set(id string, stored int64, modified time.Time, size int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.files[id] = &cachedSize{
+		stored:   stored,
+		modified: modified,
+		size:     size,
+	}
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, cryptPrefix+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[cryptPrefix:], counter)
+	return nonce
+}
+
+func chunkData(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// paddedSize is the size of the last chunk, before it's sealed, for the passed
+// in length of content
+func paddedSize(length int64) int64 {
+	padded := int64(cryptMinPad)
+	for padded < length+cryptLength {
+		padded *= 2
+	}
+	return padded
+}
+
+// encryptedSize is the size of the stored file for content of the passed in size
+func encryptedSize(size int64) int64 {
+	chunks := (size + cryptBlock - 1) / cryptBlock
+	if chunks == 0 {
+		chunks = 1
+	}
+	last := size - (chunks-1)*cryptBlock
+	return int64(cryptHeader) + (chunks-1)*(cryptChunk+cryptOverhead) + paddedSize(last) + cryptOverhead
+}
+
+// lastChunk is the number of the last chunk of a stored file of the passed in
+// size, and where in the file it starts
+func lastChunk(size int64) (uint32, int64) {
+	body := size - int64(cryptHeader)
+	if body < cryptOverhead {
+		return 0, int64(cryptHeader)
+	}
+	counter := (body - 1) / (cryptChunk + cryptOverhead)
+	return uint32(counter), int64(cryptHeader) + counter*(cryptChunk+cryptOverhead)
+}
+
+// readChunk reads up to size bytes, eof is true if the reader ran out
+func readChunk(r io.Reader, size int) (data []byte, eof bool, err error) {
+	data = make([]byte, size)
+	n, err := io.ReadFull(r, data)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return data[:n], true, nil
+	}
+	return data[:n], false, err
+}
+
+// openChunk decrypts the sealed chunk and returns the content in it, without
+// any padding
+func openChunk(aead cipher.AEAD, prefix []byte, counter uint32, chunk []byte, final bool) ([]byte, error) {
+	plain, err := aead.Open(chunk[:0], chunkNonce(prefix, counter), chunk, chunkData(final))
+	if err != nil || len(plain) < cryptLength {
+		return nil, ErrDecrypt
+	}
+	length := int(binary.BigEndian.Uint32(plain[len(plain)-cryptLength:]))
+	if length > len(plain)-cryptLength || (!final && length != cryptBlock) {
+		return nil, ErrDecrypt
+	}
+	return plain[:length], nil
+}
+
+// readSize decrypts the last chunk of a stored file of the passed in size to
+// get the size of its content.  src must start at the beginning of the last
+// chunk, see lastChunk
+func readSize(src io.Reader, key, prefix []byte, size int64) (int64, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return 0, err
+	}
+	counter, _ := lastChunk(size)
+	chunk, _, err := readChunk(src, cryptChunk+cryptOverhead)
+	if err != nil {
+		return 0, err
+	}
+	content, err := openChunk(aead, prefix, counter, chunk, true)
+	if err != nil {
+		return 0, err
+	}
+	return int64(counter)*cryptBlock + int64(len(content)), nil
+}
+
+// encryptReader encrypts the content read from src
+type encryptReader struct {
+	src     io.ReadCloser
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	chunk   []byte // next chunk of content, read ahead to know if it's the last one
+	eof     bool   // src has been read to the end
+	out     []byte // encrypted data waiting to be read
+	size    int64  // content encrypted so far
+	done    bool
+}
+
+func newEncryptReader(src io.ReadCloser, key []byte) (*encryptReader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, cryptPrefix)
+	_, err = rand.Read(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte(cryptMagic), cryptVersion)
+	return &encryptReader{
+		src:    src,
+		aead:   aead,
+		prefix: prefix,
+		out:    append(header, prefix...),
+	}, nil
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		err := r.seal()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// seal encrypts the next chunk of content
+func (r *encryptReader) seal() error {
+	var err error
+	if r.chunk == nil {
+		r.chunk, r.eof, err = readChunk(r.src, cryptBlock)
+		if err != nil {
+			return err
+		}
+	}
+
+	final := r.eof
+	var next []byte
+	if !r.eof {
+		next, r.eof, err = readChunk(r.src, cryptBlock)
+		if err != nil {
+			return err
+		}
+		// a full chunk with nothing after it is the last one
+		final = r.eof && len(next) == 0
+	}
+
+	length := len(r.chunk)
+	plain := r.chunk
+	if final {
+		plain = make([]byte, paddedSize(int64(length)))
+		copy(plain, r.chunk)
+	} else {
+		plain = append(plain, make([]byte, cryptLength)...)
+	}
+	binary.BigEndian.PutUint32(plain[len(plain)-cryptLength:], uint32(length))
+
+	r.out = r.aead.Seal(nil, chunkNonce(r.prefix, r.counter), plain, chunkData(final))
+	r.counter++
+	r.size += int64(length)
+	r.chunk = next
+	r.done = final
+	return nil
+}
+
+func (r *encryptReader) Close() error {
+	return r.src.Close()
+}
+
+// decryptReader decrypts the content of an encrypted file read from src
+type decryptReader struct {
+	src     io.ReadCloser
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	skip    int    // content to drop from the first chunk, when reading from part way through
+	next    []byte // next encrypted chunk, read ahead to know if the current one is the last
+	out     []byte // decrypted content waiting to be read
+	started bool
+	done    bool
+}
+
+// newDecryptReader decrypts a whole encrypted file
+func newDecryptReader(src io.ReadCloser, key []byte) (*decryptReader, error) {
+	prefix, err := readCryptHeader(src)
+	if err != nil {
+		return nil, err
+	}
+	return newDecryptReaderAt(src, key, prefix, 0)
+}
+
+// newDecryptReaderAt decrypts an encrypted file starting at the content offset.  src
+// must start at the beginning of the chunk the offset is in, see chunkOffset
+func newDecryptReaderAt(src io.ReadCloser, key, prefix []byte, offset int64) (*decryptReader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		src:     src,
+		aead:    aead,
+		prefix:  prefix,
+		counter: uint32(offset / cryptBlock),
+		skip:    int(offset % cryptBlock),
+	}, nil
+}
+
+// chunkOffset is where in the stored file the chunk holding the content offset starts
+func chunkOffset(offset int64) int64 {
+	return int64(cryptHeader) + (offset/cryptBlock)*(cryptChunk+cryptOverhead)
+}
+
+// readCryptHeader checks the header of an encrypted file and returns its nonce prefix
+func readCryptHeader(r io.Reader) ([]byte, error) {
+	header := make([]byte, cryptHeader)
+	_, err := io.ReadFull(r, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrDecrypt
+	}
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:len(cryptMagic)]) != cryptMagic || header[len(cryptMagic)] != cryptVersion {
+		return nil, ErrDecrypt
+	}
+	return header[len(cryptMagic)+1:], nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		err := r.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// open decrypts the next chunk
+func (r *decryptReader) open() error {
+	var err error
+	if !r.started {
+		r.next, _, err = readChunk(r.src, cryptChunk+cryptOverhead)
+		if err != nil {
+			return err
+		}
+		r.started = true
+	}
+
+	chunk := r.next
+	if len(chunk) == 0 && r.counter > 0 && r.skip == 0 {
+		// started reading right at the end of the content
+		r.done = true
+		return nil
+	}
+	r.next, _, err = readChunk(r.src, cryptChunk+cryptOverhead)
+	if err != nil {
+		return err
+	}
+	final := len(r.next) == 0
+
+	content, err := openChunk(r.aead, r.prefix, r.counter, chunk, final)
+	if err != nil {
+		return err
+	}
+	r.counter++
+
+	if r.skip > len(content) {
+		return ErrDecrypt
+	}
+	r.out = content[r.skip:]
+	r.skip = 0
+	r.done = final
+	return nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.src.Close()
+}
@@ -0,0 +1,110 @@
+package remote
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+var testKey = bytes.Repeat([]byte{7}, 32)
+
+func encrypt(t *testing.T, content []byte) []byte {
+	er, err := newEncryptReader(ioutil.NopCloser(bytes.NewReader(content)), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := ioutil.ReadAll(er)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if er.size != int64(len(content)) {
+		t.Fatalf("Expected %d bytes to be encrypted, got %d", len(content), er.size)
+	}
+	return sealed
+}
+
+func testContent(size int) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	return content
+}
+
+func TestCryptRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, 900, cryptBlock - 1, cryptBlock, cryptBlock + 1, 3*cryptBlock + 5} {
+		content := testContent(size)
+		sealed := encrypt(t, content)
+		if int64(len(sealed)) != encryptedSize(int64(size)) {
+			t.Fatalf("Expected %d bytes of content to be stored in %d bytes, got %d",
+				size, encryptedSize(int64(size)), len(sealed))
+		}
+
+		dr, err := newDecryptReader(ioutil.NopCloser(bytes.NewReader(sealed)), testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := ioutil.ReadAll(dr)
+		if err != nil {
+			t.Fatalf("Error decrypting %d bytes: %s", size, err)
+		}
+		if !bytes.Equal(plain, content) {
+			t.Fatalf("Decrypted content of %d bytes doesn't match", size)
+		}
+
+		prefix := sealed[len(cryptMagic)+1 : cryptHeader]
+		_, start := lastChunk(int64(len(sealed)))
+		read, err := readSize(bytes.NewReader(sealed[start:]), testKey, prefix, int64(len(sealed)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read != int64(size) {
+			t.Fatalf("Expected a size of %d from the last chunk, got %d", size, read)
+		}
+	}
+}
+
+func TestCryptPadding(t *testing.T) {
+	if len(encrypt(t, testContent(1))) != len(encrypt(t, testContent(900))) {
+		t.Fatal("Content of similar sizes should be stored at the same size")
+	}
+	if encryptedSize(cryptBlock+1) != encryptedSize(cryptBlock+500) {
+		t.Fatal("The last chunk should be padded")
+	}
+}
+
+func TestCryptTruncated(t *testing.T) {
+	sealed := encrypt(t, testContent(2*cryptBlock+10))
+
+	// cut off the last chunk, leaving a file that ends on a chunk boundary
+	_, start := lastChunk(int64(len(sealed)))
+	dr, err := newDecryptReader(ioutil.NopCloser(bytes.NewReader(sealed[:start])), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(dr)
+	if err != ErrDecrypt {
+		t.Fatalf("Expected ErrDecrypt for a truncated file, got %v", err)
+	}
+}
+
+func TestCryptOffset(t *testing.T) {
+	content := testContent(3*cryptBlock + 5)
+	sealed := encrypt(t, content)
+	prefix := sealed[len(cryptMagic)+1 : cryptHeader]
+
+	for _, offset := range []int64{1, cryptBlock - 1, cryptBlock, cryptBlock + 1, 3 * cryptBlock, 3*cryptBlock + 4, int64(len(content))} {
+		src := ioutil.NopCloser(bytes.NewReader(sealed[chunkOffset(offset):]))
+		dr, err := newDecryptReaderAt(src, testKey, prefix, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := ioutil.ReadAll(dr)
+		if err != nil {
+			t.Fatalf("Error decrypting from offset %d: %s", offset, err)
+		}
+		if !bytes.Equal(plain, content[offset:]) {
+			t.Fatalf("Content read from offset %d doesn't match", offset)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// propertiesPath is the part of the path of requests for file and folder
+// properties, which is how the freehold client lists folders
+const propertiesPath = "/properties/"
+
+var listings listingCache // last listing of each folder, to make polling requests conditional
+
+func init() {
+	listings = listingCache{
+		responses: make(map[string]*cachedListing),
+	}
+}
+
+type cachedListing struct {
+	etag         string
+	lastModified string
+	header       http.Header
+	body         []byte
+}
+
+type listingCache struct {
+	sync.RWMutex
+	responses map[string]*cachedListing
+}
+
+// listingKey includes the user, since different users can see different files
+// in the same folder
+func listingKey(req *http.Request) string {
+	user, _, _ := req.BasicAuth()
+	return user + "|" + req.URL.String()
+}
+
+func (l *listingCache) get(key string) *cachedListing {
+	l.RLock()
+	defer l.RUnlock()
+	return l.responses[key]
+}
+
+func (l *listingCache) set(key string, listing *cachedListing) {
+	l.Lock()
+	defer l.Unlock()
+	if listing == nil {
+		delete(l.responses, key)
+		return
+	}
+	l.responses[key] = listing
+}
+
+// etagTransport makes folder listings conditional on the ETag or Last-Modified
+// date of the last listing of the same folder.  When the instance answers that
+// the folder hasn't changed, the last listing is handed back to the freehold
+// client as if it had been sent again, so unchanged folders cost a request
+// with no body instead of the whole listing
+type etagTransport struct {
+	base http.RoundTripper
+}
+
+func (t *etagTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// only folders, which end in a slash, are listed
+	if req.Method != "GET" || !strings.Contains(req.URL.Path, propertiesPath) || !strings.HasSuffix(req.URL.Path, "/") {
+		return t.base.RoundTrip(req)
+	}
+
+	key := listingKey(req)
+	cached := listings.get(key)
+	if cached != nil {
+		conditional := req.Clone(req.Context())
+		if cached.etag != "" {
+			conditional.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			conditional.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+		req = conditional
+	}
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+
+	if res.StatusCode == http.StatusNotModified && cached != nil {
+		res.Body.Close()
+		res.StatusCode = http.StatusOK
+		res.Status = "200 OK"
+		res.Header = cached.header.Clone()
+		res.Body = io.NopCloser(bytes.NewReader(cached.body))
+		res.ContentLength = int64(len(cached.body))
+		return res, nil
+	}
+
+	if res.StatusCode != http.StatusOK {
+		listings.set(key, nil)
+		return res, nil
+	}
+
+	etag := res.Header.Get("ETag")
+	lastModified := res.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		// the instance doesn't support conditional requests
+		listings.set(key, nil)
+		return res, nil
+	}
+
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	listings.set(key, &cachedListing{
+		etag:         etag,
+		lastModified: lastModified,
+		header:       res.Header.Clone(),
+		body:         body,
+	})
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	return res, nil
+}
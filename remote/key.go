@@ -0,0 +1,260 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// checkValue is sealed with the key and stored in the key file, so a wrong
+// passphrase is caught before anything is encrypted with it
+const checkValue = "freehold-sync"
+
+var keys keyMap // encryption keys of remote folders
+
+func init() {
+	keys = keyMap{
+		roots: make(map[string]*folderKey),
+	}
+}
+
+type folderKey struct {
+	passphrase string
+	key        []byte
+	names      cipher.AEAD // encrypts file and folder names, nil if names aren't encrypted
+	nonceKey   []byte      // derives the nonce of each name, so the same name always encrypts the same
+}
+
+type keyMap struct {
+	sync.RWMutex
+	roots map[string]*folderKey // by the folder's ID
+}
+
+// get returns the key of the encrypted folder the file is in, nil if it isn't
+// in one
+func (k *keyMap) get(id string) []byte {
+	_, fk := k.folder(id)
+	if fk == nil {
+		return nil
+	}
+	return fk.key
+}
+
+// folder returns the ID and key of the encrypted folder the file is in, nil
+// if it isn't in one
+func (k *keyMap) folder(id string) (string, *folderKey) {
+	k.RLock()
+	defer k.RUnlock()
+
+	var match string
+	var key *folderKey
+	for root, fk := range k.roots {
+		if (id == root || strings.HasPrefix(id, root+"/")) && len(root) > len(match) {
+			match = root
+			key = fk
+		}
+	}
+	return match, key
+}
+
+func (k *keyMap) set(root string, fk *folderKey) {
+	k.Lock()
+	defer k.Unlock()
+	if fk == nil {
+		delete(k.roots, root)
+		return
+	}
+	k.roots[root] = fk
+}
+
+// current is whether or not the folder is already set up with the same settings
+func (k *keyMap) current(root, passphrase string, names bool) bool {
+	k.RLock()
+	defer k.RUnlock()
+	fk, ok := k.roots[root]
+	if !ok {
+		return false
+	}
+	return fk.passphrase == passphrase && (fk.names != nil) == names
+}
+
+func keyRoot(root *File) string {
+	return strings.TrimSuffix(root.ID(), "/")
+}
+
+// key is the key the file's content is encrypted with, nil if it isn't encrypted
+func (f *File) key() []byte {
+	return keys.get(f.ID())
+}
+
+// keyFile is stored in the root of an encrypted folder
+type keyFile struct {
+	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce"`
+	Check []byte `json:"check"` // checkValue sealed with the key
+	Names bool   `json:"names"` // whether or not file and folder names are encrypted
+}
+
+// Encrypt has all file content written to or read from the folder and its
+// children encrypted with a key derived from the passphrase, and if names is
+// true, the names of the files and folders in it as well.  The first time
+// a folder is encrypted it must be empty.  An empty passphrase stops
+// encrypting the folder
+func Encrypt(root *File, passphrase string, names bool) error {
+	rootID := keyRoot(root)
+	if passphrase == "" {
+		keys.set(rootID, nil)
+		return nil
+	}
+	if keys.current(rootID, passphrase, names) {
+		return nil
+	}
+
+	kf, err := root.readKeyFile()
+	if err != nil {
+		return err
+	}
+
+	if kf == nil {
+		kf, err = root.newKeyFile(passphrase, names)
+		if err != nil {
+			return err
+		}
+	}
+	if kf.Names != names {
+		if kf.Names {
+			return errors.New("The remote folder was set up with encrypted names")
+		}
+		return errors.New("The remote folder was set up without encrypted names")
+	}
+
+	key, err := deriveKey(passphrase, kf.Salt)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	check, err := aead.Open(nil, kf.Nonce, kf.Check, nil)
+	if err != nil || string(check) != checkValue {
+		return errors.New("Incorrect encryption passphrase")
+	}
+
+	fk := &folderKey{
+		passphrase: passphrase,
+		key:        key,
+	}
+	if names {
+		fk.names, err = newAEAD(subKey(key, "names"))
+		if err != nil {
+			return err
+		}
+		fk.nonceKey = subKey(key, "name nonces")
+	}
+	keys.set(rootID, fk)
+	return nil
+}
+
+// subKey derives a separate key for another use from the folder's key
+func subKey(key []byte, use string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(use))
+	return mac.Sum(nil)
+}
+
+func deriveKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+}
+
+// readKeyFile reads the folder's key file, nil if it doesn't have one
+func (f *File) readKeyFile() (*keyFile, error) {
+	req, err := newRequest(f.client, "GET", path.Join(f.URL, syncer.KeyFile), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := do(f.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error reading the encryption key file of %s. Status: %s", f.ID(), res.Status)
+	}
+
+	kf := &keyFile{}
+	err = json.NewDecoder(res.Body).Decode(kf)
+	if err != nil {
+		return nil, err
+	}
+	return kf, nil
+}
+
+// newKeyFile sets up the empty folder for encryption with the passphrase
+func (f *File) newKeyFile(passphrase string, names bool) (*keyFile, error) {
+	children, err := f.Children()
+	if err != nil {
+		return nil, err
+	}
+	for i := range children {
+		if children[i].Name != syncer.MetaFolder && children[i].Name != syncer.VersionsFolder {
+			return nil, errors.New("Encryption can only be turned on for an empty remote folder")
+		}
+	}
+
+	kf := &keyFile{
+		Salt:  make([]byte, 32),
+		Nonce: make([]byte, 12),
+		Names: names,
+	}
+	_, err = rand.Read(kf.Salt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = rand.Read(kf.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := deriveKey(passphrase, kf.Salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	kf.Check = aead.Seal(nil, kf.Nonce, []byte(checkValue), nil)
+
+	data, err := json.Marshal(kf)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.client.UploadFromReader(syncer.KeyFile, bytes.NewReader(data), int64(len(data)), time.Now(), f.file)
+	if err != nil {
+		return nil, err
+	}
+	return kf, nil
+}
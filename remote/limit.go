@@ -0,0 +1,126 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxRequests is the most requests per second that will be made against a single
+// freehold instance, 0 for no limit.  Must be set before any clients are created
+var MaxRequests = 0
+
+const (
+	busyRetries   = 3                // times a request refused as too busy is sent again
+	busyWait      = 5 * time.Second  // wait when the instance is too busy but doesn't say for how long
+	maxRetryAfter = 10 * time.Minute // longest Retry-After that will be waited out
+)
+
+// busyUntil is when requests to the instance can start again, after it
+// asked for them to slow down
+func (i *clientInfo) busyUntil() time.Time {
+	i.busyLock.Lock()
+	defer i.busyLock.Unlock()
+	return i.busy
+}
+
+// setBusy holds off requests to the instance for the passed in time, returns
+// false if they already were
+func (i *clientInfo) setBusy(wait time.Duration) bool {
+	i.busyLock.Lock()
+	defer i.busyLock.Unlock()
+	until := time.Now().Add(wait)
+	if until.Before(i.busy) {
+		return false
+	}
+	already := time.Now().Before(i.busy)
+	i.busy = until
+	return !already
+}
+
+// limitTransport keeps requests to the instance under MaxRequests per second, and
+// waits out 429 and 503 responses for as long as their Retry-After header asks
+// before trying again
+type limitTransport struct {
+	base http.RoundTripper
+	info *clientInfo // set once the client is built
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.info == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	for attempt := 0; ; attempt++ {
+		if wait := time.Until(t.info.busyUntil()); wait > 0 {
+			time.Sleep(wait)
+		}
+		t.info.requests.Wait(1)
+
+		res, err := t.base.RoundTrip(req)
+		if err != nil {
+			return res, err
+		}
+		if res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusServiceUnavailable {
+			return res, nil
+		}
+
+		wait, ok := retryAfter(res.Header.Get("Retry-After"))
+		if !ok {
+			if res.StatusCode == http.StatusServiceUnavailable {
+				// down rather than busy
+				return res, nil
+			}
+			wait = busyWait
+		}
+		if t.info.setBusy(wait) {
+			logger.Warnf("The freehold instance at %s is busy, waiting %s before sending more requests",
+				req.URL.Host, wait)
+		}
+
+		if attempt >= busyRetries || (req.Body != nil && req.GetBody == nil) {
+			return res, nil
+		}
+
+		next := req.Clone(req.Context())
+		if req.GetBody != nil {
+			next.Body, err = req.GetBody()
+			if err != nil {
+				return res, nil
+			}
+		}
+		res.Body.Close()
+		req = next
+	}
+}
+
+// retryAfter parses a Retry-After header, which is either a number of seconds
+// or a date
+func retryAfter(header string) (time.Duration, bool) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0, false
+	}
+
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(header); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if when, err := http.ParseTime(header); err == nil {
+		wait = time.Until(when)
+	} else {
+		return 0, false
+	}
+
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > maxRetryAfter {
+		wait = maxRetryAfter
+	}
+	return wait, true
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	fh "bitbucket.org/tshannon/freehold-client"
+
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// defaultMode is the permission most files have, it isn't recorded
+const defaultMode = os.FileMode(0644)
+
+// fileMeta is the metadata freehold doesn't keep for a file, which is stored
+// in the profile's meta folder in place of it
+type fileMeta struct {
+	Mode os.FileMode `json:"mode"`
+}
+
+// metaPath is the path of the file's metadata in the profile's meta folder
+func (f *File) metaPath(p *syncer.Profile) (string, error) {
+	return encryptPath(f.client, path.Join(p.Remote.Path(p), syncer.MetaFolder, f.Path(p)))
+}
+
+// Mode returns the POSIX permission bits the file had on the local side it
+// was uploaded from, 0 if they weren't recorded
+func (f *File) Mode(p *syncer.Profile) (os.FileMode, error) {
+	metaPath, err := f.metaPath(p)
+	if err != nil {
+		return 0, err
+	}
+	req, err := newRequest(f.client, "GET", metaPath, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := do(f.client, req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return 0, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Error reading the metadata of %s. Status: %s", f.ID(), res.Status)
+	}
+
+	meta := &fileMeta{}
+	err = json.NewDecoder(res.Body).Decode(meta)
+	if err != nil {
+		return 0, err
+	}
+	return meta.Mode, nil
+}
+
+// SetMode records the POSIX permission bits of the file, so they can be
+// restored when it's downloaded
+func (f *File) SetMode(p *syncer.Profile, mode os.FileMode) error {
+	metaPath, err := f.metaPath(p)
+	if err != nil {
+		return err
+	}
+
+	if mode == 0 || mode == defaultMode {
+		file, err := f.client.GetFile(metaPath)
+		if fh.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return file.Delete()
+	}
+
+	data, err := json.Marshal(&fileMeta{Mode: mode})
+	if err != nil {
+		return err
+	}
+
+	dir := path.Dir(metaPath)
+	err = f.makeDirs(p, dir)
+	if err != nil {
+		return err
+	}
+
+	existing, err := f.client.GetFile(metaPath)
+	if err == nil {
+		err = existing.Delete()
+	}
+	if err != nil && !fh.IsNotFound(err) {
+		return err
+	}
+
+	_, err = f.client.UploadFromReader(path.Base(metaPath), bytes.NewReader(data), int64(len(data)), time.Now(),
+		&fh.File{
+			Property: fh.Property{
+				URL:   dir,
+				Name:  path.Base(dir),
+				IsDir: true,
+			},
+		})
+	return err
+}
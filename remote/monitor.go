@@ -22,16 +22,33 @@ const (
 	bucket = datastore.BucketRemote
 	//LogType is the log type for remote logging
 	LogType = "remote"
+
+	// MinPollInterval and MaxPollInterval are the bounds of a profile's remote
+	// polling interval
+	MinPollInterval = 10 * time.Second
+	MaxPollInterval = 24 * time.Hour
+
+	// idlePolls is how many polls in a row a folder has to be unchanged before
+	// the time between its polls is doubled
+	idlePolls = 10
 )
 
+var logger = log.Module(LogType)
+
+// MaxIdleBackoff is the most times longer a folder which hasn't changed in a
+// while waits between polls.  1 turns off backing off
+var MaxIdleBackoff = 16
+
 var (
 	changeHandler ChangeHandler
 	watching      profileFiles
 	stopped       chan int
 	ignore        ignoreFiles //File changes to ignore because they are from this process
+	changes       changeMap   //changes currently being handled, so overlapping polls don't sync a file twice
 	pollInterval  time.Duration
 	pollTimer     *time.Timer
 	stopPoll      bool
+	polled        pollTimes
 )
 
 func init() {
@@ -42,6 +59,12 @@ func init() {
 	ignore = ignoreFiles{
 		files: make(map[string]struct{}),
 	}
+	changes = changeMap{
+		files: make(map[string]syncer.Syncer),
+	}
+	polled = pollTimes{
+		folders: make(map[string]*pollState),
+	}
 }
 
 type profileFiles struct {
@@ -127,6 +150,7 @@ func (p *profileFiles) remove(profile *syncer.Profile, file *File) {
 		}
 		if len(profiles) == 0 {
 			delete(p.files, file.ID())
+			polled.remove(file.ID())
 			//remove from DS if exists
 			datastore.Delete(bucket, file.ID())
 
@@ -138,29 +162,168 @@ func (p *profileFiles) remove(profile *syncer.Profile, file *File) {
 	return
 }
 
-func (p *profileFiles) dirWatchList() ([]*File, error) {
+// dirWatchList returns the watched folders which are due to be polled
+func (p *profileFiles) dirWatchList(now time.Time) ([]*File, error) {
 	p.RLock()
 	defer p.RUnlock()
 
-	result := make([]*File, len(p.files), len(p.files))
-	i := 0
+	var result []*File
 	for k, v := range p.files {
+		if now.Before(dueAt(k, v)) {
+			continue
+		}
 		// All profiles watching this folder will share the same client root
 		uri, err := url.Parse(k)
 		if err != nil {
 			return nil, fmt.Errorf("Error parsing file watch url: %v", err)
 		}
 
-		result[i], err = New(v[0].Remote.(*File).Client(), uri.Path)
+		f, err := New(v[0].Remote.(*File).Client(), uri.Path)
 		if err != nil {
 			return nil, fmt.Errorf("Error building remote dir watch list: %v", err)
 		}
-		i++
+		result = append(result, f)
 	}
 
 	return result, nil
 }
 
+// nextPoll returns how long until the next watched folder is due to be polled
+func (p *profileFiles) nextPoll(now time.Time) time.Duration {
+	p.RLock()
+	defer p.RUnlock()
+
+	wait := pollInterval
+	for k, v := range p.files {
+		if until := dueAt(k, v).Sub(now); until < wait {
+			wait = until
+		}
+	}
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait
+}
+
+// clients returns the clients of the watched folders
+func (p *profileFiles) clients() []*fh.Client {
+	p.RLock()
+	defer p.RUnlock()
+
+	var result []*fh.Client
+	for _, v := range p.files {
+		result = append(result, v[0].Remote.(*File).Client())
+	}
+	return result
+}
+
+// folderInterval is how often a folder is polled, the shortest interval of the
+// profiles watching it
+func folderInterval(profiles []*syncer.Profile) time.Duration {
+	interval := time.Duration(0)
+	for i := range profiles {
+		pInterval := profiles[i].PollInterval
+		if pInterval == 0 {
+			pInterval = pollInterval
+		}
+		if interval == 0 || pInterval < interval {
+			interval = pInterval
+		}
+	}
+	if interval == 0 {
+		interval = pollInterval
+	}
+	return interval
+}
+
+// dueAt is when the folder is next due to be polled.  Folders whose changes are
+// pushed are polled far less often, in case a change is missed
+func dueAt(folderID string, profiles []*syncer.Profile) time.Time {
+	state, ok := polled.get(folderID)
+	if !ok {
+		return time.Time{}
+	}
+	interval := folderInterval(profiles)
+	if len(profiles) > 0 && pushed.active(profiles[0].Remote.(*File).Client()) {
+		interval *= pushPollRounds
+	}
+	return state.last.Add(idleInterval(interval, state.idle))
+}
+
+// idleInterval lengthens the polling interval of a folder which has been
+// unchanged for the passed in number of polls, doubling it every idlePolls
+// up to MaxIdleBackoff times as long, but no longer than MaxPollInterval
+func idleInterval(interval time.Duration, idle int) time.Duration {
+	backoff := 1
+	for i := idlePolls; i <= idle && backoff*2 <= MaxIdleBackoff; i += idlePolls {
+		backoff *= 2
+	}
+	if backoff == 1 {
+		return interval
+	}
+
+	backed := interval * time.Duration(backoff)
+	if backed > MaxPollInterval {
+		if interval > MaxPollInterval {
+			return interval
+		}
+		return MaxPollInterval
+	}
+	return backed
+}
+
+type pollState struct {
+	last time.Time // when the folder was last polled
+	idle int       // number of polls in a row the folder has been unchanged
+}
+
+type pollTimes struct {
+	sync.Mutex
+	folders map[string]*pollState
+}
+
+func (p *pollTimes) get(folderID string) (pollState, bool) {
+	p.Lock()
+	defer p.Unlock()
+	state, ok := p.folders[folderID]
+	if !ok {
+		return pollState{}, false
+	}
+	return *state, true
+}
+
+func (p *pollTimes) set(folderID string, when time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	if state, ok := p.folders[folderID]; ok {
+		state.last = when
+		return
+	}
+	p.folders[folderID] = &pollState{last: when}
+}
+
+// changed records whether or not the folder changed since it was last polled,
+// so any activity puts it straight back to its normal interval
+func (p *pollTimes) changed(folderID string, changed bool) {
+	p.Lock()
+	defer p.Unlock()
+	state, ok := p.folders[folderID]
+	if !ok {
+		return
+	}
+	if changed {
+		state.idle = 0
+		return
+	}
+	state.idle++
+}
+
+func (p *pollTimes) remove(folderID string) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.folders, folderID)
+}
+
 // ChangeHandler is the function called when a change occurs in a monitored folder
 type ChangeHandler func(*syncer.Profile, syncer.Syncer)
 
@@ -169,7 +332,7 @@ func StartWatcher(handler ChangeHandler, interval time.Duration) error {
 	changeHandler = handler
 	pollInterval = interval
 
-	// Loop every pollInterval
+	// Loop every pollInterval, or sooner for profiles which poll more often
 	// record what the current folder looks like
 	// call changeHandler for any file that changed
 	// set deleted boolean if file used to exist and no longer does
@@ -180,32 +343,81 @@ func StartWatcher(handler ChangeHandler, interval time.Duration) error {
 
 func watchDirs() {
 	var wg sync.WaitGroup
-	watchList, err := watching.dirWatchList()
+	watchList, err := watching.dirWatchList(time.Now())
 	if err != nil {
-		log.New(fmt.Sprintf("Error getting watch list: %s", err.Error()), LogType)
+		logger.Errorf("Error getting watch list: %s", err.Error())
 	}
 	for i := range watchList {
 		wg.Add(1)
 		go func(watchFile *File) {
 			defer wg.Done()
-			diff, err := watchFile.differences()
-			profiles := watching.profiles(watchFile)
-			if err != nil {
-				log.New(fmt.Sprintf("Error getting differences for %s: %s", watchFile.ID(), err.Error()), LogType)
-			}
-			for d := range diff {
-				for p := range profiles {
-					changeHandler(profiles[p], diff[d])
-				}
-
-			}
-
+			pollFolder(watchFile)
 		}(watchList[i])
 	}
 	wg.Wait()
+	pushed.subscribe(watching.clients())
 
 	if !stopPoll {
-		pollTimer = time.AfterFunc(pollInterval, watchDirs)
+		pollTimer = time.AfterFunc(watching.nextPoll(time.Now()), watchDirs)
+	}
+}
+
+// pollFolder sends any changes in the folder since it was last looked at
+func pollFolder(watchFile *File) {
+	diff, changed, err := watchFile.differences()
+	polled.set(watchFile.ID(), time.Now())
+	profiles := watching.profiles(watchFile)
+	if err != nil && !IsUnavailable(err) {
+		logger.Errorf("Error getting differences for %s: %s", watchFile.ID(), err.Error())
+	}
+	if err == nil {
+		polled.changed(watchFile.ID(), changed)
+	}
+	for d := range diff {
+		for p := range profiles {
+			if profiles[p].Excluded(diff[d]) {
+				continue
+			}
+			sendChange(profiles[p], diff[d])
+		}
+
+	}
+}
+
+type changeMap struct {
+	sync.Mutex
+	files map[string]syncer.Syncer // latest version of the file seen while its change is being handled
+}
+
+// sendChange calls the change handler for the file.  If the file is already
+// being handled for the profile, such as from an overlapping poll, the change
+// is coalesced and handled once more, with the latest version of the file,
+// after the current one finishes
+func sendChange(p *syncer.Profile, f syncer.Syncer) {
+	key := p.ID() + "_" + f.ID()
+
+	changes.Lock()
+	if _, ok := changes.files[key]; ok {
+		changes.files[key] = f
+		changes.Unlock()
+		return
+	}
+	changes.files[key] = nil
+	changes.Unlock()
+
+	for {
+		changeHandler(p, f)
+
+		changes.Lock()
+		next := changes.files[key]
+		if next == nil {
+			delete(changes.files, key)
+			changes.Unlock()
+			return
+		}
+		changes.files[key] = nil
+		changes.Unlock()
+		f = next
 	}
 }
 
@@ -230,36 +442,37 @@ func StopWatcher() {
 	if pollTimer != nil {
 		pollTimer.Stop()
 	}
+	pushed.stopAll()
 }
 
 // Returns the differences between the local record of the folder and
 // the current remote view of the folder.  Sets deleted if file used
-// to exist
-func (f *File) differences() ([]syncer.Syncer, error) {
-	var diff []syncer.Syncer
+// to exist.  Changed is whether or not anything in the folder actually
+// changed, since dirs are always returned as differences
+func (f *File) differences() (diff []syncer.Syncer, changed bool, err error) {
 	if !f.IsDir() {
-		return nil, nil
+		return nil, false, nil
 	}
 
 	remFiles, err := f.Children()
 	if err != nil && !fh.IsNotFound(err) {
-		return nil, err
+		return nil, false, err
 	}
 
 	if fh.IsNotFound(err) {
 		//clean up monitor and update ds
 		err = f.StopMonitor(nil)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
-		return nil, nil
+		return nil, true, nil
 	}
 
 	var dsFiles []*File
 
 	err = datastore.Get(bucket, f.ID(), &dsFiles)
 	if err != nil && err != datastore.ErrNotFound {
-		return nil, fmt.Errorf("Error reading remote DS file list for %s: Error: %s", f.ID(), err.Error())
+		return nil, false, fmt.Errorf("Error reading remote DS file list for %s: Error: %s", f.ID(), err.Error())
 	}
 
 	for i := range dsFiles {
@@ -272,9 +485,11 @@ func (f *File) differences() ([]syncer.Syncer, error) {
 				found = true
 				//Dirs are always marked as different
 				// to ensure they are being monitored see syncer.Profile.Sync
-				if !remFiles[j].Modified().Equal(dsFiles[i].Modified()) || remFiles[j].IsDir() {
+				modified := !remFiles[j].Modified().Equal(dsFiles[i].Modified())
+				if modified || remFiles[j].IsDir() {
 					diff = append(diff, remFiles[j])
 				}
+				changed = changed || modified
 			}
 		}
 		if !found {
@@ -282,6 +497,7 @@ func (f *File) differences() ([]syncer.Syncer, error) {
 			// file was deleted
 			dsFiles[i].deleted = true
 			diff = append(diff, dsFiles[i])
+			changed = true
 			dsFiles[i].StopMonitor(nil)
 		}
 	}
@@ -301,39 +517,44 @@ func (f *File) differences() ([]syncer.Syncer, error) {
 			// file is new
 
 			diff = append(diff, remFiles[i])
+			changed = true
 		}
 	}
 
 	// insert current view of remote site into DS
 	err = datastore.Put(bucket, f.ID(), remFiles)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	return diff, nil
+	return diff, changed, nil
 }
 
 func deleteRemoteFileFromDS(fileID string) error {
-	var dsFiles []*File
 	parent := filepath.Dir(strings.TrimRight(fileID, "/"))
 
-	err := datastore.Get(bucket, parent, &dsFiles)
-	if err == datastore.ErrNotFound {
-		return nil //nothing to delete
-	}
-	if err != nil {
-		return err
-	}
+	// read and written back in one transaction, so a poll of the parent
+	// can't store its listing in between and have it overwritten
+	return datastore.Update(func(tx *datastore.Tx) error {
+		var dsFiles []*File
+		err := tx.Get(bucket, parent, &dsFiles)
+		if err == datastore.ErrNotFound {
+			return nil //nothing to delete
+		}
+		if err != nil {
+			return err
+		}
 
-	for i := range dsFiles {
-		if dsFiles[i].ID() == fileID {
-			//Remove file from list
-			dsFiles = append(dsFiles[:i], dsFiles[i+1:]...)
-			break
+		for i := range dsFiles {
+			if dsFiles[i].ID() == fileID {
+				//Remove file from list
+				dsFiles = append(dsFiles[:i], dsFiles[i+1:]...)
+				break
+			}
 		}
-	}
 
-	return datastore.Put(bucket, parent, dsFiles)
+		return tx.Put(bucket, parent, dsFiles)
+	})
 }
 
 type ignoreFiles struct {
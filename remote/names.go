@@ -0,0 +1,130 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"strings"
+
+	fh "bitbucket.org/tshannon/freehold-client"
+)
+
+// nameEncoding only uses digits and upper case letters, which are written lower
+// case, so encrypted names survive case insensitive file systems on the server
+var nameEncoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+const (
+	nameNonce = 12
+	// maxNameLength is the longest name most file systems will store, which
+	// encrypted names have to fit in
+	maxNameLength = 255
+)
+
+// encryptName encrypts the name.  The nonce is derived from the name itself,
+// so the same name always has the same encrypted name, and a file can be found
+// again by its plain name.  Names which are already encrypted are returned as is.
+// Encrypting a name makes it longer, so names which would end up longer than
+// maxNameLength can't be encrypted
+func (fk *folderKey) encryptName(name string) (string, error) {
+	if name == "" || fk.names == nil {
+		return name, nil
+	}
+	if _, ok := fk.decryptName(name); ok {
+		return name, nil
+	}
+
+	size := nameEncoding.EncodedLen(nameNonce + len(name) + fk.names.Overhead())
+	if size > maxNameLength {
+		return "", fmt.Errorf("The name %s is too long to be encrypted. Encrypted names can't be longer than %d bytes, "+
+			"and this one would be %d", name, maxNameLength, size)
+	}
+
+	mac := hmac.New(sha256.New, fk.nonceKey)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:nameNonce]
+
+	sealed := fk.names.Seal(nonce, nonce, []byte(name), nil)
+	return strings.ToLower(nameEncoding.EncodeToString(sealed)), nil
+}
+
+// decryptName returns the plain name of an encrypted name, false if the name
+// isn't one
+func (fk *folderKey) decryptName(name string) (string, bool) {
+	if fk.names == nil {
+		return name, false
+	}
+	sealed, err := nameEncoding.DecodeString(strings.ToUpper(name))
+	if err != nil || len(sealed) < nameNonce+fk.names.Overhead() {
+		return name, false
+	}
+	plain, err := fk.names.Open(nil, sealed[:nameNonce], sealed[nameNonce:], nil)
+	if err != nil {
+		return name, false
+	}
+	return string(plain), true
+}
+
+// encryptPath encrypts the names in the path below the encrypted folder it's
+// in, if that folder encrypts names
+func encryptPath(client *fh.Client, filePath string) (string, error) {
+	id := newEmptyFile(client, filePath).ID()
+	root, fk := keys.folder(strings.TrimSuffix(id, "/"))
+	if fk == nil || fk.names == nil {
+		return filePath, nil
+	}
+
+	rel := strings.TrimPrefix(id, root)
+	if !strings.HasSuffix(filePath, rel) {
+		// escaped differently than the ID, leave it alone rather than guess
+		return filePath, nil
+	}
+
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		var err error
+		parts[i], err = fk.encryptName(parts[i])
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSuffix(filePath, rel) + strings.Join(parts, "/"), nil
+}
+
+// decryptPath decrypts the names in the relative path of the file, if it's in
+// an encrypted folder which encrypts names
+func (f *File) decryptPath(rel string) string {
+	_, fk := keys.folder(f.ID())
+	if fk == nil || fk.names == nil {
+		return rel
+	}
+
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		parts[i], _ = fk.decryptName(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
+
+// plainName is the unencrypted name of the file
+func (f *File) plainName() string {
+	_, fk := keys.folder(f.ID())
+	if fk == nil {
+		return f.Name
+	}
+	name, _ := fk.decryptName(f.Name)
+	return name
+}
+
+// encryptedName is the name the passed in plain name is stored under next to the file
+func (f *File) encryptedName(name string) (string, error) {
+	_, fk := keys.folder(f.ID())
+	if fk == nil {
+		return name, nil
+	}
+	return fk.encryptName(name)
+}
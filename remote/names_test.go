@@ -0,0 +1,40 @@
+package remote
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncryptName(t *testing.T) {
+	names, err := newAEAD(subKey(testKey, "names"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fk := &folderKey{
+		names:    names,
+		nonceKey: subKey(testKey, "name nonces"),
+	}
+
+	encrypted, err := fk.encryptName("report.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, ok := fk.decryptName(encrypted)
+	if !ok || plain != "report.txt" {
+		t.Fatalf("Expected %s to decrypt to report.txt, got %s", encrypted, plain)
+	}
+
+	longest := strings.Repeat("a", 131)
+	encrypted, err = fk.encryptName(longest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encrypted) > maxNameLength {
+		t.Fatalf("Encrypted name is %d bytes long", len(encrypted))
+	}
+
+	_, err = fk.encryptName(longest + "a")
+	if err == nil {
+		t.Fatal("Expected an error for a name too long to encrypt")
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"path"
+	"strings"
+	"unicode"
+
+	fh "bitbucket.org/tshannon/freehold-client"
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// hasUnicode returns whether the path contains any non ASCII characters, which
+// could be normalized differently
+func hasUnicode(filePath string) bool {
+	return strings.IndexFunc(filePath, func(r rune) bool { return r > unicode.MaxASCII }) >= 0
+}
+
+// findNormalized looks for an existing remote file whose path only differs
+// from filePath by its Unicode normalization, such as a decomposed name
+// uploaded from Mac OS through the freehold web interface
+func findNormalized(client *fh.Client, filePath string) (*fh.File, bool) {
+	trimmed := strings.TrimSuffix(filePath, "/")
+	dir, base := path.Dir(trimmed), path.Base(trimmed)
+	if dir == trimmed {
+		return nil, false
+	}
+
+	parent, err := client.GetFile(dir)
+	if fh.IsNotFound(err) {
+		var ok bool
+		parent, ok = findNormalized(client, dir)
+		if !ok {
+			return nil, false
+		}
+	} else if err != nil {
+		return nil, false
+	}
+
+	children, err := parent.Children()
+	if err != nil {
+		return nil, false
+	}
+
+	for i := range children {
+		if syncer.SameName(children[i].Name, base) {
+			return children[i], true
+		}
+	}
+	return nil, false
+}
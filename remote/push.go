@@ -0,0 +1,226 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	fh "bitbucket.org/tshannon/freehold-client"
+)
+
+const (
+	// changeFeedPath is the freehold path of the change feed, which holds each
+	// request open until something changes, or the wait runs out.  Freehold
+	// itself has no change feed, so instances without one are found out by the
+	// first request, and never asked again
+	changeFeedPath = "/v1/changes/"
+	changeFeedWait = 60 * time.Second
+	// pushPollRounds is how many times longer folders wait between polls while
+	// their changes are being pushed
+	pushPollRounds = 20
+)
+
+var errFeedUnsupported = errors.New("The freehold instance doesn't have a change feed")
+
+var pushed pushMap // change feeds being followed, by client
+
+func init() {
+	pushed = pushMap{
+		feeds:       make(map[string]*feed),
+		unsupported: make(map[string]bool),
+	}
+}
+
+type pushMap struct {
+	sync.Mutex
+	feeds       map[string]*feed
+	unsupported map[string]bool // instances without a change feed
+}
+
+type feed struct {
+	sync.Mutex
+	client *fh.Client
+	active bool // changes are currently being received
+	stop   chan struct{}
+}
+
+func (f *feed) setActive(active bool) {
+	f.Lock()
+	defer f.Unlock()
+	if active && !f.active {
+		logger.Infof("Receiving changes from %s as they happen", instanceKey(f.client.RootURL()))
+	}
+	f.active = active
+}
+
+func (f *feed) isActive() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.active
+}
+
+// active is whether or not changes from the client are being pushed
+func (p *pushMap) active(c *fh.Client) bool {
+	p.Lock()
+	fd, ok := p.feeds[clientKey(c)]
+	p.Unlock()
+	return ok && fd.isActive()
+}
+
+// subscribe follows the change feed of each client, and stops following the
+// ones no folder is watched with anymore
+func (p *pushMap) subscribe(clients []*fh.Client) {
+	p.Lock()
+	defer p.Unlock()
+
+	current := make(map[string]*fh.Client)
+	for i := range clients {
+		current[clientKey(clients[i])] = clients[i]
+	}
+
+	for key, c := range current {
+		if _, ok := p.feeds[key]; ok || p.unsupported[instanceKey(c.RootURL())] {
+			continue
+		}
+		fd := &feed{
+			client: c,
+			stop:   make(chan struct{}),
+		}
+		p.feeds[key] = fd
+		go fd.follow(key)
+	}
+
+	for key, fd := range p.feeds {
+		if _, ok := current[key]; !ok {
+			close(fd.stop)
+			delete(p.feeds, key)
+		}
+	}
+}
+
+func (p *pushMap) unsupport(key string, c *fh.Client) {
+	p.Lock()
+	defer p.Unlock()
+	p.unsupported[instanceKey(c.RootURL())] = true
+	delete(p.feeds, key)
+}
+
+func (p *pushMap) stopAll() {
+	p.Lock()
+	defer p.Unlock()
+	for key, fd := range p.feeds {
+		close(fd.stop)
+		delete(p.feeds, key)
+	}
+}
+
+// follow waits on the change feed, and polls the folders changes are pushed for
+// right away
+func (f *feed) follow(key string) {
+	cursor := ""
+	for {
+		select {
+		case <-f.stop:
+			return
+		default:
+		}
+
+		changed, next, err := f.wait(cursor)
+		if err == errFeedUnsupported {
+			pushed.unsupport(key, f.client)
+			return
+		}
+		if err != nil {
+			f.setActive(false)
+			select {
+			case <-f.stop:
+				return
+			case <-time.After(pollInterval):
+			}
+			continue
+		}
+
+		f.setActive(true)
+		if cursor != "" {
+			// changes from before the first request are picked up by polling
+			for i := range changed {
+				pushChange(f.client, changed[i])
+			}
+		}
+		cursor = next
+	}
+}
+
+// wait asks the change feed for the paths changed since the cursor, and the
+// cursor to ask with next time
+func (f *feed) wait(cursor string) ([]string, string, error) {
+	req, err := newRequest(f.client, "GET", changeFeedPath, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.URL.RawQuery = url.Values{
+		"since": []string{cursor},
+		"wait":  []string{strconv.Itoa(int(changeFeedWait / time.Second))},
+	}.Encode()
+
+	res, err := do(f.client, req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return nil, "", errFeedUnsupported
+	default:
+		return nil, "", fmt.Errorf("Error reading the change feed. Status: %s", res.Status)
+	}
+
+	result := &struct {
+		Data struct {
+			Cursor  string   `json:"cursor"`
+			Changes []string `json:"changes"` // paths of the changed files
+		} `json:"data"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(result)
+	if err != nil || result.Data.Cursor == "" {
+		// answered by something other than a change feed
+		return nil, "", errFeedUnsupported
+	}
+	return result.Data.Changes, result.Data.Cursor, nil
+}
+
+// pushChange polls the watched folder the changed file is in
+func pushChange(c *fh.Client, changedPath string) {
+	dir := path.Dir(strings.TrimSuffix(changedPath, "/"))
+	for _, folder := range []string{dir, changedPath} {
+		f := newEmptyFile(c, folder)
+		for _, id := range []string{strings.TrimSuffix(f.ID(), "/"), strings.TrimSuffix(f.ID(), "/") + "/"} {
+			profiles := watching.profiles(&File{FullURL: id})
+			if len(profiles) == 0 {
+				continue
+			}
+			watchFile, err := New(c, folder)
+			if err != nil {
+				if !IsUnavailable(err) {
+					logger.Errorf("Error getting pushed change for %s: %s", folder, err)
+				}
+				return
+			}
+			go pollFolder(watchFile)
+			break
+		}
+	}
+}
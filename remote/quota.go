@@ -0,0 +1,140 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	fh "bitbucket.org/tshannon/freehold-client"
+)
+
+// quotaPath is where freehold instances which limit how much a user can
+// store report the user's quota and usage.  Instances that don't are
+// treated as having no limit, and aren't asked again
+const quotaPath = "/v1/auth/quota/"
+
+// quotaCacheTime is how long a freehold instance's reported quota is used
+// before asking for it again
+const quotaCacheTime = 30 * time.Second
+
+var quotas quotaMap
+
+func init() {
+	quotas = quotaMap{
+		clients: make(map[string]*quotaInfo),
+	}
+}
+
+type quotaInfo struct {
+	free        int64
+	checked     time.Time
+	unsupported bool // the instance has no quota to report
+}
+
+type quotaMap struct {
+	sync.Mutex
+	clients map[string]*quotaInfo
+}
+
+func (q *quotaMap) get(c *fh.Client) (int64, bool) {
+	q.Lock()
+	defer q.Unlock()
+	info, ok := q.clients[clientKey(c)]
+	if !ok || (!info.unsupported && time.Since(info.checked) > quotaCacheTime) {
+		return 0, false
+	}
+	return info.free, true
+}
+
+// unsupported records that the instance has no quota to report, so it's never
+// asked for one again
+func (q *quotaMap) unsupported(c *fh.Client) {
+	q.Lock()
+	defer q.Unlock()
+	q.clients[clientKey(c)] = &quotaInfo{
+		free:        math.MaxInt64,
+		checked:     time.Now(),
+		unsupported: true,
+	}
+}
+
+func (q *quotaMap) set(c *fh.Client, free int64) {
+	q.Lock()
+	defer q.Unlock()
+	q.clients[clientKey(c)] = &quotaInfo{
+		free:    free,
+		checked: time.Now(),
+	}
+}
+
+// used takes the bytes just written from the cached free space, so uploads
+// in between checks are still counted
+func (q *quotaMap) used(c *fh.Client, size int64) {
+	q.Lock()
+	defer q.Unlock()
+	info, ok := q.clients[clientKey(c)]
+	if !ok || info.free == math.MaxInt64 {
+		return
+	}
+	info.free -= size
+}
+
+type quotaResponse struct {
+	Data struct {
+		Quota *int64 `json:"quota"` // bytes the user can store, 0 for no limit
+		Usage int64  `json:"usage"` // bytes the user is currently storing
+	} `json:"data"`
+}
+
+// FreeSpace returns the number of bytes left in the user's quota on the
+// freehold instance
+func (f *File) FreeSpace() (int64, error) {
+	if free, ok := quotas.get(f.client); ok {
+		return free, nil
+	}
+
+	req, err := newRequest(f.client, "GET", quotaPath, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := do(f.client, req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		quotas.unsupported(f.client)
+		return math.MaxInt64, nil
+	default:
+		return 0, fmt.Errorf("Error reading the storage quota of %s. Status: %s", f.client.RootURL(), res.Status)
+	}
+
+	quota := &quotaResponse{}
+	err = json.NewDecoder(res.Body).Decode(quota)
+	if err != nil {
+		return 0, err
+	}
+
+	if quota.Data.Quota == nil {
+		// answered by something other than a quota lookup
+		quotas.unsupported(f.client)
+		return math.MaxInt64, nil
+	}
+
+	free := int64(math.MaxInt64)
+	if *quota.Data.Quota > 0 {
+		free = *quota.Data.Quota - quota.Data.Usage
+	}
+	quotas.set(f.client, free)
+	return free, nil
+}
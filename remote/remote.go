@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"path"
 	"path/filepath"
@@ -30,6 +31,8 @@ type File struct {
 	ModifiedTime time.Time `json:"modified"`
 	deleted      bool
 	exists       bool
+	permissions  *fh.Permission // kept so they can be put back when the file is replaced
+	listed       bool           // built from a listing, file hasn't been retrieved from the instance yet
 }
 
 // New Returns a File from the remote instance for use in syncing
@@ -37,12 +40,22 @@ func New(client *fh.Client, filePath string) (*File, error) {
 	if client == nil {
 		return nil, errors.New("Can't retrieve a file with a nil client")
 	}
-	filePath = filepath.ToSlash(filePath)
+	filePath, err := encryptPath(client, filepath.ToSlash(filePath))
+	if err != nil {
+		return nil, err
+	}
 
 	f := newEmptyFile(client, filePath)
 
 	file, err := client.GetFile(filePath)
 	if fh.IsNotFound(err) {
+		// may exist under a differently normalized name
+		if hasUnicode(filePath) {
+			if found, ok := findNormalized(client, filePath); ok {
+				return newFromFile(client, found), nil
+			}
+		}
+
 		//Check if deleted
 		in, err := f.inRemoteDS()
 		if err != nil {
@@ -74,6 +87,7 @@ func newFromFile(client *fh.Client, file *fh.File) *File {
 		FullURL:      eURL,
 		ModifiedTime: file.ModifiedTime(),
 		file:         file,
+		permissions:  file.Permissions,
 	}
 	return f
 }
@@ -111,7 +125,7 @@ func (f *File) Path(p *syncer.Profile) string {
 	if f.ID() == p.Remote.ID() {
 		return f.URL
 	}
-	return strings.TrimPrefix(f.URL, p.Remote.Path(p))
+	return syncer.NormalizeName(f.decryptPath(strings.TrimPrefix(f.URL, p.Remote.Path(p))))
 }
 
 // Modified is the date the file was last modified
@@ -128,7 +142,19 @@ func (f *File) Children() ([]*File, error) {
 	if !f.exists {
 		return nil, nil
 	}
-	children, err := f.file.Children()
+	if props, ok := trees.take(f.client, f.URL); ok {
+		syncers := make([]*File, len(props))
+		for i := range props {
+			syncers[i] = newFromListing(f.Client(), props[i])
+		}
+		return syncers, nil
+	}
+
+	file, err := f.handle()
+	if err != nil {
+		return nil, err
+	}
+	children, err := file.Children()
 	if err != nil {
 		return nil, err
 	}
@@ -140,9 +166,150 @@ func (f *File) Children() ([]*File, error) {
 	return syncers, nil
 }
 
+// ChildrenIter calls fn with each page of the child files of the directory, see
+// syncer.ChildIterator.  The listing is decoded as it's read, so the whole of
+// a huge folder is never held in memory at once
+func (f *File) ChildrenIter(fn func(page []syncer.Syncer) error) error {
+	return f.eachChildPage(func(page []*File) error {
+		list := make([]syncer.Syncer, len(page))
+		for i := range page {
+			list[i] = page[i]
+		}
+		return fn(list)
+	})
+}
+
+// List returns the children of the directory as Syncers
+func (f *File) List() ([]syncer.Syncer, error) {
+	children, err := f.Children()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]syncer.Syncer, len(children))
+	for i := range children {
+		list[i] = children[i]
+	}
+	return list, nil
+}
+
 // Open returns a ReadWriteCloser for reading, and writing data to the file
 func (f *File) Open() (io.ReadCloser, error) {
-	return f, nil
+	r := &transferReader{
+		ReadCloser: f,
+		done:       startTransfer(f.client),
+	}
+	key := f.key()
+	if key == nil {
+		return r, nil
+	}
+	dr, err := newDecryptReader(r, key)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return dr, nil
+}
+
+// OpenAt returns a ReadCloser for reading the file's data starting at the
+// passed in offset
+func (f *File) OpenAt(offset int64) (io.ReadCloser, error) {
+	if !f.exists {
+		return nil, fmt.Errorf("Can't read file %s , because it doesn't exist.", f.ID())
+	}
+	if offset == 0 {
+		return f.Open()
+	}
+
+	key := f.key()
+	var prefix []byte
+	start := offset
+	if key != nil {
+		var err error
+		prefix, err = f.cryptPrefix()
+		if err != nil {
+			return nil, err
+		}
+		start = chunkOffset(offset)
+	}
+
+	req, err := newRequest(f.client, "GET", f.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+
+	done := startTransfer(f.client)
+	res, err := do(f.client, req)
+	if err != nil {
+		done()
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		done()
+		return nil, fmt.Errorf("Remote server won't resume reading %s at byte %d. Status: %s", f.ID(), offset, res.Status)
+	}
+
+	r := &transferReader{
+		ReadCloser: res.Body,
+		done:       done,
+	}
+	if key == nil {
+		return r, nil
+	}
+	return newDecryptReaderAt(r, key, prefix, offset)
+}
+
+// cryptPrefix reads the nonce prefix from the header of the encrypted file
+func (f *File) cryptPrefix() ([]byte, error) {
+	return headerPrefix(f.client, f.URL)
+}
+
+// headerPrefix reads the nonce prefix from the header of the encrypted file at
+// the freehold path
+func headerPrefix(c *fh.Client, fileURL string) ([]byte, error) {
+	req, err := newRequest(c, "GET", fileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", cryptHeader-1))
+
+	res, err := do(c, req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent && res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error reading the header of %s. Status: %s", fileURL, res.Status)
+	}
+	return readCryptHeader(res.Body)
+}
+
+// contentSize reads the size of the content of the encrypted file at the freehold
+// path out of its last chunk, since the stored size is padded
+func contentSize(c *fh.Client, fileURL string, stored int64, key []byte) (int64, error) {
+	prefix, err := headerPrefix(c, fileURL)
+	if err != nil {
+		return 0, err
+	}
+	_, start := lastChunk(stored)
+
+	req, err := newRequest(c, "GET", fileURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+
+	res, err := do(c, req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("Error reading the last chunk of %s. Status: %s", fileURL, res.Status)
+	}
+	return readSize(res.Body, key, prefix, stored)
 }
 
 // Read reads the data out of the remote file
@@ -150,7 +317,11 @@ func (f *File) Read(p []byte) (n int, err error) {
 	if !f.exists {
 		return 0, fmt.Errorf("Can't read file %s , because it doesn't exist.")
 	}
-	return f.file.Read(p)
+	file, err := f.handle()
+	if err != nil {
+		return 0, err
+	}
+	return file.Read(p)
 }
 
 // Close closes an open file reader
@@ -158,7 +329,11 @@ func (f *File) Close() error {
 	if !f.exists {
 		return fmt.Errorf("Can't close file %s , because it doesn't exist.")
 	}
-	return f.file.Close()
+	file, err := f.handle()
+	if err != nil {
+		return err
+	}
+	return file.Close()
 }
 
 // Write writes from the reader to the Syncer
@@ -171,11 +346,15 @@ func (f *File) Write(r io.ReadCloser, size int64, modTime time.Time) error {
 	ignore.add(f.ID())
 	defer ignore.remove(f.ID())
 	var err error
+	// freehold can't overwrite a file in place, so the existing file is
+	// deleted, and its permissions put back on the new one
+	permissions := f.permissions
 	if f.exists {
-		err = f.file.Delete()
-		if err != nil && !fh.IsNotFound(err) {
+		err = f.deleteUnchanged()
+		if err != nil {
 			return err
 		}
+		quotas.used(f.client, -f.file.Size)
 	}
 	dest := &fh.File{
 		Property: fh.Property{
@@ -185,12 +364,40 @@ func (f *File) Write(r io.ReadCloser, size int64, modTime time.Time) error {
 		},
 	}
 
-	newFile, err := f.client.UploadFromReader(f.Name, r, size, modTime, dest)
+	// the content is streamed from the reader as it's sent, never buffered
+	var body io.Reader = r
+	var er *encryptReader
+	if key := f.key(); key != nil {
+		er, err = newEncryptReader(r, key)
+		if err != nil {
+			return err
+		}
+		body = er
+		size = encryptedSize(size)
+	}
+
+	done := startTransfer(f.client)
+	newFile, err := f.client.UploadFromReader(f.Name, body, size, modTime, dest)
+	done()
 	if err != nil {
 		return err
 	}
+	quotas.used(f.client, newFile.Size)
+	if er != nil {
+		sizes.set(f.ID(), newFile.Size, newFile.ModifiedTime(), er.size)
+	}
+
+	if permissions != nil {
+		err = newFile.SetPermissions(permissions)
+		if err != nil {
+			return fmt.Errorf("Error restoring the permissions of %s: %s", f.ID(), err)
+		}
+		newFile.Permissions = permissions
+	}
 
 	f.file = newFile
+	f.ModifiedTime = newFile.ModifiedTime()
+	f.permissions = newFile.Permissions
 
 	f.exists = true
 	f.deleted = false
@@ -233,16 +440,23 @@ func (f *File) Delete() error {
 		}
 	}
 
-	err := f.file.Delete()
-	if err != nil && !fh.IsNotFound(err) {
-		return err
+	if f.IsDir() {
+		file, err := f.handle()
+		if err != nil {
+			return err
+		}
+		err = file.Delete()
+		if err != nil && !fh.IsNotFound(err) {
+			return err
+		}
+		return nil
 	}
-	return nil
+	return f.deleteUnchanged()
 }
 
 // Rename renames the file based on the filename and the time
 // the rename function is called
-func (f *File) Rename() error {
+func (f *File) Rename(p *syncer.Profile) error {
 	if !f.Exists() {
 		return errors.New("Can't Rename / Move a file which doesn't exist!")
 	}
@@ -253,22 +467,171 @@ func (f *File) Rename() error {
 	//ignore  events for this change
 	ignore.add(f.ID())
 	defer ignore.remove(f.ID())
-	ext := path.Ext(f.file.URL)
-	newName := strings.TrimSuffix(f.file.URL, ext)
 
-	newName += time.Now().Format(time.Stamp) + ext
+	dir := path.Dir(f.file.URL)
+	newName, err := p.ConflictName(f.plainName(), func(name string) (bool, error) {
+		encrypted, err := f.encryptedName(name)
+		if err != nil {
+			return false, err
+		}
+		_, err = f.client.GetFile(path.Join(dir, encrypted))
+		if fh.IsNotFound(err) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		return err
+	}
+
+	mode, err := f.Mode(p)
+	if err != nil {
+		return err
+	}
+	file, err := f.handle()
+	if err != nil {
+		return err
+	}
+	encrypted, err := f.encryptedName(newName)
+	if err != nil {
+		return err
+	}
+	err = file.Move(path.Join(dir, encrypted))
+	if err != nil {
+		return err
+	}
+	// the recorded mode goes along with the file to its new name
+	err = newEmptyFile(f.client, path.Join(dir, encrypted)).SetMode(p, mode)
+	if err != nil {
+		return err
+	}
+	err = f.SetMode(p, 0)
+	if err != nil {
+		return err
+	}
+	// the original name is now free for the conflicting file to be written to
+	f.file = nil
+	f.exists = false
+	return nil
+}
+
+// Move moves the file to the location of the passed in, non-existent file
+// on the same freehold instance
+func (f *File) Move(to syncer.Syncer) error {
+	dest, ok := to.(*File)
+	if !ok {
+		return errors.New("Can't move a remote file to a non-remote location")
+	}
+	if !f.Exists() {
+		return errors.New("Can't Rename / Move a file which doesn't exist!")
+	}
+	if dest.Exists() {
+		return errors.New("Can't move file, destination already exists")
+	}
+
+	//ignore  events for this change
+	ignore.add(f.ID())
+	defer ignore.remove(f.ID())
+	ignore.add(dest.ID())
+	defer ignore.remove(dest.ID())
+
+	file, err := f.handle()
+	if err != nil {
+		return err
+	}
+	err = file.Move(dest.URL)
+	if err != nil {
+		return err
+	}
+
+	err = deleteRemoteFileFromDS(f.ID())
+	if err != nil {
+		return err
+	}
 
-	return f.file.Move(newName)
+	moved, err := New(f.client, dest.URL)
+	if err != nil {
+		return err
+	}
+	*dest = *moved
+	f.file = nil
+	f.exists = false
+	return nil
 }
 
-// Size returns the size of the file
+// Size returns the size of the file.  The stored size of encrypted files is
+// padded, so their size is read from the file unless it's already known, and
+// is -1 if it can't be read, which no other file's size will match
 func (f *File) Size() int64 {
+	if !f.exists {
+		return 0
+	}
+	if key := f.key(); !f.file.IsDir && key != nil {
+		modified := f.file.ModifiedTime()
+		if size, ok := sizes.get(f.ID(), f.file.Size, modified); ok {
+			return size
+		}
+		size, err := contentSize(f.client, f.URL, f.file.Size, key)
+		if err != nil {
+			logger.Errorf("Error reading the size of %s: %s", f.ID(), err)
+			return -1
+		}
+		sizes.set(f.ID(), f.file.Size, modified, size)
+		return size
+	}
+	return f.file.Size
+}
+
+// StoredSize returns the size of the file as stored on the freehold instance,
+// padding included
+func (f *File) StoredSize() int64 {
 	if !f.exists {
 		return 0
 	}
 	return f.file.Size
 }
 
+// SetSize sets the size of the content of an encrypted file, when it's already
+// known from the last time the file was synced
+func (f *File) SetSize(size int64) {
+	if !f.exists || f.key() == nil {
+		return
+	}
+	sizes.set(f.ID(), f.file.Size, f.file.ModifiedTime(), size)
+}
+
+// Hash returns the SHA-256 hash of the file's content.  Freehold doesn't
+// provide file hashes, so the file has to be read to get one
+func (f *File) Hash() (string, error) {
+	return f.HashThrough(func(r io.ReadCloser) io.ReadCloser { return r })
+}
+
+// HashThrough returns the SHA-256 hash of the file's content, read through
+// wrap the same way a download is, so it takes a transfer slot
+func (f *File) HashThrough(wrap func(io.ReadCloser) io.ReadCloser) (string, error) {
+	if !f.exists {
+		return "", fmt.Errorf("Can't hash file %s , because it doesn't exist.", f.ID())
+	}
+	if f.IsDir() {
+		return "", errors.New("Can't hash a directory")
+	}
+	return syncer.CachedHash(f, func() (string, error) {
+		r := wrap(&transferReader{
+			ReadCloser: f,
+			done:       startTransfer(f.client),
+		})
+		defer r.Close()
+		if key := f.key(); key != nil {
+			dr, err := newDecryptReader(r, key)
+			if err != nil {
+				return "", err
+			}
+			return syncer.HashReader(dr)
+		}
+		return syncer.HashReader(r)
+	})
+}
+
 // Deleted - If the file doesn't exist was it deleted
 func (f *File) Deleted() bool {
 	return f.deleted
@@ -308,7 +671,16 @@ func (f *File) StartMonitor(p *syncer.Profile) error {
 	// Start watching, and check for current differences
 	// if folder hasn't been watched yet, then all
 	// files will be checked
-	diff, err := f.differences()
+	if f.ID() == p.Remote.ID() {
+		// the whole tree is about to be scanned
+		err := f.listTree()
+		if err != nil {
+			logger.Errorf("Error listing %s recursively, listing its folders one at a time instead: %s",
+				f.ID(), err)
+		}
+	}
+
+	diff, _, err := f.differences()
 	if err != nil {
 		return err
 	}
@@ -317,6 +689,9 @@ func (f *File) StartMonitor(p *syncer.Profile) error {
 	// child folders are monitored recursively and all
 	// files are in sync
 	for i := range diff {
+		if p.Excluded(diff[i]) {
+			continue
+		}
 		go func(s syncer.Syncer) {
 			changeHandler(p, s)
 		}(diff[i])
@@ -334,18 +709,19 @@ func (f *File) StopMonitor(p *syncer.Profile) error {
 
 func (f *File) stopWatcherRecursive(p *syncer.Profile) error {
 	// Recursively stop watching all children dirs
-	children, err := f.Children()
-	if err != nil {
-		return err
-	}
-
-	for i := range children {
-		if children[i].IsDir() {
-			err = children[i].stopWatcherRecursive(p)
-			if err != nil {
-				return err
+	err := f.eachChildPage(func(children []*File) error {
+		for i := range children {
+			if children[i].IsDir() {
+				err := children[i].stopWatcherRecursive(p)
+				if err != nil {
+					return err
+				}
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 	watching.remove(p, f)
 	deleteRemoteFileFromDS(f.ID())
@@ -0,0 +1,132 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TLSOptions are the TLS settings for connecting to a freehold instance
+type TLSOptions struct {
+	CAFile   string   // PEM file of certificate authorities trusted on top of the system ones
+	CertFile string   // PEM client certificate, for instances which require one
+	KeyFile  string   // PEM key of the client certificate
+	Pins     []string // SHA-256 hashes of the public keys the instance's certificate chain must include
+}
+
+// TLSConfig builds the TLS configuration for the options, nil if there are none
+func TLSConfig(opts TLSOptions) (*tls.Config, error) {
+	if opts.CAFile == "" && opts.CertFile == "" && opts.KeyFile == "" && len(opts.Pins) == 0 {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{}
+
+	if opts.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA file: %s", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificates found in CA file %s", opts.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		if opts.CertFile == "" || opts.KeyFile == "" {
+			return nil, errors.New("A client certificate needs both a certificate file and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client certificate: %s", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(opts.Pins) > 0 {
+		pins := make(map[string]bool, len(opts.Pins))
+		for i := range opts.Pins {
+			pin, err := parsePin(opts.Pins[i])
+			if err != nil {
+				return nil, err
+			}
+			pins[pin] = true
+		}
+
+		// verified in VerifyConnection instead, so a self-signed certificate can
+		// be trusted by pinning it
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPinned(cs, cfg.RootCAs, pins)
+		}
+	}
+
+	return cfg, nil
+}
+
+// parsePin accepts a SHA-256 hash in hex, or in base64 with an optional sha256/
+// prefix as used by HTTP public key pinning, and returns it in hex
+func parsePin(pin string) (string, error) {
+	pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+	if data, err := hex.DecodeString(strings.Replace(pin, ":", "", -1)); err == nil && len(data) == sha256.Size {
+		return hex.EncodeToString(data), nil
+	}
+	if data, err := base64.StdEncoding.DecodeString(pin); err == nil && len(data) == sha256.Size {
+		return hex.EncodeToString(data), nil
+	}
+	return "", fmt.Errorf("Invalid certificate pin %s, it must be a SHA-256 hash in hex or base64", pin)
+}
+
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyPinned accepts the connection if the server's own certificate is pinned,
+// or if its chain verifies normally and includes a pinned certificate
+func verifyPinned(cs tls.ConnectionState, roots *x509.CertPool, pins map[string]bool) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("The freehold instance sent no certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+	if pins[spkiHash(leaf)] {
+		return nil
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if pins[spkiHash(cert)] {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("The certificate of %s doesn't match any pinned certificate", cs.ServerName)
+}
@@ -0,0 +1,310 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	fh "bitbucket.org/tshannon/freehold-client"
+
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// treeCacheTime is how long the folders from a recursive listing are used
+// in place of listing them one at a time
+const treeCacheTime = 2 * time.Minute
+
+var trees treeCache // folder contents from recursive listings
+
+func init() {
+	trees = treeCache{
+		folders: make(map[string]*treeFolder),
+	}
+}
+
+type treeFolder struct {
+	expires  time.Time
+	children []fh.Property
+}
+
+type treeCache struct {
+	sync.Mutex
+	folders map[string]*treeFolder
+}
+
+func treeKey(c *fh.Client, folderURL string) string {
+	return clientKey(c) + "|" + dirKey(folderURL)
+}
+
+func dirKey(folderURL string) string {
+	return strings.TrimSuffix(folderURL, "/") + "/"
+}
+
+func (t *treeCache) set(c *fh.Client, folders map[string][]fh.Property) {
+	t.Lock()
+	defer t.Unlock()
+	expires := time.Now().Add(treeCacheTime)
+	for folder, children := range folders {
+		t.folders[treeKey(c, folder)] = &treeFolder{
+			expires:  expires,
+			children: children,
+		}
+	}
+}
+
+// take returns the contents of the folder from a recent recursive listing.  Each
+// folder is only used once, so later listings of it come from the instance
+func (t *treeCache) take(c *fh.Client, folderURL string) ([]fh.Property, bool) {
+	t.Lock()
+	defer t.Unlock()
+	key := treeKey(c, folderURL)
+	folder, ok := t.folders[key]
+	if !ok {
+		return nil, false
+	}
+	delete(t.folders, key)
+	if time.Now().After(folder.expires) {
+		return nil, false
+	}
+	return folder.children, true
+}
+
+// propertiesURL is the freehold path for the properties of the file
+func propertiesURL(fileURL string) string {
+	return "/v1/properties" + strings.TrimPrefix(fileURL, "/v1")
+}
+
+// listTree asks the instance for the properties of every file and folder under
+// the folder in one request, which are then used in place of listing each
+// folder in turn when the tree is first scanned.  Instances which don't
+// support recursive listings only get asked once per client
+func (f *File) listTree() error {
+	info, ok := clients.get(f.client)
+	if !ok || !f.IsDir() {
+		return nil
+	}
+
+	info.treeLock.Lock()
+	checked, supported := info.treeChecked, info.tree
+	info.treeLock.Unlock()
+	if checked && !supported {
+		return nil
+	}
+
+	req, err := newRequest(f.client, "GET", propertiesURL(dirKey(f.URL)), nil)
+	if err != nil {
+		return err
+	}
+	req.URL.RawQuery = url.Values{"recursive": []string{"true"}}.Encode()
+
+	res, err := do(f.client, req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		// turned down the recursive option rather than ignoring it
+		info.treeUnsupported()
+		return nil
+	default:
+		return fmt.Errorf("Error listing %s. Status: %s", f.ID(), res.Status)
+	}
+
+	listing := &struct {
+		Data []fh.Property `json:"data"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(listing)
+	if err != nil {
+		return err
+	}
+
+	root := dirKey(f.URL)
+	folders := map[string][]fh.Property{root: nil}
+	deeper := false
+	hasDirs := false
+	for _, prop := range listing.Data {
+		if dirKey(prop.URL) == root {
+			continue
+		}
+		parent := dirKey(path.Dir(strings.TrimSuffix(prop.URL, "/")))
+		if parent != root {
+			deeper = true
+		}
+		if prop.IsDir {
+			hasDirs = true
+			if _, ok := folders[dirKey(prop.URL)]; !ok {
+				folders[dirKey(prop.URL)] = nil
+			}
+		}
+		folders[parent] = append(folders[parent], prop)
+	}
+
+	// an instance which ignores the recursive option only lists the folder itself
+	if hasDirs && !deeper {
+		info.treeUnsupported()
+		return nil
+	}
+	info.treeLock.Lock()
+	info.treeChecked = true
+	info.tree = true
+	info.treeLock.Unlock()
+
+	trees.set(f.client, folders)
+	return nil
+}
+
+// treeUnsupported records that the instance can't list folders recursively,
+// so it isn't asked to again
+func (c *clientInfo) treeUnsupported() {
+	c.treeLock.Lock()
+	defer c.treeLock.Unlock()
+	c.treeChecked = true
+	c.tree = false
+}
+
+// newFromListing builds a file from its properties in a listing.  The freehold
+// file it wraps isn't retrieved until it's needed, see handle
+func newFromListing(client *fh.Client, prop fh.Property) *File {
+	f := newEmptyFile(client, prop.URL)
+	file := &fh.File{Property: prop}
+	f.exists = true
+	f.Name = prop.Name
+	f.ModifiedTime = file.ModifiedTime()
+	f.file = file
+	f.permissions = prop.Permissions
+	f.listed = true
+	return f
+}
+
+// handle returns the freehold file for making requests against, retrieving
+// it first if the file was built from a listing
+func (f *File) handle() (*fh.File, error) {
+	if !f.listed {
+		return f.file, nil
+	}
+	file, err := f.client.GetFile(f.URL)
+	if err != nil {
+		return nil, err
+	}
+	f.file = file
+	f.listed = false
+	return file, nil
+}
+
+// eachChildPage lists the folder, calling fn with each syncer.ChildPageSize
+// children as they're decoded from the listing
+func (f *File) eachChildPage(fn func(page []*File) error) error {
+	if !f.exists || !f.IsDir() {
+		return nil
+	}
+	if props, ok := trees.take(f.client, f.URL); ok {
+		for start := 0; start < len(props); start += syncer.ChildPageSize {
+			end := start + syncer.ChildPageSize
+			if end > len(props) {
+				end = len(props)
+			}
+			page := make([]*File, 0, end-start)
+			for i := start; i < end; i++ {
+				page = append(page, newFromListing(f.client, props[i]))
+			}
+			err := fn(page)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	req, err := newRequest(f.client, "GET", propertiesURL(dirKey(f.URL)), nil)
+	if err != nil {
+		return err
+	}
+	res, err := do(f.client, req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error listing %s. Status: %s", f.ID(), res.Status)
+	}
+
+	dec := json.NewDecoder(res.Body)
+	err = seekData(dec)
+	if err != nil {
+		return fmt.Errorf("Error reading the listing of %s: %s", f.ID(), err)
+	}
+
+	root := dirKey(f.URL)
+	page := make([]*File, 0, syncer.ChildPageSize)
+	for dec.More() {
+		var prop fh.Property
+		err = dec.Decode(&prop)
+		if err != nil {
+			return fmt.Errorf("Error reading the listing of %s: %s", f.ID(), err)
+		}
+		if dirKey(prop.URL) == root {
+			continue
+		}
+		page = append(page, newFromListing(f.client, prop))
+		if len(page) == syncer.ChildPageSize {
+			err = fn(page)
+			if err != nil {
+				return err
+			}
+			page = make([]*File, 0, syncer.ChildPageSize)
+		}
+	}
+	if len(page) > 0 {
+		return fn(page)
+	}
+	return nil
+}
+
+// seekData moves the decoder to the start of the data array of a freehold
+// response
+func seekData(dec *json.Decoder) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != json.Delim('{') {
+		return errors.New("Listing isn't a JSON object")
+	}
+	for dec.More() {
+		tok, err = dec.Token()
+		if err != nil {
+			return err
+		}
+		if tok != "data" {
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		tok, err = dec.Token()
+		if err != nil {
+			return err
+		}
+		if tok != json.Delim('[') {
+			return errors.New("Listing data isn't an array")
+		}
+		return nil
+	}
+	return errors.New("Listing has no data")
+}
@@ -0,0 +1,218 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	fh "bitbucket.org/tshannon/freehold-client"
+
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// versionTimeFormat is the format of the timestamp prefixed to the name of each version
+const versionTimeFormat = "20060102-150405.000"
+
+// restoring is the versions currently being restored, which aren't pruned
+// until they've been written back
+var restoring = ignoreFiles{
+	files: make(map[string]struct{}),
+}
+
+// Version is a previous version of a remote file
+type Version struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Replaced time.Time `json:"replaced"` // when the version was overwritten or deleted
+}
+
+// versionDir is the folder the versions of the file are kept in
+func (f *File) versionDir(p *syncer.Profile) (string, error) {
+	return encryptPath(f.client, path.Join(p.Remote.Path(p), syncer.VersionsFolder, f.Path(p)))
+}
+
+// Version moves the file into the profile's versions folder, and removes
+// any versions older than the number the profile keeps
+func (f *File) Version(p *syncer.Profile) error {
+	err := f.moveToVersions(p)
+	if err != nil {
+		return err
+	}
+	return f.pruneVersions(p)
+}
+
+func (f *File) moveToVersions(p *syncer.Profile) error {
+	if !f.exists || f.IsDir() {
+		return errors.New("Can only keep versions of files which exist")
+	}
+
+	dir, err := f.versionDir(p)
+	if err != nil {
+		return err
+	}
+	err = f.makeDirs(p, dir)
+	if err != nil {
+		return err
+	}
+
+	//ignore  events for this change
+	ignore.add(f.ID())
+	defer ignore.remove(f.ID())
+
+	file, err := f.handle()
+	if err != nil {
+		return err
+	}
+	err = file.Move(path.Join(dir, time.Now().Format(versionTimeFormat)+"_"+f.Name))
+	if err != nil {
+		return err
+	}
+
+	err = deleteRemoteFileFromDS(f.ID())
+	if err != nil {
+		return err
+	}
+	f.file = nil
+	f.exists = false
+	return nil
+}
+
+// makeDirs creates the passed in folder and any missing parents below the
+// profile's root
+func (f *File) makeDirs(p *syncer.Profile, dir string) error {
+	root := p.Remote.Path(p)
+	current := root
+	for _, part := range strings.Split(strings.TrimPrefix(dir, root), "/") {
+		if part == "" {
+			continue
+		}
+		current = path.Join(current, part)
+		err := f.client.NewFolder(current)
+		if err != nil && !strings.Contains(err.Error(), "Folder already exists") {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *File) versionFiles(p *syncer.Profile) ([]*fh.File, error) {
+	dirPath, err := f.versionDir(p)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := f.client.GetFile(dirPath)
+	if fh.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	children, err := dir.Children()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*fh.File, 0, len(children))
+	for i := range children {
+		if !children[i].IsDir {
+			files = append(files, children[i])
+		}
+	}
+	// the timestamp prefix sorts oldest first
+	sort.Sort(versionSort(files))
+	return files, nil
+}
+
+type versionSort []*fh.File
+
+func (s versionSort) Len() int           { return len(s) }
+func (s versionSort) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s versionSort) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+func (f *File) pruneVersions(p *syncer.Profile) error {
+	if p.KeepVersions <= 0 {
+		return nil
+	}
+	files, err := f.versionFiles(p)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(files)-p.KeepVersions; i++ {
+		if restoring.has(files[i].URL) {
+			continue
+		}
+		err = files[i].Delete()
+		if err != nil && !fh.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Versions lists the previous versions of the file, newest first
+func (f *File) Versions(p *syncer.Profile) ([]*Version, error) {
+	files, err := f.versionFiles(p)
+	if err != nil {
+		return nil, err
+	}
+
+	key := f.key()
+	versions := make([]*Version, 0, len(files))
+	for i := len(files) - 1; i >= 0; i-- {
+		v := &Version{
+			Name:     files[i].Name,
+			Size:     files[i].Size,
+			Modified: files[i].ModifiedTime(),
+		}
+		if key != nil {
+			size, err := contentSize(f.client, files[i].URL, files[i].Size, key)
+			if err != nil {
+				return nil, err
+			}
+			v.Size = size
+		}
+		if stamp := strings.SplitN(files[i].Name, "_", 2); len(stamp) == 2 {
+			v.Replaced, _ = time.ParseInLocation(versionTimeFormat, stamp[0], time.Local)
+		}
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+// RestoreVersion writes the named version back over the file, through the
+// profile's queue like any other change.  The current file is kept as a version
+// itself
+func (f *File) RestoreVersion(p *syncer.Profile, name string) error {
+	if strings.Contains(name, "/") {
+		return fmt.Errorf("Invalid version name %s", name)
+	}
+	dir, err := f.versionDir(p)
+	if err != nil {
+		return err
+	}
+	version, err := f.client.GetFile(path.Join(dir, name))
+	if fh.IsNotFound(err) {
+		return fmt.Errorf("Version %s of %s not found", name, f.ID())
+	}
+	if err != nil {
+		return err
+	}
+
+	// versioning the current file prunes the oldest version, which may be
+	// the one being restored
+	restoring.add(version.URL)
+	err = p.Restore(newFromFile(f.client, version), f)
+	restoring.remove(version.URL)
+	if err != nil {
+		return err
+	}
+	return f.pruneVersions(p)
+}
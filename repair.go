@@ -0,0 +1,71 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"path"
+
+	"bitbucket.org/tshannon/freehold-sync/local"
+	"bitbucket.org/tshannon/freehold-sync/log"
+	"bitbucket.org/tshannon/freehold-sync/remote"
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// repair re-syncs every file found out of sync in the profile's latest
+// verify report. Files that fail to repair are retried later
+func (p *profileStore) repair() error {
+	if !p.Active {
+		return errors.New("Profile is not active")
+	}
+
+	report, err := syncer.ProfileAudit(p.ID)
+	if err != nil {
+		return err
+	}
+	if report.Running {
+		return errors.New("Profile is still being verified")
+	}
+	if report.Error != "" {
+		return errors.New("The last verify of this profile failed. Verify the profile again before repairing it.")
+	}
+
+	profile, err := p.makeProfile()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for _, item := range report.Items {
+			lFile, rFile, err := profileFiles(profile, item.Path)
+			if err != nil {
+				log.Module(syncer.LogType).Errorf("Error building syncers to repair %s Error: %s", item.Path, err)
+				continue
+			}
+			err = profile.Repair(lFile, rFile)
+			if err != nil && err != syncer.ErrCanceled {
+				log.Module(syncer.LogType).Errorf("Error repairing %s Error: %s", item.Path, err)
+				queueRetry(profile, lFile, rFile, syncer.LogType, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// profileFiles returns the local and remote syncers for the slash separated
+// path relative to the roots of the profile
+func profileFiles(profile *syncer.Profile, relPath string) (*local.File, *remote.File, error) {
+	lFile, err := local.New(local.Join(profile.Local.Path(profile), relPath))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rFile, err := remote.New(profile.Remote.(*remote.File).Client(), path.Join(profile.Remote.Path(profile), relPath))
+	if err != nil {
+		return nil, nil, err
+	}
+	return lFile, rFile, nil
+}
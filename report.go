@@ -0,0 +1,397 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+	"bitbucket.org/tshannon/freehold-sync/log"
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// How often profiles send summary reports
+const (
+	reportDaily  = "daily"
+	reportWeekly = "weekly" // sent on Mondays
+)
+
+const (
+	reportBucket   = datastore.BucketReport
+	reportInterval = 10 * time.Minute // how often profiles are checked for reports that are due
+	reportErrors   = 10               // latest errors listed in a report
+	alertDelay     = time.Minute      // alerts are held to send the ones for a profile together
+)
+
+// smtpSettings is the mail server reports and alerts are sent through
+type smtpSettings struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	From     string // sender of the emails, the user if not set
+}
+
+var (
+	smtpServer  smtpSettings
+	reportHour  = 8 // local hour of the day reports are sent at
+	reportTimer *time.Timer
+)
+
+// validateReport checks a profile's report settings
+func (p *profileStore) validateReport() error {
+	if p.ReportFrequency != "" && p.ReportFrequency != reportDaily && p.ReportFrequency != reportWeekly {
+		return errors.New("Invalid report frequency, it must be daily or weekly")
+	}
+	if p.ReportEmail == "" {
+		if p.ReportFrequency != "" || p.ReportAlerts {
+			return errors.New("An email address is needed to send reports and alerts to")
+		}
+		return nil
+	}
+	_, err := mail.ParseAddressList(p.ReportEmail)
+	if err != nil {
+		return fmt.Errorf("Invalid report email address: %s", err)
+	}
+	return nil
+}
+
+// reportSummary is what a profile did between two times
+type reportSummary struct {
+	Since        time.Time
+	Until        time.Time
+	Uploaded     int
+	Downloaded   int
+	Deleted      int
+	Moved        int
+	Conflicts    int // conflicts found
+	Unresolved   int // conflicts currently waiting to be resolved
+	Errors       int
+	Files        int // files in the profile, as of their last sync
+	Size         int64
+	LatestErrors []*log.Log
+}
+
+func (p *profileStore) summary(since, until time.Time) (*reportSummary, error) {
+	s := &reportSummary{
+		Since:      since,
+		Until:      until,
+		Unresolved: syncer.ProfileConflictCount(p.ID),
+	}
+
+	history, err := syncer.HistorySince(p.ID, since)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range history {
+		if !entry.When.Before(until) {
+			continue
+		}
+		switch entry.Action {
+		case syncer.ActionCreate, syncer.ActionUpdate:
+			if entry.IsDir {
+				continue
+			}
+			if entry.Side == "remote" {
+				s.Uploaded++
+			} else {
+				s.Downloaded++
+			}
+		case syncer.ActionDelete:
+			s.Deleted++
+		case syncer.ActionMove:
+			s.Moved++
+		case syncer.ActionConflict:
+			s.Conflicts++
+		}
+	}
+
+	errs, err := log.Find(log.Query{
+		Level:   log.LevelWarn,
+		Profile: p.Name,
+		Since:   since,
+		Until:   until,
+	}, 0, log.MaxEntries)
+	if err != nil {
+		return nil, err
+	}
+	s.Errors = len(errs)
+	if len(errs) > reportErrors {
+		errs = errs[:reportErrors]
+	}
+	s.LatestErrors = errs
+
+	s.Files, s.Size, err = syncer.SyncedSize(p.ID)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *reportSummary) text(name string) string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "Freehold-Sync summary of profile %s\n", name)
+	fmt.Fprintf(buf, "from %s to %s\n\n", s.Since.Format(time.RFC1123), s.Until.Format(time.RFC1123))
+	fmt.Fprintf(buf, "Uploaded:    %d files\n", s.Uploaded)
+	fmt.Fprintf(buf, "Downloaded:  %d files\n", s.Downloaded)
+	fmt.Fprintf(buf, "Deleted:     %d files\n", s.Deleted)
+	fmt.Fprintf(buf, "Moved:       %d files\n", s.Moved)
+	fmt.Fprintf(buf, "Conflicts:   %d, %d waiting to be resolved\n", s.Conflicts, s.Unresolved)
+	fmt.Fprintf(buf, "Errors:      %d\n", s.Errors)
+	fmt.Fprintf(buf, "Storage:     %s in %d files\n", formatBytes(s.Size), s.Files)
+
+	if len(s.LatestErrors) > 0 {
+		fmt.Fprintf(buf, "\nLatest errors:\n")
+		for _, l := range s.LatestErrors {
+			fmt.Fprintf(buf, "%s %s\n", l.When, l.Log)
+			if l.Error != "" {
+				fmt.Fprintf(buf, "\t%s\n", l.Error)
+			}
+		}
+	}
+	return buf.String()
+}
+
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// reportDue returns when the latest report of the frequency was due, as of now
+func reportDue(frequency string, now time.Time) time.Time {
+	due := time.Date(now.Year(), now.Month(), now.Day(), reportHour, 0, 0, 0, now.Location())
+	days := 1
+	if frequency == reportWeekly {
+		// back to Monday
+		due = due.AddDate(0, 0, -int((due.Weekday()+6)%7))
+		days = 7
+	}
+	if due.After(now) {
+		due = due.AddDate(0, 0, -days)
+	}
+	return due
+}
+
+// lastReport returns when the profile's last report was sent, zero if one
+// never has been
+func lastReport(profileID string) (time.Time, error) {
+	var sent time.Time
+	err := datastore.Get(reportBucket, profileID, &sent)
+	if err == datastore.ErrNotFound {
+		return time.Time{}, nil
+	}
+	return sent, err
+}
+
+// sendReport emails the profile's summary between the two times
+func (p *profileStore) sendReport(since, until time.Time) error {
+	s, err := p.summary(since, until)
+	if err != nil {
+		return err
+	}
+	frequency := p.ReportFrequency
+	if frequency == "" {
+		frequency = "summary"
+	}
+	return sendMail(p.ReportEmail, fmt.Sprintf("Freehold-Sync %s report for %s", frequency, p.Name), s.text(p.Name))
+}
+
+// sendDueReports sends the reports of every profile whose report is due.  The
+// first report of a profile covers from when reports were turned on
+func sendDueReports() {
+	all, err := storedProfiles()
+	if err != nil {
+		logger.Errorf("Error reading profiles to send reports: %s", err)
+		return
+	}
+	now := time.Now()
+	for _, ps := range all {
+		if ps.ReportFrequency == "" || ps.ReportEmail == "" {
+			continue
+		}
+		last, err := lastReport(ps.ID)
+		if err != nil {
+			logger.Profile(ps.Name).Errorf("Error reading when the last report of profile %s was sent: %s",
+				ps.Name, err)
+			continue
+		}
+		if !last.IsZero() && !last.Before(reportDue(ps.ReportFrequency, now)) {
+			continue
+		}
+		if !last.IsZero() {
+			err = ps.sendReport(last, now)
+			if err != nil {
+				logger.Profile(ps.Name).Errorf("Error sending the report of profile %s: %s", ps.Name, err)
+				continue
+			}
+		}
+		err = datastore.Put(reportBucket, ps.ID, now)
+		if err != nil {
+			logger.Profile(ps.Name).Errorf("Error recording the report of profile %s: %s", ps.Name, err)
+		}
+	}
+}
+
+// reportPoll sends reports as they come due
+func reportPoll() {
+	reportTimer = time.AfterFunc(reportInterval, func() {
+		sendDueReports()
+		reportPoll()
+	})
+}
+
+func stopReports() {
+	if reportTimer != nil {
+		reportTimer.Stop()
+	}
+}
+
+var alerts alertData
+
+func init() {
+	alerts = alertData{
+		pending: make(map[string][]string),
+	}
+}
+
+type alertData struct {
+	sync.Mutex
+	pending map[string][]string // alerts waiting to be sent, by profile ID
+	timer   *time.Timer
+}
+
+// alert emails the message right away to profiles with alerts turned on, along
+// with any other alerts for the profile which come in within alertDelay.
+// Alerts are for critical failures, which need someone to fix them
+func alert(profileID, message string) {
+	if smtpServer.Host == "" {
+		return
+	}
+	alerts.Lock()
+	defer alerts.Unlock()
+
+	alerts.pending[profileID] = append(alerts.pending[profileID], message)
+	if alerts.timer == nil {
+		alerts.timer = time.AfterFunc(alertDelay, alerts.flush)
+	}
+}
+
+func (a *alertData) flush() {
+	a.Lock()
+	pending := a.pending
+	a.pending = make(map[string][]string)
+	a.timer = nil
+	a.Unlock()
+
+	for id, messages := range pending {
+		ps, err := profileOf(id)
+		if err != nil || !ps.ReportAlerts || ps.ReportEmail == "" {
+			continue
+		}
+		err = sendMail(ps.ReportEmail, "Freehold-Sync alert for "+ps.Name, strings.Join(messages, "\n")+"\n")
+		if err != nil {
+			logger.Profile(ps.Name).Errorf("Error sending an alert for profile %s: %s", ps.Name, err)
+		}
+	}
+}
+
+// sendMail sends a plain text email to the comma separated addresses
+func sendMail(to, subject, body string) error {
+	if smtpServer.Host == "" {
+		return errors.New("No mail server is set, set smtpHost in settings.json to send email")
+	}
+	recipients, err := mail.ParseAddressList(to)
+	if err != nil {
+		return err
+	}
+	sender := smtpServer.From
+	if sender == "" {
+		sender = smtpServer.User
+	}
+	from, err := mail.ParseAddress(sender)
+	if err != nil {
+		return fmt.Errorf("Invalid sender address %q, set smtpFrom in settings.json: %s", sender, err)
+	}
+
+	addresses := make([]string, len(recipients))
+	headerTo := make([]string, len(recipients))
+	for i := range recipients {
+		addresses[i] = recipients[i].Address
+		headerTo[i] = recipients[i].String()
+	}
+
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %s\r\n", from)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(headerTo, ", "))
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+
+	var auth smtp.Auth
+	if smtpServer.User != "" {
+		auth = smtp.PlainAuth("", smtpServer.User, smtpServer.Password, smtpServer.Host)
+	}
+	return smtp.SendMail(net.JoinHostPort(smtpServer.Host, strconv.Itoa(smtpServer.Port)), auth, from.Address,
+		addresses, msg.Bytes())
+}
+
+// profileReportPost emails a profile's report right away, covering the time
+// since its last report, to check its settings
+func profileReportPost(w http.ResponseWriter, r *http.Request) {
+	input := &profileStore{}
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	ps, err := getProfile(input.ID)
+	if errHandled(err, w) {
+		return
+	}
+	if ps.ReportEmail == "" {
+		errHandled(errors.New("The profile has no report email address"), w)
+		return
+	}
+
+	now := time.Now()
+	since, err := lastReport(ps.ID)
+	if errHandled(err, w) {
+		return
+	}
+	if since.IsZero() {
+		since = now.AddDate(0, 0, -1)
+		if ps.ReportFrequency == reportWeekly {
+			since = now.AddDate(0, 0, -7)
+		}
+	}
+
+	if errHandled(ps.sendReport(since, now), w) {
+		return
+	}
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+		Data:   ps.ReportEmail,
+	})
+}
@@ -5,69 +5,203 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"path/filepath"
 	"time"
 
+	"bitbucket.org/tshannon/freehold-sync/datastore"
 	"bitbucket.org/tshannon/freehold-sync/local"
 	"bitbucket.org/tshannon/freehold-sync/log"
 	"bitbucket.org/tshannon/freehold-sync/remote"
 	"bitbucket.org/tshannon/freehold-sync/syncer"
 )
 
-// retrier is for retrying errors
-type retrier interface {
-	//profile() *syncer.Profile
-	retry() error
+const (
+	retryBucket   = datastore.BucketRetry
+	retryInterval = 5 * time.Second // how often the retry queue is checked
+	retryBackoff  = 5 * time.Second // wait before the first retry, doubled on each attempt
+	retryMaxWait  = time.Hour       // longest wait between retries
+)
+
+var (
+	retryMaxAttempts = 5
+	retryTimer       *time.Timer
+)
+
+// syncRetry is a failed sync stored in the persistent retry queue
+type syncRetry struct {
+	ProfileID     string    `json:"profileID"`
+	LocalPath     string    `json:"localPath"`
+	LocalDeleted  bool      `json:"localDeleted"`
+	RemoteURL     string    `json:"remoteURL"`
+	RemoteDeleted bool      `json:"remoteDeleted"`
+	LogType       string    `json:"logType"`
+	Error         string    `json:"error"`
+	Attempts      int       `json:"attempts"`
+	NextAttempt   time.Time `json:"nextAttempt"`
+}
+
+func (s *syncRetry) key() string {
+	return s.ProfileID + "_" + s.LocalPath
+}
+
+// backoff is how long to wait before the next attempt
+func backoff(attempts int) time.Duration {
+	wait := retryBackoff
+	for i := 0; i < attempts && wait < retryMaxWait; i++ {
+		wait *= 2
+	}
+	if wait > retryMaxWait {
+		wait = retryMaxWait
+	}
+	return wait
+}
+
+// queueRetry adds a failed sync to the retry queue
+func queueRetry(p *syncer.Profile, l, r syncer.Syncer, logType string, err error) {
+	putRetry(&syncRetry{
+		ProfileID:     p.ID(),
+		LocalPath:     l.ID(),
+		LocalDeleted:  l.Deleted(),
+		RemoteURL:     r.(*remote.File).URL,
+		RemoteDeleted: r.Deleted(),
+		LogType:       logType,
+		Error:         err.Error(),
+	}, err)
+}
+
+// putRetry stores the retry in the queue. If the same file is already
+// queued, its attempts carry over
+func putRetry(s *syncRetry, err error) {
+	perr := datastore.Update(func(tx *datastore.Tx) error {
+		existing := &syncRetry{}
+		if tx.Get(retryBucket, s.key(), existing) == nil {
+			s.Attempts = existing.Attempts
+		}
+		s.NextAttempt = time.Now().Add(backoff(s.Attempts))
+		return tx.Put(retryBucket, s.key(), s)
+	})
+	if perr != nil {
+		log.Module(s.LogType).Errorf("Error queuing retry for %s: %s. Original Error: %s", s.LocalPath, perr, err)
+	}
 }
 
 func retryPoll() {
-	go func() {
-		// while there are errors to retry, wait until the profiles are idle / not actively syncing, and
-		// re-run the errors.  If they fail again, then log them.  This should clear up any order of operation issues
-		// that my pop up due to user activity
-		for r := range retry {
+	// while there are errors to retry, wait until they are due and re-run them.
+	// This should clear up any order of operation issues that my pop up due to user
+	// activity, as well as temporary network or server problems
+	retryTimer = time.AfterFunc(retryInterval, func() {
+		due, err := dueRetries()
+		if err != nil {
+			logger.Errorf("Error reading retry queue: %s", err)
+		}
+
+		if len(due) > 0 {
 			remote.PauseWatcher()
-			err := r.retry()
-			if err != nil {
-				retry <- r
+			for i := range due {
+				due[i].retry()
 			}
 			remote.ResumeWatcher()
 		}
-	}()
+		retryPoll()
+	})
 }
 
-type syncRetry struct {
-	profile       *syncer.Profile
-	local, remote syncer.Syncer
-	logType       string
-	originalError error
-	retryCount    int
+func stopRetry() {
+	if retryTimer != nil {
+		retryTimer.Stop()
+	}
 }
 
-func (s *syncRetry) retry() error {
-	time.Sleep(5 * time.Second)
-	//Set deleted
-	l, err := local.New(s.local.ID())
+func dueRetries() ([]*syncRetry, error) {
+	var due []*syncRetry
+	now := time.Now()
+	err := datastore.View(func(tx *datastore.Tx) error {
+		return tx.Each(retryBucket, func(key string, value []byte) error {
+			s := &syncRetry{}
+			err := json.Unmarshal(value, s)
+			if err != nil {
+				return err
+			}
+			if !s.NextAttempt.After(now) {
+				due = append(due, s)
+			}
+			return nil
+		})
+	})
+	return due, err
+}
+
+func (s *syncRetry) retry() {
+	err := s.sync()
+	if err == nil || err == syncer.ErrCanceled {
+		s.remove()
+		return
+	}
+
+	if !remote.IsOffline(err) && err != errVolumeMissing {
+		// waiting for the remote instance or local volume to come back isn't a failed attempt
+		s.Attempts++
+	}
+	s.Error = err.Error()
+	if s.Attempts >= retryMaxAttempts {
+		log.Module(s.LogType).Errorf("Error with syncing %s and %s after %d attempts.  Error: %s", s.RemoteURL,
+			s.LocalPath, s.Attempts, err)
+		notify("Couldn't sync files", fmt.Sprintf("%s failed %d times: %s", filepath.Base(s.LocalPath), s.Attempts,
+			log.Redact(err.Error())))
+		alert(s.ProfileID, fmt.Sprintf("Gave up syncing %s and %s after %d attempts: %s", s.LocalPath, s.RemoteURL,
+			s.Attempts, log.Redact(err.Error())))
+		s.remove()
+		return
+	}
+
+	s.NextAttempt = time.Now().Add(backoff(s.Attempts))
+	err = datastore.Put(retryBucket, s.key(), s)
+	if err != nil {
+		log.Module(s.LogType).Errorf("Error updating retry for %s: %s", s.LocalPath, err)
+	}
+}
+
+func (s *syncRetry) remove() {
+	err := datastore.Delete(retryBucket, s.key())
+	if err != nil {
+		log.Module(s.LogType).Errorf("Error removing retry for %s: %s", s.LocalPath, err)
+	}
+}
+
+func (s *syncRetry) sync() error {
+	ps, err := profileOf(s.ProfileID)
+	if err == datastore.ErrNotFound {
+		// profile has since been removed
+		return nil
+	}
 	if err != nil {
-		log.New(fmt.Sprintf("Error building local syncer %s for retying error: %s", s.local.ID(), err.Error()), local.LogType)
 		return err
 	}
-	l.SetDeleted(s.local.Deleted())
-	r, err := remote.New(s.remote.(*remote.File).Client(), s.remote.(*remote.File).URL)
+	if !ps.Active {
+		return nil
+	}
+	if unmounted.has(ps.ID) {
+		return errVolumeMissing
+	}
+
+	profile, err := ps.syncProfile(s.ProfileID)
 	if err != nil {
-		log.New(fmt.Sprintf("Error building remote syncer %s for retying error: %s", s.remote.ID(), err.Error()), remote.LogType)
 		return err
 	}
-	r.SetDeleted(s.remote.Deleted())
 
-	err = s.profile.Sync(l, r)
+	//Set deleted
+	l, err := local.New(s.LocalPath)
 	if err != nil {
-		s.retryCount++
-		if s.retryCount >= 3 {
-			//after 3 attempts log error and don't retry again
-			log.New(fmt.Sprintf("Error with syncing %s and %s retrying.  Error: %s\n", r.ID(), l.ID(), err), s.logType)
-			return nil
-		}
+		return fmt.Errorf("Error building local syncer %s for retying error: %s", s.LocalPath, err)
 	}
-	return err
+	l.SetDeleted(s.LocalDeleted)
+	r, err := remote.New(profile.Remote.(*remote.File).Client(), s.RemoteURL)
+	if err != nil {
+		return fmt.Errorf("Error building remote syncer %s for retying error: %s", s.RemoteURL, err)
+	}
+	r.SetDeleted(s.RemoteDeleted)
+
+	return profile.Sync(l, r)
 }
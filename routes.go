@@ -4,7 +4,10 @@
 
 package main
 
-import "net/http"
+import (
+	"net/http"
+	"strings"
+)
 
 var rootHandler *http.ServeMux
 
@@ -20,10 +23,43 @@ func init() {
 		Put: Update existing Sync Profile
 	/profile/status:
 		Get: Retrieve sync status of a specific sync profile
+	/profile/plan:
+		Get: Retrieve the planned changes of a profile running in dry run mode
+	/profile/history:
+		Get: Retrieve every change made to a file in a profile, and why
+	/profile/pause:
+		Put: Pause or resume a profile
+	/profile/verify:
+		Get: Retrieve the latest verify report of a profile
+		Post: Start comparing every file in a profile, without changing anything
+	/profile/repair:
+		Post: Re-sync the files found out of sync by the latest verify of a profile
+	/profile/conflicts:
+		Get: List the conflicts a profile is waiting to have resolved
+		Post: Resolve a conflict by keeping the local file, the remote file, or both
+	/profile/quarantine:
+		Get: List the files a profile quarantined for being synced back and forth
+		Post: Release a quarantined file, and sync it again
+	/profile/test:
+		Post: Test a profile's connection, and that its paths can be read and written
+	/profile/report:
+		Post: Email a profile's summary report right away, covering the time since its last report
+	/profile/deletes:
+		Get: Retrieve the deletes a profile is holding because they went over its delete limits
+		Post: Confirm and run the held deletes of a profile
+		Delete: Discard the held deletes of a profile, and sync the files back
+	/profile/queue:
+		Get: Retrieve the pending and running changes of a profile
+		Delete: Cancel a pending or running change
+	/versions:
+		Get: List the previous versions of a remote file in a profile
+		Put: Restore a previous version of a remote file
 	/local:
 		Get: Get local file Directory listings for Sync profile selection
 	/local/root:
 		GET: get local starting point
+	/local/roots:
+		Get: List the local folders which can be browsed
 	/remote:
 		Get: Get remote file directory listings
 	/remote/root:
@@ -32,6 +68,36 @@ func init() {
 		Post: Get token from user / password
 	/log:
 		Get: Get logs
+	/auth:
+		Get: Retrieve whether a password is set, and if so whether the request is logged in
+	/auth/login:
+		Post: Log in to the web interface with its password
+	/auth/logout:
+		Post: Log out of the web interface
+	/auth/password:
+		Put: Set, change or remove the web interface's password
+	/auth/token:
+		Get: List the API tokens
+		Post: Create an API token
+		Delete: Revoke an API token
+	/events:
+		Get: Websocket stream of sync events and profile status changes
+	/datastore/gc:
+		Post: Remove stale entries from the datastore now
+	/datastore/compact:
+		Post: Rewrite the datastore without the free space left by removed entries
+	/datastore/backup:
+		Get: Download a snapshot of the datastore
+	/datastore/restore:
+		Post: Replace the datastore with a snapshot sent as the request body
+	/datastore/export:
+		Get: Retrieve the contents of the datastore as JSON, without credentials
+	/healthz:
+		Get: Liveness check, responds as long as freehold-sync is running
+	/readyz:
+		Get: Readiness check of the datastore and each profile's connectivity,
+			503 when something isn't working
+	/v1/: Versioned API for scripts and other tools, see api.go
 */
 
 func setupRoutes() {
@@ -55,6 +121,10 @@ func setupRoutes() {
 		get: localRootGet,
 	})
 
+	rootHandler.Handle("/local/roots/", &methodHandler{
+		get: localRootsGet,
+	})
+
 	//Remote
 	rootHandler.Handle("/remote/", &methodHandler{
 		get: remoteGet,
@@ -77,6 +147,124 @@ func setupRoutes() {
 	rootHandler.Handle("/profile/status/", &methodHandler{
 		get: profileStatusGet,
 	})
+
+	rootHandler.Handle("/profile/plan/", &methodHandler{
+		get: profilePlanGet,
+	})
+
+	rootHandler.Handle("/profile/history/", &methodHandler{
+		get: profileHistoryGet,
+	})
+
+	rootHandler.Handle("/profile/pause/", &methodHandler{
+		put: profilePausePut,
+	})
+
+	rootHandler.Handle("/profile/verify/", &methodHandler{
+		get:  profileVerifyGet,
+		post: profileVerifyPost,
+	})
+
+	rootHandler.Handle("/profile/repair/", &methodHandler{
+		post: profileRepairPost,
+	})
+
+	rootHandler.Handle("/profile/conflicts/", &methodHandler{
+		get:  profileConflictsGet,
+		post: profileConflictsPost,
+	})
+
+	rootHandler.Handle("/profile/quarantine/", &methodHandler{
+		get:  profileQuarantineGet,
+		post: profileQuarantinePost,
+	})
+
+	rootHandler.Handle("/profile/test/", &methodHandler{
+		post: profileTestPost,
+	})
+
+	rootHandler.Handle("/profile/report/", &methodHandler{
+		post: profileReportPost,
+	})
+
+	rootHandler.Handle("/profile/deletes/", &methodHandler{
+		get:    profileDeletesGet,
+		post:   profileDeletesPost,
+		delete: profileDeletesDelete,
+	})
+
+	rootHandler.Handle("/profile/queue/", &methodHandler{
+		get:    profileQueueGet,
+		delete: profileQueueDelete,
+	})
+
+	rootHandler.Handle("/versions/", &methodHandler{
+		get: versionsGet,
+		put: versionsPut,
+	})
+
+	//Datastore
+	rootHandler.Handle("/events/", eventsHandler)
+
+	rootHandler.Handle("/auth/", &methodHandler{
+		get: authGet,
+	})
+
+	rootHandler.Handle("/auth/login/", &methodHandler{
+		post: authLoginPost,
+	})
+
+	rootHandler.Handle("/auth/logout/", &methodHandler{
+		post: authLogoutPost,
+	})
+
+	rootHandler.Handle("/auth/password/", &methodHandler{
+		put: authPasswordPut,
+	})
+
+	rootHandler.Handle("/auth/token/", &methodHandler{
+		get:    authTokenGet,
+		post:   authTokenPost,
+		delete: authTokenDelete,
+	})
+
+	rootHandler.Handle("/datastore/gc/", &methodHandler{
+		post: datastoreGCPost,
+	})
+	rootHandler.Handle("/datastore/compact/", &methodHandler{
+		post: datastoreCompactPost,
+	})
+	rootHandler.Handle("/datastore/backup/", &methodHandler{
+		get: datastoreBackupGet,
+	})
+	rootHandler.Handle("/datastore/restore/", &methodHandler{
+		post: datastoreRestorePost,
+	})
+	rootHandler.Handle("/datastore/export/", &methodHandler{
+		get: datastoreExportGet,
+	})
+
+	//Health checks
+	rootHandler.Handle("/healthz", &methodHandler{
+		get: healthzGet,
+	})
+	rootHandler.Handle("/readyz", &methodHandler{
+		get: readyzGet,
+	})
+}
+
+// serveRoot sends /v1/ requests straight to the API, as the mux would clean the
+// slashes in their escaped profile IDs, and everything else to the mux.  Only
+// authorized requests are let through to either
+func serveRoot(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/v1/") {
+		apiServe(w, r)
+		return
+	}
+	rootHandler.ServeHTTP(w, r)
 }
 
 type methodHandler struct {
@@ -0,0 +1,24 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+// serviceCommands install and remove the Windows service, there are none on
+// other platforms
+var serviceCommands = map[string]func(args []string) error{}
+
+// runningAsService is always false, outside of Windows freehold-sync is run as a
+// daemon instead, see systemd.go
+func runningAsService() bool {
+	return false
+}
+
+func runService(start func()) {
+	start()
+}
+
+func logHalt(msg string) {}
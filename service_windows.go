@@ -0,0 +1,240 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+
+	"bitbucket.org/tshannon/freehold-sync/log"
+)
+
+const (
+	serviceName        = "freehold-sync"
+	serviceDisplayName = "Freehold-Sync"
+	serviceDescription = "Keeps local folders in sync with folders on freehold instances."
+	serviceEventID     = 1
+
+	// serviceRestartDelay is how long Windows waits to restart the service after
+	// it fails
+	serviceRestartDelay = time.Minute
+	// serviceStopMargin is the time on top of shutdownTimeout the service asks
+	// for to stop, for canceled transfers to stop and the datastore to close
+	serviceStopMargin = 10 * time.Second
+)
+
+// servicePasswordEnv is the environment variable install-service reads the
+// password of the account the service runs as from, instead of asking for it
+const servicePasswordEnv = "FREEHOLD_SYNC_SERVICE_PASSWORD"
+
+const installServiceUsage = "Usage: freehold-sync install-service [-user <account>]"
+
+// serviceCommands install and remove the Windows service
+var serviceCommands = map[string]func(args []string) error{
+	"install-service":   installService,
+	"uninstall-service": uninstallService,
+}
+
+var (
+	events     *eventlog.Log // the service's event log, nil unless running as a service
+	eventsLock sync.Mutex
+)
+
+// runningAsService is whether freehold-sync was started by the Windows service
+// control manager
+func runningAsService() bool {
+	service, err := svc.IsWindowsService()
+	return err == nil && service
+}
+
+// runService runs freehold-sync as a Windows service until the service is
+// stopped, with its system log written to the Windows event log
+func runService(start func()) {
+	l, err := eventlog.Open(serviceName)
+	if err == nil {
+		eventsLock.Lock()
+		events = l
+		eventsLock.Unlock()
+		log.SetSystemOutput(writeEvent)
+	}
+
+	err = svc.Run(serviceName, &windowsService{start: start})
+	if err != nil {
+		halt("Error running the " + serviceName + " service: " + err.Error())
+	}
+}
+
+// writeEvent writes a system log entry to the event log
+func writeEvent(level, line string) {
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	if events == nil {
+		return
+	}
+	switch level {
+	case log.LevelError:
+		events.Error(serviceEventID, line)
+	case log.LevelWarn:
+		events.Warning(serviceEventID, line)
+	default:
+		events.Info(serviceEventID, line)
+	}
+}
+
+// logHalt writes the reason freehold-sync is stopping to the event log, where
+// it can be seen when running as a service
+func logHalt(msg string) {
+	writeEvent(log.LevelError, msg)
+}
+
+type windowsService struct {
+	start func()
+}
+
+// Execute starts freehold-sync, and stops it cleanly when the service is
+// stopped, or Windows shuts down
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest,
+	status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	go s.start()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for r := range requests {
+		switch r.Cmd {
+		case svc.Interrogate:
+			status <- r.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			wait := serverShutdownTimeout + shutdownTimeout + serviceStopMargin
+			status <- svc.Status{State: svc.StopPending, WaitHint: uint32(wait / time.Millisecond)}
+			stop()
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+// installService installs freehold-sync as a service which starts
+// automatically with Windows, and is restarted if it fails, and starts it.  It
+// runs as the local system account unless another account is passed in
+func installService(args []string) error {
+	flags := flag.NewFlagSet("install-service", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	user := flags.String("user", "", "")
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() != 0 {
+		return errors.New(installServiceUsage)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	config := mgr.Config{
+		DisplayName:      serviceDisplayName,
+		Description:      serviceDescription,
+		StartType:        mgr.StartAutomatic,
+		DelayedAutoStart: true,
+	}
+	if *user != "" {
+		config.ServiceStartName = *user
+		config.Password, err = readSecret(servicePasswordEnv, fmt.Sprintf("Password for %s: ", *user))
+		if err != nil {
+			return err
+		}
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("Error connecting to the service control manager, install-service must be run as an "+
+			"administrator: %s", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err == nil {
+		s.Close()
+		return fmt.Errorf("The %s service is already installed", serviceName)
+	}
+
+	s, err = m.CreateService(serviceName, exe, config, "daemon")
+	if err != nil {
+		return fmt.Errorf("Error installing the %s service: %s", serviceName, err)
+	}
+	defer s.Close()
+
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: serviceRestartDelay},
+	}, uint32((24 * time.Hour).Seconds()))
+	if err != nil {
+		s.Delete()
+		return fmt.Errorf("Error setting the %s service to restart when it fails: %s", serviceName, err)
+	}
+
+	// left behind if the service was removed some other way
+	eventlog.Remove(serviceName)
+	err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil {
+		s.Delete()
+		return fmt.Errorf("Error setting up the event log for the %s service: %s", serviceName, err)
+	}
+
+	err = s.Start()
+	if err != nil {
+		return fmt.Errorf("The %s service was installed, but couldn't be started: %s", serviceName, err)
+	}
+	fmt.Printf("Installed and started the %s service, it starts automatically with Windows\n", serviceName)
+	return nil
+}
+
+// uninstallService stops and removes the service
+func uninstallService(args []string) error {
+	if len(args) != 0 {
+		return errors.New("Usage: freehold-sync uninstall-service")
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("Error connecting to the service control manager, uninstall-service must be run as an "+
+			"administrator: %s", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("The %s service isn't installed", serviceName)
+	}
+	defer s.Close()
+
+	status, err := s.Control(svc.Stop)
+	if err == nil {
+		// give it the time it asked for to finish running transfers
+		deadline := time.Now().Add(time.Duration(status.WaitHint)*time.Millisecond + time.Minute)
+		for status.State != svc.Stopped && time.Now().Before(deadline) {
+			time.Sleep(time.Second)
+			status, err = s.Query()
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	err = s.Delete()
+	if err != nil {
+		return fmt.Errorf("Error removing the %s service: %s", serviceName, err)
+	}
+	eventlog.Remove(serviceName)
+	fmt.Printf("Removed the %s service\n", serviceName)
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+	"bitbucket.org/tshannon/freehold-sync/local"
+	"bitbucket.org/tshannon/freehold-sync/log"
+	"bitbucket.org/tshannon/freehold-sync/remote"
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// serverShutdownTimeout is how long open requests, such as event streams, are
+// given to finish before the web server is closed
+const serverShutdownTimeout = 5 * time.Second
+
+var (
+	// shutdownTimeout is how long running transfers are given to finish when
+	// freehold-sync is stopped, before they're canceled
+	shutdownTimeout = 30 * time.Second
+	shuttingDown    sync.Once
+)
+
+// shutdown stops freehold-sync cleanly, and exits
+func shutdown() {
+	stop()
+	if flagOnce {
+		// the profiles didn't get to finish syncing
+		os.Exit(onceErrors)
+	}
+	os.Exit(0)
+}
+
+// stop stops freehold-sync cleanly.  Changes stop being watched for, running
+// transfers get shutdownTimeout to finish, and changes which were noticed but
+// didn't finish are kept for when freehold-sync starts again
+func stop() {
+	shuttingDown.Do(func() {
+		logger.Infof("Freehold-Sync shutting down")
+		sdNotify("STOPPING=1")
+
+		if server != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+			if server.Shutdown(ctx) != nil {
+				server.Close()
+			}
+			cancel()
+		}
+		stopRetry()
+		stopGC()
+		stopLogTrim()
+		stopReports()
+
+		remote.StopWatcher()
+		local.StopWatcher()
+		for p, files := range local.StopChanges() {
+			for _, f := range files {
+				err := p.KeepChange(f)
+				if err != nil {
+					log.Module(local.LogType).Profile(p.Name).Errorf("Error keeping change to %s: %s", f.ID(), err)
+				}
+			}
+		}
+
+		syncer.Shutdown(shutdownTimeout)
+		datastore.Close()
+	})
+}
@@ -0,0 +1,22 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenSocket listens on the unix socket.  The socket is created with only the
+// current user able to connect to it, rather than changed once it's already
+// been listening
+func listenSocket(filename string) (net.Listener, error) {
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", filename)
+}
@@ -0,0 +1,25 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// listenSocket listens on the unix socket.  Windows has no umask, so the
+// permissions are set once it's created
+func listenSocket(filename string) (net.Listener, error) {
+	l, err := net.Listen("unix", filename)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(filename, 0600)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,231 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var audits auditData // latest audit report of each profile
+
+func init() {
+	audits = auditData{
+		profiles: make(map[string]*AuditReport),
+	}
+}
+
+// Lister is an optional interface for directory Syncers which can list
+// their contents. Both sides of a profile must implement it to be audited
+type Lister interface {
+	List() ([]Syncer, error) // Files and directories in the directory
+}
+
+// Audit problems, relative to the local side of the profile
+const (
+	AuditMissing   = "missing"   // exists locally, but not remotely
+	AuditExtra     = "extra"     // exists remotely, but not locally
+	AuditDifferent = "different" // exists on both sides, but the content or type doesn't match
+)
+
+// AuditItem is a file found to be out of sync by an audit
+type AuditItem struct {
+	Path           string    `json:"path"`
+	Problem        string    `json:"problem"`
+	IsDir          bool      `json:"isDir"`
+	LocalSize      int64     `json:"localSize"`
+	LocalModified  time.Time `json:"localModified"`
+	RemoteSize     int64     `json:"remoteSize"`
+	RemoteModified time.Time `json:"remoteModified"`
+}
+
+// AuditReport is the result of comparing every file in a profile
+type AuditReport struct {
+	Running  bool         `json:"running"`
+	Started  time.Time    `json:"started"`
+	Finished time.Time    `json:"finished,omitempty"`
+	Checked  int          `json:"checked"`
+	Items    []*AuditItem `json:"items"`
+	Error    string       `json:"error,omitempty"`
+}
+
+type auditData struct {
+	sync.RWMutex
+	profiles map[string]*AuditReport
+}
+
+// start records a running audit, returns false if one is already running
+func (ad *auditData) start(profileID string, report *AuditReport) bool {
+	ad.Lock()
+	defer ad.Unlock()
+	if current, ok := ad.profiles[profileID]; ok && current.Running {
+		return false
+	}
+	ad.profiles[profileID] = report
+	return true
+}
+
+func (ad *auditData) set(profileID string, report *AuditReport) {
+	ad.Lock()
+	defer ad.Unlock()
+	ad.profiles[profileID] = report
+}
+
+func (ad *auditData) get(profileID string) (*AuditReport, bool) {
+	ad.RLock()
+	defer ad.RUnlock()
+	report, ok := ad.profiles[profileID]
+	return report, ok
+}
+
+// StartAudit starts comparing every file on both sides of the profile in the
+// background, without changing anything.  The report can be retrieved with
+// ProfileAudit
+func (p *Profile) StartAudit() error {
+	if _, ok := p.Local.(Lister); !ok {
+		return errors.New("Local side of the profile can't be audited")
+	}
+	if _, ok := p.Remote.(Lister); !ok {
+		return errors.New("Remote side of the profile can't be audited")
+	}
+
+	if !audits.start(p.ID(), &AuditReport{Running: true, Started: time.Now()}) {
+		return errors.New("An audit of this profile is already running")
+	}
+
+	go func() {
+		audits.set(p.ID(), p.Audit())
+	}()
+	return nil
+}
+
+// ProfileAudit returns the latest audit report for the profile
+func ProfileAudit(profileID string) (*AuditReport, error) {
+	report, ok := audits.get(profileID)
+	if !ok {
+		return nil, errors.New("This profile hasn't been audited")
+	}
+	return report, nil
+}
+
+// Audit compares every file on both sides of the profile, and reports
+// the ones that are out of sync
+func (p *Profile) Audit() *AuditReport {
+	report := &AuditReport{
+		Started: time.Now(),
+		Items:   []*AuditItem{},
+	}
+
+	err := p.auditDir(report, p.Local, p.Remote)
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	sort.Sort(auditSort(report.Items))
+	report.Finished = time.Now()
+	return report
+}
+
+func (p *Profile) auditDir(report *AuditReport, local, remote Syncer) error {
+	localChildren, err := p.auditList(local)
+	if err != nil {
+		return err
+	}
+	remoteChildren, err := p.auditList(remote)
+	if err != nil {
+		return err
+	}
+
+	for relPath, l := range localChildren {
+		r, ok := remoteChildren[relPath]
+		if !ok {
+			report.add(relPath, AuditMissing, l, nil)
+			continue
+		}
+
+		report.Checked++
+		switch {
+		case l.IsDir() && r.IsDir():
+			err = p.auditDir(report, l, r)
+			if err != nil {
+				return err
+			}
+		case l.IsDir() != r.IsDir():
+			report.add(relPath, AuditDifferent, l, r)
+		default:
+			same, _, err := p.freshContent(l, r)
+			if err != nil {
+				return err
+			}
+			if !same {
+				report.add(relPath, AuditDifferent, l, r)
+			}
+		}
+	}
+
+	for relPath, r := range remoteChildren {
+		if _, ok := localChildren[relPath]; !ok {
+			report.add(relPath, AuditExtra, nil, r)
+		}
+	}
+	return nil
+}
+
+// auditList returns the synced children of the directory keyed by their
+// path relative to the profile
+func (p *Profile) auditList(dir Syncer) (map[string]Syncer, error) {
+	list := make(map[string]Syncer)
+	add := func(children []Syncer) error {
+		for i := range children {
+			if p.ignore(children[i].ID()) || p.Excluded(children[i]) {
+				continue
+			}
+			list[strings.Trim(filepath.ToSlash(children[i].Path(p)), "/")] = children[i]
+		}
+		return nil
+	}
+
+	if it, ok := dir.(ChildIterator); ok {
+		err := it.ChildrenIter(add)
+		if err != nil {
+			return nil, err
+		}
+		return list, nil
+	}
+
+	children, err := dir.(Lister).List()
+	if err != nil {
+		return nil, err
+	}
+	return list, add(children)
+}
+
+func (r *AuditReport) add(relPath, problem string, local, remote Syncer) {
+	item := &AuditItem{
+		Path:    relPath,
+		Problem: problem,
+	}
+	if local != nil {
+		item.IsDir = local.IsDir()
+		item.LocalSize = local.Size()
+		item.LocalModified = local.Modified()
+	}
+	if remote != nil {
+		item.IsDir = item.IsDir || remote.IsDir()
+		item.RemoteSize = remote.Size()
+		item.RemoteModified = remote.Modified()
+	}
+	r.Items = append(r.Items, item)
+}
+
+type auditSort []*AuditItem
+
+func (s auditSort) Len() int           { return len(s) }
+func (s auditSort) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s auditSort) Less(i, j int) bool { return s[i].Path < s[j].Path }
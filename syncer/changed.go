@@ -0,0 +1,35 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import "errors"
+
+// ErrChanged is returned when a file was changed by someone else after it was read,
+// and overwriting or deleting it would lose that change.  The next sync of the
+// file sees both sides changed, and handles it as a conflict
+var ErrChanged = errors.New("File was changed by someone else while it was being synced")
+
+// ChangeChecker is an optional interface for Syncers which can check they
+// haven't been changed by someone else since they were read
+type ChangeChecker interface {
+	Unchanged() (bool, error)
+}
+
+// checkUnchanged makes sure the destination hasn't changed since it was read,
+// before it's overwritten or deleted
+func (c *changeItem) checkUnchanged() error {
+	cc, ok := c.to.(ChangeChecker)
+	if !ok || !c.to.Exists() || c.to.IsDir() {
+		return nil
+	}
+	unchanged, err := cc.Unchanged()
+	if err != nil {
+		return err
+	}
+	if !unchanged {
+		return ErrChanged
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import (
+	"sync"
+	"time"
+)
+
+// skewThreshold is the smallest clock offset that is compensated for, anything
+// smaller is within the precision of the probe
+const skewThreshold = 2 * time.Second
+
+var offsets clockData
+
+func init() {
+	offsets = clockData{
+		profiles: make(map[string]time.Duration),
+	}
+}
+
+// ClockProber is an optional interface for Syncers whose modified times come
+// from a different clock than the local machine's
+type ClockProber interface {
+	ClockOffset() (time.Duration, error) // How far the Syncer's clock is ahead of the local clock
+}
+
+type clockData struct {
+	sync.RWMutex
+	profiles map[string]time.Duration
+}
+
+func (c *clockData) set(profileID string, offset time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.profiles[profileID] = offset
+}
+
+func (c *clockData) get(profileID string) time.Duration {
+	c.RLock()
+	defer c.RUnlock()
+	return c.profiles[profileID]
+}
+
+// probeClock records the offset between the remote and local clocks of
+// the profile, so the modified times of each side can be compared fairly
+func (p *Profile) probeClock() {
+	prober, ok := p.Remote.(ClockProber)
+	if !ok {
+		return
+	}
+
+	offset, err := prober.ClockOffset()
+	if err != nil {
+		logger.Profile(p.Name).Errorf("Error checking the remote clock of profile %s: %s", p.Name, err)
+		return
+	}
+
+	if offset < skewThreshold && offset > -skewThreshold {
+		offset = 0
+	} else {
+		logger.Profile(p.Name).Warnf("The remote clock of profile %s is off from the local clock by %s", p.Name, offset)
+	}
+	offsets.set(p.ID(), offset)
+}
+
+// ClockOffset returns how far the remote clock of the profile is ahead of the
+// local clock, as of when the profile was started
+func (p *Profile) ClockOffset() time.Duration {
+	return offsets.get(p.ID())
+}
+
+// remoteModified returns the modified time of the remote file in terms of the
+// local clock
+func (p *Profile) remoteModified(remote Syncer) time.Time {
+	return remote.Modified().Add(-p.ClockOffset())
+}
@@ -0,0 +1,70 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import (
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// Compressor is an optional interface for Syncers which can have their content
+// sent compressed over the network
+type Compressor interface {
+	OpenCompressed() (io.ReadCloser, error)                               // Opens the file for reading, asking for the content to be sent compressed
+	WriteCompressed(r io.ReadCloser, size int64, modTime time.Time) error // Writes from the reader, sending the content compressed, closes reader
+}
+
+// compressedTypes are the extensions of files which are already compressed, and
+// are never worth compressing again
+var compressedTypes = []string{
+	".7z", ".aac", ".avi", ".bz2", ".docx", ".epub", ".flac", ".gif", ".gz", ".jar", ".jpeg", ".jpg",
+	".m4a", ".mkv", ".mov", ".mp3", ".mp4", ".odt", ".ogg", ".png", ".pptx", ".rar", ".tgz",
+	".webm", ".webp", ".xlsx", ".xz", ".zip", ".zst",
+}
+
+// compress is whether or not the content of the named file should be compressed
+// when it is transferred.  Files which are already compressed, or have an extension in
+// the profile's exclusion list, are sent as is
+func (p *Profile) compress(name string) bool {
+	if !p.Compress {
+		return false
+	}
+	ext := strings.ToLower(path.Ext(name))
+	if ext == "" {
+		return true
+	}
+	for _, list := range [][]string{compressedTypes, p.CompressExclude} {
+		for i := range list {
+			exclude := strings.ToLower(list[i])
+			if !strings.HasPrefix(exclude, ".") {
+				exclude = "." + exclude
+			}
+			if ext == exclude {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// open opens the from file for reading, compressed over the network if
+// the profile allows it
+func (c *changeItem) open() (io.ReadCloser, error) {
+	if cp, ok := c.from.(Compressor); ok && c.profile.compress(c.from.ID()) {
+		return cp.OpenCompressed()
+	}
+	return c.from.Open()
+}
+
+// writeTo writes from the reader to the destination, compressed over the
+// network if the profile allows it
+func (c *changeItem) writeTo(r io.ReadCloser, size int64, modTime time.Time) error {
+	if cp, ok := c.to.(Compressor); ok && c.profile.compress(c.from.ID()) {
+		return cp.WriteCompressed(r, size, modTime)
+	}
+	return c.to.Write(r, size, modTime)
+}
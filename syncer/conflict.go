@@ -0,0 +1,287 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+)
+
+const conflictBucket = datastore.BucketConflict
+
+// Resolutions of a conflict held by a profile which asks before resolving
+// conflicts
+const (
+	ResolveLocal  = "local"  // keep the local file, overwriting the remote one
+	ResolveRemote = "remote" // keep the remote file, overwriting the local one
+	ResolveBoth   = "both"   // rename the older file, then copy in the newer one
+)
+
+// ErrNoConflict is returned when resolving a file which isn't in conflict
+var ErrNoConflict = errors.New("The file is not in conflict")
+
+// DefaultConflictName is the template used to name conflict copies of files
+// when a profile doesn't specify one.  Templates can use the placeholders:
+//	{name}: the file's name without its extension
+//	{ext}: the file's extension, including the dot
+//	{date}: the date and time the conflict was found
+//	{host}: the name of the computer freehold-sync is running on
+//	{profile}: the name of the profile
+const DefaultConflictName = "{name} (conflict {date}){ext}"
+
+// conflictDateFormat is the format of the {date} placeholder, which avoids
+// characters that aren't valid in file names on some systems
+const conflictDateFormat = "2006-01-02 150405"
+
+// maxConflictCopies is the most times a counter will be tried to find an unused name
+const maxConflictCopies = 1000
+
+// ValidateConflictName returns an error if the passed in template can't
+// be used to name conflict copies
+func ValidateConflictName(template string) error {
+	if template == "" {
+		return nil
+	}
+	if !strings.Contains(template, "{name}") {
+		return errors.New("The conflict name must contain {name}")
+	}
+	if strings.ContainsAny(template, `/\`) {
+		return errors.New("The conflict name can't contain a path separator")
+	}
+	return nil
+}
+
+// ConflictName returns a name for the conflict copy of the file with the
+// passed in name, based on the profile's conflict name template.  If the
+// name is already in use, as reported by exists, a counter is added
+func (p *Profile) ConflictName(name string, exists func(name string) (bool, error)) (string, error) {
+	template := p.ConflictTemplate
+	if template == "" {
+		template = DefaultConflictName
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	newName := strings.NewReplacer(
+		"{name}", base,
+		"{ext}", ext,
+		"{date}", time.Now().Format(conflictDateFormat),
+		"{host}", host,
+		"{profile}", p.Name,
+	).Replace(template)
+
+	newExt := path.Ext(newName)
+	newBase := strings.TrimSuffix(newName, newExt)
+	candidate := newName
+	for i := 1; i <= maxConflictCopies; i++ {
+		found, err := exists(candidate)
+		if err != nil {
+			return "", err
+		}
+		if !found && candidate != name {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s (%d)%s", newBase, i, newExt)
+	}
+
+	return "", fmt.Errorf("Couldn't find an unused conflict name for %s", name)
+}
+
+// Conflict is a file changed on both sides.  Conflicts settled by the profile's
+// conflict resolution are recorded along with how they were resolved, and held
+// ones wait without a resolution for someone to choose which side to keep
+type Conflict struct {
+	Path           string    `json:"path"`
+	Found          time.Time `json:"found"`
+	LocalModified  time.Time `json:"localModified"`
+	LocalSize      int64     `json:"localSize"`
+	RemoteModified time.Time `json:"remoteModified"`
+	RemoteSize     int64     `json:"remoteSize"`
+	Resolution     string    `json:"resolution,omitempty"` // one of the Resolve constants, empty while waiting
+	Resolved       time.Time `json:"resolved,omitempty"`
+}
+
+// waiting is whether the conflict is still waiting to be resolved
+func (c *Conflict) waiting() bool {
+	return c.Resolution == ""
+}
+
+// holdConflict records the file pair as in conflict, leaving both files as
+// they are.  It returns whether the pair wasn't already in conflict
+func (p *Profile) holdConflict(local, remote Syncer) (bool, error) {
+	return p.recordConflict(local, remote, "")
+}
+
+// recordConflict records the file pair as in conflict, and how it was resolved,
+// or an empty resolution if it's being held.  It returns whether the pair wasn't
+// already waiting to be resolved
+func (p *Profile) recordConflict(local, remote Syncer, resolution string) (bool, error) {
+	if p.DryRun {
+		return false, nil
+	}
+	found := false
+	err := datastore.Update(func(tx *datastore.Tx) error {
+		c := &Conflict{}
+		err := tx.GetIn(conflictBucket, p.ID(), stateKey(p, local), c)
+		if err != nil && err != datastore.ErrNotFound {
+			return err
+		}
+		found = err == datastore.ErrNotFound || !c.waiting()
+		if found {
+			c.Found = time.Now()
+		}
+		// either side may have changed again since it was found
+		c.Path = strings.Trim(filepath.ToSlash(local.Path(p)), "/")
+		c.LocalModified = local.Modified()
+		c.LocalSize = local.Size()
+		c.RemoteModified = remote.Modified()
+		c.RemoteSize = remote.Size()
+		c.Resolution = resolution
+		c.Resolved = time.Time{}
+		if resolution != "" {
+			c.Resolved = time.Now()
+		}
+		return tx.PutIn(conflictBucket, p.ID(), stateKey(p, local), c)
+	})
+	return found, err
+}
+
+// clearConflict removes the pair's conflict if it's still waiting to be
+// resolved, the pair having been synced or deleted some other way.  Resolved
+// conflicts are kept
+func (p *Profile) clearConflict(tx *datastore.Tx, local Syncer) error {
+	c := &Conflict{}
+	err := tx.GetIn(conflictBucket, p.ID(), stateKey(p, local), c)
+	if err == datastore.ErrNotFound || (err == nil && !c.waiting()) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return tx.DeleteIn(conflictBucket, p.ID(), stateKey(p, local))
+}
+
+// ProfileConflicts returns the conflicts waiting to be resolved in the profile,
+// in path order
+func ProfileConflicts(profileID string) ([]*Conflict, error) {
+	all, err := ProfileConflictLog(profileID)
+	if err != nil {
+		return nil, err
+	}
+	conflicts := []*Conflict{}
+	for i := range all {
+		if all[i].waiting() {
+			conflicts = append(conflicts, all[i])
+		}
+	}
+	return conflicts, nil
+}
+
+// ProfileConflictLog returns every conflict recorded in the profile, resolved
+// or not, in path order.  Only the latest conflict of each file is kept
+func ProfileConflictLog(profileID string) ([]*Conflict, error) {
+	conflicts := []*Conflict{}
+	err := datastore.View(func(tx *datastore.Tx) error {
+		return tx.EachIn(conflictBucket, profileID, func(key string, value []byte) error {
+			c := &Conflict{}
+			err := json.Unmarshal(value, c)
+			if err != nil {
+				return err
+			}
+			conflicts = append(conflicts, c)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return conflicts, nil
+}
+
+// ProfileConflictCount returns the number of conflicts waiting to be resolved
+// in the profile
+func ProfileConflictCount(profileID string) int {
+	conflicts, err := ProfileConflicts(profileID)
+	if err != nil {
+		return 0
+	}
+	return len(conflicts)
+}
+
+// Resolve settles a conflict held for the file pair with the chosen resolution,
+// one of the Resolve constants
+func (p *Profile) Resolve(local, remote Syncer, resolution string) error {
+	c := &Conflict{}
+	err := datastore.GetIn(conflictBucket, p.ID(), stateKey(p, local), c)
+	if err == datastore.ErrNotFound || (err == nil && !c.waiting()) {
+		return ErrNoConflict
+	}
+	if err != nil {
+		return err
+	}
+
+	if !local.Exists() || !remote.Exists() || local.IsDir() || remote.IsDir() {
+		// no longer a conflict, sync sorts out whatever happened to it since
+		err = datastore.DeleteIn(conflictBucket, p.ID(), stateKey(p, local))
+		if err != nil {
+			return err
+		}
+		return p.Sync(local, remote)
+	}
+
+	switch resolution {
+	case ResolveLocal:
+		if !p.canWrite(false) {
+			return errors.New("The profile's direction doesn't allow writing to the remote side")
+		}
+		_, err = p.recordConflict(local, remote, resolution)
+		if err != nil {
+			return err
+		}
+		return p.transfer(local, remote, false, ReasonResolved)
+	case ResolveRemote:
+		if !p.canWrite(true) {
+			return errors.New("The profile's direction doesn't allow writing to the local side")
+		}
+		_, err = p.recordConflict(local, remote, resolution)
+		if err != nil {
+			return err
+		}
+		return p.transfer(local, remote, true, ReasonResolved)
+	case ResolveBoth:
+		beforeLocal := local.Modified().Before(p.remoteModified(remote))
+		if !p.canWrite(beforeLocal) {
+			return errors.New("The profile's direction doesn't allow replacing the older file")
+		}
+		_, err = p.recordConflict(local, remote, resolution)
+		if err != nil {
+			return err
+		}
+		before := remote
+		if beforeLocal {
+			before = local
+		}
+		err = <-p.rename(before)
+		if err != nil {
+			return err
+		}
+		return p.transfer(local, remote, beforeLocal, ReasonResolved)
+	}
+	return fmt.Errorf("Invalid conflict resolution %s", resolution)
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+)
+
+// minCopySize is the smallest file worth looking for an existing copy of,
+// anything smaller is cheaper to just write
+const minCopySize = minDeltaSize
+
+// Copier is an optional interface for Syncers which can be written by copying
+// another file on the same side, without transferring the content again
+type Copier interface {
+	// CopyFrom makes the non-existent file a copy of the file at relPath in the profile.
+	// Returns false without copying if that file's size or modified time no longer match
+	CopyFrom(p *Profile, relPath string, size int64, modified time.Time) (bool, error)
+}
+
+// copy writes the change by copying a file already on the destination side
+// which has the same content, if the profile has synced one.  Returns true
+// if the file was copied
+func (c *changeItem) copy(cp Copier) (bool, error) {
+	if c.to.Exists() || c.from.Size() < minCopySize {
+		return false, nil
+	}
+
+	hash, err := c.profile.hash(c.from)
+	if err != nil {
+		return false, err
+	}
+
+	toLocal := c.profile.side(c.to) == "local"
+	found := false
+	var copyErr error
+	err = c.profile.eachState(func(relPath string, state *fileState) bool {
+		if state.Hash != hash || state.Size != c.from.Size() || relPath == c.path {
+			return true
+		}
+		modified := state.RemoteModified
+		if toLocal {
+			modified = state.LocalModified
+		}
+		found, copyErr = cp.CopyFrom(c.profile, relPath, state.Size, modified)
+		return copyErr == nil && !found
+	})
+	if err != nil {
+		return false, err
+	}
+	return found, copyErr
+}
+
+// eachState calls fn with the slash separated path and synced state of each of
+// the profile's file pairs, until fn returns false
+func (p *Profile) eachState(fn func(relPath string, state *fileState) bool) error {
+	var paths []string
+	var states []*fileState
+
+	err := datastore.View(func(tx *datastore.Tx) error {
+		return tx.EachIn(stateBucket, p.ID(), func(key string, value []byte) error {
+			state := &fileState{}
+			err := json.Unmarshal(value, state)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, strings.Trim(key, "/"))
+			states = append(states, state)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// fn is run outside of the transaction, so it's free to make requests
+	// or write to the datastore
+	for i := range states {
+		if !fn(paths[i], states[i]) {
+			return nil
+		}
+	}
+	return nil
+}
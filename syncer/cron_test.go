@@ -0,0 +1,39 @@
+package syncer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCron(t *testing.T) {
+	start := time.Date(2015, time.June, 10, 13, 30, 0, 0, time.UTC) // a wednesday
+
+	tests := []struct {
+		expr string
+		next time.Time
+	}{
+		{"0 2 * * *", time.Date(2015, time.June, 11, 2, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2015, time.June, 10, 13, 45, 0, 0, time.UTC)},
+		{"0 9-17 * * 1-5", time.Date(2015, time.June, 10, 14, 0, 0, 0, time.UTC)},
+		{"30 1 * * 0", time.Date(2015, time.June, 14, 1, 30, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1,15 * *", time.Date(2015, time.June, 15, 12, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		c, err := ParseCron(test.expr)
+		if err != nil {
+			t.Fatalf("Error parsing %s: %s", test.expr, err)
+		}
+		next := c.Next(start)
+		if !next.Equal(test.next) {
+			t.Errorf("%s: expected next run at %s got %s", test.expr, test.next, next)
+		}
+	}
+
+	for _, bad := range []string{"* * * *", "60 * * * *", "* 5-2 * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := ParseCron(bad); err == nil {
+			t.Errorf("Expected error parsing %s", bad)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	EventStarted     = "started"     // a change to a file started running
+	EventFinished    = "finished"    // a change to a file finished
+	EventConflict    = "conflict"    // a file was changed on both sides
+	EventError       = "error"       // a change to a file failed
+	EventQuarantined = "quarantined" // a file kept being synced back and forth, and is no longer synced
+)
+
+// eventBuffer is how many events a subscriber can fall behind by before
+// newer events are dropped for it
+const eventBuffer = 100
+
+// Event is something that happened while syncing a profile
+type Event struct {
+	Type    string    `json:"type"`
+	Profile string    `json:"profile"` // profile ID
+	Path    string    `json:"path"`
+	Side    string    `json:"side,omitempty"`   // local or remote, the side being changed
+	Action  string    `json:"action,omitempty"` // see the Action constants
+	Error   string    `json:"error,omitempty"`
+	When    time.Time `json:"when"`
+}
+
+var subscribers eventSubscribers
+
+func init() {
+	subscribers = eventSubscribers{
+		chans: make(map[chan *Event]struct{}),
+	}
+}
+
+type eventSubscribers struct {
+	sync.RWMutex
+	chans map[chan *Event]struct{}
+}
+
+// Subscribe returns a channel every event is sent to, until the returned
+// func is called.  Subscribers which don't keep up miss events rather than
+// holding up syncing
+func Subscribe() (<-chan *Event, func()) {
+	ch := make(chan *Event, eventBuffer)
+	subscribers.Lock()
+	subscribers.chans[ch] = struct{}{}
+	subscribers.Unlock()
+
+	return ch, func() {
+		subscribers.Lock()
+		delete(subscribers.chans, ch)
+		subscribers.Unlock()
+	}
+}
+
+func publish(e *Event) {
+	e.When = time.Now()
+	subscribers.RLock()
+	defer subscribers.RUnlock()
+	for ch := range subscribers.chans {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// publishChange publishes an event about the change described by entry
+func (p *Profile) publishChange(eventType string, entry *HistoryEntry, err error) {
+	e := &Event{
+		Type:    eventType,
+		Profile: p.ID(),
+		Path:    entry.Path,
+		Side:    entry.Side,
+		Action:  entry.Action,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	publish(e)
+}
+
+// publishConflict publishes and counts that the file pair was changed on
+// both sides
+func (p *Profile) publishConflict(local Syncer) {
+	stats.conflict(p.ID())
+	publish(&Event{
+		Type:    EventConflict,
+		Profile: p.ID(),
+		Path:    strings.Trim(filepath.ToSlash(local.Path(p)), "/"),
+	})
+}
@@ -0,0 +1,185 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Filter is an ordered list of gitignore style patterns for excluding
+// files from syncing.  Patterns are matched against the path relative to
+// the profile root, and the last matching pattern wins.
+//	*.tmp: matches tmp files in any folder
+//	/build: matches build only in the root folder
+//	node_modules/**: matches everything in the root node_modules folder
+//	**/cache/**: matches everything in any cache folder
+//	logs/: matches only directories named logs
+//	!important.tmp: re-includes a file excluded by an earlier pattern
+type Filter struct {
+	patterns []*pattern
+}
+
+type pattern struct {
+	rx      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// NewFilter compiles the list of patterns into a Filter
+func NewFilter(patterns []string) (*Filter, error) {
+	f := &Filter{}
+	for i := range patterns {
+		pat := strings.TrimSpace(patterns[i])
+		if pat == "" || strings.HasPrefix(pat, "#") {
+			continue
+		}
+
+		p := &pattern{}
+		if strings.HasPrefix(pat, "!") {
+			p.negate = true
+			pat = pat[1:]
+		}
+		if strings.HasSuffix(pat, "/") {
+			p.dirOnly = true
+			pat = strings.TrimRight(pat, "/")
+		}
+
+		anchored := strings.Contains(pat, "/")
+		pat = strings.TrimPrefix(pat, "/")
+		if pat == "" {
+			return nil, fmt.Errorf("Invalid filter pattern: %s", patterns[i])
+		}
+
+		expr := globToRegexp(pat)
+		if anchored {
+			expr = "^" + expr + "$"
+		} else {
+			expr = "(^|/)" + expr + "$"
+		}
+
+		rx, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid filter pattern %s: %s", patterns[i], err)
+		}
+		p.rx = rx
+		f.patterns = append(f.patterns, p)
+	}
+	return f, nil
+}
+
+// Excluded returns whether or not the relative path is excluded by the filter
+func (f *Filter) Excluded(relPath string, isDir bool) bool {
+	if f == nil {
+		return false
+	}
+	relPath = strings.Trim(filepath.ToSlash(relPath), "/")
+	excluded := false
+	for _, p := range f.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if p.rx.MatchString(relPath) {
+			excluded = !p.negate
+		}
+	}
+	return excluded
+}
+
+func globToRegexp(glob string) string {
+	expr := ""
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			expr += "(.*/)?"
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**"):
+			expr += "(/.*)?"
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			expr += ".*"
+			i++
+		case c == '*':
+			expr += "[^/]*"
+		case c == '?':
+			expr += "[^/]"
+		case c == '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				expr += regexp.QuoteMeta(string(c))
+				continue
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr += "[" + class + "]"
+			i += end
+		default:
+			expr += regexp.QuoteMeta(string(c))
+		}
+	}
+	return expr
+}
+
+// Excluded returns whether or not the passed in syncer is excluded from
+// syncing by the profile's filter, selected folders, or symlink policy
+func (p *Profile) Excluded(s Syncer) bool {
+	if s.ID() == p.Local.ID() || s.ID() == p.Remote.ID() {
+		return false
+	}
+	relPath := strings.Trim(filepath.ToSlash(s.Path(p)), "/")
+	for _, reserved := range []string{VersionsFolder, TrashFolder, MetaFolder, KeyFile} {
+		if relPath == reserved || strings.HasPrefix(relPath, reserved+"/") {
+			return true
+		}
+	}
+	if !p.selected(relPath, s.IsDir() || !s.Exists()) {
+		return true
+	}
+	if p.skipLink(s, false) {
+		return true
+	}
+	return p.Filter.Excluded(relPath, s.IsDir())
+}
+
+// selected returns whether or not the relative path is in one of the profile's
+// selected folders.  Parents of selected folders are included so they can be
+// monitored, but the other files and folders in them are not
+func (p *Profile) selected(relPath string, isDir bool) bool {
+	if len(p.Folders) == 0 {
+		return true
+	}
+	for _, folder := range p.Folders {
+		if relPath == folder || strings.HasPrefix(relPath, folder+"/") {
+			return true
+		}
+		if isDir && strings.HasPrefix(folder, relPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanFolders normalizes a list of selected folders to slash separated
+// paths relative to the profile root
+func CleanFolders(folders []string) ([]string, error) {
+	var result []string
+	for i := range folders {
+		folder := path.Clean(strings.Trim(filepath.ToSlash(strings.TrimSpace(folders[i])), "/"))
+		if folder == "." {
+			continue
+		}
+		if folder == ".." || strings.HasPrefix(folder, "../") {
+			return nil, fmt.Errorf("Selected folder %s is outside of the profile", folders[i])
+		}
+		result = append(result, folder)
+	}
+	return result, nil
+}
@@ -0,0 +1,77 @@
+package syncer
+
+import "testing"
+
+func TestFilter(t *testing.T) {
+	f, err := NewFilter([]string{
+		"*.tmp",
+		"!important.tmp",
+		"node_modules/**",
+		"**/cache/**",
+		"/build",
+		"logs/",
+		"# comment",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		isDir    bool
+		excluded bool
+	}{
+		{"file.tmp", false, true},
+		{"sub/dir/file.tmp", false, true},
+		{"important.tmp", false, false},
+		{"sub/important.tmp", false, false},
+		{"file.txt", false, false},
+		{"node_modules/pkg/index.js", false, true},
+		{"src/node_modules/pkg/index.js", false, false},
+		{"cache/file", false, true},
+		{"src/cache/file", false, true},
+		{"build", true, true},
+		{"src/build", true, false},
+		{"logs", true, true},
+		{"logs", false, false},
+		{"/sub/file.tmp", false, true},
+	}
+
+	for _, test := range tests {
+		if f.Excluded(test.path, test.isDir) != test.excluded {
+			t.Errorf("Expected excluded to be %t for %s", test.excluded, test.path)
+		}
+	}
+}
+
+func TestSelectedFolders(t *testing.T) {
+	folders, err := CleanFolders([]string{"/docs/work/", "photos", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Profile{Folders: folders}
+
+	tests := []struct {
+		path     string
+		isDir    bool
+		selected bool
+	}{
+		{"docs", true, true},
+		{"docs/notes.txt", false, false},
+		{"docs/work", true, true},
+		{"docs/work/report.doc", false, true},
+		{"photos/2015/img.jpg", false, true},
+		{"music", true, false},
+	}
+
+	for _, test := range tests {
+		if p.selected(test.path, test.isDir) != test.selected {
+			t.Errorf("Expected selected to be %t for %s", test.selected, test.path)
+		}
+	}
+
+	_, err = CleanFolders([]string{"../outside"})
+	if err == nil {
+		t.Fatal("Expected error for folder outside of the profile")
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+)
+
+// deleteWindow is how long deletes are counted together against the
+// profile's delete limits
+const deleteWindow = time.Minute
+
+// deleteSettle is how long the profile has to go without planning another
+// delete, or syncing anything, before the deletes it has planned are counted
+const deleteSettle = 2 * time.Second
+
+var guards guardData
+
+func init() {
+	guards = guardData{
+		profiles: make(map[string]*deleteGuard),
+	}
+}
+
+type guardData struct {
+	sync.Mutex
+	profiles map[string]*deleteGuard
+}
+
+// deleteGuard counts the deletes planned by a profile before any of them are
+// run, and holds them if there are more than the profile allows at once
+type deleteGuard struct {
+	started time.Time     // start of the current window
+	count   int           // deletes run in the current window
+	total   int           // number of synced files in the profile at the start of the window
+	planned []*heldDelete // deletes waiting to be counted
+	first   time.Time     // when the first of the planned deletes was planned
+	last    time.Time     // when the last of the planned deletes was planned
+	held    []*heldDelete
+}
+
+type heldDelete struct {
+	profile       *Profile
+	local, remote Syncer
+	toLocal       bool // whether or not the local file is the one deleted
+}
+
+// target is the file the delete removes
+func (h *heldDelete) target() Syncer {
+	if h.toLocal {
+		return h.local
+	}
+	return h.remote
+}
+
+// HeldDelete is a delete waiting on the user to confirm it
+type HeldDelete struct {
+	Path  string `json:"path"`
+	Side  string `json:"side"`
+	IsDir bool   `json:"isDir"`
+}
+
+// holdDelete returns true if the delete is held back instead of run.  When the
+// profile has delete limits, its deletes are collected until it stops planning
+// more, so a scan which would delete more files than it's allowed to at once
+// doesn't run any of them, see countDeletes
+func (p *Profile) holdDelete(local, remote Syncer, toLocal bool) bool {
+	if p.MaxDeletes <= 0 && p.MaxDeletePercent <= 0 {
+		return false
+	}
+
+	guards.Lock()
+	defer guards.Unlock()
+
+	g, ok := guards.profiles[p.ID()]
+	if !ok {
+		g = &deleteGuard{}
+		guards.profiles[p.ID()] = g
+	}
+
+	held := &heldDelete{
+		profile: p,
+		local:   local,
+		remote:  remote,
+		toLocal: toLocal,
+	}
+
+	if len(g.held) > 0 {
+		g.held = append(g.held, held)
+		return true
+	}
+
+	if len(g.planned) == 0 {
+		g.first = time.Now()
+		time.AfterFunc(deleteSettle, p.countDeletes)
+	}
+	g.last = time.Now()
+	g.planned = append(g.planned, held)
+	return true
+}
+
+// countDeletes runs the deletes the profile has planned, once it has settled,
+// unless together with the deletes already run in the current window they're
+// more than the profile is allowed to delete at once, in which case they're all
+// held until they're confirmed.  A profile which never settles has its deletes
+// counted after the delete window
+func (p *Profile) countDeletes() {
+	guards.Lock()
+	defer guards.Unlock()
+
+	g, ok := guards.profiles[p.ID()]
+	if !ok || len(g.planned) == 0 {
+		return
+	}
+
+	settling := time.Since(g.last) < deleteSettle || syncing.count(p.ID()) > 0
+	if settling && time.Since(g.first) < deleteWindow {
+		time.AfterFunc(deleteSettle, p.countDeletes)
+		return
+	}
+
+	planned := g.planned
+	g.planned = nil
+
+	if time.Since(g.started) > deleteWindow {
+		g.started = time.Now()
+		g.count = 0
+		g.total = 0
+		if p.MaxDeletePercent > 0 {
+			total, err := p.syncedCount()
+			if err != nil {
+				logger.Profile(p.Name).Errorf("Error counting the files in profile %s: %s", p.Name, err)
+			}
+			g.total = total
+		}
+	}
+	count := g.count + len(planned)
+
+	over := len(g.held) > 0 || (p.MaxDeletes > 0 && count > p.MaxDeletes)
+	if p.MaxDeletePercent > 0 && g.total > 0 && count*100 > g.total*p.MaxDeletePercent {
+		over = true
+	}
+	if over {
+		logger.Profile(p.Name).Warnf("Profile %s is deleting %d files, more than it's allowed to at once.  The deletes are being "+
+			"held until they are confirmed.", p.Name, len(planned))
+		g.held = append(g.held, planned...)
+		return
+	}
+
+	g.count = count
+	go func() {
+		for _, h := range planned {
+			err := h.profile.removeNow(h.local, h.target())
+			if err != nil {
+				logger.Profile(h.profile.Name).Errorf("Error deleting %s: %s", h.target().ID(), err)
+			}
+		}
+	}()
+}
+
+// syncedCount is the number of files the profile has synced
+func (p *Profile) syncedCount() (int, error) {
+	count := 0
+	err := datastore.View(func(tx *datastore.Tx) error {
+		var err error
+		count, err = tx.CountIn(stateBucket, p.ID())
+		return err
+	})
+	return count, err
+}
+
+// take removes and returns the held deletes of the profile.  Deletes the
+// profile has planned since are still counted
+func (g *guardData) take(profileID string) []*heldDelete {
+	g.Lock()
+	defer g.Unlock()
+
+	guard, ok := g.profiles[profileID]
+	if !ok {
+		return nil
+	}
+	held := guard.held
+	if len(guard.planned) == 0 {
+		delete(g.profiles, profileID)
+		return held
+	}
+	guard.held = nil
+	guard.started = time.Time{}
+	return held
+}
+
+// ProfileHeldDeletes returns the deletes the profile is holding until
+// they are confirmed
+func ProfileHeldDeletes(profileID string) []*HeldDelete {
+	guards.Lock()
+	defer guards.Unlock()
+
+	g, ok := guards.profiles[profileID]
+	if !ok {
+		return nil
+	}
+
+	list := make([]*HeldDelete, len(g.held))
+	for i, h := range g.held {
+		target := h.target()
+		list[i] = &HeldDelete{
+			Path:  strings.Trim(filepath.ToSlash(target.Path(h.profile)), "/"),
+			Side:  h.profile.side(target),
+			IsDir: target.IsDir(),
+		}
+	}
+	return list
+}
+
+// ConfirmDeletes runs the deletes the profile is holding
+func ConfirmDeletes(profileID string) error {
+	held := guards.take(profileID)
+	if len(held) == 0 {
+		return errors.New("This profile has no deletes waiting to be confirmed")
+	}
+
+	go func() {
+		for _, h := range held {
+			err := h.profile.removeNow(h.local, h.target())
+			if err != nil {
+				logger.Profile(h.profile.Name).Errorf("Error deleting %s: %s", h.target().ID(), err)
+			}
+		}
+	}()
+	return nil
+}
+
+// DiscardDeletes throws out the deletes the profile is holding.  The files
+// that weren't deleted are copied back to the side they were deleted from,
+// if the profile's direction writes to it
+func DiscardDeletes(profileID string) error {
+	held := guards.take(profileID)
+	if len(held) == 0 {
+		return errors.New("This profile has no deletes waiting to be confirmed")
+	}
+
+	go func() {
+		for _, h := range held {
+			err := h.restore()
+			if err != nil {
+				logger.Profile(h.profile.Name).Errorf("Error restoring %s: %s", h.target().ID(), err)
+			}
+		}
+	}()
+	return nil
+}
+
+// restore copies the file the delete was held for back to the side it was
+// deleted from
+func (h *heldDelete) restore() error {
+	p := h.profile
+	if !p.canWrite(!h.toLocal) {
+		return nil
+	}
+
+	from, to := h.remote, h.local
+	if h.toLocal {
+		from, to = h.local, h.remote
+	}
+	if d, ok := to.(deletedSetter); ok {
+		d.SetDeleted(false)
+	}
+
+	if from.IsDir() {
+		// the folder's children are only synced when it starts being
+		// monitored, and it already is
+		err := from.StopMonitor(p)
+		if err != nil {
+			return err
+		}
+		return <-p.createDir(from, to)
+	}
+	return p.transfer(h.local, h.remote, !h.toLocal, ReasonNew)
+}
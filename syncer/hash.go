@@ -0,0 +1,138 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+	"bitbucket.org/tshannon/freehold-sync/throttle"
+)
+
+const hashBucket = datastore.BucketHash
+
+// cachedHash is a file's hash, which is valid as long as the file's
+// size and modified time haven't changed
+type cachedHash struct {
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Hash     string    `json:"hash"`
+}
+
+// HashReader returns the hex encoded SHA-256 hash of the reader's content
+func HashReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CachedHash returns the cached hash for the syncer if its size and modified
+// time haven't changed since it was cached, otherwise hash is called and
+// the result is cached
+func CachedHash(s Syncer, hash func() (string, error)) (string, error) {
+	cached := &cachedHash{}
+	err := datastore.Get(hashBucket, s.ID(), cached)
+	if err != nil && err != datastore.ErrNotFound {
+		return "", err
+	}
+
+	if err == nil && cached.Size == s.Size() && cached.Modified.Equal(s.Modified()) {
+		return cached.Hash, nil
+	}
+
+	h, err := hash()
+	if err != nil {
+		return "", err
+	}
+
+	err = datastore.Put(hashBucket, s.ID(), &cachedHash{
+		Size:     s.Size(),
+		Modified: s.Modified(),
+		Hash:     h,
+	})
+	if err != nil {
+		return "", err
+	}
+	return h, nil
+}
+
+// hash returns the hash of the syncer's content.  Syncers which have to be
+// downloaded to be hashed are read within the profile's download limit, and
+// the bytes read are counted as downloaded
+func (p *Profile) hash(s Syncer) (string, error) {
+	rh, ok := s.(ReadHasher)
+	if !ok {
+		return s.Hash()
+	}
+	return rh.HashThrough(func(r io.ReadCloser) io.ReadCloser {
+		return throttle.NewReader(&countReader{
+			ReadCloser: r,
+			profileID:  p.ID(),
+		}, throttle.Download, p.download)
+	})
+}
+
+// countReader counts the bytes read from it as downloaded by the profile
+type countReader struct {
+	io.ReadCloser
+	profileID string
+}
+
+func (c *countReader) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	stats.downloaded(c.profileID, int64(n))
+	return n, err
+}
+
+// clearHash removes the syncer's cached hash so that it will be hashed again
+func clearHash(s Syncer) error {
+	return datastore.Delete(hashBucket, s.ID())
+}
+
+// sameContent returns whether or not the local and remote files have
+// the same content
+func (p *Profile) sameContent(local, remote Syncer) (bool, string, error) {
+	if local.Size() != remote.Size() {
+		return false, "", nil
+	}
+
+	lHash, err := local.Hash()
+	if err != nil {
+		return false, "", err
+	}
+
+	rHash, err := p.hash(remote)
+	if err != nil {
+		return false, "", err
+	}
+
+	return lHash == rHash, lHash, nil
+}
+
+// freshContent is the same as sameContent, but ignores any cached hashes
+// so that changes that don't show in the size or modified time, such as
+// corruption, are found
+func (p *Profile) freshContent(local, remote Syncer) (bool, string, error) {
+	if local.Size() != remote.Size() {
+		return false, "", nil
+	}
+
+	err := clearHash(local)
+	if err != nil {
+		return false, "", err
+	}
+	err = clearHash(remote)
+	if err != nil {
+		return false, "", err
+	}
+
+	return p.sameContent(local, remote)
+}
@@ -0,0 +1,129 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+)
+
+const historyBucket = datastore.BucketHistory
+
+// Reasons changes are made to files
+const (
+	ReasonNew         = "new"         // the file only exists on the other side
+	ReasonChanged     = "changed"     // the other side changed since the last sync
+	ReasonNewer       = "newer"       // never synced before, and the other side was modified later
+	ReasonConflict    = "conflict"    // both sides changed, settled by the profile's conflict resolution
+	ReasonResolved    = "resolved"    // both sides changed, settled by someone choosing which to keep
+	ReasonDeleted     = "deleted"     // the other side was deleted
+	ReasonMoved       = "moved"       // the other side was moved or renamed
+	ReasonMirror      = "mirror"      // made to match the other side of a mirrored profile
+	ReasonRepair      = "repair"      // found out of sync by a verify
+	ReasonInterrupted = "interrupted" // run again after being interrupted by a crash
+	ReasonRestored    = "restored"    // a previous version was restored by someone
+)
+
+// HistoryEntry is a change that was made to a file.  Creates and updates on the
+// local side are downloads, and on the remote side are uploads
+type HistoryEntry struct {
+	Action string    `json:"action"`
+	Path   string    `json:"path"`
+	Side   string    `json:"side"` // local or remote, the side which was changed
+	IsDir  bool      `json:"isDir"`
+	From   string    `json:"from,omitempty"` // path the file was moved from
+	Reason string    `json:"reason"`
+	When   time.Time `json:"when"`
+}
+
+// historyKey sorts each file's entries together, oldest first.  Paths can't
+// contain a null, so one file's entries never run into another's
+func historyKey(relPath string, when time.Time) string {
+	return fmt.Sprintf("%s\x00%020d", relPath, when.UnixNano())
+}
+
+// historyEntry describes the change for the file's history.  Must be called
+// before the change is run
+func (c *changeItem) historyEntry() *HistoryEntry {
+	entry := &HistoryEntry{
+		Path:   strings.Trim(filepath.ToSlash(c.to.Path(c.profile)), "/"),
+		Side:   c.profile.side(c.to),
+		Reason: c.reason,
+	}
+	entry.Action, entry.IsDir = c.action()
+	if c.changeType == changeTypeMove {
+		entry.From = strings.Trim(filepath.ToSlash(c.from.Path(c.profile)), "/")
+	}
+	return entry
+}
+
+// record adds the change to the history of the file it was made to.  Moves
+// are added to the history of the path they were moved from as well
+func (p *Profile) record(entry *HistoryEntry) {
+	entry.When = time.Now()
+	err := datastore.Update(func(tx *datastore.Tx) error {
+		err := tx.PutIn(historyBucket, p.ID(), historyKey(entry.Path, entry.When), entry)
+		if err != nil || entry.From == "" {
+			return err
+		}
+		return tx.PutIn(historyBucket, p.ID(), historyKey(entry.From, entry.When), entry)
+	})
+	if err != nil {
+		logger.Profile(p.Name).Errorf("Error recording the history of %s in profile %s: %s", entry.Path, p.Name, err)
+	}
+}
+
+// ProfileHistory returns every change made to the file at the slash separated
+// path relative to the profile, oldest first
+func ProfileHistory(profileID, relPath string) ([]*HistoryEntry, error) {
+	relPath = strings.Trim(filepath.ToSlash(relPath), "/")
+	var entries []*HistoryEntry
+
+	err := datastore.View(func(tx *datastore.Tx) error {
+		return tx.EachPrefixIn(historyBucket, profileID, relPath+"\x00", func(key string, value []byte) error {
+			entry := &HistoryEntry{}
+			err := json.Unmarshal(value, entry)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// HistorySince returns every change made to the files of the profile since the
+// passed in time.  Moves are only returned once, not for both of their paths
+func HistorySince(profileID string, since time.Time) ([]*HistoryEntry, error) {
+	var entries []*HistoryEntry
+
+	err := datastore.View(func(tx *datastore.Tx) error {
+		return tx.EachIn(historyBucket, profileID, func(key string, value []byte) error {
+			entry := &HistoryEntry{}
+			err := json.Unmarshal(value, entry)
+			if err != nil {
+				return err
+			}
+			if entry.When.Before(since) || !strings.HasPrefix(key, entry.Path+"\x00") {
+				return nil
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
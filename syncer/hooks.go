@@ -0,0 +1,180 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hook events, passed to hook commands in FHS_EVENT
+const (
+	HookPreSync  = "preSync"  // before a sync cycle starts
+	HookPostSync = "postSync" // after a sync cycle finished without errors
+	HookError    = "error"    // after a sync cycle with errors, or when the preSync hook failed
+)
+
+// hookOutput is the most output of a failed hook command that's logged
+const hookOutput = 1024
+
+// HookTimeout is the longest a hook command can run before it's killed
+var HookTimeout = 10 * time.Minute
+
+// Hooks are shell commands run around each sync cycle of a profile.  A cycle is
+// a full sync of the profile, when it starts or is resumed, each time its
+// schedule fires, or when it's synced on demand, and lasts until the changes
+// it found have run.  Empty commands aren't run
+type Hooks struct {
+	PreSync  string // the cycle is skipped if it fails, such as when a volume can't be mounted
+	PostSync string
+	OnError  string
+}
+
+var cycles cycleProfiles
+
+func init() {
+	cycles = cycleProfiles{
+		running: make(map[string]bool),
+	}
+}
+
+// cycleProfiles are the profiles with a sync cycle running, so a cycle started
+// while another is still running doesn't run the hooks again
+type cycleProfiles struct {
+	sync.Mutex
+	running map[string]bool
+}
+
+// start returns false if the profile already has a cycle running
+func (c *cycleProfiles) start(profileID string) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.running[profileID] {
+		return false
+	}
+	c.running[profileID] = true
+	return true
+}
+
+func (c *cycleProfiles) stop(profileID string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.running, profileID)
+}
+
+// SyncAll runs a sync cycle of the whole profile, running its hooks around it
+func (p *Profile) SyncAll() error {
+	if p.Hooks == (Hooks{}) || !cycles.start(p.ID()) {
+		p.syncPending()
+		return p.Sync(p.Local, p.Remote)
+	}
+	defer cycles.stop(p.ID())
+
+	before := stats.get(p.ID())
+	err := p.runHook(HookPreSync, p.Hooks.PreSync, before, nil)
+	if err != nil {
+		err = fmt.Errorf("The preSync hook failed, the profile wasn't synced: %s", err)
+		p.runHook(HookError, p.Hooks.OnError, before, err)
+		return err
+	}
+
+	p.syncPending()
+	err = p.Sync(p.Local, p.Remote)
+	if err == nil && !p.settle() {
+		// stopped part way through
+		return nil
+	}
+	if err == ErrCanceled {
+		return err
+	}
+	if failed := stats.get(p.ID()).Errors - before.Errors; err == nil && failed > 0 {
+		err = fmt.Errorf("%d changes failed", failed)
+	}
+	if err != nil {
+		p.runHook(HookError, p.Hooks.OnError, before, err)
+		return err
+	}
+	p.runHook(HookPostSync, p.Hooks.PostSync, before, nil)
+	return nil
+}
+
+// settle waits for the changes found by a sync cycle to run, or to be held
+// until the profile is resumed.  Returns false if the profile was stopped
+func (p *Profile) settle() bool {
+	q, ok := queues.get(p.ID())
+	if !ok {
+		return false
+	}
+	// changes trickle in as folders are scanned, so wait until nothing
+	// has been syncing for two checks in a row
+	settled := 0
+	for settled < 2 {
+		select {
+		case <-q.stopped:
+			return false
+		case <-time.After(settleInterval):
+		}
+		if ProfileSyncCount(p.ID()) == 0 && (q.len() == 0 || q.held()) {
+			settled++
+		} else {
+			settled = 0
+		}
+	}
+	return true
+}
+
+// runHook runs the hook's command, if there is one, with environment variables
+// describing the profile, and what the cycle has done since it started
+func (p *Profile) runHook(event, command string, before Stats, cycleErr error) error {
+	if strings.TrimSpace(command) == "" {
+		return nil
+	}
+	l := logger.Profile(p.Name).With("hook", event)
+
+	after := stats.get(p.ID())
+	env := append(os.Environ(),
+		"FHS_EVENT="+event,
+		"FHS_PROFILE="+p.Name,
+		"FHS_PROFILE_ID="+p.ID(),
+		"FHS_LOCAL_PATH="+p.Local.ID(),
+		"FHS_REMOTE_PATH="+p.Remote.ID(),
+		"FHS_UPLOADED="+strconv.FormatInt(after.FilesUploaded-before.FilesUploaded, 10),
+		"FHS_DOWNLOADED="+strconv.FormatInt(after.FilesDownloaded-before.FilesDownloaded, 10),
+		"FHS_CONFLICTS="+strconv.FormatInt(after.Conflicts-before.Conflicts, 10),
+		"FHS_ERRORS="+strconv.FormatInt(after.Errors-before.Errors, 10),
+	)
+	if cycleErr != nil {
+		env = append(env, "FHS_ERROR="+cycleErr.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), HookTimeout)
+	defer cancel()
+	cmd := hookCommand(ctx, command)
+	cmd.Env = env
+	output := &bytes.Buffer{}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	l.Debugf("Running the %s hook of profile %s", event, p.Name)
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("Timed out after %s", HookTimeout)
+	}
+	if err != nil {
+		out := output.String()
+		if len(out) > hookOutput {
+			out = out[len(out)-hookOutput:]
+		}
+		l.With("output", strings.TrimSpace(out)).Errorf("Error running the %s hook of profile %s: %s",
+			event, p.Name, err)
+	}
+	return err
+}
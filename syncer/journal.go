@@ -0,0 +1,178 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+)
+
+const journalBucket = datastore.BucketJournal
+
+// journalEntry is a change that has been started, but not yet finished.
+// Any entries left over at startup were interrupted by a crash
+type journalEntry struct {
+	ChangeType int       `json:"changeType"`
+	Side       string    `json:"side"`
+	Path       string    `json:"path"`
+	From       string    `json:"from,omitempty"` // path the file was moved from
+	Started    time.Time `json:"started"`
+}
+
+func (c *changeItem) journalKey() string {
+	return fmt.Sprintf("%d_%d", c.queued.UnixNano(), c.id)
+}
+
+// journal records the change as started, before it is run
+func (c *changeItem) journal() {
+	entry := &journalEntry{
+		ChangeType: c.changeType,
+		Side:       c.profile.side(c.to),
+		Path:       strings.Trim(filepath.ToSlash(c.to.Path(c.profile)), "/"),
+		Started:    time.Now(),
+	}
+	if c.changeType == changeTypeMove {
+		entry.From = strings.Trim(filepath.ToSlash(c.from.Path(c.profile)), "/")
+	}
+
+	err := datastore.PutIn(journalBucket, c.profile.ID(), c.journalKey(), entry)
+	if err != nil {
+		logger.Profile(c.profile.Name).Errorf("Error journaling change to %s: %s", c.to.ID(), err)
+	}
+}
+
+// complete removes the change from the journal once it has been run
+func (c *changeItem) complete() {
+	err := datastore.DeleteIn(journalBucket, c.profile.ID(), c.journalKey())
+	if err != nil {
+		logger.Profile(c.profile.Name).Errorf("Error removing change to %s from the journal: %s", c.to.ID(), err)
+	}
+}
+
+// ReplayJournal finishes any changes to the profile that were interrupted by
+// a crash, so that half written or half deleted files aren't synced back as
+// if they were real changes, and loads the changes kept when freehold-sync last
+// stopped.  files returns the local and remote syncers for a slash separated
+// path relative to the profile.  Should be run before the profile is started
+func (p *Profile) ReplayJournal(files func(relPath string) (local, remote Syncer, err error)) error {
+	var keys []string
+	var entries []*journalEntry
+
+	err := datastore.View(func(tx *datastore.Tx) error {
+		return tx.EachIn(journalBucket, p.ID(), func(key string, value []byte) error {
+			entry := &journalEntry{}
+			err := json.Unmarshal(value, entry)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range entries {
+		err = p.replay(entries[i], files)
+		if err != nil {
+			logger.Profile(p.Name).Errorf("Error replaying interrupted change to %s in profile %s: %s", entries[i].Path,
+				p.Name, err)
+		}
+		err = datastore.DeleteIn(journalBucket, p.ID(), keys[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return p.loadPending(files)
+}
+
+// replay re-runs an interrupted change.  Writes and deletes are run again
+// from the start, as the destination may have been left half written.
+// Creating folders and conflict copies are picked up by the normal sync
+func (p *Profile) replay(entry *journalEntry, files func(relPath string) (local, remote Syncer, err error)) error {
+	if p.DryRun {
+		return nil
+	}
+
+	local, remote, err := files(entry.Path)
+	if err != nil {
+		return err
+	}
+
+	from, to := remote, local
+	if entry.Side == "remote" {
+		from, to = local, remote
+	}
+
+	item := &changeItem{
+		changeType: entry.ChangeType,
+		from:       from,
+		to:         to,
+		profile:    p,
+		done:       make(chan error, 1),
+		canceled:   make(chan struct{}),
+		reason:     ReasonInterrupted,
+	}
+
+	switch entry.ChangeType {
+	case changeTypeWrite:
+		if !from.Exists() || from.IsDir() {
+			return nil
+		}
+		logger.Profile(p.Name).Infof("Rewriting %s, which was interrupted", to.ID())
+		history := item.historyEntry()
+		// the destination was versioned before the write started
+		err = item.verifiedWrite()
+		if err != nil {
+			return err
+		}
+		err = item.copyMode()
+		if err != nil {
+			return err
+		}
+		p.record(history)
+		hash, err := local.Hash()
+		if err != nil {
+			return err
+		}
+		return p.setState(local, remote, hash)
+	case changeTypeDelete:
+		if !to.Exists() {
+			return nil
+		}
+		logger.Profile(p.Name).Infof("Deleting %s, which was interrupted", to.ID())
+		item.runChange()
+		err = <-item.done
+		if err != nil {
+			return err
+		}
+		return p.deleteState(local)
+	case changeTypeMove:
+		fromLocal, fromRemote, err := files(entry.From)
+		if err != nil {
+			return err
+		}
+		item.from = fromRemote
+		if entry.Side == "local" {
+			item.from = fromLocal
+		}
+		if !item.from.Exists() || to.Exists() {
+			return nil
+		}
+		logger.Profile(p.Name).Infof("Moving %s to %s, which was interrupted", item.from.ID(), to.ID())
+		item.runChange()
+		return <-item.done
+	}
+
+	return nil
+}
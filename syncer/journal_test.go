@@ -0,0 +1,76 @@
+package syncer
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+)
+
+// testSyncer is a syncer with only an ID, for tests which don't touch files
+type testSyncer struct {
+	Syncer
+	id string
+}
+
+func (s *testSyncer) ID() string { return s.id }
+
+// openTestDatastore opens a new datastore in a temporary folder, and returns
+// a function which closes and removes it
+func openTestDatastore(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "freehold-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = datastore.Open(filepath.Join(dir, "test.ds"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return func() {
+		datastore.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestReplayJournal(t *testing.T) {
+	defer openTestDatastore(t)()
+
+	p := &Profile{
+		Name:   "docs",
+		Local:  &testSyncer{id: "/home/user/docs"},
+		Remote: &testSyncer{id: "/v1/file/docs/"},
+	}
+	entry := &journalEntry{
+		ChangeType: changeTypeDelete,
+		Side:       "remote",
+		Path:       "report.txt",
+		Started:    time.Now(),
+	}
+	err := datastore.PutIn(journalBucket, p.ID(), "1_1", entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var replayed []string
+	err = p.ReplayJournal(func(relPath string) (Syncer, Syncer, error) {
+		replayed = append(replayed, relPath)
+		return nil, nil, errors.New("File not found")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(replayed) != 1 || replayed[0] != "report.txt" {
+		t.Fatalf("Expected report.txt to be replayed, got %v", replayed)
+	}
+	err = datastore.GetIn(journalBucket, p.ID(), "1_1", &journalEntry{})
+	if err != datastore.ErrNotFound {
+		t.Fatalf("Expected the replayed entry to be removed from the journal, got %v", err)
+	}
+}
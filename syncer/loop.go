@@ -0,0 +1,236 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+)
+
+const quarantineBucket = datastore.BucketQuarantine
+
+const (
+	// loopWindow is how long the writes to a file are remembered, to spot it
+	// being synced back and forth
+	loopWindow = 10 * time.Minute
+	// loopFlips is how many times in a row a file can be written to the side it
+	// was last written from, within loopWindow, before it's quarantined
+	loopFlips = 4
+	// loopVersions is the most versions of the content a file can be written
+	// with while flipping, for it to be a loop rather than someone editing it
+	// on both sides
+	loopVersions = 2
+)
+
+// ErrNotQuarantined is returned when releasing a file which isn't quarantined
+var ErrNotQuarantined = errors.New("The file is not quarantined")
+
+// Quarantine is a file which kept being synced back and forth between the two
+// sides without its content changing.  It isn't synced again until it's
+// released
+type Quarantine struct {
+	Path       string    `json:"path"`
+	Found      time.Time `json:"found"`
+	Since      time.Time `json:"since"`    // when the first of the writes was made
+	Writes     int       `json:"writes"`   // times the file was written since
+	Versions   int       `json:"versions"` // different versions of the content it was written with
+	Diagnostic string    `json:"diagnostic"`
+}
+
+var loops loopData // recent writes to each file, by profile
+
+func init() {
+	loops = loopData{
+		profiles: make(map[string]*profileLoops),
+	}
+}
+
+type loopData struct {
+	sync.Mutex
+	profiles map[string]*profileLoops
+}
+
+type profileLoops struct {
+	swept  time.Time
+	writes map[string][]*loopWrite // by state key
+}
+
+// loopWrite is a file pair being written to one side
+type loopWrite struct {
+	toLocal bool
+	hash    string
+	when    time.Time
+}
+
+// watchLoop records the write of the file pair, and quarantines it if it's
+// being synced back and forth
+func (p *Profile) watchLoop(local Syncer, toLocal bool, hash string) {
+	key := stateKey(p, local)
+	now := time.Now()
+
+	loops.Lock()
+	pl, ok := loops.profiles[p.ID()]
+	if !ok {
+		pl = &profileLoops{
+			swept:  now,
+			writes: make(map[string][]*loopWrite),
+		}
+		loops.profiles[p.ID()] = pl
+	}
+	if now.Sub(pl.swept) > loopWindow {
+		// files which haven't been written to lately
+		for k, writes := range pl.writes {
+			if now.Sub(writes[len(writes)-1].when) > loopWindow {
+				delete(pl.writes, k)
+			}
+		}
+		pl.swept = now
+	}
+
+	writes := recentWrites(pl.writes[key], now)
+	writes = append(writes, &loopWrite{toLocal: toLocal, hash: hash, when: now})
+	if !isLoop(writes) {
+		pl.writes[key] = writes
+		loops.Unlock()
+		return
+	}
+	delete(pl.writes, key)
+	loops.Unlock()
+
+	err := p.quarantine(local, writes)
+	if err != nil {
+		logger.Profile(p.Name).Errorf("Error quarantining %s: %s", local.ID(), err)
+	}
+}
+
+// recentWrites drops the writes made longer ago than loopWindow
+func recentWrites(writes []*loopWrite, now time.Time) []*loopWrite {
+	for len(writes) > 0 && now.Sub(writes[0].when) > loopWindow {
+		writes = writes[1:]
+	}
+	return writes
+}
+
+// isLoop is whether the writes flip between the two sides, loopFlips times in a
+// row, with no more than loopVersions versions of the content
+func isLoop(writes []*loopWrite) bool {
+	if len(writes) <= loopFlips {
+		return false
+	}
+	writes = writes[len(writes)-loopFlips-1:]
+	versions := make(map[string]bool)
+	for i := range writes {
+		if i > 0 && writes[i].toLocal == writes[i-1].toLocal {
+			return false
+		}
+		versions[writes[i].hash] = true
+	}
+	return len(versions) <= loopVersions
+}
+
+// quarantine stops the file pair from being synced until it's released, and
+// says why
+func (p *Profile) quarantine(local Syncer, writes []*loopWrite) error {
+	versions := make(map[string]bool)
+	for i := range writes {
+		versions[writes[i].hash] = true
+	}
+	q := &Quarantine{
+		Path:     strings.Trim(filepath.ToSlash(local.Path(p)), "/"),
+		Found:    time.Now(),
+		Since:    writes[0].when,
+		Writes:   len(writes),
+		Versions: len(versions),
+	}
+	q.Diagnostic = fmt.Sprintf("%s was written %d times in %s, to the local and remote side in turn, with only %d "+
+		"version(s) of its content.  Something is changing it back each time it's synced, such as another sync tool, "+
+		"a profile syncing the same folder, or a program which rewrites the file.  It won't be synced until it's released.",
+		q.Path, q.Writes, q.Found.Sub(q.Since).Round(time.Second), q.Versions)
+
+	err := datastore.PutIn(quarantineBucket, p.ID(), stateKey(p, local), q)
+	if err != nil {
+		return err
+	}
+	logger.Profile(p.Name).Path(q.Path).Errorf("Quarantined %s in profile %s. %s", q.Path, p.Name, q.Diagnostic)
+	publish(&Event{
+		Type:    EventQuarantined,
+		Profile: p.ID(),
+		Path:    q.Path,
+		Error:   q.Diagnostic,
+	})
+	return nil
+}
+
+// quarantined is whether the file pair is quarantined
+func (p *Profile) quarantined(local Syncer) bool {
+	err := datastore.GetIn(quarantineBucket, p.ID(), stateKey(p, local), &Quarantine{})
+	if err != nil && err != datastore.ErrNotFound {
+		logger.Profile(p.Name).Errorf("Error checking if %s is quarantined: %s", local.ID(), err)
+	}
+	return err == nil
+}
+
+// ProfileQuarantined returns the files quarantined in the profile, in path order
+func ProfileQuarantined(profileID string) ([]*Quarantine, error) {
+	quarantined := []*Quarantine{}
+	err := datastore.View(func(tx *datastore.Tx) error {
+		return tx.EachIn(quarantineBucket, profileID, func(key string, value []byte) error {
+			q := &Quarantine{}
+			err := json.Unmarshal(value, q)
+			if err != nil {
+				return err
+			}
+			quarantined = append(quarantined, q)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return quarantined, nil
+}
+
+// ProfileQuarantineCount returns the number of files quarantined in the profile
+func ProfileQuarantineCount(profileID string) int {
+	count := 0
+	datastore.View(func(tx *datastore.Tx) error {
+		var err error
+		count, err = tx.CountIn(quarantineBucket, profileID)
+		return err
+	})
+	return count
+}
+
+// Release lets a quarantined file pair be synced again, and syncs it.  It's
+// quarantined again if it goes on being synced back and forth
+func (p *Profile) Release(local, remote Syncer) error {
+	key := stateKey(p, local)
+	err := datastore.GetIn(quarantineBucket, p.ID(), key, &Quarantine{})
+	if err == datastore.ErrNotFound {
+		return ErrNotQuarantined
+	}
+	if err != nil {
+		return err
+	}
+	err = datastore.DeleteIn(quarantineBucket, p.ID(), key)
+	if err != nil {
+		return err
+	}
+
+	loops.Lock()
+	if pl, ok := loops.profiles[p.ID()]; ok {
+		delete(pl.writes, key)
+	}
+	loops.Unlock()
+
+	return p.Sync(local, remote)
+}
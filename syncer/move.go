@@ -0,0 +1,188 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import (
+	"sync"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/log"
+)
+
+// LogType is the log type for syncing
+const LogType = "sync"
+
+var logger = log.Module(LogType)
+
+// moveWindow is how long a delete is held waiting for a new file with the
+// same content to show up, in which case the file was moved, not deleted
+const moveWindow = 10 * time.Second
+
+var moves pendingMoves // deletes held waiting for a matching new file
+
+func init() {
+	moves = pendingMoves{
+		deletes: make(map[string][]*pendingDelete),
+	}
+}
+
+// Mover is an optional interface for Syncers which can be moved to a new
+// location without rewriting their content
+type Mover interface {
+	Move(to Syncer) error // Moves the file to the location of the non-existent to Syncer
+}
+
+// pendingDelete is a delete that hasn't been run yet, because it may be
+// one half of a move
+type pendingDelete struct {
+	target  Syncer // file to delete
+	local   Syncer // local file of the pair, for cleaning up synced state
+	remote  Syncer // remote file of the pair
+	toLocal bool   // whether or not target is the local file
+	hash    string
+	timer   *time.Timer
+}
+
+type pendingMoves struct {
+	sync.Mutex
+	deletes map[string][]*pendingDelete
+}
+
+func (m *pendingMoves) add(p *Profile, d *pendingDelete) {
+	m.Lock()
+	defer m.Unlock()
+	m.deletes[p.ID()] = append(m.deletes[p.ID()], d)
+}
+
+// take removes and returns the pending delete, false if it has already
+// been removed by someone else
+func (m *pendingMoves) take(p *Profile, d *pendingDelete) bool {
+	m.Lock()
+	defer m.Unlock()
+	deletes := m.deletes[p.ID()]
+	for i := range deletes {
+		if deletes[i] == d {
+			m.deletes[p.ID()] = append(deletes[:i], deletes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// candidates returns pending deletes on the same side and with the same size
+// as the new file
+func (m *pendingMoves) candidates(p *Profile, toLocal bool, size int64) []*pendingDelete {
+	m.Lock()
+	defer m.Unlock()
+	var result []*pendingDelete
+	for _, d := range m.deletes[p.ID()] {
+		if d.toLocal == toLocal && d.target.Size() == size {
+			result = append(result, d)
+		}
+	}
+	return result
+}
+
+// deleteOrMove holds the delete of the local (toLocal == true) or remote file for
+// the move window.  If a new file with the same content shows up in that time,
+// then the file is moved to it instead
+func (p *Profile) deleteOrMove(local, remote Syncer, toLocal bool, hash string) error {
+	target := remote
+	if toLocal {
+		target = local
+	}
+	if _, ok := target.(Mover); !ok || target.IsDir() || p.DryRun {
+		return p.removePair(local, remote, toLocal)
+	}
+
+	var err error
+	if hash == "" {
+		if !toLocal {
+			// hashing the remote file means reading all of it, which
+			// isn't worth it just to find out if it was moved
+			return p.removePair(local, remote, toLocal)
+		}
+		hash, err = p.hash(target)
+		if err != nil {
+			return err
+		}
+	}
+
+	d := &pendingDelete{
+		target:  target,
+		local:   local,
+		remote:  remote,
+		toLocal: toLocal,
+		hash:    hash,
+	}
+
+	d.timer = time.AfterFunc(moveWindow, func() {
+		if !moves.take(p, d) {
+			return
+		}
+		err := p.removePair(d.local, d.remote, d.toLocal)
+		if err != nil {
+			logger.Profile(p.Name).Errorf("Error deleting %s: %s", d.target.ID(), err)
+		}
+	})
+
+	moves.add(p, d)
+	return nil
+}
+
+// removePair deletes the local (toLocal == true) or remote file and the synced
+// state of the pair, unless the delete is held to be counted against the
+// profile's delete limits, see holdDelete
+func (p *Profile) removePair(local, remote Syncer, toLocal bool) error {
+	if !p.DryRun && p.holdDelete(local, remote, toLocal) {
+		return nil
+	}
+	if toLocal {
+		return p.removeNow(local, local)
+	}
+	return p.removeNow(local, remote)
+}
+
+// removeNow deletes target and the synced state of its pair
+func (p *Profile) removeNow(local, target Syncer) error {
+	err := <-p.delete(target)
+	if err != nil {
+		return err
+	}
+	return p.deleteState(local)
+}
+
+// moved checks if the new from file matches any recently deleted file, and if so
+// moves the matching file into place instead of writing it
+func (p *Profile) moved(from, to Syncer, toLocal bool) (bool, error) {
+	candidates := moves.candidates(p, toLocal, from.Size())
+	if len(candidates) == 0 {
+		return false, nil
+	}
+
+	hash, err := p.hash(from)
+	if err != nil {
+		return false, err
+	}
+
+	for i := range candidates {
+		if candidates[i].hash != hash {
+			continue
+		}
+		if !moves.take(p, candidates[i]) {
+			// delete already ran
+			continue
+		}
+		candidates[i].timer.Stop()
+
+		err = <-p.move(candidates[i].target, to)
+		if err != nil {
+			return false, err
+		}
+		return true, p.deleteState(candidates[i].local)
+	}
+
+	return false, nil
+}
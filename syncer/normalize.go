@@ -0,0 +1,32 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import "golang.org/x/text/unicode/norm"
+
+// NormalizeName returns the file name or path in Unicode normal form C.  Mac OS
+// stores names decomposed (NFD) while most other systems use NFC, so the same
+// name can be spelled with different bytes on each side of a profile.  Paths
+// are always compared and stored normalized
+func NormalizeName(name string) string {
+	if isASCII(name) {
+		return name
+	}
+	return norm.NFC.String(name)
+}
+
+// SameName returns whether the two names are the same once normalized
+func SameName(a, b string) bool {
+	return a == b || NormalizeName(a) == NormalizeName(b)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
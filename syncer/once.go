@@ -0,0 +1,44 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import "errors"
+
+// SyncOnce runs a single sync cycle of the whole profile and waits for the
+// changes it found to finish, then stops the profile.  It's for syncing from
+// cron rather than watching for changes, so the profile's schedule is ignored.
+// Returns what the cycle did
+func (p *Profile) SyncOnce() (Stats, error) {
+	if p.Local == nil {
+		return Stats{}, errors.New("Local sync starting point not set.")
+	}
+	if p.Remote == nil {
+		return Stats{}, errors.New("Remote sync starting point not set.")
+	}
+
+	before := stats.get(p.ID())
+	p.startQueue()
+	defer p.Stop()
+
+	p.probeClock()
+	err := p.SyncAll()
+	if err == nil && p.Hooks == (Hooks{}) {
+		// SyncAll only waits for the changes when it runs hooks
+		p.settle()
+	}
+
+	after := stats.get(p.ID())
+	return Stats{
+		FilesUploaded:   after.FilesUploaded - before.FilesUploaded,
+		BytesUploaded:   after.BytesUploaded - before.BytesUploaded,
+		FilesDownloaded: after.FilesDownloaded - before.FilesDownloaded,
+		BytesDownloaded: after.BytesDownloaded - before.BytesDownloaded,
+		Conflicts:       after.Conflicts - before.Conflicts,
+		Errors:          after.Errors - before.Errors,
+		LastSync:        after.LastSync,
+		LastError:       after.LastError,
+		Since:           before.Since,
+	}, err
+}
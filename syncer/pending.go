@@ -0,0 +1,284 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+)
+
+const pendingBucket = datastore.BucketPending
+
+// pendingEntry is a change which was noticed, but hadn't run when freehold-sync
+// stopped.  Its path is synced again when the profile next starts, before the
+// rest of the profile is scanned, and with any deletes that were seen kept, so
+// the scan doesn't undo them
+type pendingEntry struct {
+	Path          string    `json:"path"`
+	LocalDeleted  bool      `json:"localDeleted"`
+	RemoteDeleted bool      `json:"remoteDeleted"`
+	Noticed       time.Time `json:"noticed"`
+}
+
+// deletedSetter is a syncer which can be marked as deleted
+type deletedSetter interface {
+	SetDeleted(deleted bool)
+}
+
+var resumes resumeData // pending changes loaded for each profile, waiting to be synced
+
+func init() {
+	resumes = resumeData{
+		profiles: make(map[string][]*resumeSync),
+	}
+}
+
+type resumeData struct {
+	sync.Mutex
+	profiles map[string][]*resumeSync
+}
+
+type resumeSync struct {
+	path          string
+	local, remote Syncer
+}
+
+func (rd *resumeData) set(profileID string, syncs []*resumeSync) {
+	rd.Lock()
+	defer rd.Unlock()
+	if len(syncs) == 0 {
+		delete(rd.profiles, profileID)
+		return
+	}
+	rd.profiles[profileID] = syncs
+}
+
+func (rd *resumeData) take(profileID string) []*resumeSync {
+	rd.Lock()
+	defer rd.Unlock()
+	syncs := rd.profiles[profileID]
+	delete(rd.profiles, profileID)
+	return syncs
+}
+
+func relPath(p *Profile, s Syncer) string {
+	return strings.Trim(filepath.ToSlash(s.Path(p)), "/")
+}
+
+// pendingEntries are the entries which sync the change again once the profile
+// starts.  A move is synced as the path it was moved from, which is deleted on
+// the side it was moved on, and the path it was moved to
+func (c *changeItem) pendingEntries() []*pendingEntry {
+	toLocal := c.profile.side(c.to) == "local"
+	now := time.Now()
+
+	if c.changeType == changeTypeMove {
+		return []*pendingEntry{
+			{Path: relPath(c.profile, c.from), LocalDeleted: !toLocal, RemoteDeleted: toLocal, Noticed: now},
+			{Path: relPath(c.profile, c.to), Noticed: now},
+		}
+	}
+
+	entry := &pendingEntry{
+		Path:    relPath(c.profile, c.to),
+		Noticed: now,
+	}
+	if toLocal {
+		entry.RemoteDeleted = c.from.Deleted()
+	} else {
+		entry.LocalDeleted = c.from.Deleted()
+	}
+	return []*pendingEntry{entry}
+}
+
+// keep stores the change as it's queued, so it isn't lost if freehold-sync
+// stops or crashes before it has run
+func (c *changeItem) keep() {
+	err := c.profile.putPending(c.pendingEntries())
+	if err != nil {
+		logger.Profile(c.profile.Name).Errorf("Error keeping pending change to %s: %s", c.to.ID(), err)
+	}
+}
+
+// forget removes the stored change once it has run, unless it was canceled
+// because freehold-sync is shutting down
+func (q *changeQueue) forget(c *changeItem) {
+	q.Lock()
+	if q.draining {
+		select {
+		case <-c.canceled:
+			q.Unlock()
+			return
+		default:
+		}
+	}
+	paths := q.unqueuedPaths(c)
+	q.Unlock()
+
+	c.profile.removePending(paths)
+}
+
+// unqueuedPaths are the paths of the change's entries which no other queued
+// change shares, so they can be removed once the change is done.  The queue
+// must be locked
+func (q *changeQueue) unqueuedPaths(c *changeItem) []string {
+	shared := func(path string) bool {
+		for _, o := range q.pending {
+			if o != c && o.hasEntry(path) {
+				return true
+			}
+		}
+		for _, o := range q.running {
+			if o != c && o.hasEntry(path) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var paths []string
+	for _, entry := range c.pendingEntries() {
+		if !shared(entry.Path) {
+			paths = append(paths, entry.Path)
+		}
+	}
+	return paths
+}
+
+// hasEntry is whether one of the change's entries is for the path
+func (c *changeItem) hasEntry(path string) bool {
+	if c.path == path {
+		return true
+	}
+	return c.changeType == changeTypeMove && relPath(c.profile, c.from) == path
+}
+
+func (p *Profile) removePending(paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+	err := datastore.Update(func(tx *datastore.Tx) error {
+		for i := range paths {
+			err := tx.DeleteIn(pendingBucket, p.ID(), paths[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Profile(p.Name).Errorf("Error removing pending changes of profile %s: %s", p.Name, err)
+	}
+}
+
+func (p *Profile) putPending(entries []*pendingEntry) error {
+	return datastore.Update(func(tx *datastore.Tx) error {
+		for i := range entries {
+			err := tx.PutIn(pendingBucket, p.ID(), entries[i].Path, entries[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// KeepChange keeps a change to the syncer which was noticed, but not yet synced,
+// so it's synced once the profile starts again
+func (p *Profile) KeepChange(s Syncer) error {
+	entry := &pendingEntry{
+		Path:    relPath(p, s),
+		Noticed: time.Now(),
+	}
+	if p.side(s) == "local" {
+		entry.LocalDeleted = s.Deleted()
+	} else {
+		entry.RemoteDeleted = s.Deleted()
+	}
+	return p.putPending([]*pendingEntry{entry})
+}
+
+// loadPending reads the changes kept from when freehold-sync last stopped, to be
+// synced at the start of the profile's next sync cycle
+func (p *Profile) loadPending(files func(relPath string) (local, remote Syncer, err error)) error {
+	var entries []*pendingEntry
+	err := datastore.View(func(tx *datastore.Tx) error {
+		return tx.EachIn(pendingBucket, p.ID(), func(key string, value []byte) error {
+			entry := &pendingEntry{}
+			err := json.Unmarshal(value, entry)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	var syncs []*resumeSync
+	for _, entry := range entries {
+		local, remote, err := files(entry.Path)
+		if err != nil {
+			logger.Profile(p.Name).Path(entry.Path).Errorf("Error loading pending change to %s in profile %s: %s",
+				entry.Path, p.Name, err)
+			continue
+		}
+		if entry.LocalDeleted && !local.Exists() {
+			if d, ok := local.(deletedSetter); ok {
+				d.SetDeleted(true)
+			}
+		}
+		if entry.RemoteDeleted && !remote.Exists() {
+			if d, ok := remote.(deletedSetter); ok {
+				d.SetDeleted(true)
+			}
+		}
+		syncs = append(syncs, &resumeSync{
+			path:   entry.Path,
+			local:  local,
+			remote: remote,
+		})
+	}
+	resumes.set(p.ID(), syncs)
+	return nil
+}
+
+// syncPending syncs the changes kept from when freehold-sync last stopped, and
+// waits for them to finish.  They wait for the next cycle if the profile is
+// holding its changes
+func (p *Profile) syncPending() {
+	q, ok := queues.get(p.ID())
+	if !ok || q.held() {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, s := range resumes.take(p.ID()) {
+		wg.Add(1)
+		go func(s *resumeSync) {
+			defer wg.Done()
+			err := p.Sync(s.local, s.remote)
+			if err == ErrCanceled {
+				// stopped, it's loaded again when the profile next starts
+				return
+			}
+			if err != nil {
+				logger.Profile(p.Name).Path(s.path).Err(err).Warnf("Error syncing pending change to %s in profile %s",
+					s.path, p.Name)
+			}
+			err = datastore.DeleteIn(pendingBucket, p.ID(), s.path)
+			if err != nil {
+				logger.Profile(p.Name).Errorf("Error removing pending change to %s: %s", s.path, err)
+			}
+		}(s)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,165 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var plans planData // planned changes for profiles running in dry run mode
+
+func init() {
+	plans = planData{
+		profiles: make(map[string]map[string]*PlanItem),
+	}
+}
+
+// Planned actions
+const (
+	ActionCreate   = "create"
+	ActionUpdate   = "update"
+	ActionDelete   = "delete"
+	ActionConflict = "conflict"
+	ActionMove     = "move"
+)
+
+// PlanItem is a change that would have been made to a file if
+// the profile wasn't running in dry run mode
+type PlanItem struct {
+	Action string    `json:"action"`
+	Path   string    `json:"path"`
+	Side   string    `json:"side"` // local or remote
+	IsDir  bool      `json:"isDir"`
+	From   string    `json:"from,omitempty"`
+	When   time.Time `json:"when"`
+}
+
+type planData struct {
+	sync.RWMutex
+	profiles map[string]map[string]*PlanItem
+}
+
+func (pd *planData) add(p *Profile, item *PlanItem) {
+	pd.Lock()
+	defer pd.Unlock()
+	if _, ok := pd.profiles[p.ID()]; !ok {
+		pd.profiles[p.ID()] = make(map[string]*PlanItem)
+	}
+	// only the latest planned change for a path is kept
+	pd.profiles[p.ID()][item.Side+":"+item.Path] = item
+}
+
+func (pd *planData) clear(profileID string) {
+	pd.Lock()
+	defer pd.Unlock()
+	delete(pd.profiles, profileID)
+}
+
+func (pd *planData) get(profileID string) []*PlanItem {
+	pd.RLock()
+	defer pd.RUnlock()
+	items := make([]*PlanItem, 0, len(pd.profiles[profileID]))
+	for _, item := range pd.profiles[profileID] {
+		items = append(items, item)
+	}
+	sort.Sort(planSort(items))
+	return items
+}
+
+type planSort []*PlanItem
+
+func (s planSort) Len() int           { return len(s) }
+func (s planSort) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s planSort) Less(i, j int) bool { return s[i].Path < s[j].Path }
+
+// ProfilePlan returns the changes the profile would have made if it wasn't
+// running in dry run mode
+func ProfilePlan(profileID string) []*PlanItem {
+	return plans.get(profileID)
+}
+
+// plan records the change instead of running it.  A folder that would be
+// created is planned along with everything in it, which would be created too
+func (c *changeItem) plan() error {
+	item := &PlanItem{
+		Path: c.to.Path(c.profile),
+		Side: c.profile.side(c.to),
+		When: time.Now(),
+	}
+	item.Action, item.IsDir = c.action()
+	if c.changeType == changeTypeMove {
+		item.From = c.from.Path(c.profile)
+	}
+
+	plans.add(c.profile, item)
+
+	if c.changeType == changeTypeCreateDir {
+		return c.planContents(c.from, item.Side)
+	}
+	return nil
+}
+
+// planContents plans the creation of the contents of the from folder on the
+// other side
+func (c *changeItem) planContents(dir Syncer, side string) error {
+	children, err := c.profile.auditList(dir)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		relPath := child.Path(c.profile)
+		if side == "remote" {
+			relPath = filepath.ToSlash(relPath)
+		} else {
+			relPath = filepath.FromSlash(relPath)
+		}
+		plans.add(c.profile, &PlanItem{
+			Action: ActionCreate,
+			Path:   relPath,
+			Side:   side,
+			IsDir:  child.IsDir(),
+			When:   time.Now(),
+		})
+		if child.IsDir() {
+			err = c.planContents(child, side)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// action is what the change does to its file, and whether that file is a folder.
+// Must be called before the change is run, as writes to existing files are updates
+func (c *changeItem) action() (string, bool) {
+	switch c.changeType {
+	case changeTypeCreateDir:
+		return ActionCreate, true
+	case changeTypeDelete:
+		return ActionDelete, c.to.IsDir()
+	case changeTypeRename:
+		return ActionConflict, false
+	case changeTypeMove:
+		return ActionMove, false
+	case changeTypeWrite:
+		if c.to.Exists() {
+			return ActionUpdate, false
+		}
+	}
+	return ActionCreate, false
+}
+
+// side returns whether the syncer is on the local or remote side of the profile
+func (p *Profile) side(s Syncer) string {
+	if strings.HasPrefix(s.ID(), p.Local.ID()) {
+		return "local"
+	}
+	return "remote"
+}
@@ -0,0 +1,362 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var queues queueData // change queues of all started profiles
+
+func init() {
+	queues = queueData{
+		profiles: make(map[string]*changeQueue),
+	}
+}
+
+// ErrCanceled is returned for changes that were canceled before they finished
+var ErrCanceled = errors.New("Change was canceled")
+
+// QueuedChange is a change that is waiting to run, or currently running
+// on a profile
+type QueuedChange struct {
+	ID      uint64    `json:"id"`
+	Action  string    `json:"action"`
+	Path    string    `json:"path"`
+	Side    string    `json:"side"` // local or remote
+	Size    int64     `json:"size"`
+	Queued  time.Time `json:"queued"`
+	Running bool      `json:"running"`
+}
+
+type queueData struct {
+	sync.RWMutex
+	profiles map[string]*changeQueue
+}
+
+func (qd *queueData) add(profileID string, q *changeQueue) {
+	qd.Lock()
+	defer qd.Unlock()
+	qd.profiles[profileID] = q
+}
+
+func (qd *queueData) get(profileID string) (*changeQueue, bool) {
+	qd.RLock()
+	defer qd.RUnlock()
+	q, ok := qd.profiles[profileID]
+	return q, ok
+}
+
+func (qd *queueData) remove(profileID string, q *changeQueue) {
+	qd.Lock()
+	defer qd.Unlock()
+	if qd.profiles[profileID] == q {
+		delete(qd.profiles, profileID)
+	}
+}
+
+// changeQueue holds the pending changes for a profile.  Changes are run in
+// order of priority: directory changes, deletes, renames and moves first, then
+// writes from smallest to largest.  A change won't start while another change is
+// running on the same path, or any of its parents or children
+type changeQueue struct {
+	sync.Mutex
+	cond     *sync.Cond
+	pending  []*changeItem
+	running  map[uint64]*changeItem
+	nextID   uint64
+	closed   bool
+	draining bool            // no more changes are started, for shutting down
+	paused   bool            // paused by the user
+	idle     bool            // waiting for the profile's next scheduled sync
+	lowSpace map[string]bool // sides writes are held on until there's enough free space
+	stopped  chan struct{}   // closed when the queue is closed
+}
+
+func newChangeQueue() *changeQueue {
+	q := &changeQueue{
+		running:  make(map[uint64]*changeItem),
+		lowSpace: make(map[string]bool),
+		stopped:  make(chan struct{}),
+	}
+	q.cond = sync.NewCond(q)
+	return q
+}
+
+// overlaps is whether or not one path is the same as, or contains the other
+func overlaps(a, b string) bool {
+	return a == b || a == "" || b == "" || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+// before is whether change a should run before change b
+func before(a, b *changeItem) bool {
+	aWrite := a.changeType == changeTypeWrite
+	bWrite := b.changeType == changeTypeWrite
+	if aWrite != bWrite {
+		return !aWrite
+	}
+	if aWrite && a.size != b.size {
+		return a.size < b.size
+	}
+	return a.id < b.id
+}
+
+func (q *changeQueue) push(c *changeItem) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		c.done <- ErrCanceled
+		return
+	}
+
+	q.nextID++
+	c.id = q.nextID
+	c.queued = time.Now()
+	c.canceled = make(chan struct{})
+	c.path = strings.Trim(filepath.ToSlash(c.to.Path(c.profile)), "/")
+	if c.changeType == changeTypeWrite {
+		c.size = c.from.Size()
+	}
+
+	q.pending = append(q.pending, c)
+	q.cond.Broadcast()
+}
+
+// pop waits for the next change which can be run.  Returns false if the
+// queue has been closed
+func (q *changeQueue) pop() (*changeItem, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	for {
+		if q.closed || q.draining {
+			return nil, false
+		}
+		if q.paused || q.idle {
+			q.cond.Wait()
+			continue
+		}
+
+		next := -1
+		for i := range q.pending {
+			if q.blocked(q.pending[i]) || q.spaceHeld(q.pending[i]) {
+				continue
+			}
+			if next == -1 || before(q.pending[i], q.pending[next]) {
+				next = i
+			}
+		}
+
+		if next != -1 {
+			c := q.pending[next]
+			q.pending = append(q.pending[:next], q.pending[next+1:]...)
+			q.running[c.id] = c
+			return c, true
+		}
+		q.cond.Wait()
+	}
+}
+
+// blocked is whether or not a running change overlaps the passed in change
+func (q *changeQueue) blocked(c *changeItem) bool {
+	for _, r := range q.running {
+		if overlaps(r.path, c.path) {
+			return true
+		}
+	}
+	return false
+}
+
+// finish marks a running change as finished
+func (q *changeQueue) finish(c *changeItem) {
+	q.Lock()
+	defer q.Unlock()
+	delete(q.running, c.id)
+	q.cond.Broadcast()
+}
+
+// cancel removes a pending change from the queue, or interrupts a running one
+func (q *changeQueue) cancel(id uint64) error {
+	q.Lock()
+	defer q.Unlock()
+
+	if c, ok := q.running[id]; ok {
+		c.cancel()
+		return nil
+	}
+
+	for i := range q.pending {
+		if q.pending[i].id == id {
+			c := q.pending[i]
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			c.profile.removePending(q.unqueuedPaths(c))
+			c.done <- ErrCanceled
+			return nil
+		}
+	}
+	return errors.New("Change not found in the queue")
+}
+
+// pause holds or releases pending changes
+func (q *changeQueue) pause(paused bool) {
+	q.Lock()
+	defer q.Unlock()
+	q.paused = paused
+	q.cond.Broadcast()
+}
+
+func (q *changeQueue) isPaused() bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.paused
+}
+
+// setIdle holds or releases pending changes outside of the profile's schedule
+func (q *changeQueue) setIdle(idle bool) {
+	q.Lock()
+	defer q.Unlock()
+	q.idle = idle
+	q.cond.Broadcast()
+}
+
+func (q *changeQueue) isIdle() bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.idle
+}
+
+// held is whether or not changes are currently being held
+func (q *changeQueue) held() bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.paused || q.idle
+}
+
+// len is the number of pending and running changes
+func (q *changeQueue) len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.pending) + len(q.running)
+}
+
+// close cancels all pending changes and stops any more from being run
+func (q *changeQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	close(q.stopped)
+	for i := range q.pending {
+		q.pending[i].done <- ErrCanceled
+	}
+	q.pending = nil
+	q.cond.Broadcast()
+}
+
+func (q *changeQueue) list() []*QueuedChange {
+	q.Lock()
+	defer q.Unlock()
+
+	pending := make([]*changeItem, len(q.pending))
+	copy(pending, q.pending)
+	sort.Sort(changeSort(pending))
+
+	list := make([]*QueuedChange, 0, len(q.running)+len(pending))
+	for _, c := range q.running {
+		list = append(list, c.queuedChange(true))
+	}
+	for i := range pending {
+		list = append(list, pending[i].queuedChange(false))
+	}
+	return list
+}
+
+type changeSort []*changeItem
+
+func (s changeSort) Len() int           { return len(s) }
+func (s changeSort) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s changeSort) Less(i, j int) bool { return before(s[i], s[j]) }
+
+func (c *changeItem) queuedChange(running bool) *QueuedChange {
+	qc := &QueuedChange{
+		ID:      c.id,
+		Path:    c.path,
+		Side:    c.profile.side(c.to),
+		Size:    c.size,
+		Queued:  c.queued,
+		Running: running,
+	}
+
+	switch c.changeType {
+	case changeTypeCreateDir:
+		qc.Action = ActionCreate
+	case changeTypeDelete:
+		qc.Action = ActionDelete
+	case changeTypeRename:
+		qc.Action = ActionConflict
+	case changeTypeMove:
+		qc.Action = ActionMove
+	case changeTypeWrite:
+		qc.Action = ActionCreate
+		if c.to.Exists() {
+			qc.Action = ActionUpdate
+		}
+	}
+	return qc
+}
+
+// cancel interrupts the change's transfer if it's running
+func (c *changeItem) cancel() {
+	select {
+	case <-c.canceled:
+	default:
+		close(c.canceled)
+	}
+}
+
+// cancelReader stops reading once its change has been canceled
+type cancelReader struct {
+	io.ReadCloser
+	canceled chan struct{}
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.canceled:
+		return 0, ErrCanceled
+	default:
+		return r.ReadCloser.Read(p)
+	}
+}
+
+// ProfileQueue returns the changes waiting to run, and running
+// on the passed in profile, running changes first
+func ProfileQueue(profileID string) ([]*QueuedChange, error) {
+	q, ok := queues.get(profileID)
+	if !ok {
+		return nil, errors.New("Profile is not running")
+	}
+	return q.list(), nil
+}
+
+// CancelChange cancels a queued change on the passed in profile. If the
+// change is already running, its transfer is interrupted
+func CancelChange(profileID string, changeID uint64) error {
+	q, ok := queues.get(profileID)
+	if !ok {
+		return errors.New("Profile is not running")
+	}
+	return q.cancel(changeID)
+}
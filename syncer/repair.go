@@ -0,0 +1,57 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+// Repair brings a pair of files an audit found out of sync back into sync.
+// Files that are missing or changed are synced as usual.  Files whose content
+// differs even though their size and modified time match, such as after
+// corruption, are compared against the hash recorded at their last sync to
+// find the good copy, falling back to the profile's conflict resolution
+func (p *Profile) Repair(local, remote Syncer) error {
+	if !local.Exists() || !remote.Exists() || local.IsDir() || remote.IsDir() {
+		return p.Sync(local, remote)
+	}
+
+	state, err := p.getState(local)
+	if err != nil {
+		return err
+	}
+
+	metaMatch := p.sameTime(p.remoteModified(remote), local.Modified()) && remote.Size() == local.Size()
+	if !metaMatch && (state == nil || state.localChanged(p, local) || state.remoteChanged(p, remote)) {
+		// a normal change, which sync can handle
+		return p.Sync(local, remote)
+	}
+
+	same, lHash, err := p.freshContent(local, remote)
+	if err != nil {
+		return err
+	}
+	if same {
+		return p.setState(local, remote, lHash)
+	}
+
+	if state != nil && state.Hash != "" {
+		if lHash == state.Hash {
+			if !p.canWrite(false) {
+				return nil
+			}
+			return p.transfer(local, remote, false, ReasonRepair)
+		}
+
+		rHash, err := p.hash(remote)
+		if err != nil {
+			return err
+		}
+		if rHash == state.Hash {
+			if !p.canWrite(true) {
+				return nil
+			}
+			return p.transfer(local, remote, true, ReasonRepair)
+		}
+	}
+
+	return p.resolveConflict(local, remote, false)
+}
@@ -0,0 +1,97 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import (
+	"time"
+)
+
+// settleInterval is how often a scheduled profile is checked to see if it's
+// finished syncing
+const settleInterval = 10 * time.Second
+
+// runSchedule syncs the profile each time its schedule fires, and leaves
+// it idle in between
+func (p *Profile) runSchedule(q *changeQueue) {
+	for {
+		next := p.Schedule.Next(time.Now())
+		if next.IsZero() {
+			logger.Profile(p.Name).Warnf("Schedule %s for profile %s will never run", p.Schedule, p.Name)
+			return
+		}
+
+		select {
+		case <-q.stopped:
+			return
+		case <-time.After(next.Sub(time.Now())):
+		}
+
+		if q.isPaused() {
+			continue
+		}
+
+		q.setIdle(false)
+		go func() {
+			err := p.SyncAll()
+			if err != nil {
+				logger.Profile(p.Name).Errorf("Error running scheduled sync for profile %s: %s", p.Name, err)
+			}
+		}()
+
+		if !p.waitForWindow(q) {
+			return
+		}
+
+		q.setIdle(true)
+		err := p.Local.StopMonitor(p)
+		if err == nil {
+			err = p.Remote.StopMonitor(p)
+		}
+		if err != nil {
+			logger.Profile(p.Name).Errorf("Error stopping scheduled profile %s: %s", p.Name, err)
+		}
+	}
+}
+
+// waitForWindow waits for the profile's schedule window to close, or if
+// there is no window, for the profile to finish syncing.  Returns false if the
+// profile was stopped while waiting
+func (p *Profile) waitForWindow(q *changeQueue) bool {
+	if p.ScheduleWindow > 0 {
+		select {
+		case <-q.stopped:
+			return false
+		case <-time.After(p.ScheduleWindow):
+			return true
+		}
+	}
+
+	// changes trickle in as folders are scanned, so wait until nothing
+	// has been syncing for two checks in a row
+	settled := 0
+	for settled < 2 {
+		select {
+		case <-q.stopped:
+			return false
+		case <-time.After(settleInterval):
+		}
+		if ProfileSyncCount(p.ID()) == 0 && q.len() == 0 {
+			settled++
+		} else {
+			settled = 0
+		}
+	}
+	return true
+}
+
+// ProfileIdle returns whether or not the profile is waiting for its next
+// scheduled sync
+func ProfileIdle(profileID string) bool {
+	q, ok := queues.get(profileID)
+	if !ok {
+		return false
+	}
+	return q.isIdle()
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import "time"
+
+const (
+	shutdownCheck = 100 * time.Millisecond // how often running changes are checked while shutting down
+	cancelWait    = 5 * time.Second        // how long canceled changes are given to stop
+)
+
+// Shutdown stops every running profile so freehold-sync can exit.  No more
+// changes are started, and the running ones have until timeout to finish before
+// they're canceled.  Changes which didn't finish are kept, and synced when
+// their profile next starts
+func Shutdown(timeout time.Duration) {
+	queues.Lock()
+	all := make([]*changeQueue, 0, len(queues.profiles))
+	for id, q := range queues.profiles {
+		all = append(all, q)
+		delete(queues.profiles, id)
+	}
+	queues.Unlock()
+
+	running := 0
+	for _, q := range all {
+		running += q.drain()
+	}
+	if running > 0 {
+		logger.Infof("Waiting up to %s for %d running changes to finish", timeout, running)
+	}
+	deadline := time.Now().Add(timeout)
+
+	var canceled []*changeQueue
+	for _, q := range all {
+		if !q.waitRunning(deadline) {
+			canceled = append(canceled, q)
+		}
+	}
+
+	for _, q := range all {
+		unfinished := q.unfinished()
+		for _, c := range unfinished {
+			err := c.profile.putPending(c.pendingEntries())
+			if err != nil {
+				logger.Profile(c.profile.Name).Errorf("Error keeping pending change to %s: %s", c.to.ID(), err)
+			}
+		}
+		if len(unfinished) > 0 {
+			logger.Profile(unfinished[0].profile.Name).Infof("Kept %d unfinished changes of profile %s for when it "+
+				"starts again", len(unfinished), unfinished[0].profile.Name)
+		}
+		q.close()
+	}
+
+	// canceled changes stop at their next read, and are written again from the
+	// start, or resumed, when the profile next starts
+	deadline = time.Now().Add(cancelWait)
+	for _, q := range canceled {
+		q.waitRunning(deadline)
+	}
+}
+
+// drain stops the queue from starting any more changes, and returns the number
+// still running
+func (q *changeQueue) drain() int {
+	q.Lock()
+	defer q.Unlock()
+	q.draining = true
+	q.cond.Broadcast()
+	return len(q.running)
+}
+
+// waitRunning waits for the running changes to finish, returns false if they
+// were still running at the deadline
+func (q *changeQueue) waitRunning(deadline time.Time) bool {
+	for {
+		q.Lock()
+		running := len(q.running)
+		q.Unlock()
+		if running == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(shutdownCheck)
+	}
+}
+
+// unfinished returns the pending changes, and the running ones, which are
+// canceled
+func (q *changeQueue) unfinished() []*changeItem {
+	q.Lock()
+	defer q.Unlock()
+
+	unfinished := make([]*changeItem, 0, len(q.pending)+len(q.running))
+	unfinished = append(unfinished, q.pending...)
+	for _, c := range q.running {
+		c.cancel()
+		unfinished = append(unfinished, c)
+	}
+	return unfinished
+}
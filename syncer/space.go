@@ -0,0 +1,131 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import (
+	"time"
+)
+
+// spaceCheckInterval is how often free space is checked again while a
+// profile's downloads are held
+const spaceCheckInterval = time.Minute
+
+// SpaceChecker is an optional interface for Syncers which can report how much
+// room is left on the volume, or in the quota, they are written to
+type SpaceChecker interface {
+	FreeSpace() (int64, error) // Bytes that can still be written next to the file
+}
+
+// hasSpace returns whether or not there is enough free space to run the change.
+// Downloads must leave the profile's minimum free space on the local volume,
+// uploads only need to fit in what's left of the remote quota
+func (c *changeItem) hasSpace() bool {
+	if c.changeType != changeTypeWrite {
+		return true
+	}
+	sc, ok := c.to.(SpaceChecker)
+	if !ok {
+		return true
+	}
+
+	var floor int64
+	need := c.size
+	if c.profile.side(c.to) == "local" {
+		if c.profile.MinFreeSpace <= 0 {
+			return true
+		}
+		// downloads are staged next to the existing file, so both take up room until the staged file replaces it
+		floor = c.profile.MinFreeSpace
+	} else if c.to.Exists() {
+		// the existing remote file is removed before the new one is uploaded
+		need -= c.to.Size()
+	}
+	if need <= 0 && floor == 0 {
+		return true
+	}
+
+	free, err := sc.FreeSpace()
+	if err != nil {
+		// not worth holding every transfer over, let the write fail on its own if it must
+		logger.Profile(c.profile.Name).Errorf("Error checking the free space for %s: %s", c.to.ID(), err)
+		return true
+	}
+	return free-need >= floor
+}
+
+// holdForSpace puts the running change back in the queue, and holds all writes
+// to the same side until there is enough free space to run it
+func (q *changeQueue) holdForSpace(c *changeItem) {
+	q.Lock()
+	defer q.Unlock()
+
+	delete(q.running, c.id)
+	if q.closed {
+		c.done <- ErrCanceled
+		return
+	}
+	q.pending = append(q.pending, c)
+	q.cond.Broadcast()
+
+	side := c.profile.side(c.to)
+	if q.lowSpace[side] {
+		return
+	}
+	q.lowSpace[side] = true
+	if side == "local" {
+		logger.Profile(c.profile.Name).Warnf("Profile %s is low on local disk space.  Downloads are paused until more space is free.",
+			c.profile.Name)
+	} else {
+		logger.Profile(c.profile.Name).Warnf("Profile %s's remote location is nearly full.  Uploads are paused until more of the "+
+			"quota is free.", c.profile.Name)
+	}
+
+	go q.waitForSpace(c, side)
+}
+
+// waitForSpace releases the held writes once there is room for the change
+func (q *changeQueue) waitForSpace(c *changeItem, side string) {
+	ticker := time.NewTicker(spaceCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.stopped:
+			return
+		case <-ticker.C:
+			if !c.hasSpace() {
+				continue
+			}
+			q.Lock()
+			delete(q.lowSpace, side)
+			q.cond.Broadcast()
+			q.Unlock()
+			logger.Profile(c.profile.Name).Infof("Profile %s has enough free %s space again, resuming transfers.", c.profile.Name, side)
+			return
+		}
+	}
+}
+
+// spaceHeld is whether or not the change is a write being held until
+// there's more free space on its side
+func (q *changeQueue) spaceHeld(c *changeItem) bool {
+	return c.changeType == changeTypeWrite && q.lowSpace[c.profile.side(c.to)]
+}
+
+func (q *changeQueue) isLowSpace(side string) bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.lowSpace[side]
+}
+
+// ProfileLowSpace returns whether or not the profile's writes to the passed in
+// side ("local" or "remote") are held because there isn't enough free space for them
+func ProfileLowSpace(profileID, side string) bool {
+	q, ok := queues.get(profileID)
+	if !ok {
+		return false
+	}
+	return q.isLowSpace(side)
+}
@@ -0,0 +1,155 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+)
+
+const stateBucket = datastore.BucketState
+
+// fileState is the state of a local and remote file pair the last time
+// they were successfully synced.  Comparing the current files against it
+// tells us which side actually changed, rather than guessing from timestamps
+type fileState struct {
+	Size           int64     `json:"size"`
+	LocalModified  time.Time `json:"localModified"`
+	RemoteModified time.Time `json:"remoteModified"`
+	Hash           string    `json:"hash,omitempty"`
+	RemoteStored   int64     `json:"remoteStored,omitempty"` // stored size of the remote file, if it's padded
+}
+
+// stateKey is the key of the file pair in the profile's state bucket
+func stateKey(p *Profile, local Syncer) string {
+	return filepath.ToSlash(local.Path(p))
+}
+
+// getState returns the last synced state of the file pair, nil if the pair
+// has never been synced
+func (p *Profile) getState(local Syncer) (*fileState, error) {
+	state := &fileState{}
+	err := datastore.GetIn(stateBucket, p.ID(), stateKey(p, local), state)
+	if err == datastore.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// setState records the current state of the file pair as synced, hash
+// is the content hash of the pair if it is known
+func (p *Profile) setState(local, remote Syncer, hash string) error {
+	if p.DryRun {
+		return nil
+	}
+	return datastore.Update(func(tx *datastore.Tx) error {
+		state := &fileState{
+			Size:           local.Size(),
+			LocalModified:  local.Modified(),
+			RemoteModified: remote.Modified(),
+			Hash:           hash,
+		}
+		if ss, ok := remote.(SealedSizer); ok {
+			state.RemoteStored = ss.StoredSize()
+		}
+		err := tx.PutIn(stateBucket, p.ID(), stateKey(p, local), state)
+		if err != nil {
+			return err
+		}
+		// the pair is in sync, so it's no longer in conflict if it was
+		return p.clearConflict(tx, local)
+	})
+}
+
+// deleteState removes the synced state of the file pair
+func (p *Profile) deleteState(local Syncer) error {
+	if p.DryRun {
+		return nil
+	}
+	return datastore.Update(func(tx *datastore.Tx) error {
+		err := tx.DeleteIn(stateBucket, p.ID(), stateKey(p, local))
+		if err != nil {
+			return err
+		}
+		return p.clearConflict(tx, local)
+	})
+}
+
+// Unchanged returns whether the local file is the same as when it was last
+// synced, so there's no need to compare it with its remote file again when the
+// profile starts.  Changes to the remote file are found by the remote side
+func (p *Profile) Unchanged(local Syncer) bool {
+	if local.IsDir() || !local.Exists() {
+		return false
+	}
+	state, err := p.getState(local)
+	if err != nil || state == nil {
+		return false
+	}
+	return !state.localChanged(p, local)
+}
+
+// stateLost returns whether the pair's synced state may have been lost when the
+// datastore was rebuilt after being found corrupt, because both files are older
+// than the rebuild.  There's no telling which side of such a pair changed
+func (p *Profile) stateLost(local, remote Syncer) bool {
+	rebuilt := datastore.Rebuilt(p.ID())
+	return !rebuilt.IsZero() && local.Modified().Before(rebuilt) && p.remoteModified(remote).Before(rebuilt)
+}
+
+func (s *fileState) localChanged(p *Profile, local Syncer) bool {
+	return s.Size != local.Size() || !p.sameTime(s.LocalModified, local.Modified())
+}
+
+func (s *fileState) remoteChanged(p *Profile, remote Syncer) bool {
+	return s.Size != remote.Size() || !p.sameTime(s.RemoteModified, remote.Modified())
+}
+
+// sealedSize passes the size of the pair on to a remote file with a padded
+// stored size, if the remote file hasn't changed since it was synced
+func (s *fileState) sealedSize(remote Syncer) {
+	ss, ok := remote.(SealedSizer)
+	if !ok || s == nil || s.RemoteStored == 0 {
+		return
+	}
+	if ss.StoredSize() == s.RemoteStored && s.RemoteModified.Equal(remote.Modified()) {
+		ss.SetSize(s.Size)
+	}
+}
+
+// hash is the content hash of the pair when it was last synced, if known
+func (s *fileState) hash() string {
+	if s == nil {
+		return ""
+	}
+	return s.Hash
+}
+
+// SyncedSize returns the number of files in the profile, and their total size
+// in bytes, as of their last sync
+func SyncedSize(profileID string) (int, int64, error) {
+	files := 0
+	var size int64
+
+	err := datastore.View(func(tx *datastore.Tx) error {
+		return tx.EachIn(stateBucket, profileID, func(key string, value []byte) error {
+			state := &fileState{}
+			err := json.Unmarshal(value, state)
+			if err != nil {
+				return err
+			}
+			files++
+			size += state.Size
+			return nil
+		})
+	})
+	return files, size, err
+}
@@ -0,0 +1,144 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import (
+	"sync"
+	"time"
+)
+
+var stats statsData
+
+func init() {
+	stats = statsData{
+		profiles: make(map[string]*Stats),
+		since:    time.Now(),
+	}
+}
+
+// Stats are counts of what a profile has done since freehold-sync started.
+// Uploads are files written to the remote side, and downloads files written
+// to the local side.  Bytes downloaded include remote files read to hash them
+type Stats struct {
+	FilesUploaded   int64
+	BytesUploaded   int64
+	FilesDownloaded int64
+	BytesDownloaded int64
+	Conflicts       int64     // files changed on both sides
+	Errors          int64     // changes which failed
+	LastSync        time.Time // when a change last finished without an error
+	LastError       time.Time
+	Queued          int // pending and running changes
+	Since           time.Time
+}
+
+// add adds the counts of other to s, keeping the latest of their times
+func (s *Stats) add(other *Stats) {
+	s.FilesUploaded += other.FilesUploaded
+	s.BytesUploaded += other.BytesUploaded
+	s.FilesDownloaded += other.FilesDownloaded
+	s.BytesDownloaded += other.BytesDownloaded
+	s.Conflicts += other.Conflicts
+	s.Errors += other.Errors
+	s.Queued += other.Queued
+	if other.LastSync.After(s.LastSync) {
+		s.LastSync = other.LastSync
+	}
+	if other.LastError.After(s.LastError) {
+		s.LastError = other.LastError
+	}
+}
+
+type statsData struct {
+	sync.Mutex
+	profiles map[string]*Stats
+	since    time.Time
+}
+
+// profile returns the stats of the profile, adding them if they don't exist
+// yet.  Must be called with the lock held
+func (sd *statsData) profile(profileID string) *Stats {
+	s, ok := sd.profiles[profileID]
+	if !ok {
+		s = &Stats{}
+		sd.profiles[profileID] = s
+	}
+	return s
+}
+
+// change counts the finished change
+func (sd *statsData) change(c *changeItem, err error) {
+	if err == ErrCanceled {
+		return
+	}
+	side := c.profile.side(c.to)
+
+	sd.Lock()
+	defer sd.Unlock()
+	s := sd.profile(c.profile.ID())
+	if err != nil {
+		s.Errors++
+		s.LastError = time.Now()
+		return
+	}
+	s.LastSync = time.Now()
+	if c.changeType != changeTypeWrite {
+		return
+	}
+	if side == "remote" {
+		s.FilesUploaded++
+		s.BytesUploaded += c.size
+	} else {
+		s.FilesDownloaded++
+		s.BytesDownloaded += c.size
+	}
+}
+
+// downloaded counts bytes read from the remote side which weren't written
+// locally, such as remote files read to hash them
+func (sd *statsData) downloaded(profileID string, n int64) {
+	sd.Lock()
+	defer sd.Unlock()
+	sd.profile(profileID).BytesDownloaded += n
+}
+
+func (sd *statsData) conflict(profileID string) {
+	sd.Lock()
+	defer sd.Unlock()
+	sd.profile(profileID).Conflicts++
+}
+
+func (sd *statsData) get(profileID string) Stats {
+	sd.Lock()
+	defer sd.Unlock()
+	s := Stats{}
+	if found, ok := sd.profiles[profileID]; ok {
+		s = *found
+	}
+	s.Since = sd.since
+	return s
+}
+
+// ProfileStats returns the stats of the passed in profile, along with
+// its current number of queued changes
+func ProfileStats(profileID string) Stats {
+	s := stats.get(profileID)
+	if q, ok := queues.get(profileID); ok {
+		s.Queued = q.len()
+	}
+	return s
+}
+
+// TotalStats returns the stats of the passed in profiles added together
+func TotalStats(profileIDs []string) Stats {
+	total := Stats{
+		Since: stats.since,
+	}
+	for i := range profileIDs {
+		s := ProfileStats(profileIDs[i])
+		total.add(&s)
+	}
+	return total
+}
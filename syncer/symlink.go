@@ -0,0 +1,49 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+// Symlinks determines how symbolic links in the local folder are handled
+//	SymlinksSkip: Symbolic links are ignored
+//	SymlinksFollow: The file or folder the link points to is synced as if it
+//		were in the link's place.  Links to one of their own parent folders are skipped
+//	SymlinksError: Symbolic links are not synced, and are logged as errors
+const (
+	SymlinksSkip = iota
+	SymlinksFollow
+	SymlinksError
+)
+
+// Linker is an optional interface for Syncers which can be symbolic links
+type Linker interface {
+	IsSymlink() bool // Whether the file is a symbolic link
+	LinkLoops() bool // Whether the link points to one of its own parent folders
+}
+
+// skipLink returns whether the file is a symbolic link that shouldn't be
+// synced under the profile's symlink policy.  If report is set, links which
+// are errors under the policy are logged
+func (p *Profile) skipLink(s Syncer, report bool) bool {
+	l, ok := s.(Linker)
+	if !ok || !l.IsSymlink() {
+		return false
+	}
+
+	switch p.Symlinks {
+	case SymlinksFollow:
+		if l.LinkLoops() {
+			if report {
+				logger.Profile(p.Name).Warnf("Skipping symbolic link %s in profile %s, it points to one of its own parent folders",
+					s.ID(), p.Name)
+			}
+			return true
+		}
+		return false
+	case SymlinksError:
+		if report {
+			logger.Profile(p.Name).Warnf("%s in profile %s is a symbolic link, which this profile doesn't sync", s.ID(), p.Name)
+		}
+	}
+	return true
+}
@@ -6,20 +6,22 @@ package syncer
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"os"
 	"regexp"
 	"sync"
 	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/delta"
+	"bitbucket.org/tshannon/freehold-sync/throttle"
 )
 
 var syncing syncingData // tracks which profiles are currently syncing
 
-//right now changes are happening single threaded. In order to make multiple changes concurrently
-// we'll need to build a dependency graph; i.e. you can't run deletes on a directory you are write a file to, etc
-// might be more trouble than it's worth
-// or maybe a simple:
-// 	if file isn't currently syncing, and none of files parents are currently syncing
-// 	then sync immediately?
+// Changes are run concurrently by each profile's workers. To keep them from stepping on
+// each other, i.e. deleting a directory that a file is being written to, a change
+// won't run while another change is running on the same path, or any of its parents or children
 
 func init() {
 	syncing = syncingData{
@@ -31,19 +33,46 @@ func init() {
 //	DirectionBoth: Sync all files both ways
 //	DirectionRemoteOnly: Only sync files up to the remote location, but not down to local
 //	DirectionLocalOnly: Only sync files to the local location, but not up to the remote
+//	DirectionMirrorRemote: Make the remote location an exact copy of the local location,
+//		undoing any changes made on the remote side
+//	DirectionMirrorLocal: Make the local location an exact copy of the remote location,
+//		undoing any changes made on the local side
+//	DirectionBackup: Sync files up to the remote location, but never delete anything from it
+//		(contribute)
 const (
 	DirectionBoth = iota
 	DirectionRemoteOnly
 	DirectionLocalOnly
+	DirectionMirrorRemote
+	DirectionMirrorLocal
+	DirectionBackup
 )
 
 // ConRes determines the method for Conflict Resolution
 // When two files are found to be in conflict (modified within
 // a set period of each other), this method is used to resolve it
-// Either Overwrite the older file, or Rename the older file
+//	ConResKeepNewest: Overwrite the older file with the newer one
+//	ConResKeepBoth: Rename the older file, then copy in the newer one
+//	ConResKeepLocal: The local file always overwrites the remote one
+//	ConResKeepRemote: The remote file always overwrites the local one
+//	ConResAsk: Leave both files alone until someone chooses which to keep, see Resolve
+const (
+	ConResKeepNewest = iota
+	ConResKeepBoth
+	ConResKeepLocal
+	ConResKeepRemote
+	ConResAsk
+)
+
+// LocalMonitor determines how the local folder is watched for changes
+//	LocalMonitorAuto: Filesystem events, unless the folder is on a network or
+//		FUSE mount where they aren't reliable, which is scanned instead
+//	LocalMonitorEvents: Filesystem events
+//	LocalMonitorScan: The folder is scanned for changes on an interval
 const (
-	ConResOverwrite = iota
-	ConResRename
+	LocalMonitorAuto = iota
+	LocalMonitorEvents
+	LocalMonitorScan
 )
 
 const (
@@ -51,6 +80,7 @@ const (
 	changeTypeDelete
 	changeTypeRename
 	changeTypeCreateDir
+	changeTypeMove
 )
 
 // Syncer is used for comparing two files local or remote
@@ -64,15 +94,102 @@ type Syncer interface {
 	Exists() bool                                               // Whether or not the file exists
 	Deleted() bool                                              // If the file doesn't exist was it deleted
 	Delete() error                                              // Deletes the file
-	Rename() error                                              // Renames the file in the case of a conflict.
+	Rename(p *Profile) error                                    // Renames the file in the case of a conflict, see ConflictName
 	Open() (io.ReadCloser, error)                               // Opens the file for reading
 	Write(r io.ReadCloser, size int64, modTime time.Time) error // Writes from the reader to the Syncer, closes reader
 	Size() int64                                                // Size of the file
+	Hash() (string, error)                                      // SHA-256 hash of the file's content
 	CreateDir() (Syncer, error)                                 // Create a New Directory based on the non-existant syncer's name
 	StartMonitor(*Profile) error                                // Start Monitoring this syncer for changes (Dir's only)
 	StopMonitor(*Profile) error                                 // Stop Monitoring this syncer for changes (Dir's only)
 }
 
+// DeltaWriter is an optional interface for Syncers which can be updated
+// with only the blocks of the file that have changed, rather than having
+// the entire file written to them.  Freehold currently has no way to patch
+// a file in place, so only local files implement it
+type DeltaWriter interface {
+	Signature() (*delta.Signature, error)                           // Block signature of the current file
+	WriteDelta(ops []delta.Op, size int64, modTime time.Time) error // Rebuilds the file from the delta operations
+}
+
+// RangeOpener is an optional interface for Syncers which can be read
+// starting part way through the file
+type RangeOpener interface {
+	OpenAt(offset int64) (io.ReadCloser, error) // Opens the file for reading starting at offset
+}
+
+// Resumer is an optional interface for Syncers which can pick up an
+// interrupted write where it left off
+type Resumer interface {
+	Resume(from Syncer) (int64, error)                                    // Number of bytes of from already written
+	WriteAt(r io.ReadCloser, offset, size int64, modTime time.Time) error // Writes from the reader starting at offset, closes reader
+}
+
+// SealedSizer is an optional interface for Syncers whose stored size is padded,
+// so their real size has to be read from the file.  The size is kept with the
+// synced state, so files which haven't changed since don't have to be read.
+// Size returns -1 if it can't be read
+type SealedSizer interface {
+	StoredSize() int64  // Size of the file as stored, padding included
+	SetSize(size int64) // Sets the real size of the file, when it's already known
+}
+
+// HashExpecter is an optional interface for Syncers which stage writes, and
+// can check the staged data against the source's hash before replacing the file
+type HashExpecter interface {
+	ExpectHash(hash string) // Hash the next write must match, or fail with ErrHashMismatch
+}
+
+// ReadHasher is an optional interface for Syncers which have to read all of
+// their content to hash it.  The content is read through wrap, so it's limited
+// and counted like any other download
+type ReadHasher interface {
+	HashThrough(wrap func(io.ReadCloser) io.ReadCloser) (string, error) // Hash with the content read through wrap
+}
+
+// Moder is an optional interface for Syncers which keep POSIX permission bits.
+// A mode of 0 means the permissions aren't known, and setting it forgets any
+// that were recorded for the file
+type Moder interface {
+	Mode(p *Profile) (os.FileMode, error)       // POSIX permission bits of the file
+	SetMode(p *Profile, mode os.FileMode) error // Sets the POSIX permission bits of the file
+}
+
+// Versioner is an optional interface for Syncers which can keep the previous
+// version of a file around when it is overwritten or deleted
+type Versioner interface {
+	Version(p *Profile) error // Moves the file out of the way into the profile's versions folder
+}
+
+// Trasher is an optional interface for Syncers which can be moved into a trash
+// folder instead of being permanently deleted
+type Trasher interface {
+	Trash(p *Profile) error // Moves the file or directory into the profile's trash folder
+}
+
+// ChildPageSize is the most entries in each page passed to ChildrenIter
+const ChildPageSize = 1000
+
+// ChildIterator is an optional interface for directory Syncers which can list
+// their contents a page at a time, so directories with a huge number of
+// entries are never held in memory all at once
+type ChildIterator interface {
+	ChildrenIter(fn func(page []Syncer) error) error // Calls fn with each page of the directory's contents, stops at the first error
+}
+
+// Folders and files in the root of a profile which are never synced
+const (
+	VersionsFolder = ".versions"  // previous versions of remote files
+	TrashFolder    = ".fhs-trash" // deleted local files
+	MetaFolder     = ".fhs-meta"  // metadata of remote files freehold doesn't keep, such as POSIX permissions
+	KeyFile        = ".fhs-key"   // salt and passphrase check of an encrypted remote folder
+)
+
+// minDeltaSize is the smallest file that will be transferred via deltas
+// anything smaller is cheaper to just write in full
+const minDeltaSize = 4 * delta.DefaultBlockSize
+
 // Profile is a profile for syncing folders between a local and
 // remote site
 // Conflict resolution happens when two files both have modified dates
@@ -91,12 +208,42 @@ type Profile struct {
 	Direction          int              //direction to sync files
 	ConflictResolution int              //Method for handling when there is a sync conflict between two files
 	ConflictDuration   time.Duration    //Duration between to file's modified times to determine if there is a conflict
+	ConflictTemplate   string           //Template for naming conflict copies of files, defaults to DefaultConflictName
 	Ignore             []*regexp.Regexp //List of regular expressions of filepaths to ignore if they match
+	DryRun             bool             //Record the changes that would be made, without making them, see ProfilePlan
+	Filter             *Filter          //gitignore style patterns of files to exclude from syncing
+	Folders            []string         //If set, only these sub folders of the profile are synced
+	MaxFileSize        int64            //Files larger than this many bytes are skipped, 0 for no limit
+	UploadLimit        int64            //Max bytes per second sent to the remote location, 0 for no limit
+	DownloadLimit      int64            //Max bytes per second retrieved from the remote location, 0 for no limit
+	Workers            int              //Number of changes to run at once, defaults to 1
+	Schedule           *Cron            //If set, the profile only syncs when the schedule fires rather than continuously
+	ScheduleWindow     time.Duration    //How long to keep syncing once the schedule fires, 0 to stop once everything is in sync
+	KeepVersions       int              //Number of previous versions of a file to keep when it's overwritten or deleted, 0 for none
+	Trash              bool             //Move deleted local files into the trash folder instead of removing them
+	TrashRetention     time.Duration    //How long to keep files in the trash, 0 to keep them until removed by hand
+	Verify             bool             //Compare the hashes of both files after every transfer
+	ModifiedTolerance  time.Duration    //Modified times this close together are treated as the same
+	Symlinks           int              //How symbolic links in the local folder are handled
+	MaxDeletes         int              //Deletes past this many at once are held until confirmed, 0 for no limit
+	MaxDeletePercent   int              //Deletes past this percent of the synced files at once are held until confirmed, 0 for no limit
+	MinFreeSpace       int64            //Downloads are held while they would leave fewer than this many bytes free locally, 0 for no limit
+	Compress           bool             //Send file content compressed over the network, if the remote side supports it
+	CompressExclude    []string         //Extensions of files to never compress, on top of the already compressed types
+	PollInterval       time.Duration    //How often the remote folders are checked for changes, 0 for the default
+	LocalMonitor       int              //How the local folder is watched for changes
+	Hooks              Hooks            //Commands run before and after each sync cycle
+
+	// LocalChanged, if set, is called with the slash separated path of each local
+	// file the profile changes, since changes made by this process aren't seen by
+	// the other profiles watching the same local folder
+	LocalChanged func(p *Profile, relPath string)
 
 	Local  Syncer //Local starting point for syncing
 	Remote Syncer // Remote starting point for syncing
 
-	changes chan *changeItem // collects all changes as they come in and runs them in the order they arrive
+	upload   *throttle.Bucket // limits UploadLimit
+	download *throttle.Bucket // limits DownloadLimit
 }
 
 // ID uniquely identifies a profile.  Is a combination of
@@ -114,19 +261,62 @@ func (p *Profile) Start() error {
 		return errors.New("Remote sync starting point not set.")
 	}
 
-	p.changes = make(chan *changeItem, 200)
-	go func() {
-		p.Sync(p.Local, p.Remote)
-	}()
-	go func() {
-		for change := range p.changes {
-			change.runChange()
-		}
-	}()
+	changes := p.startQueue()
+
+	if p.Schedule != nil {
+		changes.setIdle(true)
+		go func() {
+			p.probeClock()
+			p.runSchedule(changes)
+		}()
+	} else {
+		go func() {
+			p.probeClock()
+			p.SyncAll()
+		}()
+	}
 
 	return nil
 }
 
+// startQueue sets up the queue which collects all changes to the profile as
+// they come in, and the workers which run them in order of priority
+func (p *Profile) startQueue() *changeQueue {
+	plans.clear(p.ID())
+	p.upload = throttle.NewBucket(p.UploadLimit)
+	p.download = throttle.NewBucket(p.DownloadLimit)
+	changes := newChangeQueue()
+	if q, ok := queues.get(p.ID()); ok {
+		q.close()
+	}
+	queues.add(p.ID(), changes)
+
+	workers := p.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func(q *changeQueue) {
+			for {
+				change, ok := q.pop()
+				if !ok {
+					return
+				}
+				if !change.hasSpace() {
+					q.holdForSpace(change)
+					continue
+				}
+				change.journal()
+				change.runChange()
+				change.complete()
+				q.forget(change)
+				q.finish(change)
+			}
+		}(changes)
+	}
+	return changes
+}
+
 // Stop stops the profile from syncing
 func (p *Profile) Stop() error {
 	err := p.Local.StopMonitor(p)
@@ -138,14 +328,94 @@ func (p *Profile) Stop() error {
 		return err
 	}
 
-	if p.changes != nil {
-		close(p.changes)
+	// the profile may have been started from a different instance
+	if q, ok := queues.get(p.ID()); ok {
+		queues.remove(p.ID(), q)
+		q.close()
+	}
+	return nil
+}
+
+// Pause stops monitoring the profile for changes, and holds any pending
+// changes until the profile is resumed
+func (p *Profile) Pause() error {
+	q, ok := queues.get(p.ID())
+	if !ok {
+		return errors.New("Profile is not running")
+	}
+
+	q.pause(true)
+
+	err := p.Local.StopMonitor(p)
+	if err != nil {
+		return err
+	}
+	return p.Remote.StopMonitor(p)
+}
+
+// Resume runs any held changes, and rescans the profile to pick up
+// everything that changed while it was paused
+func (p *Profile) Resume() error {
+	q, ok := queues.get(p.ID())
+	if !ok {
+		return errors.New("Profile is not running")
+	}
+
+	q.pause(false)
+	if q.isIdle() {
+		// will sync on the next scheduled run
+		return nil
 	}
+	go func() {
+		err := p.SyncAll()
+		if err != nil {
+			logger.Profile(p.Name).Errorf("Error resuming profile %s: %s", p.Name, err)
+		}
+	}()
 	return nil
 }
 
+// Rescan compares all of a running profile's files again, syncing anything
+// that changed without waiting for it to be noticed.  Folders which are
+// already monitored aren't read again when they're synced, so the profile's
+// monitors are stopped first, and restarted as its folders are read
+func (p *Profile) Rescan() error {
+	q, ok := queues.get(p.ID())
+	if !ok {
+		return errors.New("Profile is not running")
+	}
+	if q.held() {
+		// picked up when the profile is resumed, or next scheduled to run
+		return nil
+	}
+
+	err := p.Local.StopMonitor(p)
+	if err != nil {
+		return err
+	}
+	err = p.Remote.StopMonitor(p)
+	if err != nil {
+		return err
+	}
+	return p.SyncAll()
+}
+
+// Paused returns whether or not the profile is currently paused
+func (p *Profile) Paused() bool {
+	q, ok := queues.get(p.ID())
+	if !ok {
+		return false
+	}
+	return q.isPaused()
+}
+
 // Sync Compares the local and remove files and updates the appropriate one
 func (p *Profile) Sync(local, remote Syncer) error {
+	if q, ok := queues.get(p.ID()); ok && q.held() {
+		// picked up when the profile is resumed, or next scheduled to run
+		return nil
+	}
+
 	syncing.start(p)
 	defer syncing.stop(p)
 
@@ -153,10 +423,26 @@ func (p *Profile) Sync(local, remote Syncer) error {
 		return nil
 	}
 
-	if p.ignore(local.ID()) || p.ignore(remote.ID()) {
+	if p.skipLink(local, true) {
+		return nil
+	}
+
+	if p.ignore(local.ID()) || p.ignore(remote.ID()) || p.Excluded(local) || p.Excluded(remote) {
+		return nil
+	}
+
+	if p.quarantined(local) {
+		// synced back and forth until it was quarantined, it waits to be released
 		return nil
 	}
 
+	if p.Direction == DirectionMirrorRemote {
+		return p.mirror(local, remote, local, remote, false)
+	}
+	if p.Direction == DirectionMirrorLocal {
+		return p.mirror(local, remote, remote, local, true)
+	}
+
 	var err error
 
 	if local.IsDir() && local.Exists() {
@@ -182,36 +468,49 @@ func (p *Profile) Sync(local, remote Syncer) error {
 		}
 	}
 
+	state, err := p.getState(local)
+	if err != nil {
+		return err
+	}
+
 	if !local.Exists() {
 		if local.Deleted() {
-			if p.Direction != DirectionLocalOnly {
-				return <-p.delete(remote)
+			if p.canDelete(false) {
+				return p.deleteOrMove(local, remote, false, state.hash())
 			}
 			return nil
 		}
-		if p.Direction != DirectionRemoteOnly {
+		if p.canWrite(true) {
 			//write local
 			if remote.IsDir() {
 				return <-p.createDir(remote, local)
 			}
-			return <-p.write(remote, local)
+			moved, err := p.moved(remote, local, true)
+			if err != nil || moved {
+				return err
+			}
+			return p.transfer(local, remote, true, ReasonNew)
 		}
 		return nil
 	}
 
 	if !remote.Exists() {
 		if remote.Deleted() {
-			if p.Direction != DirectionRemoteOnly {
-				return <-p.delete(local)
+			if p.canDelete(true) {
+				return p.deleteOrMove(local, remote, true, state.hash())
 			}
 			return nil
 		}
-		if p.Direction != DirectionLocalOnly {
+		if p.canWrite(false) {
 			//write remote
 			if local.IsDir() {
 				return <-p.createDir(local, remote)
 			}
-			return <-p.write(local, remote)
+			moved, err := p.moved(local, remote, false)
+			if err != nil || moved {
+				return err
+			}
+			return p.transfer(local, remote, false, ReasonNew)
 		}
 		return nil
 	}
@@ -235,40 +534,267 @@ func (p *Profile) Sync(local, remote Syncer) error {
 		return nil
 	}
 
+	state.sealedSize(remote)
+	if remote.Size() < 0 {
+		return fmt.Errorf("Can't compare %s with %s without its size", remote.ID(), local.ID())
+	}
+
 	//Both exist Check modified
-	if remote.Modified().Equal(local.Modified()) {
+	if p.sameTime(p.remoteModified(remote), local.Modified()) && remote.Size() == local.Size() {
 		//Already in Sync
+		if state == nil {
+			return p.setState(local, remote, "")
+		}
 		return nil
 	}
 
-	var before, after Syncer
-
-	if local.Modified().Before(remote.Modified()) {
-		if p.Direction == DirectionRemoteOnly {
+	// three-way compare against the last synced state, only fall back
+	// to comparing timestamps if we've never synced this pair before
+	var localChanged, remoteChanged bool
+	if state != nil {
+		localChanged = state.localChanged(p, local)
+		remoteChanged = state.remoteChanged(p, remote)
+		if !localChanged && !remoteChanged {
+			// neither side changed since the last sync, the timestamps just
+			// don't line up (e.g. clock drift between the two machines)
 			return nil
 		}
+	}
+
+	// timestamps changed, but the content may not have
+	same, hash, err := p.sameContent(local, remote)
+	if err != nil {
+		return err
+	}
+	if same {
+		return p.setState(local, remote, hash)
+	}
+
+	if state != nil {
+		switch {
+		case localChanged && !remoteChanged:
+			if !p.canWrite(false) {
+				return nil
+			}
+			return p.transfer(local, remote, false, ReasonChanged)
+		case !localChanged && remoteChanged:
+			if !p.canWrite(true) {
+				return nil
+			}
+			return p.transfer(local, remote, true, ReasonChanged)
+		}
+
+		// changed on both sides
+		return p.resolveConflict(local, remote, local.Modified().Before(p.remoteModified(remote)))
+	}
+
+	if p.stateLost(local, remote) {
+		return p.resolveConflict(local, remote, local.Modified().Before(p.remoteModified(remote)))
+	}
+
+	// compare modified times on the same clock
+	localModified := local.Modified()
+	remoteModified := p.remoteModified(remote)
 
-		before = local
-		after = remote
+	if p.sameTime(remoteModified, localModified) {
+		// same modified time but different content, and no way to tell which is newer
+		return p.resolveConflict(local, remote, false)
+	}
+
+	var before, after time.Time
+	beforeLocal := localModified.Before(remoteModified)
+
+	if beforeLocal {
+		before = localModified
+		after = remoteModified
 	} else {
 		//remote before local
+		before = remoteModified
+		after = localModified
+	}
+
+	//check for conflict
+	if p.isConflict(before, after) {
+		return p.resolveConflict(local, remote, beforeLocal)
+	}
+
+	if !p.canWrite(beforeLocal) {
+		return nil
+	}
+	return p.transfer(local, remote, beforeLocal, ReasonNewer)
+}
+
+// resolveConflict applies the profile's conflict resolution method to the
+// local and remote files.  beforeLocal is whether the local file is the older of the two
+func (p *Profile) resolveConflict(local, remote Syncer, beforeLocal bool) error {
+	if p.ConflictResolution == ConResAsk {
+		found, err := p.holdConflict(local, remote)
+		if found {
+			p.publishConflict(local)
+		}
+		return err
+	}
+
+	p.publishConflict(local)
+	toLocal := beforeLocal
+	switch p.ConflictResolution {
+	case ConResKeepLocal:
+		toLocal = false
+	case ConResKeepRemote:
+		toLocal = true
+	}
+	if !p.canWrite(toLocal) {
+		return nil
+	}
+
+	resolution := ResolveLocal
+	if toLocal {
+		resolution = ResolveRemote
+	}
+	if p.ConflictResolution == ConResKeepBoth {
+		resolution = ResolveBoth
+	}
+	_, err := p.recordConflict(local, remote, resolution)
+	if err != nil {
+		return err
+	}
+
+	if p.ConflictResolution == ConResKeepBoth {
+		before := remote
+		if beforeLocal {
+			before = local
+		}
+		err = <-p.rename(before)
+		if err != nil {
+			return err
+		}
+	}
+
+	return p.transfer(local, remote, toLocal, ReasonConflict)
+}
+
+// transfer writes the remote file to the local file (toLocal == true) or the local
+// file to the remote file, and records the synced state of the pair once it succeeds.
+// Reason is why the file is being written, for its history
+func (p *Profile) transfer(local, remote Syncer, toLocal bool, reason string) error {
+	from := local
+	if toLocal {
+		from = remote
+	}
+	if p.MaxFileSize > 0 && from.Size() > p.MaxFileSize {
+		logger.Profile(p.Name).Warnf("Skipping %s, its size of %d bytes is larger than the max file size of %d bytes for profile %s",
+			from.ID(), from.Size(), p.MaxFileSize, p.Name)
+		return nil
+	}
+
+	var err error
+	if toLocal {
+		err = <-p.write(remote, local, reason)
+	} else {
+		err = <-p.write(local, remote, reason)
+	}
+	if err != nil || p.DryRun {
+		return err
+	}
 
-		if p.Direction == DirectionLocalOnly {
+	// local file was just written or read in full, so hashing it is cheap
+	// compared to the transfer, and lets us spot it if it is moved later
+	hash, err := local.Hash()
+	if err != nil {
+		return err
+	}
+
+	err = p.setState(local, remote, hash)
+	if err != nil {
+		return err
+	}
+	if reason != ReasonResolved {
+		p.watchLoop(local, toLocal, hash)
+	}
+	return nil
+}
+
+// Restore writes a previous version of a file back over it.  It's written like
+// any other change, so it's journaled, verified and recorded in the profile's
+// history, and the current file is versioned first if the profile keeps them
+func (p *Profile) Restore(version, to Syncer) error {
+	return <-p.write(version, to, ReasonRestored)
+}
+
+// canWrite returns whether or not the profile's direction allows
+// changes to be written to the local (toLocal == true) or remote side
+func (p *Profile) canWrite(toLocal bool) bool {
+	switch p.Direction {
+	case DirectionRemoteOnly, DirectionMirrorRemote, DirectionBackup:
+		return !toLocal
+	case DirectionLocalOnly, DirectionMirrorLocal:
+		return toLocal
+	}
+	return true
+}
+
+// canDelete returns whether or not the profile's direction allows
+// deletes to be made on the local (toLocal == true) or remote side
+func (p *Profile) canDelete(toLocal bool) bool {
+	if p.Direction == DirectionBackup {
+		return false
+	}
+	return p.canWrite(toLocal)
+}
+
+// mirror makes dest match source exactly, any changes made on the dest side
+// are overwritten or deleted
+func (p *Profile) mirror(local, remote, source, dest Syncer, toLocal bool) error {
+	if !source.Exists() {
+		if !dest.Exists() {
 			return nil
 		}
-		before = remote
-		after = local
+		return p.removePair(local, remote, toLocal)
 	}
 
-	//check for conflict
-	if p.isConflict(before.Modified(), after.Modified()) {
-		//resolve conflict
-		if p.ConflictResolution == ConResRename {
-			return <-p.rename(before)
+	if dest.Exists() && dest.IsDir() != source.IsDir() {
+		err := p.removePair(local, remote, toLocal)
+		if err != nil {
+			return err
+		}
+	}
+
+	if source.IsDir() {
+		if !dest.Exists() || !dest.IsDir() {
+			return <-p.createDir(source, dest)
+		}
+		err := local.StartMonitor(p)
+		if err != nil {
+			return err
 		}
+		return remote.StartMonitor(p)
 	}
 
-	return <-p.write(after, before)
+	if dest.Exists() && !dest.IsDir() {
+		if p.sameTime(p.remoteModified(remote), local.Modified()) && dest.Size() == source.Size() {
+			return nil
+		}
+		same, hash, err := p.sameContent(local, remote)
+		if err != nil {
+			return err
+		}
+		if same {
+			return p.setState(local, remote, hash)
+		}
+	}
+
+	return p.transfer(local, remote, toLocal, ReasonMirror)
+}
+
+// sameTime returns whether the modified times are within the profile's
+// tolerance of each other.  Some file systems and servers only keep whole
+// or even seconds, so times which should match can be off slightly
+func (p *Profile) sameTime(a, b time.Time) bool {
+	diff := a.Sub(b)
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= p.ModifiedTolerance
 }
 
 func (p *Profile) isConflict(before, after time.Time) bool {
@@ -291,17 +817,20 @@ func (p *Profile) ignore(id string) bool {
 }
 
 func (p *Profile) rename(s Syncer) chan error {
-	return queueChange(p, nil, s, changeTypeRename)
+	return queueChange(p, nil, s, changeTypeRename, ReasonConflict)
 }
 
 func (p *Profile) createDir(from, to Syncer) chan error {
-	return queueChange(p, from, to, changeTypeCreateDir)
+	return queueChange(p, from, to, changeTypeCreateDir, ReasonNew)
 }
 func (p *Profile) delete(s Syncer) chan error {
-	return queueChange(p, nil, s, changeTypeDelete)
+	return queueChange(p, nil, s, changeTypeDelete, ReasonDeleted)
+}
+func (p *Profile) write(from, to Syncer, reason string) chan error {
+	return queueChange(p, from, to, changeTypeWrite, reason)
 }
-func (p *Profile) write(from, to Syncer) chan error {
-	return queueChange(p, from, to, changeTypeWrite)
+func (p *Profile) move(from, to Syncer) chan error {
+	return queueChange(p, from, to, changeTypeMove, ReasonMoved)
 }
 
 type syncingData struct {
@@ -344,45 +873,287 @@ type changeItem struct {
 	from, to   Syncer
 	profile    *Profile
 	done       chan error
+
+	id       uint64
+	path     string // slash separated path relative to the profile
+	size     int64
+	queued   time.Time
+	canceled chan struct{}
+	reason   string // why the change was made, see the Reason constants
 }
 
 func (c *changeItem) runChange() {
+	entry := c.historyEntry()
+	c.profile.publishChange(EventStarted, entry, nil)
+	err := c.run()
+	stats.change(c, err)
+	l := logger.Profile(c.profile.Name).Path(entry.Path).With("side", entry.Side).With("reason", entry.Reason)
+	if err == nil {
+		l.Debugf("Finished %s of %s", entry.Action, entry.Path)
+		c.profile.record(entry)
+		c.profile.publishChange(EventFinished, entry, nil)
+		c.localChanged(entry)
+	} else {
+		if err != ErrCanceled {
+			l.Err(err).Warnf("Error during %s of %s", entry.Action, entry.Path)
+		}
+		c.profile.publishChange(EventError, entry, err)
+	}
+	c.done <- err
+}
+
+// localChanged passes on the local files the change was made to, if the
+// profile wants to know about them
+func (c *changeItem) localChanged(entry *HistoryEntry) {
+	if c.profile.LocalChanged == nil || entry.Side != "local" {
+		return
+	}
+	if entry.From != "" {
+		c.profile.LocalChanged(c.profile, entry.From)
+	}
+	c.profile.LocalChanged(c.profile, entry.Path)
+}
+
+func (c *changeItem) run() error {
 	switch c.changeType {
 	case changeTypeCreateDir:
 		dir, err := c.to.CreateDir()
 		if err != nil {
-			c.done <- err
-			return
+			return err
 		}
 		err = dir.StartMonitor(c.profile)
 		if err != nil {
-			c.done <- err
-			return
+			return err
 		}
-		c.done <- c.from.StartMonitor(c.profile)
+		return c.from.StartMonitor(c.profile)
 
 	case changeTypeDelete:
-		c.done <- c.to.Delete()
+		err := c.checkUnchanged()
+		if err != nil {
+			return err
+		}
+		versioned, err := c.version()
+		if err != nil {
+			return err
+		}
+		if !versioned {
+			if t, ok := c.to.(Trasher); ok && c.profile.Trash {
+				err = t.Trash(c.profile)
+			} else {
+				err = c.to.Delete()
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return c.dropMode()
 	case changeTypeRename:
-		c.done <- c.to.Rename()
+		return c.to.Rename(c.profile)
+	case changeTypeMove:
+		return c.move()
 	case changeTypeWrite:
-		r, err := c.from.Open()
+		err := c.checkUnchanged()
+		if err != nil {
+			return err
+		}
+		_, err = c.version()
+		if err != nil {
+			return err
+		}
+		err = c.verifiedWrite()
 		if err != nil {
-			c.done <- err
-			return
+			return err
 		}
-		c.done <- c.to.Write(r, c.from.Size(), c.from.Modified())
+		return c.copyMode()
 	}
+	return nil
 }
 
-func queueChange(p *Profile, from, to Syncer, changeType int) chan error {
-	done := make(chan error)
-	p.changes <- &changeItem{
+// dropMode forgets any permission bits recorded for either file of the deleted
+// pair, so they aren't left behind for a file that's no longer there
+func (c *changeItem) dropMode() error {
+	for _, s := range []Syncer{c.from, c.to} {
+		if m, ok := s.(Moder); ok {
+			err := m.SetMode(c.profile, 0)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// move moves the from file into place, and its permission bits along with it
+func (c *changeItem) move() error {
+	var mode os.FileMode
+	from, ok := c.from.(Moder)
+	if ok {
+		var err error
+		mode, err = from.Mode(c.profile)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := c.from.(Mover).Move(c.to)
+	if err != nil || !ok {
+		return err
+	}
+
+	if to, ok := c.to.(Moder); ok {
+		err = to.SetMode(c.profile, mode)
+		if err != nil {
+			return err
+		}
+	}
+	return from.SetMode(c.profile, 0)
+}
+
+// copyMode copies the permission bits of the from file to the destination,
+// if both sides keep them
+func (c *changeItem) copyMode() error {
+	from, ok := c.from.(Moder)
+	if !ok {
+		return nil
+	}
+	to, ok := c.to.(Moder)
+	if !ok {
+		return nil
+	}
+
+	mode, err := from.Mode(c.profile)
+	if err != nil {
+		return err
+	}
+	return to.SetMode(c.profile, mode)
+}
+
+// write writes the from file to the destination, using the cheapest
+// method both sides support
+func (c *changeItem) write() error {
+	if he, ok := c.to.(HashExpecter); ok && c.profile.Verify {
+		hash, err := c.profile.hash(c.from)
+		if err != nil {
+			return err
+		}
+		he.ExpectHash(hash)
+	}
+	if cp, ok := c.to.(Copier); ok {
+		copied, err := c.copy(cp)
+		if err != nil || copied {
+			return err
+		}
+	}
+	if dw, ok := c.to.(DeltaWriter); ok && c.to.Exists() && c.from.Size() >= minDeltaSize {
+		return c.writeDelta(dw)
+	}
+	if rw, ok := c.to.(Resumer); ok {
+		if ro, ok := c.from.(RangeOpener); ok {
+			return c.resumeWrite(rw, ro)
+		}
+	}
+	r, err := c.open()
+	if err != nil {
+		return err
+	}
+	return c.writeTo(c.throttle(r), c.from.Size(), c.from.Modified())
+}
+
+// version moves the existing file the change is being made to into the
+// versions folder, if the profile keeps versions.  Returns true if the file was moved
+func (c *changeItem) version() (bool, error) {
+	v, ok := c.to.(Versioner)
+	if !ok || c.profile.KeepVersions <= 0 || !c.to.Exists() || c.to.IsDir() {
+		return false, nil
+	}
+	return true, v.Version(c.profile)
+}
+
+// resumeWrite writes the from file to the destination, picking up where
+// any previously interrupted write of the same file left off
+func (c *changeItem) resumeWrite(rw Resumer, ro RangeOpener) error {
+	offset, err := rw.Resume(c.from)
+	if err != nil {
+		return err
+	}
+
+	var r io.ReadCloser
+	if offset > 0 {
+		r, err = ro.OpenAt(offset)
+	}
+	if offset == 0 || err != nil {
+		// can't resume, start over from the beginning
+		offset = 0
+		r, err = c.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	return rw.WriteAt(c.throttle(r), offset, c.from.Size(), c.from.Modified())
+}
+
+// throttle limits the rate the reader is read from to the global and
+// profile limits for the direction of the change, and stops reading if the
+// change is canceled
+func (c *changeItem) throttle(r io.ReadCloser) io.ReadCloser {
+	r = &cancelReader{
+		ReadCloser: r,
+		canceled:   c.canceled,
+	}
+	if c.profile.side(c.to) == "local" {
+		return throttle.NewReader(r, throttle.Download, c.profile.download)
+	}
+	return throttle.NewReader(r, throttle.Upload, c.profile.upload)
+}
+
+// writeDelta writes only the changed blocks of the from file to the destination
+func (c *changeItem) writeDelta(dw DeltaWriter) error {
+	sig, err := dw.Signature()
+	if err != nil {
+		return err
+	}
+
+	r, err := c.open()
+	if err != nil {
+		return err
+	}
+
+	ops, err := delta.Diff(sig, c.throttle(r))
+	if err != nil {
+		r.Close()
+		return err
+	}
+	err = r.Close()
+	if err != nil {
+		return err
+	}
+
+	return dw.WriteDelta(ops, c.from.Size(), c.from.Modified())
+}
+
+func queueChange(p *Profile, from, to Syncer, changeType int, reason string) chan error {
+	done := make(chan error, 1)
+	item := &changeItem{
 		changeType: changeType,
 		from:       from,
 		to:         to,
 		profile:    p,
 		done:       done,
+		reason:     reason,
+	}
+
+	if p.DryRun {
+		done <- item.plan()
+		return done
+	}
+
+	q, ok := queues.get(p.ID())
+	if !ok {
+		done <- ErrCanceled
+		return done
 	}
+	item.keep()
+	q.push(item)
 	return done
 }
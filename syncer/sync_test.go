@@ -0,0 +1,459 @@
+package syncer
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOverlaps(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		overlaps bool
+	}{
+		{"docs", "docs", true},
+		{"docs", "docs/report.txt", true},
+		{"docs/a/b", "docs", true},
+		{"docs", "docs2/report.txt", false},
+		{"docs/a", "docs/b", false},
+		{"", "docs", true},
+	}
+
+	for _, test := range tests {
+		if overlaps(test.a, test.b) != test.overlaps {
+			t.Errorf("Expected overlaps(%q, %q) to be %t", test.a, test.b, test.overlaps)
+		}
+	}
+}
+
+func TestChangePriority(t *testing.T) {
+	changes := []*changeItem{
+		{id: 1, changeType: changeTypeWrite, size: 1 << 30},
+		{id: 2, changeType: changeTypeWrite, size: 10},
+		{id: 3, changeType: changeTypeDelete},
+		{id: 4, changeType: changeTypeWrite, size: 10},
+		{id: 5, changeType: changeTypeCreateDir},
+	}
+	sort.Sort(changeSort(changes))
+
+	expected := []uint64{3, 5, 2, 4, 1}
+	for i := range expected {
+		if changes[i].id != expected[i] {
+			t.Fatalf("Expected change %d at position %d, got %d", expected[i], i, changes[i].id)
+		}
+	}
+}
+
+func TestConflictName(t *testing.T) {
+	p := &Profile{
+		Name:             "docs",
+		ConflictTemplate: "{name}.{profile}{ext}",
+	}
+
+	taken := map[string]bool{
+		"report.docs.txt":     true,
+		"report.docs (1).txt": true,
+	}
+	exists := func(name string) (bool, error) {
+		return taken[name], nil
+	}
+
+	name, err := p.ConflictName("report.txt", exists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "report.docs (2).txt" {
+		t.Fatalf("Expected report.docs (2).txt got %s", name)
+	}
+
+	if ValidateConflictName("conflict{ext}") == nil {
+		t.Fatal("Expected error for a template without {name}")
+	}
+}
+
+func TestSameTime(t *testing.T) {
+	p := &Profile{ModifiedTolerance: 2 * time.Second}
+	now := time.Now()
+
+	if !p.sameTime(now, now.Add(-2*time.Second)) {
+		t.Fatal("Times within the tolerance should be the same")
+	}
+	if !p.sameTime(now, now.Truncate(time.Second)) {
+		t.Fatal("Truncated time should be the same")
+	}
+	if p.sameTime(now, now.Add(3*time.Second)) {
+		t.Fatal("Times outside the tolerance should not be the same")
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	nfd := "Cafe\u0301/re\u0301sume\u0301.txt"
+	nfc := "Caf\u00e9/r\u00e9sum\u00e9.txt"
+
+	if NormalizeName(nfd) != nfc {
+		t.Fatalf("Expected %q got %q", nfc, NormalizeName(nfd))
+	}
+	if !SameName(nfd, nfc) {
+		t.Fatal("Decomposed and composed names should be the same")
+	}
+	if SameName("cafe", nfc) {
+		t.Fatal("Different names should not be the same")
+	}
+}
+
+func TestCompress(t *testing.T) {
+	p := &Profile{
+		Compress:        true,
+		CompressExclude: []string{"iso", ".DAT"},
+	}
+
+	tests := []struct {
+		name     string
+		compress bool
+	}{
+		{"/docs/report.txt", true},
+		{"/docs/Makefile", true},
+		{"/photos/beach.JPG", false},
+		{"/backup/disk.iso", false},
+		{"/backup/game.dat", false},
+	}
+
+	for _, test := range tests {
+		if p.compress(test.name) != test.compress {
+			t.Errorf("Expected compress(%q) to be %t", test.name, test.compress)
+		}
+	}
+
+	p.Compress = false
+	if p.compress("/docs/report.txt") {
+		t.Fatal("Nothing should be compressed when the profile has compression off")
+	}
+}
+
+func TestTotalStats(t *testing.T) {
+	now := time.Now()
+	stats.Lock()
+	stats.profiles["a"] = &Stats{FilesUploaded: 1, BytesUploaded: 10, Errors: 1, LastSync: now.Add(-time.Hour)}
+	stats.profiles["b"] = &Stats{FilesDownloaded: 2, BytesDownloaded: 20, Conflicts: 1, LastSync: now}
+	stats.Unlock()
+	defer func() {
+		stats.Lock()
+		delete(stats.profiles, "a")
+		delete(stats.profiles, "b")
+		stats.Unlock()
+	}()
+
+	total := TotalStats([]string{"a", "b", "missing"})
+	if total.FilesUploaded != 1 || total.BytesUploaded != 10 ||
+		total.FilesDownloaded != 2 || total.BytesDownloaded != 20 {
+		t.Fatalf("Transfers weren't added together: %+v", total)
+	}
+	if total.Errors != 1 || total.Conflicts != 1 {
+		t.Fatalf("Errors and conflicts weren't added together: %+v", total)
+	}
+	if !total.LastSync.Equal(now) {
+		t.Fatalf("Expected the latest sync time %s, got %s", now, total.LastSync)
+	}
+}
+
+func TestIsLoop(t *testing.T) {
+	now := time.Now()
+	writes := func(toLocal []bool, hashes ...string) []*loopWrite {
+		list := make([]*loopWrite, len(toLocal))
+		for i := range toLocal {
+			list[i] = &loopWrite{toLocal: toLocal[i], hash: hashes[i%len(hashes)], when: now}
+		}
+		return list
+	}
+
+	tests := []struct {
+		name   string
+		writes []*loopWrite
+		loop   bool
+	}{
+		{"same content flipping", writes([]bool{true, false, true, false, true}, "a"), true},
+		{"two versions flipping", writes([]bool{false, true, false, true, false}, "a", "b"), true},
+		{"too few flips", writes([]bool{true, false, true, false}, "a"), false},
+		{"edited on both sides", writes([]bool{true, false, true, false, true}, "a", "b", "c"), false},
+		{"written to one side", writes([]bool{false, false, false, false, false}, "a"), false},
+		{"latest flips", writes([]bool{false, false, true, false, true, false}, "a"), true},
+	}
+
+	for _, test := range tests {
+		if isLoop(test.writes) != test.loop {
+			t.Errorf("%s: expected isLoop to be %t", test.name, test.loop)
+		}
+	}
+
+	old := &loopWrite{when: now.Add(-2 * loopWindow)}
+	recent := recentWrites(append([]*loopWrite{old}, writes([]bool{true}, "a")...), now)
+	if len(recent) != 1 || recent[0] == old {
+		t.Fatalf("Expected only the write within the loop window, got %d writes", len(recent))
+	}
+}
+
+func TestLocalChanged(t *testing.T) {
+	var changed []string
+	c := &changeItem{profile: &Profile{
+		LocalChanged: func(p *Profile, relPath string) {
+			changed = append(changed, relPath)
+		},
+	}}
+
+	c.localChanged(&HistoryEntry{Path: "a/b.txt", Side: "remote", Action: ActionUpdate})
+	if len(changed) != 0 {
+		t.Fatalf("Expected remote changes not to be passed on, got %v", changed)
+	}
+
+	c.localChanged(&HistoryEntry{Path: "a/b.txt", Side: "local", Action: ActionCreate})
+	c.localChanged(&HistoryEntry{Path: "c.txt", From: "a/c.txt", Side: "local", Action: ActionMove})
+	expected := []string{"a/b.txt", "a/c.txt", "c.txt"}
+	if strings.Join(changed, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected %v to be passed on, got %v", expected, changed)
+	}
+}
+
+func TestHoldDeletes(t *testing.T) {
+	defer openTestDatastore(t)()
+
+	p := &Profile{
+		Name:       "docs",
+		MaxDeletes: 2,
+		Local:      &testSyncer{id: "/home/user/guarded"},
+		Remote:     &testSyncer{id: "/v1/file/guarded/"},
+	}
+	defer guards.take(p.ID())
+
+	for i := 0; i < 3; i++ {
+		if !p.holdDelete(&testSyncer{id: "local"}, &testSyncer{id: "remote"}, false) {
+			t.Fatalf("Expected delete %d to wait to be counted", i)
+		}
+	}
+
+	guards.Lock()
+	g := guards.profiles[p.ID()]
+	g.last = time.Now().Add(-deleteSettle)
+	guards.Unlock()
+
+	p.countDeletes()
+
+	guards.Lock()
+	defer guards.Unlock()
+	if len(g.held) != 3 || len(g.planned) != 0 {
+		t.Fatalf("Expected all 3 planned deletes to be held, got %d held and %d planned", len(g.held), len(g.planned))
+	}
+}
+
+type sealedSyncer struct {
+	testSyncer
+	stored   int64
+	modified time.Time
+	size     int64
+}
+
+func (s *sealedSyncer) Modified() time.Time { return s.modified }
+func (s *sealedSyncer) StoredSize() int64   { return s.stored }
+func (s *sealedSyncer) SetSize(size int64)  { s.size = size }
+
+func TestSealedSize(t *testing.T) {
+	now := time.Now()
+	state := &fileState{Size: 900, RemoteModified: now, RemoteStored: 1053}
+
+	remote := &sealedSyncer{stored: 1053, modified: now, size: -1}
+	state.sealedSize(remote)
+	if remote.size != 900 {
+		t.Fatalf("Expected the synced size of an unchanged file, got %d", remote.size)
+	}
+
+	remote = &sealedSyncer{stored: 2077, modified: now, size: -1}
+	state.sealedSize(remote)
+	if remote.size != -1 {
+		t.Fatal("The synced size shouldn't be used for a file stored at a different size")
+	}
+
+	remote = &sealedSyncer{stored: 1053, modified: now.Add(time.Second), size: -1}
+	state.sealedSize(remote)
+	if remote.size != -1 {
+		t.Fatal("The synced size shouldn't be used for a file modified since")
+	}
+}
+
+type readHashSyncer struct {
+	testSyncer
+	content string
+}
+
+func (s *readHashSyncer) HashThrough(wrap func(io.ReadCloser) io.ReadCloser) (string, error) {
+	r := wrap(ioutil.NopCloser(strings.NewReader(s.content)))
+	defer r.Close()
+	return HashReader(r)
+}
+
+func TestHashCounted(t *testing.T) {
+	p := &Profile{
+		Local:  &testSyncer{id: "local"},
+		Remote: &testSyncer{id: "remote"},
+	}
+	defer func() {
+		stats.Lock()
+		delete(stats.profiles, p.ID())
+		stats.Unlock()
+	}()
+
+	_, err := p.hash(&readHashSyncer{content: "hashed content"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := stats.get(p.ID()); s.BytesDownloaded != int64(len("hashed content")) || s.FilesDownloaded != 0 {
+		t.Fatalf("Expected the bytes read for hashing to be counted as downloaded, got %+v", s)
+	}
+}
+
+type modeSyncer struct {
+	testSyncer
+	mode os.FileMode
+}
+
+func (s *modeSyncer) Mode(p *Profile) (os.FileMode, error)       { return s.mode, nil }
+func (s *modeSyncer) SetMode(p *Profile, mode os.FileMode) error { s.mode = mode; return nil }
+func (s *modeSyncer) Move(to Syncer) error                       { return nil }
+
+func TestMoveMode(t *testing.T) {
+	from := &modeSyncer{testSyncer: testSyncer{id: "from"}, mode: 0755}
+	to := &modeSyncer{testSyncer: testSyncer{id: "to"}}
+	c := &changeItem{profile: &Profile{}, from: from, to: to, changeType: changeTypeMove}
+
+	err := c.move()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to.mode != 0755 {
+		t.Fatalf("Expected the mode to be moved with the file, got %s", to.mode)
+	}
+	if from.mode != 0 {
+		t.Fatalf("Expected the mode of the old location to be forgotten, got %s", from.mode)
+	}
+
+	to.mode = 0700
+	c = &changeItem{profile: &Profile{}, from: from, to: to, changeType: changeTypeDelete}
+	err = c.dropMode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to.mode != 0 {
+		t.Fatalf("Expected the mode of a deleted file to be forgotten, got %s", to.mode)
+	}
+}
+
+type dirSyncer struct {
+	testSyncer
+	path     string
+	dir      bool
+	children []Syncer
+}
+
+func (s *dirSyncer) Path(p *Profile) string  { return s.path }
+func (s *dirSyncer) IsDir() bool             { return s.dir }
+func (s *dirSyncer) Exists() bool            { return true }
+func (s *dirSyncer) List() ([]Syncer, error) { return s.children, nil }
+
+func TestPlanDirContents(t *testing.T) {
+	p := &Profile{
+		Local:  &testSyncer{id: "/local"},
+		Remote: &testSyncer{id: "/remote"},
+		DryRun: true,
+	}
+	defer plans.clear(p.ID())
+
+	from := &dirSyncer{testSyncer: testSyncer{id: "/local/docs"}, path: "/docs", dir: true, children: []Syncer{
+		&dirSyncer{testSyncer: testSyncer{id: "/local/docs/a.txt"}, path: "/docs/a.txt"},
+		&dirSyncer{testSyncer: testSyncer{id: "/local/docs/sub"}, path: "/docs/sub", dir: true, children: []Syncer{
+			&dirSyncer{testSyncer: testSyncer{id: "/local/docs/sub/b.txt"}, path: "/docs/sub/b.txt"},
+		}},
+	}}
+	to := &dirSyncer{testSyncer: testSyncer{id: "/remote/docs"}, path: "/docs"}
+
+	err := <-p.createDir(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan := ProfilePlan(p.ID())
+	expected := []string{"/docs", "/docs/a.txt", "/docs/sub", "/docs/sub/b.txt"}
+	if len(plan) != len(expected) {
+		t.Fatalf("Expected %d planned creates, got %d", len(expected), len(plan))
+	}
+	for i := range plan {
+		if plan[i].Path != expected[i] || plan[i].Action != ActionCreate || plan[i].Side != "remote" {
+			t.Fatalf("Expected a remote create of %s, got %+v", expected[i], plan[i])
+		}
+	}
+}
+
+type pairSyncer struct {
+	testSyncer
+	path     string
+	size     int64
+	modified time.Time
+}
+
+func (s *pairSyncer) Path(p *Profile) string { return s.path }
+func (s *pairSyncer) Modified() time.Time    { return s.modified }
+func (s *pairSyncer) Size() int64            { return s.size }
+
+func TestRecordConflict(t *testing.T) {
+	defer openTestDatastore(t)()
+
+	p := &Profile{
+		Local:  &testSyncer{id: "/home/user/docs"},
+		Remote: &testSyncer{id: "/v1/file/docs/"},
+	}
+	now := time.Now()
+	held := &pairSyncer{path: "/held.txt", size: 10, modified: now}
+	settled := &pairSyncer{path: "/settled.txt", size: 20, modified: now}
+	remote := &pairSyncer{size: 30, modified: now}
+
+	found, err := p.holdConflict(held, remote)
+	if err != nil || !found {
+		t.Fatalf("Expected the held conflict to be new, got %v, %v", found, err)
+	}
+	_, err = p.recordConflict(settled, remote, ResolveRemote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waiting, err := ProfileConflicts(p.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(waiting) != 1 || waiting[0].Path != "held.txt" || ProfileConflictCount(p.ID()) != 1 {
+		t.Fatalf("Expected only the held conflict to be waiting, got %d", len(waiting))
+	}
+
+	// both pairs synced
+	err = p.setState(held, remote, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.setState(settled, remote, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := ProfileConflictLog(p.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].Path != "settled.txt" || all[0].Resolution != ResolveRemote || all[0].Resolved.IsZero() {
+		t.Fatalf("Expected only the settled conflict to be kept with its resolution, got %+v", all)
+	}
+
+	found, err = p.holdConflict(settled, remote)
+	if err != nil || !found {
+		t.Fatalf("Expected a conflict after a settled one to be new, got %v, %v", found, err)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package syncer
+
+import (
+	"errors"
+	"fmt"
+)
+
+// verifyAttempts is the number of times a transfer is tried before a
+// destination file that keeps failing verification is quarantined
+const verifyAttempts = 3
+
+// ErrHashMismatch is returned by HashExpecters when the data written doesn't
+// match the expected hash
+var ErrHashMismatch = errors.New("Written data doesn't match the expected hash")
+
+// verifiedWrite writes the file, and if the profile verifies transfers,
+// checks the destination's hash against the source, writing it again if they
+// don't match. If the file never matches, the bad copy is renamed out of the way
+// as a conflict copy, so it won't later be seen as in sync
+func (c *changeItem) verifiedWrite() error {
+	for attempt := 1; ; attempt++ {
+		err := c.write()
+		if err == ErrHashMismatch {
+			// the bad copy was thrown out before it replaced the destination
+			if attempt >= verifyAttempts {
+				return fmt.Errorf("%s failed verification after %d attempts", c.to.ID(), attempt)
+			}
+			logger.Profile(c.profile.Name).Warnf("%s failed verification, writing it again", c.to.ID())
+			continue
+		}
+		if err != nil || !c.profile.Verify {
+			return err
+		}
+		if _, ok := c.to.(HashExpecter); ok {
+			// already checked before it was moved into place
+			return nil
+		}
+
+		match, err := c.verify()
+		if err != nil {
+			return err
+		}
+		if match {
+			return nil
+		}
+
+		if attempt >= verifyAttempts {
+			err = c.to.Rename(c.profile)
+			if err != nil {
+				return fmt.Errorf("Error quarantining %s which failed verification: %s", c.to.ID(), err)
+			}
+			return fmt.Errorf("%s failed verification after %d attempts, the bad copy was renamed", c.to.ID(), attempt)
+		}
+		logger.Profile(c.profile.Name).Warnf("%s failed verification, writing it again", c.to.ID())
+	}
+}
+
+// verify returns whether the destination's content matches the source
+func (c *changeItem) verify() (bool, error) {
+	if c.to.Size() != c.from.Size() {
+		return false, nil
+	}
+
+	fromHash, err := c.profile.hash(c.from)
+	if err != nil {
+		return false, err
+	}
+
+	// don't trust a hash cached from an earlier write
+	err = clearHash(c.to)
+	if err != nil {
+		return false, err
+	}
+	toHash, err := c.profile.hash(c.to)
+	if err != nil {
+		return false, err
+	}
+
+	return fromHash == toHash, nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+)
+
+// listenFdsStart is the first file descriptor systemd passes activated
+// sockets on
+const listenFdsStart = 3
+
+// sdNotify sends the state to systemd, for units with Type=notify.  Does nothing
+// when freehold-sync wasn't started by systemd
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// abstract socket
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdListeners returns the sockets systemd opened for freehold-sync, for units
+// started by a .socket unit, nil if there are none.  The environment variables
+// are cleared so hook commands don't think the sockets are for them
+func sdListeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+
+	listeners := make([]net.Listener, 0, count)
+	for fd := listenFdsStart; fd < listenFdsStart+count; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for i := range listeners {
+				listeners[i].Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// sdWatchdog pings systemd's watchdog, for units with WatchdogSec set, at half
+// the interval systemd expects.  Pings stop when the datastore can't be read, or
+// stops responding, so systemd restarts freehold-sync
+func sdWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+
+	interval := time.Duration(usec) * time.Microsecond / 2
+	go func() {
+		for range time.Tick(interval) {
+			err := datastore.View(func(tx *datastore.Tx) error {
+				_, err := tx.Profiles(datastore.BucketState)
+				return err
+			})
+			if err != nil {
+				logger.Errorf("Not pinging the systemd watchdog, the datastore can't be read: %s", err)
+				continue
+			}
+			err = sdNotify("WATCHDOG=1")
+			if err != nil {
+				logger.Errorf("Error pinging the systemd watchdog: %s", err)
+			}
+		}
+	}()
+}
+
+// webListeners returns the listeners the web interface is served on, the
+// sockets systemd opened if freehold-sync was socket activated
+func webListeners(port string) ([]net.Listener, error) {
+	listeners, err := sdListeners()
+	if err != nil || len(listeners) > 0 {
+		return listeners, err
+	}
+	l, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{l}, nil
+}
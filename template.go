@@ -0,0 +1,171 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+const templateBucket = datastore.BucketTemplate
+
+// profileTemplate is a named set of a profile's filter rules, throttles and
+// conflict settings, which new profiles can be created from
+type profileTemplate struct {
+	Name                    string   `json:"name"`
+	Ignore                  []string `json:"ignore"`
+	Filters                 []string `json:"filters"`
+	MaxFileSizeMB           int      `json:"maxFileSizeMB"`
+	UploadLimitKB           int      `json:"uploadLimitKB"`
+	DownloadLimitKB         int      `json:"downloadLimitKB"`
+	ConflictResolution      int      `json:"conflictResolution"`
+	ConflictDurationSeconds int      `json:"conflictDurationSeconds"`
+	ConflictName            string   `json:"conflictName"`
+}
+
+// newTemplate returns a template with the profile's settings
+func newTemplate(name string, p *profileStore) *profileTemplate {
+	return &profileTemplate{
+		Name:                    name,
+		Ignore:                  p.Ignore,
+		Filters:                 p.Filters,
+		MaxFileSizeMB:           p.MaxFileSizeMB,
+		UploadLimitKB:           p.UploadLimitKB,
+		DownloadLimitKB:         p.DownloadLimitKB,
+		ConflictResolution:      p.ConflictResolution,
+		ConflictDurationSeconds: p.ConflictDurationSeconds,
+		ConflictName:            p.ConflictName,
+	}
+}
+
+// apply replaces the profile's settings with the template's
+func (t *profileTemplate) apply(a *apiProfile) {
+	a.Ignore = t.Ignore
+	a.Filters = t.Filters
+	a.MaxFileSizeMB = t.MaxFileSizeMB
+	a.UploadLimitKB = t.UploadLimitKB
+	a.DownloadLimitKB = t.DownloadLimitKB
+	a.ConflictResolution = t.ConflictResolution
+	a.ConflictDurationSeconds = t.ConflictDurationSeconds
+	a.ConflictName = t.ConflictName
+}
+
+// validate checks the template's settings the same way a profile's are
+// checked, so profiles created from it don't fail on them later
+func (t *profileTemplate) validate() error {
+	if strings.TrimSpace(t.Name) == "" {
+		return errors.New("No Name specified for this template")
+	}
+
+	if t.ConflictResolution != syncer.ConResKeepNewest &&
+		t.ConflictResolution != syncer.ConResKeepBoth &&
+		t.ConflictResolution != syncer.ConResKeepLocal &&
+		t.ConflictResolution != syncer.ConResKeepRemote &&
+		t.ConflictResolution != syncer.ConResAsk {
+		return errors.New("Invalid template conflict resolution")
+	}
+
+	err := syncer.ValidateConflictName(t.ConflictName)
+	if err != nil {
+		return err
+	}
+
+	for i := range t.Ignore {
+		_, err = regexp.Compile(t.Ignore[i])
+		if err != nil {
+			return fmt.Errorf("Invalid Regular expression: %s", err)
+		}
+	}
+
+	_, err = syncer.NewFilter(t.Filters)
+	if err != nil {
+		return err
+	}
+
+	if t.MaxFileSizeMB < 0 {
+		return errors.New("Invalid max file size")
+	}
+
+	if t.UploadLimitKB < 0 || t.DownloadLimitKB < 0 {
+		return errors.New("Invalid bandwidth limit")
+	}
+	return nil
+}
+
+// put validates and stores the template, replacing any template with the same
+// name
+func (t *profileTemplate) put() error {
+	t.Name = strings.TrimSpace(t.Name)
+	err := t.validate()
+	if err != nil {
+		return err
+	}
+	return datastore.Put(templateBucket, t.Name, t)
+}
+
+func getTemplate(name string) (*profileTemplate, error) {
+	t := &profileTemplate{}
+	err := datastore.Get(templateBucket, name, t)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// allTemplates returns every template, sorted by name
+func allTemplates() ([]*profileTemplate, error) {
+	var all []*profileTemplate
+	err := datastore.View(func(tx *datastore.Tx) error {
+		return tx.Each(templateBucket, func(key string, value []byte) error {
+			t := &profileTemplate{}
+			err := json.Unmarshal(value, t)
+			if err != nil {
+				return err
+			}
+			all = append(all, t)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return strings.ToLower(all[i].Name) < strings.ToLower(all[j].Name)
+	})
+	return all, nil
+}
+
+// deleteTemplate removes the template.  Profiles created from it keep their
+// settings
+func deleteTemplate(name string) error {
+	return datastore.Delete(templateBucket, name)
+}
+
+// clone creates a new profile with every setting and secret of the profile, but
+// syncing a different pair of folders, without the profile's destinations
+func (p *profileStore) clone(name, localPath, remotePath string) (*profileStore, error) {
+	c := *p
+	if p.Client != nil {
+		client := *p.Client
+		c.Client = &client
+	}
+	c.Name = name
+	c.LocalPath = localPath
+	c.RemotePath = remotePath
+	// the destinations would overlap the profile's
+	c.Destinations = nil
+	// the clone is managed here, even if the profile it's cloned from is in the
+	// profiles file
+	c.Declared = false
+	return newProfile(&c)
+}
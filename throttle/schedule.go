@@ -0,0 +1,122 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package throttle
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Window is a period of the day during which different global limits apply
+type Window struct {
+	Start    time.Duration // time since midnight the window starts
+	End      time.Duration // time since midnight the window ends, may be before Start to wrap past midnight
+	Upload   int64         // upload limit in bytes per second during the window, 0 for no limit
+	Download int64         // download limit in bytes per second during the window, 0 for no limit
+}
+
+func (w Window) contains(t time.Time) bool {
+	since := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.Start <= w.End {
+		return since >= w.Start && since < w.End
+	}
+	return since >= w.Start || since < w.End
+}
+
+// ParseSchedule parses a comma separated list of windows in the format
+// HH:MM-HH:MM upload/download where the limits are in KB per second
+// For example:
+//	01:00-06:00 0/0, 09:00-17:00 500/1000
+func ParseSchedule(schedule string) ([]Window, error) {
+	var windows []Window
+	for _, entry := range strings.Split(schedule, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		fields := strings.Fields(entry)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid schedule entry %s", entry)
+		}
+		times := strings.Split(fields[0], "-")
+		limits := strings.Split(fields[1], "/")
+		if len(times) != 2 || len(limits) != 2 {
+			return nil, fmt.Errorf("Invalid schedule entry %s", entry)
+		}
+
+		w := Window{}
+		var err error
+		if w.Start, err = parseClock(times[0]); err != nil {
+			return nil, err
+		}
+		if w.End, err = parseClock(times[1]); err != nil {
+			return nil, err
+		}
+		if w.Upload, err = parseKB(limits[0]); err != nil {
+			return nil, err
+		}
+		if w.Download, err = parseKB(limits[1]); err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func parseClock(clock string) (time.Duration, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid schedule time %s", clock)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func parseKB(limit string) (int64, error) {
+	kb, err := strconv.ParseInt(limit, 10, 64)
+	if err != nil || kb < 0 {
+		return 0, fmt.Errorf("Invalid schedule limit %s", limit)
+	}
+	return kb * 1024, nil
+}
+
+// limits returns the upload and download limits in effect at the passed in time
+// the first matching window wins, if none match the defaults are used
+func limits(windows []Window, t time.Time, upload, download int64) (int64, int64) {
+	for i := range windows {
+		if windows[i].contains(t) {
+			return windows[i].Upload, windows[i].Download
+		}
+	}
+	return upload, download
+}
+
+// StartSchedule sets the global Upload and Download limits according to the
+// schedule, checking every minute for a change. Outside of any window the
+// passed in upload and download limits are used.  Because the buckets are
+// updated in place, transfers already in progress pick up the new limits
+func StartSchedule(windows []Window, upload, download int64) {
+	apply := func() {
+		up, down := limits(windows, time.Now(), upload, download)
+		if Upload.Rate() != up {
+			Upload.SetRate(up)
+		}
+		if Download.Rate() != down {
+			Download.SetRate(down)
+		}
+	}
+
+	apply()
+	if len(windows) == 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			apply()
+		}
+	}()
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+// Package throttle limits the rate data is read from readers using
+// token buckets.  A reader can be limited by several buckets at once
+// such as a global limit and a per profile limit
+package throttle
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// maxChunk is the most data read at once through a throttled reader
+// so that limits are applied smoothly
+const maxChunk = 32 * 1024
+
+var (
+	// Upload is the global limit for data sent to remote locations
+	Upload = NewBucket(0)
+	// Download is the global limit for data retrieved from remote locations
+	Download = NewBucket(0)
+)
+
+// Bucket is a token bucket which limits the number of bytes per second
+// that can pass through it
+type Bucket struct {
+	sync.Mutex
+	rate   int64 // bytes per second, 0 is unlimited
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a new bucket limited to rate bytes per second
+// a rate of 0 is unlimited
+func NewBucket(rate int64) *Bucket {
+	return &Bucket{
+		rate: rate,
+		last: time.Now(),
+	}
+}
+
+// SetRate changes the bucket's rate, which applies immediately to
+// any readers currently using it
+func (b *Bucket) SetRate(rate int64) {
+	b.Lock()
+	defer b.Unlock()
+	b.rate = rate
+	b.tokens = 0
+	b.last = time.Now()
+}
+
+// Rate is the bucket's current rate in bytes per second
+func (b *Bucket) Rate() int64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.rate
+}
+
+// Wait blocks until n bytes are allowed through the bucket
+func (b *Bucket) Wait(n int) {
+	time.Sleep(b.take(n))
+}
+
+// take takes n tokens from the bucket, and returns how long to wait until
+// they've been paid for.  Taking more tokens than the bucket has puts it into
+// debt, so a read larger than a second's worth still only gets through at the
+// bucket's rate, and following reads wait for the debt to be paid off
+func (b *Bucket) take(n int) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	b.last = now
+
+	// allow at most one second of burst
+	if b.tokens > float64(b.rate) {
+		b.tokens = float64(b.rate)
+	}
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+type reader struct {
+	io.ReadCloser
+	buckets []*Bucket
+}
+
+// NewReader returns a reader which reads from r no faster than
+// every one of the passed in buckets allows.  Nil buckets are skipped
+func NewReader(r io.ReadCloser, buckets ...*Bucket) io.ReadCloser {
+	t := &reader{
+		ReadCloser: r,
+	}
+	for i := range buckets {
+		if buckets[i] != nil {
+			t.buckets = append(t.buckets, buckets[i])
+		}
+	}
+	return t
+}
+
+func (t *reader) Read(p []byte) (int, error) {
+	if len(p) > maxChunk {
+		p = p[:maxChunk]
+	}
+	n, err := t.ReadCloser.Read(p)
+	for i := range t.buckets {
+		t.buckets[i].Wait(n)
+	}
+	return n, err
+}
@@ -0,0 +1,94 @@
+package throttle
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestReader(t *testing.T) {
+	data := make([]byte, 200*1024)
+	b := NewBucket(100 * 1024)
+
+	start := time.Now()
+	r := NewReader(ioutil.NopCloser(bytes.NewReader(data)), b, nil)
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) {
+		t.Fatalf("Expected to read %d bytes, read %d", len(data), n)
+	}
+
+	if time.Since(start) < 900*time.Millisecond {
+		t.Fatalf("Reader wasn't throttled, took %s", time.Since(start))
+	}
+}
+
+func TestSmallRate(t *testing.T) {
+	// a single read is larger than the rate
+	data := make([]byte, 32*1024)
+	b := NewBucket(16 * 1024)
+
+	start := time.Now()
+	r := NewReader(ioutil.NopCloser(bytes.NewReader(data)), b)
+	_, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Since(start) < 1900*time.Millisecond {
+		t.Fatalf("Reader exceeded the bucket's rate, took %s", time.Since(start))
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	data := make([]byte, 10*1024*1024)
+	start := time.Now()
+	r := NewReader(ioutil.NopCloser(bytes.NewReader(data)), NewBucket(0))
+	_, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Unlimited reader was throttled, took %s", time.Since(start))
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	windows, err := ParseSchedule("01:00-06:00 0/0, 09:00-17:00 500/1000, 22:00-00:30 10/20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(windows) != 3 {
+		t.Fatalf("Expected 3 windows, got %d", len(windows))
+	}
+
+	tests := []struct {
+		clock    string
+		up, down int64
+	}{
+		{"02:00", 0, 0},
+		{"06:00", 1, 2},
+		{"12:30", 500 * 1024, 1000 * 1024},
+		{"23:59", 10 * 1024, 20 * 1024},
+		{"00:15", 10 * 1024, 20 * 1024},
+		{"18:00", 1, 2},
+	}
+
+	for _, test := range tests {
+		now, _ := time.Parse("15:04", test.clock)
+		up, down := limits(windows, now, 1, 2)
+		if up != test.up || down != test.down {
+			t.Errorf("At %s expected %d/%d got %d/%d", test.clock, test.up, test.down, up, down)
+		}
+	}
+
+	for _, bad := range []string{"01:00 0/0", "25:00-02:00 0/0", "01:00-02:00 -1/0", "01:00-02:00 0"} {
+		if _, err := ParseSchedule(bad); err == nil {
+			t.Errorf("Expected error parsing %s", bad)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// files the self signed certificate is kept in, in the same folder as the
+// settings file
+const (
+	selfSignedCert = "cert.pem"
+	selfSignedKey  = "key.pem"
+)
+
+// selfSignedAge is how long a generated certificate is valid for
+const selfSignedAge = 10 * 365 * 24 * time.Hour
+
+var (
+	useTLS     bool   // serve the web interface over HTTPS
+	tlsCert    string // certificate and key files, generated if left empty
+	tlsKey     string
+	socketFile string // unix socket the web interface is also served on
+)
+
+// certificateFiles returns the certificate and key files the web server uses,
+// the self signed ones in dataDir if none were set
+func certificateFiles(dataDir string) (string, string) {
+	if tlsCert != "" {
+		return tlsCert, tlsKey
+	}
+	return filepath.Join(dataDir, selfSignedCert), filepath.Join(dataDir, selfSignedKey)
+}
+
+// ensureCertificate generates a self signed certificate, unless one was
+// generated already or a certificate was set
+func ensureCertificate(certFile, keyFile string) error {
+	if tlsCert != "" {
+		if tlsKey == "" {
+			return errors.New("The tlsKey setting is required with tlsCert")
+		}
+		return nil
+	}
+	_, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil {
+		return nil
+	}
+	if _, statErr := os.Stat(certFile); !os.IsNotExist(statErr) {
+		return fmt.Errorf("Error loading certificate %s: %s", certFile, err)
+	}
+	return generateCertificate(certFile, keyFile)
+}
+
+// generateCertificate writes a new self signed certificate for this machine's
+// host name and localhost
+func generateCertificate(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Freehold-Sync"}, CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedAge),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if host, err := os.Hostname(); err == nil && host != "localhost" {
+		template.DNSNames = append(template.DNSNames, host)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// pinnedTLS returns a client TLS config which only trusts the web server's own
+// certificate, whatever names it was issued for, so commands can reach it on
+// localhost
+func pinnedTLS(certFile string) (*tls.Config, error) {
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("No certificate found in %s", certFile)
+	}
+	pinned := block.Bytes
+
+	return &tls.Config{
+		// verified against the pinned certificate instead
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], pinned) {
+				return errors.New("The certificate doesn't match freehold-sync's certificate")
+			}
+			return nil
+		},
+	}, nil
+}
+
+// serveSocket serves the web interface on the unix socket, which only the
+// current user can connect to
+func serveSocket(server *http.Server, filename string) error {
+	// a socket left behind by a crash would keep it from listening
+	if info, err := os.Lstat(filename); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(filename)
+	}
+
+	l, err := listenSocket(filename)
+	if err != nil {
+		return err
+	}
+	return server.Serve(l)
+}
@@ -0,0 +1,224 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+)
+
+const tokenBucket = datastore.BucketToken
+
+// tokenUsedInterval is how out of date a token's last used time can get, so
+// a busy script doesn't write to the datastore on every request
+const tokenUsedInterval = time.Minute
+
+var errInvalidToken = errors.New("Invalid API token")
+
+// apiToken lets scripts use the /v1/ API and event stream without logging in.
+// Only a hash of the token is stored, the token itself is only shown when
+// it's created
+type apiToken struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Hash     string    `json:"hash,omitempty"`
+	ReadOnly bool      `json:"readOnly"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+func tokenHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIToken creates and stores a token, returning it along with the token
+// string to send as a bearer token
+func newAPIToken(name string, readOnly bool) (*apiToken, string, error) {
+	if strings.TrimSpace(name) == "" {
+		return nil, "", errors.New("A name is required for an API token")
+	}
+	id, err := randomToken()
+	if err != nil {
+		return nil, "", err
+	}
+	id = id[:16] // short enough to type when revoking it
+	secret, err := randomToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	t := &apiToken{
+		ID:       id,
+		Name:     name,
+		Hash:     tokenHash(secret),
+		ReadOnly: readOnly,
+		Created:  time.Now(),
+	}
+	err = datastore.Put(tokenBucket, t.ID, t)
+	if err != nil {
+		return nil, "", err
+	}
+	return t, t.ID + "." + secret, nil
+}
+
+// apiTokens returns every token, oldest first, without their hashes
+func apiTokens() ([]*apiToken, error) {
+	all := []*apiToken{}
+	err := datastore.View(func(tx *datastore.Tx) error {
+		return tx.Each(tokenBucket, func(key string, value []byte) error {
+			t := &apiToken{}
+			err := json.Unmarshal(value, t)
+			if err != nil {
+				return err
+			}
+			t.Hash = ""
+			all = append(all, t)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Created.Before(all[j].Created)
+	})
+	return all, nil
+}
+
+// checkToken returns the stored token the token string is for, or
+// errInvalidToken if it isn't one, or was revoked
+func checkToken(token string) (*apiToken, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, errInvalidToken
+	}
+	t := &apiToken{}
+	err := datastore.Get(tokenBucket, parts[0], t)
+	if err == datastore.ErrNotFound {
+		return nil, errInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(tokenHash(parts[1])), []byte(t.Hash)) != 1 {
+		return nil, errInvalidToken
+	}
+
+	if time.Since(t.LastUsed) > tokenUsedInterval {
+		t.LastUsed = time.Now()
+		err = datastore.Put(tokenBucket, t.ID, t)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// bearerToken returns the token in the request's Authorization header, if it
+// has one
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
+
+// tokenAuthorized returns whether the request is allowed through with its API
+// token, responding to it if it isn't.  Tokens only work for the /v1/ API, the
+// event stream and the readiness check, so they can't be used to change the password or make more
+// tokens
+func tokenAuthorized(w http.ResponseWriter, r *http.Request, token string) bool {
+	t, err := checkToken(token)
+	if err == errInvalidToken {
+		time.Sleep(failedLoginDelay)
+		apiFail(w, http.StatusUnauthorized, err)
+		return false
+	}
+	if errHandled(err, w) {
+		return false
+	}
+	if !strings.HasPrefix(r.URL.Path, "/v1/") && r.URL.Path != "/events/" && r.URL.Path != "/readyz" {
+		apiFail(w, http.StatusForbidden, errors.New("API tokens can only be used with the /v1/ API, /events/ and /readyz"))
+		return false
+	}
+	if t.ReadOnly && r.Method != "GET" && r.Method != "HEAD" {
+		apiFail(w, http.StatusForbidden, errors.New("This API token can only read"))
+		return false
+	}
+	return true
+}
+
+func authTokenGet(w http.ResponseWriter, r *http.Request) {
+	all, err := apiTokens()
+	if errHandled(err, w) {
+		return
+	}
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+		Data:   all,
+	})
+}
+
+// authTokenPost creates a token.  The response is the only time the token
+// itself is ever sent
+func authTokenPost(w http.ResponseWriter, r *http.Request) {
+	input := &struct {
+		Name     string `json:"name"`
+		ReadOnly bool   `json:"readOnly"`
+	}{}
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	t, token, err := newAPIToken(input.Name, input.ReadOnly)
+	if errHandled(err, w) {
+		return
+	}
+	t.Hash = ""
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+		Data: &struct {
+			*apiToken
+			Token string `json:"token"`
+		}{t, token},
+	})
+}
+
+// authTokenDelete revokes a token
+func authTokenDelete(w http.ResponseWriter, r *http.Request) {
+	input := &struct {
+		ID string `json:"id"`
+	}{}
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	t := &apiToken{}
+	err := datastore.Get(tokenBucket, input.ID, t)
+	if err == datastore.ErrNotFound {
+		errHandled(errors.New("No API token found with that ID"), w)
+		return
+	}
+	if errHandled(err, w) {
+		return
+	}
+	if errHandled(datastore.Delete(tokenBucket, input.ID), w) {
+		return
+	}
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+	})
+}
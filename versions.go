@@ -0,0 +1,113 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+
+	"bitbucket.org/tshannon/freehold-sync/remote"
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+type versionInput struct {
+	ID      string `json:"id"`
+	Path    string `json:"path"`
+	Version string `json:"version"`
+}
+
+// remoteFile returns the profile and the remote file at the input's path
+func (v *versionInput) remoteFile() (*syncer.Profile, *remote.File, error) {
+	if strings.TrimSpace(v.ID) == "" {
+		return nil, nil, errors.New("No ID specified. You must specify a profile ID.")
+	}
+
+	paths, err := syncer.CleanFolders([]string{v.Path})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(paths) == 0 {
+		return nil, nil, errors.New("No path specified. You must specify the path of a file in the profile.")
+	}
+
+	ps, err := getProfile(v.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	profile, err := ps.makeProfile()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rFile, err := remote.New(profile.Remote.(*remote.File).Client(), path.Join(profile.Remote.Path(profile), paths[0]))
+	if err != nil {
+		return nil, nil, err
+	}
+	return profile, rFile, nil
+}
+
+func versionsGet(w http.ResponseWriter, r *http.Request) {
+	input := &versionInput{}
+
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	profile, rFile, err := input.remoteFile()
+	if errHandled(err, w) {
+		return
+	}
+
+	versions, err := rFile.Versions(profile)
+	if errHandled(err, w) {
+		return
+	}
+
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+		Data:   versions,
+	})
+}
+
+func versionsPut(w http.ResponseWriter, r *http.Request) {
+	input := &versionInput{}
+
+	if errHandled(parseJSON(r, input), w) {
+		return
+	}
+
+	if strings.TrimSpace(input.Version) == "" {
+		errHandled(errors.New("No version specified."), w)
+		return
+	}
+
+	profile, rFile, err := input.remoteFile()
+	if errHandled(err, w) {
+		return
+	}
+
+	// restoring goes through the profile's queue, which has to be running
+	if profile.Paused() {
+		errHandled(errors.New("The profile is paused. Resume it to restore a version."), w)
+		return
+	}
+	err = rFile.RestoreVersion(profile, input.Version)
+	if err == syncer.ErrCanceled {
+		err = errors.New("The profile isn't running. Start it to restore a version.")
+	}
+	if errHandled(err, w) {
+		return
+	}
+
+	// sync the restored file back down
+	go remoteChanges(profile, rFile)
+
+	respondJsend(w, &jsend{
+		Status: statusSuccess,
+	})
+}
@@ -0,0 +1,163 @@
+// Copyright 2015 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"bitbucket.org/tshannon/freehold-sync/datastore"
+	"bitbucket.org/tshannon/freehold-sync/local"
+	"bitbucket.org/tshannon/freehold-sync/log"
+	"bitbucket.org/tshannon/freehold-sync/syncer"
+)
+
+// volumeInterval is how often the volumes the local folders of running profiles
+// are on are checked
+const volumeInterval = 10 * time.Second
+
+var errVolumeMissing = errors.New("The volume the local folder is on is missing")
+
+var unmounted unmountedProfiles // profiles paused because the volume their local folder is on is gone
+
+func init() {
+	unmounted = unmountedProfiles{
+		running: make(map[string]*syncer.Profile),
+		missing: make(map[string]bool),
+	}
+}
+
+type unmountedProfiles struct {
+	sync.Mutex
+	running map[string]*syncer.Profile // started profiles, by ID
+	missing map[string]bool
+	start   sync.Once
+}
+
+// started checks the volume of the profile's local folder from now on
+func (u *unmountedProfiles) started(p *syncer.Profile) {
+	u.Lock()
+	defer u.Unlock()
+	u.running[p.ID()] = p
+	u.start.Do(func() {
+		go u.watch()
+	})
+}
+
+func (u *unmountedProfiles) has(id string) bool {
+	u.Lock()
+	defer u.Unlock()
+	return u.missing[id]
+}
+
+// set marks the profile as missing its volume or not, and returns whether
+// that's a change
+func (u *unmountedProfiles) set(id string, missing bool) bool {
+	u.Lock()
+	defer u.Unlock()
+	if u.missing[id] == missing {
+		return false
+	}
+	if missing {
+		u.missing[id] = true
+	} else {
+		delete(u.missing, id)
+	}
+	return true
+}
+
+func (u *unmountedProfiles) list() []*syncer.Profile {
+	u.Lock()
+	defer u.Unlock()
+	list := make([]*syncer.Profile, 0, len(u.running))
+	for _, p := range u.running {
+		list = append(list, p)
+	}
+	return list
+}
+
+func (u *unmountedProfiles) stopped(id string) {
+	u.Lock()
+	defer u.Unlock()
+	delete(u.running, id)
+	delete(u.missing, id)
+}
+
+// watch checks the volumes of the running profiles every volumeInterval, so
+// a volume which goes without any change events is still noticed, and profiles
+// resume once their volume is back
+func (u *unmountedProfiles) watch() {
+	for {
+		time.Sleep(volumeInterval)
+		for _, p := range u.list() {
+			ps, err := profileOf(p.ID())
+			if err == datastore.ErrNotFound || (err == nil && !ps.Active) {
+				u.stopped(p.ID())
+				continue
+			}
+			if err != nil {
+				logger.Profile(p.Name).Errorf("Error reading profile %s: %s", p.Name, err)
+				continue
+			}
+
+			if !u.has(p.ID()) {
+				volumeGone(p)
+				continue
+			}
+			if local.VolumeMissing(p.ID()) {
+				continue
+			}
+			volumeBack(p, ps.Paused)
+		}
+	}
+}
+
+// volumeGone pauses the profile if the volume its local folder is on has been
+// unmounted or disconnected, rather than syncing its vanished files as deletes,
+// and returns whether or not it's gone
+func volumeGone(p *syncer.Profile) bool {
+	if unmounted.has(p.ID()) {
+		return true
+	}
+	if !local.VolumeMissing(p.ID()) {
+		return false
+	}
+	if !unmounted.set(p.ID(), true) {
+		// already paused by another change
+		return true
+	}
+
+	log.Module(local.LogType).Profile(p.Name).Warnf("The volume the local folder of profile %s is on is missing. The profile is paused "+
+		"until it's back", p.Name)
+	notify("Volume missing for "+p.Name, "Syncing is paused until the volume is back")
+	alert(p.ID(), fmt.Sprintf("The volume the local folder %s is on is missing. Syncing is paused until it's back.",
+		p.Local.ID()))
+	// the folders can't be read to stop watching them one at a time
+	local.Forget(p)
+	err := p.Pause()
+	if err != nil {
+		log.Module(local.LogType).Profile(p.Name).Errorf("Error pausing profile %s: %s", p.Name, err)
+	}
+	return true
+}
+
+// volumeBack resumes the profile once the volume of its local folder is back,
+// which rescans both sides for what changed while it was gone.  Profiles
+// paused by the user stay paused
+func volumeBack(p *syncer.Profile, paused bool) {
+	if !unmounted.set(p.ID(), false) {
+		return
+	}
+	log.Module(local.LogType).Profile(p.Name).Infof("The volume the local folder of profile %s is on is back", p.Name)
+	if paused {
+		return
+	}
+	err := p.Resume()
+	if err != nil {
+		log.Module(local.LogType).Profile(p.Name).Errorf("Error resuming profile %s: %s", p.Name, err)
+	}
+}
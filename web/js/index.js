@@ -10,18 +10,88 @@ $(document).ready(function() {
         template: "#tMain",
         data: {
             alerts: [],
+            localRoots: [],
             page: "main",
             logPage: 0,
+            logLevel: "",
+            logRecent: false,
         },
     });
 
 
-    loadProfiles();
-    loadLogs();
+    var csrf = "";
 
-    refreshStatuses();
+    $.ajaxSetup({
+        beforeSend: function(xhr) {
+            if (csrf) {
+                xhr.setRequestHeader("X-CSRF-Token", csrf);
+            }
+        }
+    });
+
+    $(document).ajaxError(function(event, xhr) {
+        if (xhr.status === 401 && r.get("page") !== "login") {
+            r.set("page", "login");
+        }
+    });
+
+    $.ajax({
+            type: "GET",
+            url: "/auth/",
+            dataType: "json",
+        })
+        .done(function(result) {
+            r.set("passwordSet", result.data.passwordSet);
+            if (result.data.passwordSet && !result.data.loggedIn) {
+                r.set("page", "login");
+                return;
+            }
+            csrf = result.data.csrf || "";
+            start();
+        })
+        .fail(function(result) {
+            error(result);
+        });
+
+    function start() {
+        loadProfiles();
+        loadLogs();
+        watchEvents();
+    }
 
     r.on({
+        "login": function(event) {
+            event.original.preventDefault();
+            $.ajax({
+                    type: "POST",
+                    url: "/auth/login/",
+                    dataType: "json",
+                    data: JSON.stringify({
+                        "password": r.get("loginPassword")
+                    }),
+                })
+                .done(function(result) {
+                    csrf = result.data.csrf;
+                    r.set("loginPassword", "");
+                    r.set("loginError", "");
+                    r.set("page", "main");
+                    start();
+                })
+                .fail(function(result) {
+                    r.set("loginError", result.responseJSON.message);
+                });
+        },
+        "logout": function() {
+            $.ajax({
+                    type: "POST",
+                    url: "/auth/logout/",
+                    dataType: "json",
+                })
+                .always(function() {
+                    csrf = "";
+                    window.location.reload();
+                });
+        },
         "addAlert": function(type, lead, detail) {
             if (!type) {
                 type = "danger";
@@ -53,6 +123,16 @@ $(document).ready(function() {
             r.add("logPage", 1);
             loadLogs();
         },
+        "logLevel": function(event, level) {
+            r.set("logLevel", level);
+            r.set("logPage", 0);
+            loadLogs();
+        },
+        "logRecent": function(event) {
+            r.toggle("logRecent");
+            r.set("logPage", 0);
+            loadLogs();
+        },
         "logPagePrev": function(event) {
             r.subtract("logPage", 1);
             if (r.get("logPage") < 0) {
@@ -91,11 +171,27 @@ $(document).ready(function() {
         "saveNewProfile": function(event) {
             var profile = event.context;
             r.set("loading", true);
-            profile.saveNew()
-                .done(function() {
-                    r.set("page", "main");
-                    r.set("loading", false);
-                    loadProfiles();
+            r.set("currentProfile.testChecks", []);
+            profile.test()
+                .done(function(result) {
+                    if (!result.data.ok) {
+                        r.set("loading", false);
+                        r.set("currentProfile.testChecks", result.data.checks.filter(function(check) {
+                            return check.error;
+                        }));
+                        r.set("currentProfile.profileError", "The profile failed its connection test");
+                        return;
+                    }
+                    profile.saveNew()
+                        .done(function() {
+                            r.set("page", "main");
+                            r.set("loading", false);
+                            loadProfiles();
+                        })
+                        .fail(function(result) {
+                            r.set("loading", false);
+                            r.set("currentProfile.profileError", result.responseJSON.message);
+                        });
                 })
                 .fail(function(result) {
                     r.set("loading", false);
@@ -125,8 +221,76 @@ $(document).ready(function() {
                     error(result);
                 });
         },
+        "togglePause": function(event) {
+            var profile = new Profile(event.context);
+            profile.setPaused(!profile.paused)
+                .done(function() {
+                    loadProfiles();
+                })
+                .fail(function(result) {
+                    error(result);
+                });
+        },
+        "showConflicts": function(event) {
+            r.set("conflictProfile", event.context);
+            r.set("conflictError", null);
+            r.set("conflicts", []);
+            loadConflicts();
+            $("#conflictsModal").modal("show");
+        },
+        "resolveConflict": function(event, resolution) {
+            var profile = new Profile(r.get("conflictProfile"));
+            profile.resolveConflict(event.context.path, resolution)
+                .done(function() {
+                    r.set("conflictError", null);
+                    r.splice("conflicts", event.index.i, 1);
+                    profile.setStatus();
+                })
+                .fail(function(result) {
+                    r.set("conflictError", result.responseJSON.message);
+                });
+        },
+        "showQuarantine": function(event) {
+            r.set("quarantineProfile", event.context);
+            r.set("quarantineError", null);
+            r.set("quarantined", []);
+            loadQuarantined();
+            $("#quarantineModal").modal("show");
+        },
+        "releaseQuarantined": function(event) {
+            var profile = new Profile(r.get("quarantineProfile"));
+            profile.releaseQuarantined(event.context.path)
+                .done(function() {
+                    r.set("quarantineError", null);
+                    r.splice("quarantined", event.index.i, 1);
+                    profile.setStatus();
+                })
+                .fail(function(result) {
+                    r.set("quarantineError", result.responseJSON.message);
+                });
+        },
+        "confirmDeletes": function(event) {
+            var profile = new Profile(event.context);
+            profile.confirmDeletes(true)
+                .done(function() {
+                    loadProfiles();
+                })
+                .fail(function(result) {
+                    error(result);
+                });
+        },
+        "discardDeletes": function(event) {
+            var profile = new Profile(event.context);
+            profile.confirmDeletes(false)
+                .done(function() {
+                    loadProfiles();
+                })
+                .fail(function(result) {
+                    error(result);
+                });
+        },
         "toggleDirection": function(event) {
-            if (event.context.direction < 2) {
+            if (event.context.direction < 5) {
                 event.context.direction++;
             } else {
                 event.context.direction = 0;
@@ -136,8 +300,28 @@ $(document).ready(function() {
         "showLocalModal": function(event) {
             $("#localModal").modal("show");
             r.set("selectKeypath", "");
+            $.ajax({
+                    type: "get",
+                    url: "/local/roots/",
+                    dataType: "json",
+                })
+                .done(function(result) {
+                    r.set("localRoots", result.data || []);
+                })
+                .fail(function(result) {
+                    error(result);
+                });
             getPath("", "root.children");
         },
+        "selectLocalRoot": function(event) {
+            r.set("selectKeypath", "");
+            r.set("root", {
+                name: event.context,
+                path: event.context,
+                open: true,
+            });
+            getPath(event.context, "root.children");
+        },
         "showRemoteModal": function(event) {
             r.set("clientError", null);
             r.set("selectKeypath", "");
@@ -161,6 +345,10 @@ $(document).ready(function() {
         },
         "treeUpDir": function(event) {
             var root = r.get("root.path");
+            if (r.get("localRoots").indexOf(root) !== -1) {
+                // can't browse outside of the local roots
+                return;
+            }
 			var pathChar;
 			if (root.indexOf("\\") > -1) {
 				pathChar = "\\";
@@ -228,6 +416,54 @@ $(document).ready(function() {
             var s = event.keypath.split(".");
             s.pop();
 
+            r.splice(s.join("."), event.index.i, 1);
+        },
+        "addFilter": function(event) {
+            var newFilter = r.get("filterInsert");
+            if (!newFilter) {
+                return;
+            }
+
+            var filters = r.get("currentProfile.filters");
+            filters.push(newFilter);
+            r.set("filterInsert", "");
+        },
+        "removeFilter": function(event) {
+            var s = event.keypath.split(".");
+            s.pop();
+
+            r.splice(s.join("."), event.index.i, 1);
+        },
+        "addCompressExclude": function(event) {
+            var newExclude = r.get("compressExcludeInsert");
+            if (!newExclude) {
+                return;
+            }
+
+            var excludes = r.get("currentProfile.compressExclude");
+            excludes.push(newExclude);
+            r.set("compressExcludeInsert", "");
+        },
+        "removeCompressExclude": function(event) {
+            var s = event.keypath.split(".");
+            s.pop();
+
+            r.splice(s.join("."), event.index.i, 1);
+        },
+        "addFolder": function(event) {
+            var newFolder = r.get("folderInsert");
+            if (!newFolder) {
+                return;
+            }
+
+            var folders = r.get("currentProfile.folders");
+            folders.push(newFolder);
+            r.set("folderInsert", "");
+        },
+        "removeFolder": function(event) {
+            var s = event.keypath.split(".");
+            s.pop();
+
             r.splice(s.join("."), event.index.i, 1);
         },
     });
@@ -242,28 +478,104 @@ $(document).ready(function() {
             this.direction = 0;
             this.conflictResolution = 0;
             this.conflictDurationSeconds = 0;
+            this.conflictName = "";
             this.active = true;
+            this.dryRun = false;
+            this.paused = false;
             this.ignore = ["(/\\.|^\\.{1}.+$)"];
+            this.filters = [];
+            this.folders = [];
+            this.maxFileSizeMB = 0;
+            this.uploadLimitKB = 0;
+            this.downloadLimitKB = 0;
+            this.schedule = "";
+            this.scheduleWindowMinutes = 0;
+            this.keepVersions = 0;
+            this.trash = false;
+            this.trashDays = 30;
+            this.verify = false;
+            this.symlinks = 0;
+            this.localMonitor = 0;
+            this.maxDeletes = 0;
+            this.maxDeletePercent = 0;
+            this.minFreeSpaceMB = 0;
+            this.pollSeconds = 0;
+            this.compress = false;
+            this.compressExclude = [];
+            this.encrypt = false;
+            this.passphrase = "";
+            this.encryptNames = false;
+            this.reportEmail = "";
+            this.reportFrequency = "";
+            this.reportAlerts = false;
+            this.preSyncHook = "";
+            this.postSyncHook = "";
+            this.errorHook = "";
             this.localPath = "";
             this.remotePath = "";
             this.client = new Client();
+            this.destinations = [];
         } else {
             this.id = profile.id;
             this.name = profile.name;
             this.direction = profile.direction;
             this.conflictResolution = profile.conflictResolution;
             this.conflictDurationSeconds = profile.conflictDurationSeconds;
+            this.conflictName = profile.conflictName || "";
             this.active = profile.active;
+            this.dryRun = profile.dryRun;
+            this.paused = profile.paused || false;
             this.ignore = profile.ignore;
+            this.filters = profile.filters || [];
+            this.folders = profile.folders || [];
+            this.maxFileSizeMB = profile.maxFileSizeMB;
+            this.uploadLimitKB = profile.uploadLimitKB || 0;
+            this.downloadLimitKB = profile.downloadLimitKB || 0;
+            this.schedule = profile.schedule || "";
+            this.scheduleWindowMinutes = profile.scheduleWindowMinutes || 0;
+            this.keepVersions = profile.keepVersions || 0;
+            this.trash = profile.trash || false;
+            this.trashDays = profile.trashDays || 0;
+            this.verify = profile.verify || false;
+            this.symlinks = profile.symlinks || 0;
+            this.localMonitor = profile.localMonitor || 0;
+            this.maxDeletes = profile.maxDeletes || 0;
+            this.maxDeletePercent = profile.maxDeletePercent || 0;
+            this.minFreeSpaceMB = profile.minFreeSpaceMB || 0;
+            this.pollSeconds = profile.pollSeconds || 0;
+            this.compress = profile.compress || false;
+            this.compressExclude = profile.compressExclude || [];
+            this.encrypt = profile.encrypt || false;
+            this.passphrase = profile.passphrase || "";
+            this.encryptNames = profile.encryptNames || false;
+            this.reportEmail = profile.reportEmail || "";
+            this.reportFrequency = profile.reportFrequency || "";
+            this.reportAlerts = profile.reportAlerts || false;
+            this.preSyncHook = profile.preSyncHook || "";
+            this.postSyncHook = profile.postSyncHook || "";
+            this.errorHook = profile.errorHook || "";
             this.localPath = profile.localPath;
             this.remotePath = profile.remotePath;
             this.client = new Client(profile.client);
+            this.destinations = profile.destinations || [];
 
         }
         //methods
         this.saveNew = function() {
             this.conflictDurationSeconds = Number(this.conflictDurationSeconds);
             this.conflictResolution = Number(this.conflictResolution);
+            this.maxFileSizeMB = Number(this.maxFileSizeMB);
+            this.uploadLimitKB = Number(this.uploadLimitKB);
+            this.downloadLimitKB = Number(this.downloadLimitKB);
+            this.scheduleWindowMinutes = Number(this.scheduleWindowMinutes);
+            this.keepVersions = Number(this.keepVersions);
+            this.trashDays = Number(this.trashDays);
+            this.symlinks = Number(this.symlinks);
+            this.localMonitor = Number(this.localMonitor);
+            this.maxDeletes = Number(this.maxDeletes);
+            this.maxDeletePercent = Number(this.maxDeletePercent);
+            this.minFreeSpaceMB = Number(this.minFreeSpaceMB);
+            this.pollSeconds = Number(this.pollSeconds);
             return $.ajax({
                 type: "POST",
                 url: "/profile/",
@@ -271,9 +583,29 @@ $(document).ready(function() {
                 data: JSON.stringify(this),
             });
         };
+        this.test = function() {
+            return $.ajax({
+                type: "POST",
+                url: "/profile/test/",
+                dataType: "json",
+                data: JSON.stringify(this),
+            });
+        };
         this.save = function() {
             this.conflictDurationSeconds = Number(this.conflictDurationSeconds);
             this.conflictResolution = Number(this.conflictResolution);
+            this.maxFileSizeMB = Number(this.maxFileSizeMB);
+            this.uploadLimitKB = Number(this.uploadLimitKB);
+            this.downloadLimitKB = Number(this.downloadLimitKB);
+            this.scheduleWindowMinutes = Number(this.scheduleWindowMinutes);
+            this.keepVersions = Number(this.keepVersions);
+            this.trashDays = Number(this.trashDays);
+            this.symlinks = Number(this.symlinks);
+            this.localMonitor = Number(this.localMonitor);
+            this.maxDeletes = Number(this.maxDeletes);
+            this.maxDeletePercent = Number(this.maxDeletePercent);
+            this.minFreeSpaceMB = Number(this.minFreeSpaceMB);
+            this.pollSeconds = Number(this.pollSeconds);
             return $.ajax({
                 type: "PUT",
                 url: "/profile/",
@@ -284,6 +616,18 @@ $(document).ready(function() {
         this.delete = function() {
             this.conflictDurationSeconds = Number(this.conflictDurationSeconds);
             this.conflictResolution = Number(this.conflictResolution);
+            this.maxFileSizeMB = Number(this.maxFileSizeMB);
+            this.uploadLimitKB = Number(this.uploadLimitKB);
+            this.downloadLimitKB = Number(this.downloadLimitKB);
+            this.scheduleWindowMinutes = Number(this.scheduleWindowMinutes);
+            this.keepVersions = Number(this.keepVersions);
+            this.trashDays = Number(this.trashDays);
+            this.symlinks = Number(this.symlinks);
+            this.localMonitor = Number(this.localMonitor);
+            this.maxDeletes = Number(this.maxDeletes);
+            this.maxDeletePercent = Number(this.maxDeletePercent);
+            this.minFreeSpaceMB = Number(this.minFreeSpaceMB);
+            this.pollSeconds = Number(this.pollSeconds);
             return $.ajax({
                 type: "DELETE",
                 url: "/profile/",
@@ -291,6 +635,70 @@ $(document).ready(function() {
                 data: JSON.stringify(this),
             });
         };
+        this.setPaused = function(paused) {
+            return $.ajax({
+                type: "PUT",
+                url: "/profile/pause/",
+                dataType: "json",
+                data: JSON.stringify({
+                    "id": this.id,
+                    "paused": paused
+                }),
+            });
+        };
+        this.confirmDeletes = function(confirm) {
+            return $.ajax({
+                type: confirm ? "POST" : "DELETE",
+                url: "/profile/deletes/",
+                dataType: "json",
+                data: JSON.stringify({
+                    "id": this.id
+                }),
+            });
+        };
+        this.conflicts = function() {
+            return $.ajax({
+                type: "GET",
+                url: "/profile/conflicts/",
+                dataType: "json",
+                data: JSON.stringify({
+                    "id": this.id
+                }),
+            });
+        };
+        this.resolveConflict = function(path, resolution) {
+            return $.ajax({
+                type: "POST",
+                url: "/profile/conflicts/",
+                dataType: "json",
+                data: JSON.stringify({
+                    "id": this.id,
+                    "path": path,
+                    "resolution": resolution
+                }),
+            });
+        };
+        this.quarantined = function() {
+            return $.ajax({
+                type: "GET",
+                url: "/profile/quarantine/",
+                dataType: "json",
+                data: JSON.stringify({
+                    "id": this.id
+                }),
+            });
+        };
+        this.releaseQuarantined = function(path) {
+            return $.ajax({
+                type: "POST",
+                url: "/profile/quarantine/",
+                dataType: "json",
+                data: JSON.stringify({
+                    "id": this.id,
+                    "path": path
+                }),
+            });
+        };
         this.setStatus = function() {
             $.ajax({
                     type: "GET",
@@ -301,17 +709,7 @@ $(document).ready(function() {
                     }),
                 })
                 .done(function(result) {
-                    var profiles = r.get("profiles");
-                    if (profiles) {
-                        for (var i = 0; i < profiles.length; i++) {
-                            if (profiles[i].id == this.id) {
-                                profiles[i].status = result.data.status;
-                                profiles[i].statusCount = result.data.count;
-                                r.set("profiles." + i, profiles[i]);
-                                return;
-                            }
-                        }
-                    }
+                    setProfileStatus(this.id, result.data);
                 }.bind(this));
         };
     }
@@ -322,11 +720,25 @@ $(document).ready(function() {
             this.user = "";
             this.password = "";
             this.token = "";
+            this.caFile = "";
+            this.certFile = "";
+            this.keyFile = "";
+            this.pins = "";
+            this.proxy = "";
+            this.proxyUser = "";
+            this.proxyPassword = "";
         } else {
             this.url = client.url;
             this.user = client.user;
             this.password = client.password;
             this.token = client.token;
+            this.caFile = client.caFile || "";
+            this.certFile = client.certFile || "";
+            this.keyFile = client.keyFile || "";
+            this.pins = client.pins || "";
+            this.proxy = client.proxy || "";
+            this.proxyUser = client.proxyUser || "";
+            this.proxyPassword = client.proxyPassword || "";
         }
         this.getToken = function(name) {
             return $.ajax({
@@ -345,7 +757,9 @@ $(document).ready(function() {
                 this.getToken(r.get("currentProfile.name"))
                     .done(function(result) {
                         this.token = result.data.token;
-                        this.password = "";
+                        if (!r.get("keepPassword")) {
+                            this.password = "";
+                        }
                         this.connect();
                     }.bind(this))
                     .fail(function(result) {
@@ -401,6 +815,35 @@ $(document).ready(function() {
             });
     }
 
+    function loadConflicts() {
+        var profile = new Profile(r.get("conflictProfile"));
+        profile.conflicts()
+            .done(function(result) {
+                for (var i = 0; i < result.data.length; i++) {
+                    result.data[i].localModified = new Date(result.data[i].localModified).toLocaleString();
+                    result.data[i].remoteModified = new Date(result.data[i].remoteModified).toLocaleString();
+                }
+                r.set("conflicts", result.data);
+            })
+            .fail(function(result) {
+                r.set("conflictError", result.responseJSON.message);
+            });
+    }
+
+    function loadQuarantined() {
+        var profile = new Profile(r.get("quarantineProfile"));
+        profile.quarantined()
+            .done(function(result) {
+                for (var i = 0; i < result.data.length; i++) {
+                    result.data[i].found = new Date(result.data[i].found).toLocaleString();
+                }
+                r.set("quarantined", result.data);
+            })
+            .fail(function(result) {
+                r.set("quarantineError", result.responseJSON.message);
+            });
+    }
+
     function loadLogs(type) {
         $.ajax({
                 type: "get",
@@ -409,21 +852,25 @@ $(document).ready(function() {
                 data: JSON.stringify({
                     page: r.get("logPage"),
                     type: type,
+                    level: r.get("logLevel"),
+                    sinceHours: r.get("logRecent") ? 24 : 0,
                 }),
             })
             .done(function(result) {
                 var logs = result.data;
 
-                if (r.get("logPage") === 0 && logs.length > 0) {
-                    //check if first log is newer than last log look
+                if (r.get("logPage") === 0) {
+                    //check if the newest warning or error is newer than last log look
                     var lastLook = new Date(window.localStorage.getItem("freehold-sync-lastloglook"));
-                    var lastLog = new Date(logs[0].when);
-
-                    if (lastLog > lastLook) {
-                        r.set("newErrors", true);
-                    } else {
-                        r.set("newErrors", false);
+                    var newErrors = false;
+                    for (var j = 0; j < logs.length; j++) {
+                        if (logs[j].level === "debug" || logs[j].level === "info") {
+                            continue;
+                        }
+                        newErrors = new Date(logs[j].when) > lastLook;
+                        break;
                     }
+                    r.set("newErrors", newErrors);
                 }
 
                 for (var i = 0; i < logs.length; i++) {
@@ -529,7 +976,77 @@ $(document).ready(function() {
                 p.setStatus();
             }
         }
-        window.setTimeout(refreshStatuses, 3000);
+    }
+
+    function setProfileStatus(id, status) {
+        var profiles = r.get("profiles");
+        if (profiles) {
+            for (var i = 0; i < profiles.length; i++) {
+                if (profiles[i].id == id) {
+                    profiles[i].status = status.status;
+                    profiles[i].statusCount = status.count;
+                    profiles[i].warning = status.warning || "";
+                    r.set("profiles." + i, profiles[i]);
+                    return;
+                }
+            }
+        }
+    }
+
+    function setProfileActivity(id, activity) {
+        var profiles = r.get("profiles");
+        if (profiles) {
+            for (var i = 0; i < profiles.length; i++) {
+                if (profiles[i].id == id) {
+                    r.set("profiles." + i + ".activity", activity);
+                    return;
+                }
+            }
+        }
+    }
+
+    function describeChange(e) {
+        switch (e.action) {
+            case "delete":
+                return "Deleting " + e.path;
+            case "move":
+                return "Moving " + e.path;
+            case "conflict":
+                return "Renaming " + e.path;
+        }
+        return (e.side === "local" ? "Downloading " : "Uploading ") + e.path;
+    }
+
+    // watchEvents keeps statuses up to date from the event stream, falling back
+    // to polling them while it can't connect
+    function watchEvents() {
+        if (!window.WebSocket) {
+            refreshStatuses();
+            window.setTimeout(watchEvents, 3000);
+            return;
+        }
+
+        var scheme = window.location.protocol === "https:" ? "wss://" : "ws://";
+        var ws = new WebSocket(scheme + window.location.host + "/events/");
+        ws.onmessage = function(msg) {
+            var e = JSON.parse(msg.data);
+            switch (e.type) {
+                case "status":
+                    setProfileStatus(e.profile, e);
+                    break;
+                case "started":
+                    setProfileActivity(e.profile, describeChange(e));
+                    break;
+                case "finished":
+                case "error":
+                    setProfileActivity(e.profile, "");
+                    break;
+            }
+        };
+        ws.onclose = function() {
+            refreshStatuses();
+            window.setTimeout(watchEvents, 3000);
+        };
     }
 
 